@@ -21,12 +21,46 @@ func main() {
 
 	common.PrintConfig(v)
 
+	tlsCfg, err := common.LoadTLSConfig(v, "tls")
+	if err != nil {
+		log.Criticalf("Invalid TLS configuration: %s", err)
+	}
+	clientTLS, err := tlsCfg.Client()
+	if err != nil {
+		log.Fatalf("Can't load the TLS certificates: %s", err)
+	}
+
+	priority, err := common.ParsePriority(v.GetString("priority"))
+	if err != nil {
+		log.Fatalf("Invalid priority: %s", err)
+	}
+
+	// Of the language detection of Q4 and the streaming joins, the ones left empty keep the config of the workers
+	options := common.JobOptions{}
+	for key, value := range map[string]string{
+		common.OptionLanguages:           v.GetString("languages.detect"),
+		common.OptionTargetLanguages:     v.GetString("languages.targets"),
+		common.OptionMinRelativeDistance: v.GetString("languages.minRelativeDistance"),
+		common.OptionLanguageBreakdown:   v.GetString("languages.breakdown"),
+		common.OptionStreaming:           v.GetString("streaming"),
+	} {
+		if value != "" {
+			options[key] = value
+		}
+	}
+
 	clientConfig := src.ClientConfig{
 		ServerAddress:   v.GetString("server.address"),
 		BatchMaxAmount:  v.GetInt("batch.maxAmount"),
 		BatchSleep:      v.GetDuration("batch.sleep"),
 		GamesFilePath:   "/app/datasets/games_sample.csv",
 		ReviewsFilePath: "/app/datasets/reviews_sample.csv",
+		Compression:     v.GetString("compression"),
+		TextProtocol:    v.GetBool("textProtocol"),
+		Token:           v.GetString("token"),
+		TLS:             clientTLS,
+		Priority:        priority,
+		Options:         options,
 	}
 
 	client := src.NewClient(clientConfig)
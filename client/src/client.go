@@ -2,6 +2,9 @@ package src
 
 import (
 	"bufio"
+	"crypto/tls"
+	"encoding/csv"
+	"errors"
 	"fmt"
 	"io"
 	"middleware/common"
@@ -10,6 +13,7 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -26,14 +30,39 @@ type ClientConfig struct {
 	BatchSleep      time.Duration
 	GamesFilePath   string
 	ReviewsFilePath string
+	// Comma separated list of the compression algorithms offered to the server
+	Compression string
+	// Skip the hello and speak the old text protocol, for servers that don't know the binary one
+	TextProtocol bool
+	// Identifies the tenant that owns the jobs of this client
+	Token string
+	// Nil connects over plain TCP
+	TLS *tls.Config
+	// Of our job, from 0 for backfills to common.MaxPriority for interactive jobs
+	Priority uint8
+	// Of our job, sent before asking for admission. Empty keeps the config of the workers
+	Options common.JobOptions
 }
 
 type Client struct {
-	Id         string
-	Config     ClientConfig
-	Connection net.Conn
-	Term       chan os.Signal
-	Results    map[int]*common.TemporaryStorage
+	Id          string
+	Config      ClientConfig
+	Connection  net.Conn
+	Term        chan os.Signal
+	Results     map[int]*common.TemporaryStorage
+	compression common.Compression
+	codec       common.ClientCodec
+	// Closed on SIGTERM
+	done chan struct{}
+}
+
+// The server has no room for our job, not even in its queue
+type busyError struct {
+	retryAfter time.Duration
+}
+
+func (e *busyError) Error() string {
+	return fmt.Sprintf("server busy, retry after %s", e.retryAfter)
 }
 
 func assertNoErrTemp(p string) *common.TemporaryStorage {
@@ -48,12 +77,19 @@ func NewClient(config ClientConfig) *Client {
 	client := &Client{
 		Config: config,
 		Term:   make(chan os.Signal, 1),
+		codec:  common.TextCodec{},
+		done:   make(chan struct{}),
 		Results: map[int]*common.TemporaryStorage{
 			common.Type_Results_Q1: assertNoErrTemp(filepath.Join(".", "results", "query_one.csv")),
 			common.Type_Results_Q2: assertNoErrTemp(filepath.Join(".", "results", "query_two.csv")),
 			common.Type_Results_Q3: assertNoErrTemp(filepath.Join(".", "results", "query_three.csv")),
 			common.Type_Results_Q4: assertNoErrTemp(filepath.Join(".", "results", "query_four.csv")),
 			common.Type_Results_Q5: assertNoErrTemp(filepath.Join(".", "results", "query_five.csv")),
+			common.Type_Results_Q6: assertNoErrTemp(filepath.Join(".", "results", "query_six.csv")),
+			common.Type_Results_Q7: assertNoErrTemp(filepath.Join(".", "results", "query_seven.csv")),
+			common.Type_Results_Q8: assertNoErrTemp(filepath.Join(".", "results", "query_eight.csv")),
+			// Languages the Q4 detector found in the reviews it classified
+			common.Type_Results_Q4_Languages: assertNoErrTemp(filepath.Join(".", "results", "query_four_languages.csv")),
 		},
 	}
 
@@ -65,6 +101,7 @@ func NewClient(config ClientConfig) *Client {
 func (c *Client) HandleShutdown() {
 	<-c.Term
 	log.Criticalf("Received SIGTERM")
+	close(c.done)
 	if c.Connection != nil {
 		c.Connection.Close()
 	}
@@ -72,7 +109,7 @@ func (c *Client) HandleShutdown() {
 
 func (c *Client) CreateSocket() {
 	time.Sleep(5 * time.Second)
-	conn, err := net.Dial("tcp", c.Config.ServerAddress)
+	conn, err := common.Dial(c.Config.ServerAddress, c.Config.TLS)
 	common.FailOnError(err, "Failed to connect to server")
 	c.Connection = conn
 }
@@ -80,14 +117,26 @@ func (c *Client) CreateSocket() {
 func (c *Client) StartClient() {
 	go c.HandleShutdown()
 
-	c.CreateSocket()
-	log.Infof("Connected to server at %s", c.Config.ServerAddress)
+	for {
+		err := c.Connect()
+		if err == nil {
+			break
+		}
 
-	err := c.GetId()
+		var busy *busyError
+		if !errors.As(err, &busy) {
+			log.Criticalf("%s", err)
+			return
+		}
 
-	if err != nil {
-		log.Criticalf("Failed to get client ID")
-		return
+		// Nothing was sent yet, a new connection starts a new job
+		log.Warningf("Action: Request Admission | Result: Busy | Retry After: %s", busy.retryAfter)
+		c.Connection.Close()
+		select {
+		case <-c.done:
+			return
+		case <-time.After(busy.retryAfter):
+		}
 	}
 
 	var wg sync.WaitGroup
@@ -106,6 +155,38 @@ func (c *Client) StartClient() {
 	log.Infof("All data sent to server. Exiting")
 }
 
+// Opens a session with the server, up to the point where it lets us send our job
+func (c *Client) Connect() error {
+	c.codec = common.TextCodec{}
+	c.compression = common.Compression_None
+
+	c.CreateSocket()
+	log.Infof("Connected to server at %s", c.Config.ServerAddress)
+
+	if err := c.GetId(); err != nil {
+		return fmt.Errorf("failed to get client ID: %w", err)
+	}
+
+	if !c.Config.TextProtocol {
+		codec, err := common.ClientHandshake(c.Connection)
+		if err != nil {
+			return fmt.Errorf("failed to open a binary session: %w", err)
+		}
+		c.codec = codec
+		log.Infof("Action: Hello | Result: Success | Version: %d", codec.Version())
+	}
+
+	if err := c.Authenticate(); err != nil {
+		return fmt.Errorf("failed to authenticate: %w", err)
+	}
+
+	if err := c.NegotiateCompression(); err != nil {
+		return fmt.Errorf("failed to negotiate compression: %w", err)
+	}
+
+	return c.RequestAdmission()
+}
+
 func (c *Client) OpenFile(path string) (*os.File, error) {
 	file, err := os.Open(path)
 	if err != nil {
@@ -158,18 +239,20 @@ func (c *Client) SendBatches(reader *bufio.Reader, messageType int) error {
 		} else if err != nil {
 			return err
 		} else {
-			content = line
+			content = strings.TrimSuffix(line, "\n")
 		}
 
 		clientMessage := common.ClientMessage{Content: content, Type: messageType}
-		clientMessageSerialized, err := clientMessage.SerializeClientMessage()
+		frame, err := c.codec.Encode(clientMessage)
 
 		common.FailOnError(err, "Failed to serialize message") // UNREACHABLE
 
+		clientMessageSerialized := string(frame)
+
 		if clientMessage.IsEOF() {
 			c.SendBatch(lastBatch)
-			common.Send(clientMessageSerialized, c.Connection) // EOF
-			log.Debugf("Seding EOF: %s", clientMessageSerialized)
+			c.Send(clientMessageSerialized) // EOF
+			log.Debugf("Seding EOF: %v", clientMessage)
 			break
 		}
 
@@ -194,7 +277,124 @@ func (c *Client) SendBatch(batch common.Batch) {
 
 	message := batch.Serialize()
 
-	common.Send(message, c.Connection)
+	c.Send(message)
+}
+
+func (c *Client) Send(message string) error {
+	return common.SendCompressed(message, c.Connection, c.compression)
+}
+
+func (c *Client) SendMessage(message common.ClientMessage) error {
+	frame, err := c.codec.Encode(message)
+	if err != nil {
+		return err
+	}
+	return common.SendFrame(frame, c.Connection, c.compression)
+}
+
+func (c *Client) Recv() ([]common.ClientMessage, error) {
+	frame, err := common.ReceiveFrame(c.Connection)
+	if err != nil {
+		return nil, err
+	}
+	return c.codec.Decode(frame)
+}
+
+func (c *Client) Authenticate() error {
+	if c.Config.Token == "" {
+		return nil
+	}
+
+	if err := c.SendMessage(common.ClientMessage{Content: c.Config.Token, Type: common.Type_Auth}); err != nil {
+		return err
+	}
+
+	answer, err := c.Recv()
+	if err != nil {
+		return err
+	}
+	if answer[0].Type == common.Type_Error {
+		return fmt.Errorf("the server rejected the token: %s", answer[0].Content)
+	}
+	if answer[0].Type != common.Type_Auth {
+		return fmt.Errorf("unexpected answer to the authentication: %v", answer[0])
+	}
+
+	log.Infof("Action: Authenticate | Result: Success | Tenant: %s", answer[0].Content)
+	return nil
+}
+
+// Offers the configured algorithms to the server, which answers with the one both will use
+func (c *Client) NegotiateCompression() error {
+	if c.Config.Compression == "" || c.Config.Compression == common.CompressionNameNone {
+		return nil
+	}
+
+	clientMessage := common.ClientMessage{Content: c.Config.Compression, Type: common.Type_NegotiateCompression}
+	if err := c.SendMessage(clientMessage); err != nil {
+		return err
+	}
+
+	answer, err := c.Recv()
+	if err != nil {
+		return err
+	}
+	answerDeserialized := answer[0]
+	if answerDeserialized.Type == common.Type_Error {
+		return fmt.Errorf("the server rejected the compression negotiation: %s", answerDeserialized.Content)
+	}
+	if answerDeserialized.Type != common.Type_NegotiateCompression {
+		return fmt.Errorf("unexpected answer to the compression negotiation: %v", answerDeserialized)
+	}
+
+	c.compression, err = common.CompressionFromName(answerDeserialized.Content)
+	if err != nil {
+		return err
+	}
+	log.Infof("Action: Negotiate Compression | Result: Success | Compression: %s", common.CompressionName(c.compression))
+	return nil
+}
+
+// Asks the server for a slot for our job and waits in its queue until we get one
+func (c *Client) RequestAdmission() error {
+	if len(c.Config.Options) > 0 {
+		// The server only answers if they are wrong, and then the admission fails
+		if err := c.SendMessage(common.ClientMessage{Content: c.Config.Options.String(), Type: common.Type_Options}); err != nil {
+			return err
+		}
+		log.Infof("Action: Send Job Options | Result: Success | Options: %s", c.Config.Options)
+	}
+
+	priority := strconv.Itoa(int(c.Config.Priority))
+	if err := c.SendMessage(common.ClientMessage{Content: priority, Type: common.Type_Admit}); err != nil {
+		return err
+	}
+
+	for {
+		answer, err := c.Recv()
+		if err != nil {
+			return err
+		}
+
+		switch answer[0].Type {
+		case common.Type_Admit:
+			log.Infof("Action: Request Admission | Result: Success")
+			return nil
+		case common.Type_Busy:
+			position, retryAfter, err := common.ParseBusyContent(answer[0].Content)
+			if err != nil {
+				return err
+			}
+			if position == 0 {
+				return &busyError{retryAfter: retryAfter}
+			}
+			log.Infof("Action: Request Admission | Result: Queued | Position: %d", position)
+		case common.Type_Error:
+			return fmt.Errorf("the server rejected the admission: %s", answer[0].Content)
+		default:
+			return fmt.Errorf("unexpected answer to the admission: %v", answer[0])
+		}
+	}
 }
 
 func (c *Client) GetId() error {
@@ -224,49 +424,64 @@ func (c *Client) AskForResults() {
 	// ASKING FOR RESULTS
 	log.Debug("Asking for results")
 	clientMessage := common.ClientMessage{Content: c.Id, Type: common.Type_AskForResults}
-	clientMessageSerialized, err := clientMessage.SerializeClientMessage()
 
-	common.FailOnError(err, "Failed to serialize message") // UNREACHABLE
+	err := c.SendMessage(clientMessage)
 
-	common.Send(clientMessageSerialized, c.Connection)
+	common.FailOnError(err, "Failed to ask for results")
 
-	log.Debugf("Asked for results: %s", clientMessageSerialized)
+	log.Debugf("Asked for results: %v", clientMessage)
 
 	// GETTING RESULTS
 	for {
-		message, err := common.Receive(c.Connection)
+		messages, err := c.Recv()
 
 		if err != nil {
-			log.Errorf("Connection with Server has been closed")
+			log.Errorf("Connection with Server has been closed: %s", err)
 			return
 		}
 
-		messageDeserialized, err := common.DeserializeClientMessage(message)
-
-		common.FailOnError(err, "Failed to deserialize message") // UNREACHABLE
-
-		if messageDeserialized.IsEndWithResults() {
-			log.Infof("Finish reading results for all queries")
-			return
-		} else if messageDeserialized.IsQueryResult() {
-			writeTo, ok := c.Results[messageDeserialized.Type]
-			if !ok {
-				log.Errorf("Action: Rerceived Query Result | Result: No place to store | Data: %s", message)
-				continue
+		for _, messageDeserialized := range messages {
+			if messageDeserialized.IsEndWithResults() {
+				log.Infof("Finish reading results for all queries")
+				return
+			} else if messageDeserialized.IsQueryResult() {
+				writeTo, ok := c.Results[messageDeserialized.Type]
+				if !ok {
+					log.Errorf("Action: Rerceived Query Result | Result: No place to store | Data: %s", messageDeserialized.Content)
+					continue
+				}
+				writeTo.AppendLine([]byte(messageDeserialized.Content))
+			} else if messageDeserialized.Type == common.Type_Results_Provisional {
+				logProvisional(messageDeserialized.Content)
+			} else if messageDeserialized.Type == common.Type_Error {
+				log.Errorf("Action: Receive Results | Result: Server Error | Error: %s", messageDeserialized.Content)
+				return
+			} else {
+				log.Errorf("Unexpected message from server")
+				return
 			}
-			writeTo.AppendLine([]byte(messageDeserialized.Content))
-		} else {
-			log.Errorf("Unexpected message from server")
-			return
 		}
 	}
 }
 
+// The query and the upserts it got, then the name and count of every game in its order
+func logProvisional(content string) {
+	row, err := csv.NewReader(strings.NewReader(content)).Read()
+	if err != nil || len(row) < 2 || len(row)%2 != 0 {
+		log.Errorf("Action: Receive Provisional Top | Result: Malformed | Data: %s", content)
+		return
+	}
+	games := make([]string, 0, len(row)/2-1)
+	for i := 2; i < len(row); i += 2 {
+		games = append(games, fmt.Sprintf("%s=%s", row[i], row[i+1]))
+	}
+	log.Infof("Action: Receive Provisional Top %s | Result: Success | Upserts: %s | Top: %s", row[0], row[1], strings.Join(games, ", "))
+}
+
 func (c *Client) CloseConnection() {
 	clientMessage := common.ClientMessage{Content: c.Id, Type: common.Type_CloseConnection}
-	clientMessageSerialized, err := clientMessage.SerializeClientMessage()
-
-	common.FailOnError(err, "Failed to serialize message") // UNREACHABLE
 
-	common.Send(clientMessageSerialized, c.Connection)
+	if err := c.SendMessage(clientMessage); err != nil {
+		log.Errorf("Failed to close the connection: %s", err)
+	}
 }
@@ -11,6 +11,14 @@ type TwoStageConfig struct {
 	StageThree PartitionConfig `mapstructure:"stage_three"`
 }
 
+// For the queries that repartition the output of stage two by another key before the
+// single node of the end
+type ThreeStageConfig struct {
+	StageTwo   PartitionConfig `mapstructure:"stage_two"`
+	StageThree PartitionConfig `mapstructure:"stage_three"`
+	StageFour  PartitionConfig `mapstructure:"stage_four"`
+}
+
 type ArchitectureConfig struct {
 	MapFilter struct {
 		QueryOneGames     PartitionConfig `mapstructure:"query_one_games"`
@@ -18,9 +26,14 @@ type ArchitectureConfig struct {
 		QueryThreeGames   PartitionConfig `mapstructure:"query_three_games"`
 		QueryFourGames    PartitionConfig `mapstructure:"query_four_games"`
 		QueryFiveGames    PartitionConfig `mapstructure:"query_five_games"`
+		QuerySixGames     PartitionConfig `mapstructure:"query_six_games"`
+		QuerySevenGames   PartitionConfig `mapstructure:"query_seven_games"`
+		QueryEightGames   PartitionConfig `mapstructure:"query_eight_games"`
 		QueryThreeReviews PartitionConfig `mapstructure:"query_three_reviews"`
 		QueryFourReviews  PartitionConfig `mapstructure:"query_four_reviews"`
 		QueryFiveReviews  PartitionConfig `mapstructure:"query_five_reviews"`
+		QuerySevenReviews PartitionConfig `mapstructure:"query_seven_reviews"`
+		QueryEightReviews PartitionConfig `mapstructure:"query_eight_reviews"`
 	} `mapstructure:"map_filter"`
 
 	QueryOne TwoStageConfig `mapstructure:"query_one"`
@@ -32,6 +45,15 @@ type ArchitectureConfig struct {
 	QueryFour TwoStageConfig `mapstructure:"query_four"`
 
 	QueryFive TwoStageConfig `mapstructure:"query_five"`
+
+	QuerySix TwoStageConfig `mapstructure:"query_six"`
+
+	QuerySeven ThreeStageConfig `mapstructure:"query_seven"`
+
+	QueryEight TwoStageConfig `mapstructure:"query_eight"`
+
+	// Exchange name to compression algorithm for the messages published to it
+	Compression map[string]string `mapstructure:"compression"`
 }
 
 func LoadArchitectureConfig(configFilePath string) *ArchitectureConfig {
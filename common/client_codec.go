@@ -0,0 +1,202 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// First byte of every binary frame. Text messages always start with an ASCII tag, so
+// the server can tell both protocols apart from the first frame.
+const binaryMagic uint8 = 0xB1
+
+const (
+	ProtocolVersion_Text uint8 = iota
+	ProtocolVersion_1
+)
+
+// Binary versions we speak, from oldest to newest
+var SupportedProtocolVersions = []uint8{ProtocolVersion_1}
+
+var ErrUnsupportedVersion = errors.New("no common protocol version")
+
+// Translates client messages to frames and back
+type ClientCodec interface {
+	Encode(message ClientMessage) ([]byte, error)
+	// A binary frame can carry several messages, like a batch of records
+	Decode(frame []byte) ([]ClientMessage, error)
+	Version() uint8
+}
+
+// The pipe delimited protocol, kept for the peers that don't send a hello
+type TextCodec struct{}
+
+func (TextCodec) Encode(message ClientMessage) ([]byte, error) {
+	s, err := message.SerializeClientMessage()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(s), nil
+}
+
+func (TextCodec) Decode(frame []byte) ([]ClientMessage, error) {
+	m, err := DeserializeClientMessage(strings.Trim(string(frame), "\n"))
+	if err != nil {
+		return nil, err
+	}
+	return []ClientMessage{m}, nil
+}
+
+func (TextCodec) Version() uint8 {
+	return ProtocolVersion_Text
+}
+
+// Every message is: magic | version | type | content, where content is length prefixed
+type BinaryCodec struct {
+	version uint8
+}
+
+func NewBinaryCodec(version uint8) *BinaryCodec {
+	return &BinaryCodec{version: version}
+}
+
+func (c *BinaryCodec) Encode(message ClientMessage) ([]byte, error) {
+	if !isKnownType(message.Type) {
+		return nil, fmt.Errorf("invalid message type %d", message.Type)
+	}
+	s := NewSerializer()
+	return s.WriteUint8(binaryMagic).WriteUint8(c.version).WriteUint8(uint8(message.Type)).WriteString(message.Content).ToBytes(), nil
+}
+
+func (c *BinaryCodec) Decode(frame []byte) ([]ClientMessage, error) {
+	d := NewDeserializer(frame)
+	messages := make([]ClientMessage, 0, 1)
+	for d.Buf.Len() > 0 {
+		m, version, err := readBinaryMessage(&d)
+		if err != nil {
+			return nil, err
+		}
+		if version != c.version {
+			return nil, fmt.Errorf("message of version %d on a version %d connection", version, c.version)
+		}
+		messages = append(messages, m)
+	}
+	if len(messages) == 0 {
+		return nil, errors.New("empty frame")
+	}
+	return messages, nil
+}
+
+func (c *BinaryCodec) Version() uint8 {
+	return c.version
+}
+
+func readBinaryMessage(d *Deserializer) (ClientMessage, uint8, error) {
+	magic, err := d.ReadUint8()
+	if err != nil {
+		return ClientMessage{}, 0, err
+	}
+	if magic != binaryMagic {
+		return ClientMessage{}, 0, errors.New("not a binary message")
+	}
+	version, err := d.ReadUint8()
+	if err != nil {
+		return ClientMessage{}, 0, err
+	}
+	t, err := d.ReadUint8()
+	if err != nil {
+		return ClientMessage{}, 0, err
+	}
+	if !isKnownType(int(t)) {
+		return ClientMessage{}, 0, fmt.Errorf("invalid message type %d", t)
+	}
+	content, err := d.ReadString()
+	if err != nil {
+		return ClientMessage{}, 0, err
+	}
+	return ClientMessage{Content: content, Type: int(t)}, version, nil
+}
+
+func isKnownType(t int) bool {
+	return t >= Type_GAMES && t <= Type_Results_Provisional
+}
+
+func IsBinaryFrame(frame []byte) bool {
+	return len(frame) > 0 && frame[0] == binaryMagic
+}
+
+// Opens a binary session: offers our versions and waits for the one chosen by the server
+func ClientHandshake(conn net.Conn) (ClientCodec, error) {
+	newest := SupportedProtocolVersions[len(SupportedProtocolVersions)-1]
+	hello, err := NewBinaryCodec(newest).Encode(ClientMessage{Content: string(SupportedProtocolVersions), Type: Type_Hello})
+	if err != nil {
+		return nil, err
+	}
+	if err = SendFrame(hello, conn, Compression_None); err != nil {
+		return nil, err
+	}
+
+	frame, err := ReceiveFrame(conn)
+	if err != nil {
+		return nil, err
+	}
+	if !IsBinaryFrame(frame) {
+		return nil, errors.New("the server answered the hello with a text message")
+	}
+
+	d := NewDeserializer(frame)
+	answer, version, err := readBinaryMessage(&d)
+	if err != nil {
+		return nil, err
+	}
+	switch answer.Type {
+	case Type_Hello:
+		if !Contains(SupportedProtocolVersions, version) {
+			return nil, ErrUnsupportedVersion
+		}
+		return NewBinaryCodec(version), nil
+	case Type_Error:
+		return nil, fmt.Errorf("the server rejected the hello: %s", answer.Content)
+	}
+	return nil, fmt.Errorf("unexpected answer to the hello of type %d", answer.Type)
+}
+
+// Answers the hello of a client with the newest version both support, or an error frame
+func ServerHandshake(conn net.Conn, hello []byte) (ClientCodec, error) {
+	d := NewDeserializer(hello)
+	m, _, err := readBinaryMessage(&d)
+	if err == nil && m.Type != Type_Hello {
+		err = errors.New("the first binary message must be a hello")
+	}
+	if err != nil {
+		SendProtocolError(conn, err)
+		return nil, err
+	}
+
+	offered := []uint8(m.Content)
+	for i := len(SupportedProtocolVersions) - 1; i >= 0; i-- {
+		version := SupportedProtocolVersions[i]
+		if !Contains(offered, version) {
+			continue
+		}
+		codec := NewBinaryCodec(version)
+		answer, err := codec.Encode(ClientMessage{Content: string([]uint8{version}), Type: Type_Hello})
+		if err != nil {
+			return nil, err
+		}
+		return codec, SendFrame(answer, conn, Compression_None)
+	}
+
+	SendProtocolError(conn, ErrUnsupportedVersion)
+	return nil, ErrUnsupportedVersion
+}
+
+// Error frames of the handshake go in the oldest version, every binary client can read them
+func SendProtocolError(conn net.Conn, cause error) error {
+	frame, err := NewBinaryCodec(SupportedProtocolVersions[0]).Encode(ClientMessage{Content: cause.Error(), Type: Type_Error})
+	if err != nil {
+		return err
+	}
+	return SendFrame(frame, conn, Compression_None)
+}
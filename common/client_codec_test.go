@@ -0,0 +1,139 @@
+package common_test
+
+import (
+	"encoding/binary"
+	"middleware/common"
+	"net"
+	"testing"
+)
+
+func TestBinaryCodecBatch(t *testing.T) {
+	codec := common.NewBinaryCodec(common.ProtocolVersion_1)
+
+	sent := []common.ClientMessage{
+		{Content: "10,Counter-Strike,\"Great | game\nreally\",1,1\n", Type: common.Type_REVIEWS},
+		{Content: "", Type: common.Type_ALV},
+		{Content: common.EOF, Type: common.Type_REVIEWS},
+	}
+
+	frame := make([]byte, 0)
+	for _, m := range sent {
+		b, err := codec.Encode(m)
+		if err != nil {
+			t.Fatalf("Cannot encode message: %s", err)
+		}
+		frame = append(frame, b...)
+	}
+
+	received, err := codec.Decode(frame)
+	if err != nil {
+		t.Fatalf("Cannot decode frame: %s", err)
+	}
+	if len(received) != len(sent) {
+		t.Fatalf("Expected %d messages, got %d", len(sent), len(received))
+	}
+	for i := range sent {
+		if received[i] != sent[i] {
+			t.Fatalf("Message %d differs: sent %v, received %v", i, sent[i], received[i])
+		}
+	}
+}
+
+func TestBinaryCodecRejectsGarbage(t *testing.T) {
+	codec := common.NewBinaryCodec(common.ProtocolVersion_1)
+	valid, _ := codec.Encode(common.ClientMessage{Content: "10,Game", Type: common.Type_GAMES})
+
+	frames := [][]byte{
+		{},
+		[]byte("GAM|10,Game"),
+		valid[:len(valid)-2],
+		append([]byte{valid[0], valid[1], 200}, valid[3:]...),
+		append([]byte{valid[0], 7}, valid[2:]...),
+		// Claims a content way bigger than the frame
+		{valid[0], valid[1], valid[2], 0xFF, 0xFF, 0xFF, 0xFF},
+	}
+
+	for i, frame := range frames {
+		if _, err := codec.Decode(frame); err == nil {
+			t.Fatalf("Expected frame %d to be rejected", i)
+		}
+	}
+
+	if _, err := (common.TextCodec{}).Decode([]byte("XXX|unknown")); err == nil {
+		t.Fatalf("Expected the unknown text tag to be rejected")
+	}
+
+	if m, err := (common.TextCodec{}).Decode([]byte("ALV")); err != nil || m[0].Type != common.Type_ALV {
+		t.Fatalf("Expected ALV to be decoded by the text codec")
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	serverCodec := make(chan common.ClientCodec, 1)
+	go func() {
+		frame, err := common.ReceiveFrame(server)
+		if err != nil || !common.IsBinaryFrame(frame) {
+			t.Errorf("Expected a binary hello")
+			serverCodec <- nil
+			return
+		}
+		codec, err := common.ServerHandshake(server, frame)
+		if err != nil {
+			t.Errorf("Server handshake failed: %s", err)
+		}
+		serverCodec <- codec
+	}()
+
+	codec, err := common.ClientHandshake(client)
+	if err != nil {
+		t.Fatalf("Client handshake failed: %s", err)
+	}
+
+	if sc := <-serverCodec; sc == nil || sc.Version() != codec.Version() {
+		t.Fatalf("Client and server didn't agree on the version")
+	}
+}
+
+func TestHandshakeUnsupportedVersion(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// A hello from the future that only speaks version 99
+	hello, _ := common.NewBinaryCodec(99).Encode(common.ClientMessage{Content: string([]uint8{99}), Type: common.Type_Hello})
+
+	go func() {
+		if _, err := common.ServerHandshake(server, hello); err == nil {
+			t.Errorf("Expected the server to reject the hello")
+		}
+	}()
+
+	frame, err := common.ReceiveFrame(client)
+	if err != nil {
+		t.Fatalf("Expected an error frame: %s", err)
+	}
+	m, err := common.NewBinaryCodec(common.ProtocolVersion_1).Decode(frame)
+	if err != nil || m[0].Type != common.Type_Error {
+		t.Fatalf("Expected an error frame, got %v", m)
+	}
+}
+
+func TestReceiveFrameTooBig(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		header := make([]byte, 4)
+		binary.BigEndian.PutUint32(header, common.MaxFrameSize+1)
+		client.Write(header)
+	}()
+
+	if _, err := common.ReceiveFrame(server); err != common.ErrFrameTooBig {
+		t.Fatalf("Expected the frame to be rejected, got %v", err)
+	}
+}
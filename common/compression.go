@@ -0,0 +1,105 @@
+package common
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"strings"
+)
+
+type Compression = uint8
+
+const (
+	Compression_None Compression = iota
+	Compression_Gzip
+)
+
+const (
+	CompressionNameNone = "none"
+	CompressionNameGzip = "gzip"
+)
+
+// Payloads smaller than this are not worth the CPU time
+const compressMinSize = 512
+
+// Marks a frame as compressed in the length prefix of the client protocol. Frames
+// are never this big, so peers that don't compress never set it.
+const compressedFrameFlag uint32 = 1 << 31
+
+func CompressionFromName(name string) (Compression, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", CompressionNameNone:
+		return Compression_None, nil
+	case CompressionNameGzip:
+		return Compression_Gzip, nil
+	}
+	return Compression_None, errors.New("unknown compression algorithm " + name)
+}
+
+func CompressionName(c Compression) string {
+	switch c {
+	case Compression_Gzip:
+		return CompressionNameGzip
+	}
+	return CompressionNameNone
+}
+
+// Picks the first algorithm offered by the peer that we also support
+func ChooseCompression(offered string, supported []Compression) Compression {
+	for _, name := range strings.Split(offered, ",") {
+		c, err := CompressionFromName(name)
+		if err != nil || c == Compression_None {
+			continue
+		}
+		if Contains(supported, c) {
+			return c
+		}
+	}
+	return Compression_None
+}
+
+func Compress(c Compression, data []byte) ([]byte, error) {
+	switch c {
+	case Compression_None:
+		return data, nil
+	case Compression_Gzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, errors.New("unknown compression algorithm")
+}
+
+func Decompress(c Compression, data []byte) ([]byte, error) {
+	switch c {
+	case Compression_None:
+		return data, nil
+	case Compression_Gzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		// Never inflate past what we would accept as a frame
+		data, err := io.ReadAll(io.LimitReader(r, int64(MaxFrameSize)+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > int(MaxFrameSize) {
+			return nil, ErrFrameTooBig
+		}
+		return data, nil
+	}
+	return nil, errors.New("unknown compression algorithm")
+}
+
+func ShouldCompress(c Compression, data []byte) bool {
+	return c != Compression_None && len(data) >= compressMinSize
+}
@@ -0,0 +1,52 @@
+package common_test
+
+import (
+	"middleware/common"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestCompressionNegotiation(t *testing.T) {
+	supported := []common.Compression{common.Compression_Gzip}
+
+	if c := common.ChooseCompression("zstd, gzip", supported); c != common.Compression_Gzip {
+		t.Fatalf("Expected gzip to be chosen, got %s", common.CompressionName(c))
+	}
+
+	if c := common.ChooseCompression("zstd", supported); c != common.Compression_None {
+		t.Fatalf("Expected no compression to be chosen, got %s", common.CompressionName(c))
+	}
+
+	if c := common.ChooseCompression("gzip", nil); c != common.Compression_None {
+		t.Fatalf("Expected no compression when the server doesn't support any, got %s", common.CompressionName(c))
+	}
+}
+
+func TestSendCompressedFrames(t *testing.T) {
+	messages := []string{
+		"small message",
+		strings.Repeat("10,Game,Review text that repeats a lot,1,0\n", 100),
+	}
+
+	for _, c := range []common.Compression{common.Compression_None, common.Compression_Gzip} {
+		for _, message := range messages {
+			sender, receiver := net.Pipe()
+			go func() {
+				if err := common.SendCompressed(message, sender, c); err != nil {
+					t.Errorf("Cannot send message: %s", err)
+				}
+				sender.Close()
+			}()
+
+			received, err := common.Receive(receiver)
+			if err != nil {
+				t.Fatalf("Cannot receive message: %s", err)
+			}
+			if received != strings.Trim(message, "\n") {
+				t.Fatalf("Received message differs from the one sent with %s", common.CompressionName(c))
+			}
+			receiver.Close()
+		}
+	}
+}
@@ -2,6 +2,7 @@ package common
 
 import (
 	"os"
+	"strings"
 
 	"github.com/op/go-logging"
 	"github.com/spf13/viper"
@@ -28,6 +29,10 @@ func PrintConfig(cfg *viper.Viper) {
 
 	// Iterate through the map and print each key-value pair
 	for key, value := range settings {
+		if strings.Contains(key, "token") {
+			// Secrets stay out of the logs
+			value = "****"
+		}
 		log.Infof("Loaded configuration %s: %v\n", key, value)
 	}
 }
@@ -32,4 +32,21 @@ const (
 	Type_ValidReview
 	Type_ReviewCounter
 	Type_NamedReviewCounter
+	Type_SaltedReviewCounter
+	Type_HotReviewCounter
+	Type_ReviewCounterUpsert
+	Type_QuantileSketch
+	Type_CountHistogram
+	Type_PercentileThreshold
+	Type_PricedGame
+	Type_PriceStats
+	Type_PriceSummary
+	Type_GameCompanies
+	Type_ReviewTally
+	Type_CompanyTally
+	Type_CompanyRank
+	Type_DatedGame
+	Type_SentimentBucket
+	Type_LanguageCount
+	Type_ProvisionalTop
 )
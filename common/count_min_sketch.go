@@ -0,0 +1,46 @@
+package common
+
+import "hash/fnv"
+
+// Approximate counts of keys in fixed memory. Estimates never fall below the real count,
+// collisions can only make them larger.
+type CountMinSketch struct {
+	width int
+	rows  [][]uint32
+}
+
+func NewCountMinSketch(width int, depth int) *CountMinSketch {
+	width = max(width, 1)
+	rows := make([][]uint32, max(depth, 1))
+	for i := range rows {
+		rows[i] = make([]uint32, width)
+	}
+	return &CountMinSketch{width: width, rows: rows}
+}
+
+// Adds n to the key and returns its new estimate
+func (s *CountMinSketch) Add(key string, n uint32) uint32 {
+	estimate := ^uint32(0)
+	for i, row := range s.rows {
+		j := s.column(key, i)
+		row[j] += n
+		estimate = min(estimate, row[j])
+	}
+	return estimate
+}
+
+func (s *CountMinSketch) Estimate(key string) uint32 {
+	estimate := ^uint32(0)
+	for i, row := range s.rows {
+		estimate = min(estimate, row[s.column(key, i)])
+	}
+	return estimate
+}
+
+func (s *CountMinSketch) column(key string, row int) int {
+	h := fnv.New32a()
+	// Every row hashes with its own seed
+	h.Write([]byte{byte(row), byte(row >> 8)})
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(s.width))
+}
@@ -0,0 +1,41 @@
+package common_test
+
+import (
+	"fmt"
+	"middleware/common"
+	"testing"
+)
+
+func TestCountMinSketchNeverUnderestimates(t *testing.T) {
+	s := common.NewCountMinSketch(256, 4)
+	seen := make(map[string]uint32)
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("%d", i%700)
+		s.Add(key, 1)
+		seen[key]++
+	}
+	for key, count := range seen {
+		if e := s.Estimate(key); e < count {
+			t.Fatalf("Estimated %d for %s, it was seen %d times", e, key, count)
+		}
+	}
+}
+
+func TestCountMinSketchFindsHeavyKey(t *testing.T) {
+	s := common.NewCountMinSketch(1024, 4)
+	for i := 0; i < 10000; i++ {
+		s.Add(fmt.Sprintf("game-%d", i), 1)
+	}
+	var last uint32
+	for i := 0; i < 3000; i++ {
+		last = s.Add("blockbuster", 1)
+	}
+
+	if last < 3000 {
+		t.Fatalf("Expected at least 3000 for the heavy key, got %d", last)
+	}
+	// 10000 keys over 1024 columns, about 10 each
+	if e := s.Estimate("game-1"); e > 100 {
+		t.Fatalf("Expected a light key to stay light, got %d", e)
+	}
+}
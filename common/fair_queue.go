@@ -0,0 +1,171 @@
+package common
+
+import "sync"
+
+// Deficit round robin between jobs. Every turn a job earns a quantum and takes messages
+// while the cost of the next one fits in what it has earned, so a job with a huge backlog
+// or huge messages gets the same share as the small ones instead of going first.
+// Jobs of a higher priority always go before the lower ones, the round is between the
+// jobs of the highest priority that can take a message.
+type FairQueue[T any] struct {
+	// Messages held at once, Push blocks once it's reached
+	capacity int
+	quantum  int
+	// Messages of one job popped and not yet marked as done, jobs at the limit are skipped
+	maxInFlight int
+
+	jobs map[JobID]*fairJob[T]
+	// Jobs with pending messages in round robin order
+	ring   []JobID
+	next   int
+	size   int
+	closed bool
+	mu     sync.Mutex
+	cond   *sync.Cond
+}
+
+type fairJob[T any] struct {
+	items    []fairItem[T]
+	deficit  int
+	inFlight int
+	priority uint8
+}
+
+type fairItem[T any] struct {
+	value T
+	cost  int
+}
+
+func NewFairQueue[T any](capacity int, quantum int, maxInFlight int) *FairQueue[T] {
+	q := &FairQueue[T]{
+		capacity:    max(capacity, 1),
+		quantum:     max(quantum, 1),
+		maxInFlight: max(maxInFlight, 1),
+		jobs:        make(map[JobID]*fairJob[T]),
+		ring:        make([]JobID, 0),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// Blocks while the queue is full. Returns false once the queue is closed.
+func (q *FairQueue[T]) Push(job JobID, value T, cost int, priority uint8) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for q.size >= q.capacity && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return false
+	}
+
+	j, ok := q.jobs[job]
+	if !ok {
+		j = &fairJob[T]{}
+		q.jobs[job] = j
+	}
+	if len(j.items) == 0 {
+		// Joining the round starts its first turn
+		q.ring = append(q.ring, job)
+		j.deficit = q.quantum
+	}
+	j.priority = priority
+	j.items = append(j.items, fairItem[T]{value: value, cost: cost})
+	q.size++
+	q.cond.Broadcast()
+	return true
+}
+
+// Blocks until a job can take a message. Returns false once the queue is closed and empty.
+func (q *FairQueue[T]) Pop() (JobID, T, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		if job, item, ok := q.pick(); ok {
+			q.cond.Broadcast()
+			return job, item.value, true
+		}
+		if q.closed && q.size == 0 {
+			var zero T
+			return JobID{}, zero, false
+		}
+		q.cond.Wait()
+	}
+}
+
+func (q *FairQueue[T]) pick() (JobID, fairItem[T], bool) {
+	eligible := false
+	var top uint8
+	for _, id := range q.ring {
+		if j := q.jobs[id]; j.inFlight < q.maxInFlight && (!eligible || j.priority > top) {
+			eligible = true
+			top = j.priority
+		}
+	}
+	if !eligible {
+		return JobID{}, fairItem[T]{}, false
+	}
+
+	// Only the jobs of the top priority that can take a message play this round
+	plays := func(j *fairJob[T]) bool {
+		return j.inFlight < q.maxInFlight && j.priority == top
+	}
+
+	for {
+		id := q.ring[q.next]
+		j := q.jobs[id]
+		if plays(j) && j.deficit >= j.items[0].cost {
+			item := j.items[0]
+			j.items = j.items[1:]
+			j.deficit -= item.cost
+			j.inFlight++
+			q.size--
+			if len(j.items) == 0 {
+				// Idle jobs don't keep what they earned
+				j.deficit = 0
+				q.ring = append(q.ring[:q.next], q.ring[q.next+1:]...)
+				if q.next >= len(q.ring) {
+					q.next = 0
+				}
+			}
+			return id, item, true
+		}
+
+		q.next = (q.next + 1) % len(q.ring)
+		if n := q.jobs[q.ring[q.next]]; plays(n) {
+			n.deficit += q.quantum
+		}
+	}
+}
+
+// Marks a message of the job as processed, letting the job take another one
+func (q *FairQueue[T]) Done(job JobID) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	j, ok := q.jobs[job]
+	if !ok {
+		return
+	}
+	j.inFlight--
+	if j.inFlight <= 0 && len(j.items) == 0 {
+		delete(q.jobs, job)
+	}
+	q.cond.Broadcast()
+}
+
+// Wakes everyone up, Pop keeps returning what is left until the queue is empty
+func (q *FairQueue[T]) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+func (q *FairQueue[T]) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size
+}
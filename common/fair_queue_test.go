@@ -0,0 +1,103 @@
+package common_test
+
+import (
+	"middleware/common"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestFairQueueSmallJobNotStarved(t *testing.T) {
+	q := common.NewFairQueue[int](200, 100, 1000)
+	big, small := uuid.New(), uuid.New()
+
+	for i := 0; i < 100; i++ {
+		q.Push(big, i, 100, 0)
+	}
+	for i := 0; i < 5; i++ {
+		q.Push(small, i, 100, 0)
+	}
+
+	smallLeft := 5
+	for pops := 1; smallLeft > 0; pops++ {
+		job, _, ok := q.Pop()
+		if !ok {
+			t.Fatalf("The queue closed before the small job finished")
+		}
+		if job == small {
+			smallLeft--
+		}
+		if pops > 10 {
+			t.Fatalf("The small job still had %d messages after %d pops", smallLeft, pops)
+		}
+	}
+}
+
+func TestFairQueueKeepsOrderWithinJob(t *testing.T) {
+	q := common.NewFairQueue[int](10, 1, 10)
+	job := uuid.New()
+	for i := 0; i < 5; i++ {
+		q.Push(job, i, 3, 0)
+	}
+
+	for i := 0; i < 5; i++ {
+		_, v, _ := q.Pop()
+		if v != i {
+			t.Fatalf("Expected message %d, got %d", i, v)
+		}
+		q.Done(job)
+	}
+}
+
+func TestFairQueueSkipsJobsAtInFlightLimit(t *testing.T) {
+	q := common.NewFairQueue[string](10, 1, 1)
+	busy, idle := uuid.New(), uuid.New()
+	q.Push(busy, "busy-1", 1, 0)
+	q.Push(busy, "busy-2", 1, 0)
+	q.Push(idle, "idle-1", 1, 0)
+
+	if _, v, _ := q.Pop(); v != "busy-1" {
+		t.Fatalf("Expected the first message of the busy job, got %s", v)
+	}
+	// busy-1 isn't done yet, so the other job goes next
+	if _, v, _ := q.Pop(); v != "idle-1" {
+		t.Fatalf("Expected the message of the idle job, got %s", v)
+	}
+
+	q.Done(busy)
+	if _, v, _ := q.Pop(); v != "busy-2" {
+		t.Fatalf("Expected the second message of the busy job, got %s", v)
+	}
+}
+
+func TestFairQueueDrainsAfterClose(t *testing.T) {
+	q := common.NewFairQueue[int](10, 1, 10)
+	job := uuid.New()
+	q.Push(job, 1, 1, 0)
+	q.Close()
+
+	if q.Push(job, 2, 1, 0) {
+		t.Fatalf("A closed queue accepted a message")
+	}
+	if _, v, ok := q.Pop(); !ok || v != 1 {
+		t.Fatalf("Expected the pending message after closing, got %d %t", v, ok)
+	}
+	if _, _, ok := q.Pop(); ok {
+		t.Fatalf("Expected an empty closed queue to stop popping")
+	}
+}
+
+func TestFairQueueHigherPriorityFirst(t *testing.T) {
+	q := common.NewFairQueue[string](10, 100, 10)
+	backfill, dashboard := uuid.New(), uuid.New()
+	q.Push(backfill, "backfill-1", 1, 0)
+	q.Push(backfill, "backfill-2", 1, 0)
+	q.Push(dashboard, "dashboard-1", 1, 5)
+	q.Push(dashboard, "dashboard-2", 1, 5)
+
+	for _, expected := range []string{"dashboard-1", "dashboard-2", "backfill-1", "backfill-2"} {
+		if _, v, _ := q.Pop(); v != expected {
+			t.Fatalf("Expected %s, got %s", expected, v)
+		}
+	}
+}
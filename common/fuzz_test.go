@@ -0,0 +1,67 @@
+package common_test
+
+import (
+	"middleware/common"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// Everything in here parses bytes that come from clients or from the queues, none of
+// them may panic whatever they receive. Run with: go test -fuzz=FuzzName ./common
+
+func FuzzDeserializeClientMessage(f *testing.F) {
+	f.Add("GAM|10,Game,Oct 21, 2008")
+	f.Add("REV|EOF")
+	f.Add("ALV")
+	f.Add("|")
+	f.Add("")
+
+	f.Fuzz(func(t *testing.T, message string) {
+		m, err := common.DeserializeClientMessage(message)
+		if err != nil {
+			return
+		}
+		if _, err := m.SerializeClientMessage(); err != nil {
+			t.Fatalf("A deserialized message can't be serialized back: %v", m)
+		}
+	})
+}
+
+func FuzzBinaryCodecDecode(f *testing.F) {
+	codec := common.NewBinaryCodec(common.ProtocolVersion_1)
+	valid, _ := codec.Encode(common.ClientMessage{Content: "10,Game", Type: common.Type_GAMES})
+	f.Add(valid)
+	f.Add(append(valid, valid...))
+	f.Add([]byte{})
+	f.Add([]byte{valid[0], valid[1], valid[2], 0xFF, 0xFF, 0xFF, 0xFF})
+
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		messages, err := codec.Decode(frame)
+		if err != nil {
+			return
+		}
+		for _, m := range messages {
+			if _, err := codec.Encode(m); err != nil {
+				t.Fatalf("A decoded message can't be encoded back: %v", m)
+			}
+		}
+	})
+}
+
+func FuzzMessageFromBytes(f *testing.F) {
+	m := common.NewMessage(uuid.New(), &common.IdempotencyID{Origin: "SV", Sequence: 1}, common.ProtocolMessage_Data, []byte("content"))
+	f.Add(m.Serialize())
+	f.Add([]byte{})
+	f.Add(make([]byte, 17))
+
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		m, err := common.MessageFromBytes(raw)
+		if err != nil {
+			return
+		}
+		if m.IdempotencyID == nil {
+			t.Fatalf("A message without idempotency id was accepted")
+		}
+	})
+}
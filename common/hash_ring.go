@@ -0,0 +1,74 @@
+package common
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// Points every partition takes in the ring. Every process routing to the same partitions
+// has to use the same amount, or the games and reviews of a key end up apart.
+const VirtualNodes = 128
+
+// Consistent hashing of keys to partitions 1..N. Every partition owns the arcs that end
+// in one of its virtual nodes, so adding a partition only takes keys from the others
+// and removing one only moves its own keys.
+type HashRing struct {
+	points     []uint32
+	partitions []int
+}
+
+func NewHashRing(partitions int, virtualNodes int) *HashRing {
+	partitions = max(partitions, 1)
+	virtualNodes = max(virtualNodes, 1)
+
+	type point struct {
+		hash      uint32
+		partition int
+	}
+	all := make([]point, 0, partitions*virtualNodes)
+	for p := 1; p <= partitions; p++ {
+		for v := 0; v < virtualNodes; v++ {
+			all = append(all, point{hash: hashKey(strconv.Itoa(p) + "#" + strconv.Itoa(v)), partition: p})
+		}
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].hash == all[j].hash {
+			return all[i].partition < all[j].partition
+		}
+		return all[i].hash < all[j].hash
+	})
+
+	r := &HashRing{
+		points:     make([]uint32, len(all)),
+		partitions: make([]int, len(all)),
+	}
+	for i, p := range all {
+		r.points[i] = p.hash
+		r.partitions[i] = p.partition
+	}
+	return r
+}
+
+// Partition of the key, starting at 1
+func (r *HashRing) Locate(key string) int {
+	h := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.partitions[i]
+}
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	// FNV spreads short keys that only differ at the end poorly, mix the bits once more
+	v := h.Sum32()
+	v ^= v >> 16
+	v *= 0x85ebca6b
+	v ^= v >> 13
+	v *= 0xc2b2ae35
+	v ^= v >> 16
+	return v
+}
@@ -0,0 +1,81 @@
+package common_test
+
+import (
+	"fmt"
+	"middleware/common"
+	"testing"
+)
+
+func TestHashRingSpreadsKeys(t *testing.T) {
+	r := common.NewHashRing(6, common.VirtualNodes)
+	counts := make(map[int]int)
+	keys := 60000
+	for i := 0; i < keys; i++ {
+		counts[r.Locate(fmt.Sprintf("%d", i))]++
+	}
+
+	if len(counts) != 6 {
+		t.Fatalf("Expected keys in the 6 partitions, got %v", counts)
+	}
+	for p, c := range counts {
+		if p < 1 || p > 6 {
+			t.Fatalf("Partition %d out of range", p)
+		}
+		// 10000 each on average
+		if c < 7000 || c > 13000 {
+			t.Fatalf("Partition %d got %d keys, expected about %d", p, c, keys/6)
+		}
+	}
+}
+
+func TestHashRingAddingPartitionOnlyMovesToIt(t *testing.T) {
+	before := common.NewHashRing(6, common.VirtualNodes)
+	after := common.NewHashRing(7, common.VirtualNodes)
+
+	moved := 0
+	keys := 10000
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("app-%d", i)
+		from, to := before.Locate(key), after.Locate(key)
+		if from == to {
+			continue
+		}
+		if to != 7 {
+			t.Fatalf("Key %s moved from %d to %d instead of the new partition", key, from, to)
+		}
+		moved++
+	}
+
+	// About a seventh of the keys, a modulo would have moved most of them
+	if moved < keys/14 || moved > keys/4 {
+		t.Fatalf("Moved %d of %d keys", moved, keys)
+	}
+}
+
+func TestHashRingSamePartitionsSameRoutes(t *testing.T) {
+	a := common.NewHashRing(3, common.VirtualNodes)
+	b := common.NewHashRing(3, common.VirtualNodes)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("%d", i)
+		if a.Locate(key) != b.Locate(key) {
+			t.Fatalf("Key %s routed to different partitions", key)
+		}
+	}
+}
+
+func TestTopologyRoundTrip(t *testing.T) {
+	topology := common.Topology{"Q1": 3, "Q3": 6, "Q5": 2}
+	parsed, err := common.ParseTopology(topology.String())
+	if err != nil {
+		t.Fatalf("Failed parsing %s: %s", topology, err)
+	}
+	if !parsed.Equal(topology) {
+		t.Fatalf("Expected %s, got %s", topology, parsed)
+	}
+	if parsed.Partitions("Q2", 4) != 4 {
+		t.Fatalf("Expected the fallback for a query without partitions")
+	}
+	if _, err := common.ParseTopology("Q1=0"); err == nil {
+		t.Fatalf("Expected an error for a query without partitions")
+	}
+}
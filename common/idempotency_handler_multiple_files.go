@@ -182,6 +182,58 @@ func (h *IdempotencyHandlerMultipleFiles[T]) LoadState(
 	return nil
 }
 
+// Same as LoadState, but every saved state is also handed to visit with the file it's in
+func (h *IdempotencyHandlerMultipleFiles[T]) LoadStateVisiting(
+	des func(*Deserializer) (T, error),
+	visit func(file string, state T),
+) error {
+	files, err := h.filemanager.Files()
+	if err != nil {
+		return err
+	}
+
+	for file := range files {
+		name := filepath.Base(file.filepath)
+		rs, err := ReadState(file, des)
+		if err != nil {
+			return err
+		}
+		// Sequences only go up within a file, not across them
+		store := NewIdempotencyStore()
+		for line := range rs {
+			store.Save(line.id)
+			visit(name, line.data)
+		}
+		h.idemStore.Merge(store)
+		file.Close()
+	}
+
+	return nil
+}
+
+// Every state saved in one of the files, as named by GetFileName
+func (h *IdempotencyHandlerMultipleFiles[T]) ReadFile(
+	file string,
+	des func(*Deserializer) (T, error),
+	visit func(state T),
+) error {
+	// Its own handle, closing a cached one would break the writes that get it later
+	f, err := NewTemporaryStorage(filepath.Join(h.filemanager.dirname, file))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rs, err := ReadState(f, des)
+	if err != nil {
+		return err
+	}
+	for line := range rs {
+		visit(line.data)
+	}
+	return nil
+}
+
 func (h *IdempotencyHandlerMultipleFiles[T]) SaveState(caused_by *IdempotencyID, state T, key string) error {
 	storage, err := h.filemanager.Open(h.GetFileName(key))
 	if err != nil {
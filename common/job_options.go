@@ -0,0 +1,80 @@
+package common
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Settings a client picks for its job, the workers use their config for the ones it leaves out
+type JobOptions map[string]string
+
+// Of the language detection of the Q4 review filter
+const (
+	OptionLanguages           = "languages"
+	OptionTargetLanguages     = "targets"
+	OptionMinRelativeDistance = "minRelativeDistance"
+	// true or false, whether the languages the filter finds are counted and sent with the results
+	OptionLanguageBreakdown = "languageBreakdown"
+)
+
+// true or false, whether the joins of Q3 to Q5 stream their counts and the job gets provisional tops
+const OptionStreaming = "streaming"
+
+var knownOptions = []string{OptionLanguages, OptionTargetLanguages, OptionMinRelativeDistance, OptionLanguageBreakdown, OptionStreaming}
+
+// Checked here, a wrong one would only fail once the workers build the handlers of the job
+var boolOptions = []string{OptionLanguageBreakdown, OptionStreaming}
+
+// The value of the option, or the fallback when the job doesn't set it
+func (o JobOptions) Get(key string, fallback string) string {
+	if v, ok := o[key]; ok && v != "" {
+		return v
+	}
+	return fallback
+}
+
+// key=value;key=value sorted by key, the values may have commas
+func (o JobOptions) String() string {
+	keys := make([]string, 0, len(o))
+	for k := range o {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%s", k, o[k]))
+	}
+	return strings.Join(parts, ";")
+}
+
+func ParseJobOptions(s string) (JobOptions, error) {
+	o := make(JobOptions)
+	if s == "" {
+		return o, nil
+	}
+	for _, part := range strings.Split(s, ";") {
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid job option %q", part)
+		}
+		key = strings.TrimSpace(key)
+		if !Contains(knownOptions, key) {
+			return nil, fmt.Errorf("unknown job option %q", key)
+		}
+		if strings.ContainsAny(value, ";=") {
+			return nil, fmt.Errorf("invalid value for the job option %s: %q", key, value)
+		}
+		value = strings.TrimSpace(value)
+		if _, err := strconv.ParseBool(value); err != nil && value != "" && Contains(boolOptions, key) {
+			return nil, fmt.Errorf("invalid value for the job option %s: %q, expected true or false", key, value)
+		}
+		o[key] = value
+	}
+	if err := ValidateLanguageOptions(o); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
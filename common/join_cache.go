@@ -1,5 +1,7 @@
 package common
 
+// Table of a hash join, bounded to limit keys. Keys already in it can always be updated,
+// new ones are refused once it's full and the caller spills them somewhere else.
 type JoinCache[K comparable, V any] struct {
 	cache map[K]V
 
@@ -14,7 +16,7 @@ func NewJoinCache[K comparable, V any](limit int) *JoinCache[K, V] {
 }
 
 func (c *JoinCache[K, V]) TryPut(key K, value V) bool {
-	if len(c.cache) > c.limit {
+	if _, ok := c.cache[key]; !ok && len(c.cache) >= c.limit {
 		return false
 	}
 	c.cache[key] = value
@@ -29,3 +31,25 @@ func (c *JoinCache[K, V]) Get(key K) (V, bool) {
 func (c *JoinCache[K, V]) Remove(key K) {
 	delete(c.cache, key)
 }
+
+// Removes every entry the function matches, returns how many
+func (c *JoinCache[K, V]) RemoveIf(f func(K, V) bool) int {
+	removed := 0
+	for k, v := range c.cache {
+		if f(k, v) {
+			delete(c.cache, k)
+			removed++
+		}
+	}
+	return removed
+}
+
+func (c *JoinCache[K, V]) Each(f func(K, V)) {
+	for k, v := range c.cache {
+		f(k, v)
+	}
+}
+
+func (c *JoinCache[K, V]) Len() int {
+	return len(c.cache)
+}
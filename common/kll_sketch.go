@@ -0,0 +1,161 @@
+package common
+
+import (
+	"math"
+	"sort"
+)
+
+// KLL quantile sketch. Level h keeps a sample of the values with weight 2^h each; when a
+// level fills up it's sorted and every other value goes up a level. The rank of any value
+// is off by about epsilon*N at most, and sketches built apart can be merged.
+type KLLSketch struct {
+	k      int
+	n      uint32
+	levels [][]uint32
+	// Alternates the half that goes up, so the same values always give the same sketch
+	coin uint32
+}
+
+// About the rank error of a sketch of the given k
+const kllErrorConstant = 1.66
+
+func NewKLLSketch(epsilon float64) *KLLSketch {
+	k := 8
+	if epsilon > 0 {
+		k = max(k, int(math.Ceil(kllErrorConstant/epsilon)))
+	}
+	return newKLLSketch(k)
+}
+
+func newKLLSketch(k int) *KLLSketch {
+	return &KLLSketch{k: k, levels: make([][]uint32, 1)}
+}
+
+func (s *KLLSketch) N() uint32 {
+	return s.n
+}
+
+func (s *KLLSketch) capacity(level int) int {
+	depth := len(s.levels) - level - 1
+	return max(2, int(math.Ceil(float64(s.k)*math.Pow(2.0/3.0, float64(depth)))))
+}
+
+func (s *KLLSketch) Add(v uint32) {
+	s.levels[0] = append(s.levels[0], v)
+	s.n++
+	s.compress()
+}
+
+// The merged sketch is as precise as the most precise of both
+func (s *KLLSketch) Merge(o *KLLSketch) {
+	s.k = max(s.k, o.k)
+	for len(s.levels) < len(o.levels) {
+		s.levels = append(s.levels, nil)
+	}
+	for h, level := range o.levels {
+		s.levels[h] = append(s.levels[h], level...)
+	}
+	s.n += o.n
+	s.compress()
+}
+
+func (s *KLLSketch) compress() {
+	for full := true; full; {
+		full = false
+		for h := 0; h < len(s.levels); h++ {
+			if len(s.levels[h]) < s.capacity(h) {
+				continue
+			}
+			full = true
+			if h+1 == len(s.levels) {
+				s.levels = append(s.levels, nil)
+			}
+
+			level := s.levels[h]
+			sort.Slice(level, func(i, j int) bool { return level[i] < level[j] })
+			// With an odd amount the last one stays, the weights must add up
+			var keep []uint32
+			if len(level)%2 == 1 {
+				keep = []uint32{level[len(level)-1]}
+				level = level[:len(level)-1]
+			}
+			for i := int(s.coin & 1); i < len(level); i += 2 {
+				s.levels[h+1] = append(s.levels[h+1], level[i])
+			}
+			s.coin++
+			s.levels[h] = keep
+		}
+	}
+}
+
+// The value with the given rank, counting from 0 in ascending order
+func (s *KLLSketch) Quantile(rank uint32) uint32 {
+	type weighted struct {
+		value  uint32
+		weight uint32
+	}
+	all := make([]weighted, 0)
+	for h, level := range s.levels {
+		for _, v := range level {
+			all = append(all, weighted{value: v, weight: 1 << h})
+		}
+	}
+	if len(all) == 0 {
+		return 0
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].value < all[j].value })
+
+	var seen uint32
+	for _, w := range all {
+		seen += w.weight
+		if seen > rank {
+			return w.value
+		}
+	}
+	return all[len(all)-1].value
+}
+
+func (s *KLLSketch) Serialize() []byte {
+	se := NewSerializer()
+	se.WriteUint32(uint32(s.k)).WriteUint32(s.n).WriteUint32(s.coin).WriteUint32(uint32(len(s.levels)))
+	for _, level := range s.levels {
+		se.WriteUint32(uint32(len(level)))
+		for _, v := range level {
+			se.WriteUint32(v)
+		}
+	}
+	return se.ToBytes()
+}
+
+func KLLSketchDeserialize(d *Deserializer) (*KLLSketch, error) {
+	var header [4]uint32
+	for i := range header {
+		v, err := d.ReadUint32()
+		if err != nil {
+			return nil, err
+		}
+		header[i] = v
+	}
+
+	// The lengths come from the wire, what's left in the buffer bounds what can be allocated
+	s := &KLLSketch{k: int(header[0]), n: header[1], coin: header[2], levels: make([][]uint32, 0, min(header[3], uint32(d.Buf.Len()/4)))}
+	for h := uint32(0); h < header[3]; h++ {
+		size, err := d.ReadUint32()
+		if err != nil {
+			return nil, err
+		}
+		level := make([]uint32, 0, min(size, uint32(d.Buf.Len()/4)))
+		for i := uint32(0); i < size; i++ {
+			v, err := d.ReadUint32()
+			if err != nil {
+				return nil, err
+			}
+			level = append(level, v)
+		}
+		s.levels = append(s.levels, level)
+	}
+	if len(s.levels) == 0 {
+		s.levels = make([][]uint32, 1)
+	}
+	return s, nil
+}
@@ -0,0 +1,53 @@
+package common_test
+
+import (
+	"math/rand"
+	"middleware/common"
+	"testing"
+)
+
+func TestKLLSketchMergedRankError(t *testing.T) {
+	epsilon := 0.02
+	n := 20000
+	r := rand.New(rand.NewSource(0))
+
+	parts := make([]*common.KLLSketch, 4)
+	for i := range parts {
+		parts[i] = common.NewKLLSketch(epsilon)
+	}
+	for _, v := range r.Perm(n) {
+		parts[v%len(parts)].Add(uint32(v))
+	}
+
+	merged := common.NewKLLSketch(epsilon)
+	for _, p := range parts {
+		merged.Merge(p)
+	}
+
+	if merged.N() != uint32(n) {
+		t.Fatalf("Expected %d values, got %d", n, merged.N())
+	}
+	// The values are their own ranks
+	for _, rank := range []uint32{0, 1000, 10000, 18000, 19999} {
+		got := float64(merged.Quantile(rank))
+		if diff := got - float64(rank); diff > 2*epsilon*float64(n) || -diff > 2*epsilon*float64(n) {
+			t.Fatalf("Expected about %d at rank %d, got %.0f", rank, rank, got)
+		}
+	}
+}
+
+func TestKLLSketchSerialize(t *testing.T) {
+	s := common.NewKLLSketch(0.05)
+	for i := 0; i < 5000; i++ {
+		s.Add(uint32(i % 97))
+	}
+
+	d := common.NewDeserializer(s.Serialize())
+	c, err := common.KLLSketchDeserialize(&d)
+	if err != nil {
+		t.Fatalf("Can't deserialize the sketch: %s", err)
+	}
+	if c.N() != s.N() || c.Quantile(4500) != s.Quantile(4500) {
+		t.Fatalf("Expected the same sketch after deserializing it")
+	}
+}
@@ -0,0 +1,159 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The languages the Q4 detector tells apart, by name and ISO 639-1 code. The same ones lingua
+// knows, kept here so the server checks the options without loading its models.
+var KnownLanguages = map[string]string{
+	"afrikaans":   "af",
+	"albanian":    "sq",
+	"arabic":      "ar",
+	"armenian":    "hy",
+	"azerbaijani": "az",
+	"basque":      "eu",
+	"belarusian":  "be",
+	"bengali":     "bn",
+	"bokmal":      "nb",
+	"bosnian":     "bs",
+	"bulgarian":   "bg",
+	"catalan":     "ca",
+	"chinese":     "zh",
+	"croatian":    "hr",
+	"czech":       "cs",
+	"danish":      "da",
+	"dutch":       "nl",
+	"english":     "en",
+	"esperanto":   "eo",
+	"estonian":    "et",
+	"finnish":     "fi",
+	"french":      "fr",
+	"ganda":       "lg",
+	"georgian":    "ka",
+	"german":      "de",
+	"greek":       "el",
+	"gujarati":    "gu",
+	"hebrew":      "he",
+	"hindi":       "hi",
+	"hungarian":   "hu",
+	"icelandic":   "is",
+	"indonesian":  "id",
+	"irish":       "ga",
+	"italian":     "it",
+	"japanese":    "ja",
+	"kazakh":      "kk",
+	"korean":      "ko",
+	"latin":       "la",
+	"latvian":     "lv",
+	"lithuanian":  "lt",
+	"macedonian":  "mk",
+	"malay":       "ms",
+	"maori":       "mi",
+	"marathi":     "mr",
+	"mongolian":   "mn",
+	"nynorsk":     "nn",
+	"persian":     "fa",
+	"polish":      "pl",
+	"portuguese":  "pt",
+	"punjabi":     "pa",
+	"romanian":    "ro",
+	"russian":     "ru",
+	"serbian":     "sr",
+	"shona":       "sn",
+	"slovak":      "sk",
+	"slovene":     "sl",
+	"somali":      "so",
+	"sotho":       "st",
+	"spanish":     "es",
+	"swahili":     "sw",
+	"swedish":     "sv",
+	"tagalog":     "tl",
+	"tamil":       "ta",
+	"telugu":      "te",
+	"thai":        "th",
+	"tsonga":      "ts",
+	"tswana":      "tn",
+	"turkish":     "tr",
+	"ukrainian":   "uk",
+	"urdu":        "ur",
+	"vietnamese":  "vi",
+	"welsh":       "cy",
+	"xhosa":       "xh",
+	"yoruba":      "yo",
+	"zulu":        "zu",
+}
+
+// The name of the language given as its name or code, in any case
+func LanguageName(s string) (string, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if _, ok := KnownLanguages[s]; ok {
+		return s, true
+	}
+	for name, code := range KnownLanguages {
+		if code == s {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// Comma separated names or codes, without repeating them
+func ParseLanguageNames(s string) ([]string, error) {
+	names := make([]string, 0)
+	for _, part := range strings.Split(s, ",") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		name, ok := LanguageName(part)
+		if !ok {
+			return nil, fmt.Errorf("unknown language %q", strings.TrimSpace(part))
+		}
+		if !Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// Checks the language options the job sets. The ones it leaves out come from the config of
+// the workers, which check the whole set again with it.
+func ValidateLanguageOptions(o JobOptions) error {
+	var languages, targets []string
+	var err error
+	if v := o.Get(OptionLanguages, ""); v != "" {
+		if languages, err = ParseLanguageNames(v); err != nil {
+			return err
+		}
+		if len(languages) < 2 {
+			return fmt.Errorf("the detector needs at least two languages, got %d", len(languages))
+		}
+	}
+	if v := o.Get(OptionTargetLanguages, ""); v != "" {
+		if targets, err = ParseLanguageNames(v); err != nil {
+			return err
+		}
+		if len(targets) == 0 {
+			return fmt.Errorf("no target languages")
+		}
+	}
+	if languages != nil {
+		for _, t := range targets {
+			if !Contains(languages, t) {
+				return fmt.Errorf("the target language %s isn't one the detector knows", t)
+			}
+		}
+	}
+	if v := o.Get(OptionMinRelativeDistance, ""); v != "" {
+		distance, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("invalid min relative distance: %w", err)
+		}
+		if distance < 0 || distance > 0.99 {
+			return fmt.Errorf("the min relative distance must be between 0 and 0.99, got %g", distance)
+		}
+	}
+	return nil
+}
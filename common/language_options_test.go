@@ -0,0 +1,53 @@
+package common_test
+
+import (
+	"middleware/common"
+	"strings"
+	"testing"
+
+	"github.com/pemistahl/lingua-go"
+)
+
+// The server checks the names with its own list, it must be the one of the detector
+func TestKnownLanguagesAreTheDetectorOnes(t *testing.T) {
+	all := lingua.AllLanguages()
+	if len(all) != len(common.KnownLanguages) {
+		t.Fatalf("The detector knows %d languages, the list has %d", len(all), len(common.KnownLanguages))
+	}
+	for _, l := range all {
+		name := strings.ToLower(l.String())
+		code, ok := common.KnownLanguages[name]
+		if !ok || code != strings.ToLower(l.IsoCode639_1().String()) {
+			t.Fatalf("Expected %s with the code %s, got %q", name, l.IsoCode639_1(), code)
+		}
+	}
+}
+
+func TestParseJobOptionsRejectsBadLanguages(t *testing.T) {
+	valid := []string{
+		"",
+		"languages=english,ES, pt;targets=english",
+		"targets=spanish",
+		"minRelativeDistance=0.25;streaming=true",
+	}
+	for _, s := range valid {
+		if _, err := common.ParseJobOptions(s); err != nil {
+			t.Fatalf("Expected %q to be valid, got %s", s, err)
+		}
+	}
+
+	invalid := []string{
+		"languages=english,klingon",
+		"languages=english",
+		"languages=english,spanish;targets=german",
+		"targets=,",
+		"minRelativeDistance=1.5",
+		"minRelativeDistance=far",
+		"languageBreakdown=yes",
+	}
+	for _, s := range invalid {
+		if _, err := common.ParseJobOptions(s); err == nil {
+			t.Fatalf("Expected %q to be rejected", s)
+		}
+	}
+}
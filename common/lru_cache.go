@@ -0,0 +1,54 @@
+package common
+
+import "container/list"
+
+type lruEntry[K comparable, V any] struct {
+	key   K
+	value V
+}
+
+// Keeps the limit most recently used keys, putting a new one past it evicts the oldest.
+// Not safe for concurrent use.
+type LRUCache[K comparable, V any] struct {
+	entries map[K]*list.Element
+	order   *list.List
+
+	limit int
+}
+
+func NewLRUCache[K comparable, V any](limit int) *LRUCache[K, V] {
+	return &LRUCache[K, V]{
+		entries: make(map[K]*list.Element),
+		order:   list.New(),
+		limit:   max(limit, 1),
+	}
+}
+
+// Marks the key as the most recently used one
+func (c *LRUCache[K, V]) Get(key K) (V, bool) {
+	e, ok := c.entries[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*lruEntry[K, V]).value, true
+}
+
+func (c *LRUCache[K, V]) Put(key K, value V) {
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*lruEntry[K, V]).value = value
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry[K, V]{key: key, value: value})
+	if c.order.Len() > c.limit {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry[K, V]).key)
+	}
+}
+
+func (c *LRUCache[K, V]) Len() int {
+	return c.order.Len()
+}
@@ -0,0 +1,33 @@
+package common_test
+
+import (
+	"middleware/common"
+	"testing"
+)
+
+func TestLRUCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := common.NewLRUCache[string, int](2)
+	c.Put("a", 1)
+	c.Put("b", 2)
+
+	// Reading a makes b the oldest one
+	if v, ok := c.Get("a"); !ok || v != 1 {
+		t.Fatalf("Expected a to be 1, got %d %t", v, ok)
+	}
+	c.Put("c", 3)
+
+	if _, ok := c.Get("b"); ok {
+		t.Fatalf("Expected b to be evicted")
+	}
+	if v, ok := c.Get("a"); !ok || v != 1 {
+		t.Fatalf("Expected a to be kept, got %d %t", v, ok)
+	}
+	if c.Len() != 2 {
+		t.Fatalf("Expected 2 entries, got %d", c.Len())
+	}
+
+	c.Put("c", 4)
+	if v, _ := c.Get("c"); v != 4 || c.Len() != 2 {
+		t.Fatalf("Expected c to be updated in place, got %d with %d entries", v, c.Len())
+	}
+}
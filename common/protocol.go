@@ -4,25 +4,39 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"net"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
-	GAMES           = "GAM"
-	REVIEWS         = "REV"
-	AskForResults   = "RES"
-	Results_Q1      = "Q1"
-	Results_Q2      = "Q2"
-	Results_Q3      = "Q3"
-	Results_Q4      = "Q4"
-	Results_Q5      = "Q5"
-	CloseConnection = "CLC"
-	EndWithResults  = "EWR"
-	EOF             = "EOF"
-	HCK             = "HCK"
-	ALV             = "ALV"
+	GAMES                = "GAM"
+	REVIEWS              = "REV"
+	AskForResults        = "RES"
+	Results_Q1           = "Q1"
+	Results_Q2           = "Q2"
+	Results_Q3           = "Q3"
+	Results_Q4           = "Q4"
+	Results_Q5           = "Q5"
+	Results_Q6           = "Q6"
+	Results_Q7           = "Q7"
+	Results_Q8           = "Q8"
+	CloseConnection      = "CLC"
+	EndWithResults       = "EWR"
+	EOF                  = "EOF"
+	HCK                  = "HCK"
+	ALV                  = "ALV"
+	NegotiateCompression = "CMP"
+	Error                = "ERR"
+	Auth                 = "AUT"
+	Admit                = "ADM"
+	Busy                 = "BSY"
+	Results_Q4_Languages = "Q4L"
+	Options              = "OPT"
+	Results_Provisional  = "QP"
 )
 
 const (
@@ -39,8 +53,27 @@ const (
 	Type_EOF
 	Type_HCK
 	Type_ALV
+	Type_NegotiateCompression
+	Type_Hello
+	Type_Error
+	Type_Auth
+	Type_Admit
+	Type_Busy
+	// Last so the binary codec keeps the numbers of the types before it
+	Type_Results_Q6
+	Type_Results_Q7
+	Type_Results_Q8
+	Type_Results_Q4_Languages
+	Type_Options
+	// While the job runs, a provisional top of Q3, Q4 or Q5 as a CSV line
+	Type_Results_Provisional
 )
 
+// Frames bigger than this are rejected before allocating them
+var MaxFrameSize uint32 = 16 << 20
+
+var ErrFrameTooBig = errors.New("frame exceeds the max frame size")
+
 type ClientMessage struct {
 	Content string
 	Type    int
@@ -55,7 +88,7 @@ func (cm ClientMessage) IsEndWithResults() bool {
 }
 
 func (cm ClientMessage) IsQueryResult() bool {
-	return cm.Type == Type_Results_Q1 || cm.Type == Type_Results_Q2 || cm.Type == Type_Results_Q3 || cm.Type == Type_Results_Q4 || cm.Type == Type_Results_Q5
+	return cm.Type == Type_Results_Q1 || cm.Type == Type_Results_Q2 || cm.Type == Type_Results_Q3 || cm.Type == Type_Results_Q4 || cm.Type == Type_Results_Q5 || cm.Type == Type_Results_Q6 || cm.Type == Type_Results_Q7 || cm.Type == Type_Results_Q8 || cm.Type == Type_Results_Q4_Languages
 }
 
 func (cm ClientMessage) SerializeClientMessage() (string, error) {
@@ -76,6 +109,14 @@ func (cm ClientMessage) SerializeClientMessage() (string, error) {
 		return Results_Q4 + "|" + cm.Content + "\n", nil
 	case Type_Results_Q5:
 		return Results_Q5 + "|" + cm.Content + "\n", nil
+	case Type_Results_Q6:
+		return Results_Q6 + "|" + cm.Content + "\n", nil
+	case Type_Results_Q7:
+		return Results_Q7 + "|" + cm.Content + "\n", nil
+	case Type_Results_Q8:
+		return Results_Q8 + "|" + cm.Content + "\n", nil
+	case Type_Results_Q4_Languages:
+		return Results_Q4_Languages + "|" + cm.Content + "\n", nil
 	case Type_CloseConnection:
 		return CloseConnection + "|" + cm.Content + "\n", nil
 	case Type_EndWithResults:
@@ -84,6 +125,20 @@ func (cm ClientMessage) SerializeClientMessage() (string, error) {
 		return HCK + "|" + cm.Content + "\n", nil
 	case Type_ALV:
 		return ALV + "|" + cm.Content + "\n", nil
+	case Type_NegotiateCompression:
+		return NegotiateCompression + "|" + cm.Content + "\n", nil
+	case Type_Error:
+		return Error + "|" + cm.Content + "\n", nil
+	case Type_Auth:
+		return Auth + "|" + cm.Content + "\n", nil
+	case Type_Admit:
+		return Admit + "|" + cm.Content + "\n", nil
+	case Type_Busy:
+		return Busy + "|" + cm.Content + "\n", nil
+	case Type_Options:
+		return Options + "|" + cm.Content + "\n", nil
+	case Type_Results_Provisional:
+		return Results_Provisional + "|" + cm.Content + "\n", nil
 	}
 
 	return "", errors.New("invalid message type")
@@ -118,26 +173,75 @@ func DeserializeClientMessage(message string) (ClientMessage, error) {
 		return ClientMessage{msg_content, Type_Results_Q4}, nil
 	case Results_Q5:
 		return ClientMessage{msg_content, Type_Results_Q5}, nil
+	case Results_Q6:
+		return ClientMessage{msg_content, Type_Results_Q6}, nil
+	case Results_Q7:
+		return ClientMessage{msg_content, Type_Results_Q7}, nil
+	case Results_Q8:
+		return ClientMessage{msg_content, Type_Results_Q8}, nil
+	case Results_Q4_Languages:
+		return ClientMessage{msg_content, Type_Results_Q4_Languages}, nil
 	case CloseConnection:
 		return ClientMessage{msg_content, Type_CloseConnection}, nil
 	case EndWithResults:
 		return ClientMessage{msg_content, Type_EndWithResults}, nil
 	case HCK:
 		return ClientMessage{msg_content, Type_HCK}, nil
+	case ALV:
+		return ClientMessage{msg_content, Type_ALV}, nil
+	case NegotiateCompression:
+		return ClientMessage{msg_content, Type_NegotiateCompression}, nil
+	case Error:
+		return ClientMessage{msg_content, Type_Error}, nil
+	case Auth:
+		return ClientMessage{msg_content, Type_Auth}, nil
+	case Admit:
+		return ClientMessage{msg_content, Type_Admit}, nil
+	case Busy:
+		return ClientMessage{msg_content, Type_Busy}, nil
+	case Options:
+		return ClientMessage{msg_content, Type_Options}, nil
+	case Results_Provisional:
+		return ClientMessage{msg_content, Type_Results_Provisional}, nil
 	}
 	return ClientMessage{}, errors.New("invalid message type")
 }
 
 func Send(message string, conn net.Conn) error {
+	return sendFrame([]byte(message), 0, conn)
+}
+
+// Sends the message compressed with the given algorithm if it's worth it. The peer must
+// have agreed on the algorithm beforehand, Receive handles both kinds of frames.
+func SendCompressed(message string, conn net.Conn, c Compression) error {
+	return SendFrame([]byte(message), conn, c)
+}
+
+func SendFrame(messageBytes []byte, conn net.Conn, c Compression) error {
+	if !ShouldCompress(c, messageBytes) {
+		return sendFrame(messageBytes, 0, conn)
+	}
+
+	compressed, err := Compress(c, messageBytes)
+	if err != nil {
+		log.Errorf("Failed to compress message %s", err)
+		return err
+	}
+
+	payload := make([]byte, 0, len(compressed)+1)
+	payload = append(payload, c)
+	payload = append(payload, compressed...)
+	return sendFrame(payload, compressedFrameFlag, conn)
+}
+
+func sendFrame(messageBytes []byte, flags uint32, conn net.Conn) error {
 	if conn == nil {
 		return errors.New("Nil conn")
 	}
 
-	messageBytes := []byte(message)
-
 	buffer := new(bytes.Buffer)
 
-	err := binary.Write(buffer, binary.BigEndian, uint32(len(messageBytes)))
+	err := binary.Write(buffer, binary.BigEndian, uint32(len(messageBytes))|flags)
 
 	if err != nil {
 		log.Errorf("Failed to write message length to buffer %s", err)
@@ -155,7 +259,7 @@ func Send(message string, conn net.Conn) error {
 	bytesSent := 0
 
 	for bytesSent < messageLength {
-		n, err := conn.Write(buffer.Bytes())
+		n, err := conn.Write(buffer.Bytes()[bytesSent:])
 		if err != nil {
 			log.Errorf("Failed to send bytes to %s: %s", conn.LocalAddr().String(), err)
 			return err
@@ -167,37 +271,68 @@ func Send(message string, conn net.Conn) error {
 }
 
 func Receive(conn net.Conn) (string, error) {
+	messageBytes, err := ReceiveFrame(conn)
+	if err != nil {
+		return "", err
+	}
+
+	messageString := strings.Trim(string(messageBytes), "\n")
+
+	return messageString, nil
+}
+
+// Reads a whole frame as it was sent, decompressing it if needed
+func ReceiveFrame(conn net.Conn) ([]byte, error) {
 	lengthBuffer := make([]byte, 4)
 	_, err := io.ReadFull(conn, lengthBuffer)
 	if err != nil {
 		log.Errorf("Failed to read message %s", err)
-		return "", err
+		return nil, err
 	}
 
-	messageLength := binary.BigEndian.Uint32(lengthBuffer)
+	header := binary.BigEndian.Uint32(lengthBuffer)
+	messageLength := header &^ compressedFrameFlag
+
+	if messageLength > MaxFrameSize {
+		log.Errorf("Failed to read message of %d bytes: %s", messageLength, ErrFrameTooBig)
+		return nil, ErrFrameTooBig
+	}
 
 	messageBytes := make([]byte, messageLength)
 	_, err = io.ReadFull(conn, messageBytes)
 	if err != nil {
 		log.Errorf("Failed to read message %s", err)
-		return "", err
+		return nil, err
 	}
 
-	messageString := strings.Trim(string(messageBytes), "\n")
+	if header&compressedFrameFlag != 0 {
+		if len(messageBytes) == 0 {
+			return nil, errors.New("compressed frame without algorithm")
+		}
+		messageBytes, err = Decompress(messageBytes[0], messageBytes[1:])
+		if err != nil {
+			log.Errorf("Failed to decompress message %s", err)
+			return nil, err
+		}
+	}
 
-	return messageString, nil
+	return messageBytes, nil
 }
 
-func GetRoutingKey(line string) string {
+func GetRoutingKey(line string) (string, error) {
+	if len(line) == 0 {
+		return "", errors.New("can't route an empty line")
+	}
+
 	lineType := int(line[0] - '0')
 
 	if lineType == TypeGame {
-		return RoutingGames
+		return RoutingGames, nil
 	} else if lineType == TypeReview {
-		return RoutingReviews
+		return RoutingReviews, nil
 	}
 
-	panic("ni idea man")
+	return "", fmt.Errorf("unknown line type %d", lineType)
 }
 
 type ManagementMessage struct {
@@ -215,3 +350,41 @@ func (mm ManagementMessage) IsAlive() bool {
 func (mm ManagementMessage) IsHealthCheck() bool {
 	return mm.Content == "HCK"
 }
+
+// Busy answers carry the position of the job in the queue of the server, zero when it
+// didn't fit, and how long to wait before trying again
+func BusyContent(position int, retryAfter time.Duration) string {
+	return fmt.Sprintf("%d,%s", position, retryAfter)
+}
+
+func ParseBusyContent(content string) (int, time.Duration, error) {
+	p, r, ok := strings.Cut(content, ",")
+	if !ok {
+		return 0, 0, fmt.Errorf("malformed busy answer %q", content)
+	}
+	position, err := strconv.Atoi(p)
+	if err != nil {
+		return 0, 0, err
+	}
+	retryAfter, err := time.ParseDuration(r)
+	if err != nil {
+		return 0, 0, err
+	}
+	return position, retryAfter, nil
+}
+
+// Jobs go from 0, overnight backfills, to MaxPriority, interactive dashboards. It's also
+// the x-max-priority of the queues, RabbitMQ advises to keep it low.
+const MaxPriority uint8 = 9
+
+// An empty priority is the lowest one
+func ParsePriority(content string) (uint8, error) {
+	if content == "" {
+		return 0, nil
+	}
+	p, err := strconv.ParseUint(content, 10, 8)
+	if err != nil || uint8(p) > MaxPriority {
+		return 0, fmt.Errorf("invalid priority %q, expected 0 to %d", content, MaxPriority)
+	}
+	return uint8(p), nil
+}
@@ -0,0 +1,56 @@
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+// Token bucket. Whoever takes more than what is left goes into debt, so a batch bigger
+// than the burst still passes, it just makes the next ones wait longer.
+type RateLimiter struct {
+	// Units per second, zero means no limit
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	mu     sync.Mutex
+}
+
+// Burst defaults to one second worth of units
+func NewRateLimiter(rate float64, burst float64) *RateLimiter {
+	if burst <= 0 {
+		burst = rate
+	}
+	return &RateLimiter{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// Takes n units and returns how long the caller must wait before using them
+func (r *RateLimiter) Reserve(n float64) time.Duration {
+	if r == nil || r.rate <= 0 {
+		return 0
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	r.tokens = min(r.burst, r.tokens+now.Sub(r.last).Seconds()*r.rate)
+	r.last = now
+
+	r.tokens -= n
+	if r.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-r.tokens / r.rate * float64(time.Second))
+}
+
+func (r *RateLimiter) Wait(n float64) {
+	if d := r.Reserve(n); d > 0 {
+		time.Sleep(d)
+	}
+}
@@ -0,0 +1,36 @@
+package common_test
+
+import (
+	"middleware/common"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterBurstThenWait(t *testing.T) {
+	r := common.NewRateLimiter(100, 10)
+
+	for i := 0; i < 10; i++ {
+		if d := r.Reserve(1); d != 0 {
+			t.Fatalf("Unit %d of the burst had to wait %s", i, d)
+		}
+	}
+
+	d := r.Reserve(10)
+	if d < 90*time.Millisecond || d > 110*time.Millisecond {
+		t.Fatalf("Expected to wait around 100ms once the burst is spent, got %s", d)
+	}
+
+	// The debt of the previous reservation is paid by the next one
+	if d := r.Reserve(1); d <= 90*time.Millisecond {
+		t.Fatalf("Expected the debt to carry over, got %s", d)
+	}
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	var nilLimiter *common.RateLimiter
+	for _, r := range []*common.RateLimiter{nilLimiter, common.NewRateLimiter(0, 0)} {
+		if d := r.Reserve(1 << 30); d != 0 {
+			t.Fatalf("An unlimited limiter made the caller wait %s", d)
+		}
+	}
+}
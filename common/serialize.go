@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"io"
 
 	"github.com/google/uuid"
 )
@@ -96,6 +97,9 @@ func (d *Deserializer) ReadString() (string, error) {
 	if err != nil {
 		return "", err
 	}
+	if int(length) > d.Buf.Len() {
+		return "", io.ErrUnexpectedEOF
+	}
 	str := make([]byte, length)
 	n, err := d.Buf.Read(str)
 	if err != nil {
@@ -172,15 +176,16 @@ func ReadArray[T Serializable](f func(*Deserializer) (T, error)) func(d *Deseria
 		if err != nil {
 			return nil, err
 		}
+		// The length comes from the wire, don't trust it to size the array
 		r := &ArraySerialize[T]{
-			Arr: make([]T, l),
+			Arr: make([]T, 0, min(l, uint32(d.Buf.Len()))),
 		}
 		for i := uint32(0); i < l; i++ {
 			o, err := f(d)
 			if err != nil {
 				return nil, err
 			}
-			r.Arr[i] = o
+			r.Arr = append(r.Arr, o)
 		}
 		return r, nil
 	}
@@ -0,0 +1,119 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+
+	"github.com/spf13/viper"
+)
+
+// TLS settings of one link, read from a viper section like:
+//
+//	tls:
+//	  enabled: true
+//	  cert: "certs/server.crt"
+//	  key: "certs/server.key"
+//	  ca: "certs/ca.crt"
+//	  clientAuth: true
+type TLSConfig struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Cert    string `mapstructure:"cert"`
+	Key     string `mapstructure:"key"`
+	// Verifies the peer against this CA instead of the system roots
+	CA string `mapstructure:"ca"`
+	// Listening side only, requires peers to present a certificate signed by the CA (mTLS)
+	ClientAuth bool `mapstructure:"clientAuth"`
+	// Dialing side only, name expected in the peer certificate when it isn't the dialed host
+	ServerName string `mapstructure:"serverName"`
+}
+
+func LoadTLSConfig(v *viper.Viper, key string) (TLSConfig, error) {
+	var c TLSConfig
+	err := v.UnmarshalKey(key, &c)
+	return c, err
+}
+
+func (c TLSConfig) loadCA() (*x509.CertPool, error) {
+	if c.CA == "" {
+		return nil, nil
+	}
+	pem, err := os.ReadFile(c.CA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in " + c.CA)
+	}
+	return pool, nil
+}
+
+// Nil when TLS is disabled, so callers can hand it to Listen as is
+func (c TLSConfig) Server() (*tls.Config, error) {
+	if !c.Enabled {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := c.loadCA()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.ClientAuth {
+		if ca == nil {
+			return nil, errors.New("client authentication needs a CA to verify the peers")
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		cfg.ClientCAs = ca
+	}
+	return cfg, nil
+}
+
+// Nil when TLS is disabled, so callers can hand it to Dial as is
+func (c TLSConfig) Client() (*tls.Config, error) {
+	if !c.Enabled {
+		return nil, nil
+	}
+	ca, err := c.loadCA()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		RootCAs:    ca,
+		ServerName: c.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if c.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+func Listen(address string, cfg *tls.Config) (net.Listener, error) {
+	if cfg == nil {
+		return net.Listen("tcp", address)
+	}
+	return tls.Listen("tcp", address, cfg)
+}
+
+func Dial(address string, cfg *tls.Config) (net.Conn, error) {
+	if cfg == nil {
+		return net.Dial("tcp", address)
+	}
+	return tls.Dial("tcp", address, cfg)
+}
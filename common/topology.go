@@ -0,0 +1,79 @@
+package common
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Stage two partitions of every query. A job keeps the one it was admitted with until it
+// finishes, so a rescale only changes where the jobs that come after it go.
+type Topology map[string]int
+
+func TopologyFromConfig(cfg *ArchitectureConfig) Topology {
+	return Topology{
+		"Q1": cfg.QueryOne.StageTwo.PartitionAmount,
+		"Q2": cfg.QueryTwo.StageTwo.PartitionAmount,
+		"Q3": cfg.QueryThree.StageTwo.PartitionAmount,
+		"Q4": cfg.QueryFour.StageTwo.PartitionAmount,
+		"Q5": cfg.QueryFive.StageTwo.PartitionAmount,
+		"Q6": cfg.QuerySix.StageTwo.PartitionAmount,
+		"Q7": cfg.QuerySeven.StageTwo.PartitionAmount,
+		"Q8": cfg.QueryEight.StageTwo.PartitionAmount,
+	}
+}
+
+// Partitions of the query, or the fallback for the jobs that don't carry a topology
+func (t Topology) Partitions(query string, fallback int) int {
+	if n, ok := t[query]; ok && n > 0 {
+		return n
+	}
+	return fallback
+}
+
+func (t Topology) Equal(other Topology) bool {
+	if len(t) != len(other) {
+		return false
+	}
+	for q, n := range t {
+		if other[q] != n {
+			return false
+		}
+	}
+	return true
+}
+
+// Q1=3,Q2=3,... sorted by query
+func (t Topology) String() string {
+	queries := make([]string, 0, len(t))
+	for q := range t {
+		queries = append(queries, q)
+	}
+	sort.Strings(queries)
+
+	parts := make([]string, 0, len(queries))
+	for _, q := range queries {
+		parts = append(parts, fmt.Sprintf("%s=%d", q, t[q]))
+	}
+	return strings.Join(parts, ",")
+}
+
+func ParseTopology(s string) (Topology, error) {
+	t := make(Topology)
+	if s == "" {
+		return t, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		query, amount, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid topology entry %q", part)
+		}
+		n, err := strconv.Atoi(amount)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid partition amount for %s: %q", query, amount)
+		}
+		t[query] = n
+	}
+	return t, nil
+}
@@ -27,12 +27,12 @@ compare_files() {
   local file2="$2"
   local base_file=$(basename "${file1}")
 
-  # Compare the files (ignoring order and whitespace differences)
-  if diff -wB <(sort "${file1}" | tr -d '\r') <(sort "${file2}" | tr -d '\r') > /dev/null; then
+  # Results are written in a fixed order, the files must be the same line by line
+  if diff <(tr -d '\r' < "${file1}") <(tr -d '\r' < "${file2}") > /dev/null; then
     echo "File ${base_file} matches."
   else
     echo "File ${base_file} does NOT match. Showing differences:"
-    diff -wB <(sort "${file1}" | tr -d '\r') <(sort "${file2}" | tr -d '\r')
+    diff <(tr -d '\r' < "${file1}") <(tr -d '\r' < "${file2}")
   fi
 }
 
@@ -40,9 +40,14 @@ controllers = {
         "query_three_games": "MFGQ3",
         "query_four_games": "MFGQ4",
         "query_five_games": "MFGQ5",
+        "query_six_games": "MFGQ6",
+        "query_seven_games": "MFGQ7",
+        "query_eight_games": "MFGQ8",
         "query_three_reviews": "MFRQ3",
         "query_four_reviews": "MFRQ4",
         "query_five_reviews": "MFRQ5",
+        "query_seven_reviews": "MFRQ7",
+        "query_eight_reviews": "MFRQ8",
     },
     "query_one": {
         "stage_two": "Q1S2",
@@ -64,6 +69,19 @@ controllers = {
         "stage_two": "Q5S2",
         "stage_three": "Q5S3"
     },
+    "query_six": {
+        "stage_two": "Q6S2",
+        "stage_three": "Q6S3"
+    },
+    "query_seven": {
+        "stage_two": "Q7S2",
+        "stage_three": "Q7S3",
+        "stage_four": "Q7S4"
+    },
+    "query_eight": {
+        "stage_two": "Q8S2",
+        "stage_three": "Q8S3"
+    },
 }
 
 def create_node_definition(node_name: str):
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"sync"
 
+	"middleware/common"
 	"middleware/infra_management/src"
 	"os"
 	"strings"
@@ -57,6 +58,36 @@ func PrintConfig(v *viper.Viper) {
 	)
 }
 
+func LoadManagerTLS(v *viper.Viper) (src.ManagerTLS, error) {
+	var r src.ManagerTLS
+
+	ring, err := common.LoadTLSConfig(v, "ring.tls")
+	if err != nil {
+		return r, err
+	}
+	if r.RingServer, err = ring.Server(); err != nil {
+		return r, err
+	}
+	if r.RingClient, err = ring.Client(); err != nil {
+		return r, err
+	}
+
+	workers, err := common.LoadTLSConfig(v, "worker.tls")
+	if err != nil {
+		return r, err
+	}
+	if r.Workers, err = workers.Client(); err != nil {
+		return r, err
+	}
+
+	server, err := common.LoadTLSConfig(v, "server.tls")
+	if err != nil {
+		return r, err
+	}
+	r.Server, err = server.Client()
+	return r, err
+}
+
 func main() {
 	v, err := InitConfig()
 	if err != nil {
@@ -71,7 +102,13 @@ func main() {
 
 	log.Debug("Creating manager")
 
-	manager, err := src.NewInfraManager(v.GetString("ring.ip"), v.GetString("ring.port"), v.GetInt("ring.replicasAmount"))
+	tlsCfg, err := LoadManagerTLS(v)
+	if err != nil {
+		log.Criticalf("Error loading TLS configuration: %s", err)
+		return
+	}
+
+	manager, err := src.NewInfraManager(v.GetString("ring.ip"), v.GetString("ring.port"), v.GetInt("ring.replicasAmount"), tlsCfg)
 
 	if err != nil {
 		log.Criticalf("Error creating manager: %s", err)
@@ -1,6 +1,7 @@
 package src
 
 import (
+	"crypto/tls"
 	"fmt"
 	"middleware/common"
 	"os"
@@ -13,9 +14,18 @@ type InfraManager struct {
 	WorkersManager *WorkerStatusManager
 	ReplicaManager *ReplicaManager
 	term           chan os.Signal
+	tls            ManagerTLS
 }
 
-func NewInfraManager(ringIp string, ringPort string, ringReplicasAmount int) (*InfraManager, error) {
+// Nil configs keep the link in plain TCP
+type ManagerTLS struct {
+	RingServer *tls.Config
+	RingClient *tls.Config
+	Workers    *tls.Config
+	Server     *tls.Config
+}
+
+func NewInfraManager(ringIp string, ringPort string, ringReplicasAmount int, tlsCfg ManagerTLS) (*InfraManager, error) {
 	id, err := strconv.Atoi(os.Getenv("MANAGER_ID"))
 
 	if err != nil {
@@ -24,9 +34,10 @@ func NewInfraManager(ringIp string, ringPort string, ringReplicasAmount int) (*I
 	}
 
 	m := &InfraManager{
-		ReplicaManager: NewReplicaManager(id, ringReplicasAmount, ringIp, ringPort),
+		ReplicaManager: NewReplicaManager(id, ringReplicasAmount, ringIp, ringPort, tlsCfg.RingServer, tlsCfg.RingClient),
 		WorkersManager: NewWorkerStatusManager(),
 		term:           make(chan os.Signal, 1),
+		tls:            tlsCfg,
 	}
 
 	signal.Notify(m.term, syscall.SIGTERM)
@@ -71,6 +82,11 @@ func (m *InfraManager) ListenForWorkers(workerPort string) {
 			}
 		default:
 			worker.port = workerPort
+			if worker.name == "server" {
+				worker.tls = m.tls.Server
+			} else {
+				worker.tls = m.tls.Workers
+			}
 			go worker.Watch()
 		}
 	}
@@ -109,6 +125,18 @@ func (m *InfraManager) LoadArchitecture() error {
 		m.WorkersManager.AddWorker(fmt.Sprintf("node_mfgq5_%d", i+1))
 	}
 
+	for i := range arcCfg.MapFilter.QuerySixGames.PartitionAmount {
+		m.WorkersManager.AddWorker(fmt.Sprintf("node_mfgq6_%d", i+1))
+	}
+
+	for i := range arcCfg.MapFilter.QuerySevenGames.PartitionAmount {
+		m.WorkersManager.AddWorker(fmt.Sprintf("node_mfgq7_%d", i+1))
+	}
+
+	for i := range arcCfg.MapFilter.QueryEightGames.PartitionAmount {
+		m.WorkersManager.AddWorker(fmt.Sprintf("node_mfgq8_%d", i+1))
+	}
+
 	for i := range arcCfg.MapFilter.QueryThreeReviews.PartitionAmount {
 		m.WorkersManager.AddWorker(fmt.Sprintf("node_mfrq3_%d", i+1))
 	}
@@ -121,6 +149,14 @@ func (m *InfraManager) LoadArchitecture() error {
 		m.WorkersManager.AddWorker(fmt.Sprintf("node_mfrq5_%d", i+1))
 	}
 
+	for i := range arcCfg.MapFilter.QuerySevenReviews.PartitionAmount {
+		m.WorkersManager.AddWorker(fmt.Sprintf("node_mfrq7_%d", i+1))
+	}
+
+	for i := range arcCfg.MapFilter.QueryEightReviews.PartitionAmount {
+		m.WorkersManager.AddWorker(fmt.Sprintf("node_mfrq8_%d", i+1))
+	}
+
 	// S2
 
 	for i := range arcCfg.QueryOne.StageTwo.PartitionAmount {
@@ -143,6 +179,18 @@ func (m *InfraManager) LoadArchitecture() error {
 		m.WorkersManager.AddWorker(fmt.Sprintf("node_q5s2_%d", i+1))
 	}
 
+	for i := range arcCfg.QuerySix.StageTwo.PartitionAmount {
+		m.WorkersManager.AddWorker(fmt.Sprintf("node_q6s2_%d", i+1))
+	}
+
+	for i := range arcCfg.QuerySeven.StageTwo.PartitionAmount {
+		m.WorkersManager.AddWorker(fmt.Sprintf("node_q7s2_%d", i+1))
+	}
+
+	for i := range arcCfg.QueryEight.StageTwo.PartitionAmount {
+		m.WorkersManager.AddWorker(fmt.Sprintf("node_q8s2_%d", i+1))
+	}
+
 	// S3
 
 	for i := range arcCfg.QueryOne.StageThree.PartitionAmount {
@@ -165,6 +213,24 @@ func (m *InfraManager) LoadArchitecture() error {
 		m.WorkersManager.AddWorker(fmt.Sprintf("node_q5s3_%d", i+1))
 	}
 
+	for i := range arcCfg.QuerySix.StageThree.PartitionAmount {
+		m.WorkersManager.AddWorker(fmt.Sprintf("node_q6s3_%d", i+1))
+	}
+
+	for i := range arcCfg.QuerySeven.StageThree.PartitionAmount {
+		m.WorkersManager.AddWorker(fmt.Sprintf("node_q7s3_%d", i+1))
+	}
+
+	for i := range arcCfg.QueryEight.StageThree.PartitionAmount {
+		m.WorkersManager.AddWorker(fmt.Sprintf("node_q8s3_%d", i+1))
+	}
+
+	// S4
+
+	for i := range arcCfg.QuerySeven.StageFour.PartitionAmount {
+		m.WorkersManager.AddWorker(fmt.Sprintf("node_q7s4_%d", i+1))
+	}
+
 	return nil
 }
 
@@ -1,6 +1,7 @@
 package src
 
 import (
+	"crypto/tls"
 	"fmt"
 	"middleware/common"
 	"net"
@@ -19,6 +20,8 @@ type ReplicaManager struct {
 	send           chan *RingMessage
 	neighbours     []*ReplicaNeighbour
 	CoordNews      chan bool
+	serverTLS      *tls.Config
+	clientTLS      *tls.Config
 }
 
 type ReplicaNeighbour struct {
@@ -26,7 +29,7 @@ type ReplicaNeighbour struct {
 	conn net.Conn
 }
 
-func NewReplicaManager(id int, replicasAmount int, ip string, port string) *ReplicaManager {
+func NewReplicaManager(id int, replicasAmount int, ip string, port string, serverTLS *tls.Config, clientTLS *tls.Config) *ReplicaManager {
 	return &ReplicaManager{
 		id:             id,
 		coordinatorId:  0,
@@ -36,6 +39,8 @@ func NewReplicaManager(id int, replicasAmount int, ip string, port string) *Repl
 		send:           make(chan *RingMessage, 10),
 		neighbours:     make([]*ReplicaNeighbour, replicasAmount-1),
 		CoordNews:      make(chan bool, 2),
+		serverTLS:      serverTLS,
+		clientTLS:      clientTLS,
 	}
 }
 
@@ -82,7 +87,7 @@ func (rm *ReplicaManager) EstablishConnection(id int) (net.Conn, error) {
 
 	err = common.DoWithRetry(func() error {
 		log.Infof("[COOR = %d] - Establishing connection with replica %d", rm.coordinatorId, id)
-		conn, err = net.Dial("tcp", fmt.Sprintf("manager_%d:%s", id, rm.port))
+		conn, err = common.Dial(fmt.Sprintf("manager_%d:%s", id, rm.port), rm.clientTLS)
 		if err != nil {
 			log.Errorf("[COOR = %d] - Failed to establish connection with replica %d: %s", rm.coordinatorId, id, err)
 			return err
@@ -205,7 +210,7 @@ func (rm *ReplicaManager) StartElection() {
 }
 
 func (rm *ReplicaManager) ListenNeighbours() error {
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%s", rm.port))
+	listener, err := common.Listen(fmt.Sprintf(":%s", rm.port), rm.serverTLS)
 	if err != nil {
 		log.Errorf("[COOR = %d] - Failed to start listening on port %s: %s", rm.coordinatorId, rm.port, err)
 		return err
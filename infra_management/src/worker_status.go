@@ -1,6 +1,7 @@
 package src
 
 import (
+	"crypto/tls"
 	"fmt"
 	"middleware/common"
 	"net"
@@ -17,6 +18,9 @@ type WorkerStatus struct {
 	conn      net.Conn
 	port      string
 	CoordNews chan bool
+	// Only set for the server, which speaks the client protocol
+	codec common.ClientCodec
+	tls   *tls.Config
 }
 
 func NewWorkerStatus(name string) *WorkerStatus {
@@ -27,10 +31,35 @@ func NewWorkerStatus(name string) *WorkerStatus {
 }
 
 func (w *WorkerStatus) Send(message string) error {
+	if w.codec != nil {
+		m, err := common.DeserializeClientMessage(message)
+		if err != nil {
+			return err
+		}
+		frame, err := w.codec.Encode(m)
+		if err != nil {
+			return err
+		}
+		return common.SendFrame(frame, w.conn, common.Compression_None)
+	}
 	return common.Send(message, w.conn)
 }
 
 func (w *WorkerStatus) Receive() (string, error) {
+	if w.codec != nil {
+		frame, err := common.ReceiveFrame(w.conn)
+		if err != nil {
+			return "", err
+		}
+		messages, err := w.codec.Decode(frame)
+		if err != nil {
+			return "", err
+		}
+		if messages[0].Type == common.Type_ALV {
+			return common.ALV, nil
+		}
+		return messages[0].Content, nil
+	}
 	return common.Receive(w.conn)
 }
 
@@ -49,14 +78,23 @@ func (w *WorkerStatus) EstablishConnection() {
 	const maxRetries = 3
 
 	for i := 1; i <= maxRetries; i++ {
-		conn, err := net.Dial("tcp", fmt.Sprintf("%s:%s", w.name, w.port))
+		conn, err := common.Dial(fmt.Sprintf("%s:%s", w.name, w.port), w.tls)
 		if err == nil {
 			log.Infof("WORKER-CONNECTED: %s", w.name)
 			w.conn = conn
 
 			if w.name == "server" {
 				// Ignore first server client id message
+				w.codec = nil
 				w.Receive()
+				codec, err := common.ClientHandshake(conn)
+				if err != nil {
+					log.Errorf("Action: Hello %s | Result: Error | Error: %s", w.name, err)
+					conn.Close()
+					time.Sleep(1 * time.Second)
+					continue
+				}
+				w.codec = codec
 			}
 
 			return
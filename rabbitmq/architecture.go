@@ -12,12 +12,16 @@ type Architecture struct {
 	QueryThree *TwoStageArchitecture
 	QueryFour  *TwoStageArchitecture
 	QueryFive  *TwoStageArchitecture
+	QuerySix   *TwoStageArchitecture
+	QuerySeven *ThreeStageArchitecture
+	QueryEight *TwoStageArchitecture
 	Results    *Results
 	rabbit     *Rabbit
 }
 
 func CreateArchitecture(cfg *common.ArchitectureConfig) *Architecture {
 	rabbit := NewRabbit()
+	rabbit.SetCompression(cfg.Compression)
 
 	return &Architecture{
 		MapFilter:  CreateMapFilterArchitecture(rabbit, cfg),
@@ -25,7 +29,10 @@ func CreateArchitecture(cfg *common.ArchitectureConfig) *Architecture {
 		QueryTwo:   CreateTwoStageArchitecture(rabbit, &cfg.QueryTwo, "Q2"),
 		QueryThree: CreateTwoStageArchitecture(rabbit, &cfg.QueryThree, "Q3"),
 		QueryFour:  CreateTwoStageArchitecture(rabbit, &cfg.QueryFour, "Q4"),
-		QueryFive:  CreateTwoStageArchitecture(rabbit, &cfg.QueryFive, "Q5"),
+		QueryFive:  CreateTwoStageArchitecture(rabbit, &cfg.QueryFive, "Q5").WithFeedback(rabbit, &cfg.QueryFive, "Q5"),
+		QuerySix:   CreateTwoStageArchitecture(rabbit, &cfg.QuerySix, "Q6"),
+		QuerySeven: CreateThreeStageArchitecture(rabbit, &cfg.QuerySeven, "Q7"),
+		QueryEight: CreateTwoStageArchitecture(rabbit, &cfg.QueryEight, "Q8"),
 		Results:    CreateResults(rabbit),
 		rabbit:     rabbit,
 	}
@@ -125,6 +132,9 @@ func createGamePartitionedExchange(rabbit *Rabbit, cfg *common.ArchitectureConfi
 		"MFG_Q3": CreatePartitionedQueuesWithNameBinding(rabbit, gex, "MFG_Q3", cfg.MapFilter.QueryThreeGames.PartitionAmount),
 		"MFG_Q4": CreatePartitionedQueuesWithNameBinding(rabbit, gex, "MFG_Q4", cfg.MapFilter.QueryFourGames.PartitionAmount),
 		"MFG_Q5": CreatePartitionedQueuesWithNameBinding(rabbit, gex, "MFG_Q5", cfg.MapFilter.QueryFiveGames.PartitionAmount),
+		"MFG_Q6": CreatePartitionedQueuesWithNameBinding(rabbit, gex, "MFG_Q6", cfg.MapFilter.QuerySixGames.PartitionAmount),
+		"MFG_Q7": CreatePartitionedQueuesWithNameBinding(rabbit, gex, "MFG_Q7", cfg.MapFilter.QuerySevenGames.PartitionAmount),
+		"MFG_Q8": CreatePartitionedQueuesWithNameBinding(rabbit, gex, "MFG_Q8", cfg.MapFilter.QueryEightGames.PartitionAmount),
 	}
 	return &PartitionedExchange{
 		exchange: gex,
@@ -139,6 +149,8 @@ func createReviewPartitionedExchange(rabbit *Rabbit, cfg *common.ArchitectureCon
 		"MFR_Q3": CreatePartitionedQueuesWithNameBinding(rabbit, gex, "MFR_Q3", cfg.MapFilter.QueryThreeReviews.PartitionAmount),
 		"MFR_Q4": CreatePartitionedQueuesWithNameBinding(rabbit, gex, "MFR_Q4", cfg.MapFilter.QueryFourReviews.PartitionAmount),
 		"MFR_Q5": CreatePartitionedQueuesWithNameBinding(rabbit, gex, "MFR_Q5", cfg.MapFilter.QueryFiveReviews.PartitionAmount),
+		"MFR_Q7": CreatePartitionedQueuesWithNameBinding(rabbit, gex, "MFR_Q7", cfg.MapFilter.QuerySevenReviews.PartitionAmount),
+		"MFR_Q8": CreatePartitionedQueuesWithNameBinding(rabbit, gex, "MFR_Q8", cfg.MapFilter.QueryEightReviews.PartitionAmount),
 	}
 	return &PartitionedExchange{
 		exchange: gex,
@@ -156,6 +168,8 @@ func CreateMapFilterArchitecture(rabbit *Rabbit, cfg *common.ArchitectureConfig)
 type TwoStageArchitecture struct {
 	StageTwo   *PartitionedExchange
 	StageThree *PartitionedExchange
+	// From stage three back to every stage two partition, nil for the queries that don't need it
+	Feedback *PartitionedExchange
 }
 
 func createStage(rabbit *Rabbit, partitionAmount int, name string) *PartitionedExchange {
@@ -176,12 +190,36 @@ func CreateTwoStageArchitecture(rabbit *Rabbit, cfg *common.TwoStageConfig, name
 	}
 }
 
+func (t *TwoStageArchitecture) WithFeedback(rabbit *Rabbit, cfg *common.TwoStageConfig, name string) *TwoStageArchitecture {
+	t.Feedback = createStage(rabbit, cfg.StageTwo.PartitionAmount, fmt.Sprintf("%s_S2_FEEDBACK", name))
+	return t
+}
+
+// Stage three is partitioned by a key other than the one of stage two, like the companies
+// of a game, stage four is the single node of the end
+type ThreeStageArchitecture struct {
+	StageTwo   *PartitionedExchange
+	StageThree *PartitionedExchange
+	StageFour  *PartitionedExchange
+}
+
+func CreateThreeStageArchitecture(rabbit *Rabbit, cfg *common.ThreeStageConfig, name string) *ThreeStageArchitecture {
+	return &ThreeStageArchitecture{
+		StageTwo:   createStage(rabbit, cfg.StageTwo.PartitionAmount, fmt.Sprintf("%s_S2", name)),
+		StageThree: createStage(rabbit, cfg.StageThree.PartitionAmount, fmt.Sprintf("%s_S3", name)),
+		StageFour:  createStage(rabbit, 1, fmt.Sprintf("%s_S4", name)),
+	}
+}
+
 type Results struct {
 	QueryOne   *PartitionedExchange
 	QueryTwo   *PartitionedExchange
 	QueryThree *PartitionedExchange
 	QueryFour  *PartitionedExchange
 	QueryFive  *PartitionedExchange
+	QuerySix   *PartitionedExchange
+	QuerySeven *PartitionedExchange
+	QueryEight *PartitionedExchange
 }
 
 func createResult(rabbit *Rabbit, name string) *PartitionedExchange {
@@ -201,5 +239,8 @@ func CreateResults(rabbit *Rabbit) *Results {
 		QueryThree: createResult(rabbit, "Q3RESULT"),
 		QueryFour:  createResult(rabbit, "Q4RESULT"),
 		QueryFive:  createResult(rabbit, "Q5RESULT"),
+		QuerySix:   createResult(rabbit, "Q6RESULT"),
+		QuerySeven: createResult(rabbit, "Q7RESULT"),
+		QueryEight: createResult(rabbit, "Q8RESULT"),
 	}
 }
@@ -0,0 +1,164 @@
+package rabbitmq
+
+import (
+	"sync"
+	"time"
+)
+
+type DepthConfig struct {
+	// Ready messages in any of the queues that pause the producers, zero disables the monitor
+	HighWatermark int
+	// The producers resume once every queue is at or below this
+	LowWatermark int
+	Interval     time.Duration
+	// Checks in a row that can fail before the producers resume anyway, a broken monitor
+	// mustn't hold them forever
+	MaxFailedChecks int
+}
+
+// Ready messages in the queue
+type QueueDepth func(q *Queue) (int, error)
+
+// Polls the depth of a set of queues and holds the producers while any of them is over the
+// high watermark
+type DepthMonitor struct {
+	depth   QueueDepth
+	queues  []*Queue
+	cfg     DepthConfig
+	failed  int
+	paused  bool
+	mu      sync.Mutex
+	resumed *sync.Cond
+}
+
+func NewDepthMonitor(queues []*Queue, cfg DepthConfig, depth QueueDepth) *DepthMonitor {
+	if cfg.LowWatermark <= 0 || cfg.LowWatermark > cfg.HighWatermark {
+		cfg.LowWatermark = cfg.HighWatermark / 2
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Second
+	}
+	if cfg.MaxFailedChecks <= 0 {
+		cfg.MaxFailedChecks = 3
+	}
+
+	m := &DepthMonitor{
+		depth:  depth,
+		queues: queues,
+		cfg:    cfg,
+	}
+	m.resumed = sync.NewCond(&m.mu)
+	return m
+}
+
+// Checks the depths with passive declares on a channel of its own, a failed passive declare
+// closes the channel it runs on and the next check opens another one
+func (a *Architecture) NewDepthMonitor(queues []*Queue, cfg DepthConfig) (*DepthMonitor, error) {
+	if cfg.HighWatermark <= 0 {
+		return nil, nil
+	}
+
+	ch, err := a.rabbit.Connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	connection := a.rabbit.Connection
+	depth := func(q *Queue) (int, error) {
+		if ch == nil {
+			if ch, err = connection.Channel(); err != nil {
+				return 0, err
+			}
+		}
+		state, err := ch.QueueDeclarePassive(q.Name, q.Durable, q.AutoDeleted, q.Exclusive, q.NoWait, nil)
+		if err != nil {
+			ch = nil
+			return 0, err
+		}
+		return state.Messages, nil
+	}
+	return NewDepthMonitor(queues, cfg, depth), nil
+}
+
+// Every queue the server publishes the client data to
+func (a *Architecture) MapFilterQueues() []*Queue {
+	queues := make([]*Queue, 0)
+	for _, ex := range []*PartitionedExchange{a.MapFilter.Games, a.MapFilter.Reviews} {
+		for _, pqs := range ex.channels {
+			queues = append(queues, pqs.queues...)
+		}
+	}
+	return queues
+}
+
+func (m *DepthMonitor) Run() {
+	ticker := time.NewTicker(m.cfg.Interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		m.Check()
+	}
+}
+
+// Pauses or resumes the producers with the depths the queues have now. Run calls it every interval.
+func (m *DepthMonitor) Check() {
+	deepest, depth := "", 0
+	for _, q := range m.queues {
+		d, err := m.depth(q)
+		if err != nil {
+			m.checkFailed(q, err)
+			return
+		}
+		if d > depth {
+			deepest, depth = q.Name, d
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failed = 0
+	if !m.paused && depth >= m.cfg.HighWatermark {
+		m.paused = true
+		log.Warningf("Action: Backpressure | Result: Paused | Queue: %s | Depth: %d | High Watermark: %d", deepest, depth, m.cfg.HighWatermark)
+	} else if m.paused && depth <= m.cfg.LowWatermark {
+		m.resume()
+		log.Infof("Action: Backpressure | Result: Resumed | Queue: %s | Depth: %d | Low Watermark: %d", deepest, depth, m.cfg.LowWatermark)
+	}
+}
+
+// Keeps the last decision until the queues can be checked again, for a few checks
+func (m *DepthMonitor) checkFailed(q *Queue, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failed++
+	log.Errorf("Action: Check Queue Depth | Queue: %s | Result: Error | Failed Checks: %d | Error: %s", q.Name, m.failed, err)
+	if m.paused && m.failed >= m.cfg.MaxFailedChecks {
+		m.resume()
+		log.Criticalf("Action: Backpressure | Result: Resumed | Error: the depths couldn't be checked %d times in a row", m.failed)
+	}
+}
+
+func (m *DepthMonitor) resume() {
+	m.paused = false
+	m.resumed.Broadcast()
+}
+
+func (m *DepthMonitor) Paused() bool {
+	if m == nil {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.paused
+}
+
+// Blocks while the queues are over the watermarks. A nil monitor never blocks.
+func (m *DepthMonitor) Wait() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for m.paused {
+		m.resumed.Wait()
+	}
+}
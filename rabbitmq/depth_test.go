@@ -0,0 +1,71 @@
+package rabbitmq_test
+
+import (
+	"errors"
+	"middleware/rabbitmq"
+	"testing"
+	"time"
+)
+
+func TestDepthMonitorWatermarks(t *testing.T) {
+	queues := []*rabbitmq.Queue{{Name: "MFG_Q1_1"}, {Name: "MFR_Q3_1"}}
+	depths := map[string]int{}
+	var failure error
+	m := rabbitmq.NewDepthMonitor(queues, rabbitmq.DepthConfig{HighWatermark: 10, LowWatermark: 4}, func(q *rabbitmq.Queue) (int, error) {
+		return depths[q.Name], failure
+	})
+
+	steps := []struct {
+		games   int
+		reviews int
+		paused  bool
+	}{
+		{5, 9, false},
+		// Any queue over the high watermark pauses them
+		{2, 10, true},
+		// Between the watermarks nothing changes
+		{6, 5, true},
+		{4, 4, false},
+		{9, 9, false},
+	}
+	for i, s := range steps {
+		depths["MFG_Q1_1"], depths["MFR_Q3_1"] = s.games, s.reviews
+		m.Check()
+		if m.Paused() != s.paused {
+			t.Fatalf("Step %d: expected paused to be %t with depths %d and %d", i, s.paused, s.games, s.reviews)
+		}
+	}
+
+	depths["MFR_Q3_1"] = 20
+	m.Check()
+	resumed := make(chan struct{})
+	go func() {
+		m.Wait()
+		close(resumed)
+	}()
+
+	// A few failed checks keep it paused, the default is to resume at the third one
+	failure = errors.New("channel closed")
+	for i := 0; i < 2; i++ {
+		m.Check()
+		if !m.Paused() {
+			t.Fatalf("Expected a failed check to keep the producers paused")
+		}
+	}
+	m.Check()
+	if m.Paused() {
+		t.Fatalf("Expected the producers to resume after the checks kept failing")
+	}
+	select {
+	case <-resumed:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the waiting producers to be woken up")
+	}
+
+	// Checks that work again pause them as usual
+	failure = nil
+	m.Check()
+	if !m.Paused() {
+		t.Fatalf("Expected the producers to be paused again once the queues can be checked")
+	}
+}
@@ -16,6 +16,7 @@ type Exchange struct {
 	Internal    bool
 	NoWait      bool
 	Arguments   []string
+	Compression common.Compression
 }
 
 func (e *Exchange) Declare() {
@@ -34,14 +35,35 @@ func (e *Exchange) Declare() {
 }
 
 func (e *Exchange) Publish(routingKey string, body common.Serializable) {
+	e.PublishWithPriority(routingKey, body, 0)
+}
+
+// The priority of the job the message belongs to, queues deliver the higher ones first
+func (e *Exchange) PublishWithPriority(routingKey string, body common.Serializable, priority uint8) {
+	e.PublishWithHeaders(routingKey, body, priority, nil)
+}
+
+func (e *Exchange) PublishWithHeaders(routingKey string, body common.Serializable, priority uint8, headers amqp.Table) {
+	b := body.Serialize()
+	encoding := ""
+	if common.ShouldCompress(e.Compression, b) {
+		compressed, err := common.Compress(e.Compression, b)
+		common.FailOnError(err, "Failed to compress a message")
+		b = compressed
+		encoding = common.CompressionName(e.Compression)
+	}
+
 	err := e.Channel.PublishWithContext(e.Context.Context,
 		e.Name,
 		routingKey,
 		false,
 		false,
 		amqp.Publishing{
-			ContentType: "text/plain",
-			Body:        body.Serialize(),
+			ContentType:     "text/plain",
+			ContentEncoding: encoding,
+			Priority:        priority,
+			Headers:         headers,
+			Body:            b,
 		},
 	)
 	common.FailOnError(err, "Failed to publish a message")
@@ -0,0 +1,36 @@
+package rabbitmq
+
+import (
+	"middleware/common"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Header with the options of the job a message belongs to, every stage forwards it like the topology
+const OptionsHeader = "x-job-options"
+
+// Adds the options to the headers, the messages of jobs without options don't carry it
+func WithOptions(headers amqp.Table, o common.JobOptions) amqp.Table {
+	if len(o) == 0 {
+		return headers
+	}
+	if headers == nil {
+		headers = amqp.Table{}
+	}
+	headers[OptionsHeader] = o.String()
+	return headers
+}
+
+// Empty when the message doesn't carry valid ones, the config of the worker is used then
+func OptionsFromHeaders(headers amqp.Table) common.JobOptions {
+	raw, ok := headers[OptionsHeader].(string)
+	if !ok {
+		return common.JobOptions{}
+	}
+	o, err := common.ParseJobOptions(raw)
+	if err != nil {
+		log.Errorf("Action: Read Job Options | Result: Error | Header: %s | Error: %s", raw, err)
+		return common.JobOptions{}
+	}
+	return o
+}
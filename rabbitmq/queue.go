@@ -17,7 +17,9 @@ type Queue struct {
 	AutoDeleted  bool
 	Exclusive    bool
 	NoWait       bool
-	Arguments    []string
+	Arguments    amqp.Table
+	// Unacked messages the broker hands to our consumer at once
+	Prefetch int
 }
 
 func (q *Queue) Declare() {
@@ -27,7 +29,7 @@ func (q *Queue) Declare() {
 		q.AutoDeleted,
 		q.Exclusive,
 		q.NoWait,
-		nil,
+		q.Arguments,
 	)
 	common.FailOnError(err, "Failed to declare a queue")
 	q.Name = queue.Name
@@ -47,6 +49,8 @@ func (q *Queue) Bind(exchange *Exchange, routingKey string) {
 }
 
 func (q *Queue) Consume() <-chan amqp.Delivery {
+	// Only applies to the consumers started after it
+	q.Channel.Qos(q.Prefetch, 0, false)
 	messages, err := q.Channel.Consume(
 		q.Name,
 		q.Name,
@@ -63,9 +67,34 @@ func (q *Queue) Consume() <-chan amqp.Delivery {
 		q.Channel.Cancel(q.Name, false)
 		log.Debugf("Action: Cancel queue connection | Queue: %s | Success: true", q.Name)
 	}()
-	q.Channel.Qos(2, 0, false)
 
 	common.FailOnError(err, "Failed to consume messages")
 
-	return messages
+	return decompressDeliveries(q.Name, messages)
+}
+
+// Decompresses the bodies according to their content encoding, so whoever consumes
+// the queue doesn't need to know how each link is configured
+func decompressDeliveries(name string, in <-chan amqp.Delivery) <-chan amqp.Delivery {
+	out := make(chan amqp.Delivery)
+	go func() {
+		defer close(out)
+		for d := range in {
+			if d.ContentEncoding != "" {
+				c, err := common.CompressionFromName(d.ContentEncoding)
+				if err == nil {
+					d.Body, err = common.Decompress(c, d.Body)
+				}
+				if err != nil {
+					// Requeued it would come back forever, the broker moves it to the dead letters
+					log.Criticalf("Action: Decompress Message | Queue: %s | Encoding: %s | Result: Dead Lettered to %s | Error: %s", name, d.ContentEncoding, DeadLetterQueue, err)
+					d.Nack(false, false)
+					continue
+				}
+				d.ContentEncoding = ""
+			}
+			out <- d
+		}
+	}()
+	return out
 }
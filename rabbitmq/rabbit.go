@@ -2,6 +2,7 @@ package rabbitmq
 
 import (
 	"middleware/common"
+	"strings"
 
 	"github.com/op/go-logging"
 	amqp "github.com/rabbitmq/amqp091-go"
@@ -9,11 +10,20 @@ import (
 
 var log = logging.MustGetLogger("log")
 
+// Where the broker moves the messages we reject, e.g. the ones that can't be decompressed.
+// They stay in the dead letters queue until someone looks at them.
+const (
+	DeadLetterExchange = "DEAD_LETTERS"
+	DeadLetterQueue    = "dead_letters"
+)
+
 type Rabbit struct {
 	Connection *amqp.Connection
 	Channel    *amqp.Channel
 	Exchanges  []Exchange
 	Queues     []Queue
+	// Compression for the messages published to each exchange, by name
+	compression map[string]common.Compression
 }
 
 func NewRabbit() *Rabbit {
@@ -24,9 +34,32 @@ func NewRabbit() *Rabbit {
 	common.FailOnError(err, "Failed to open a channel")
 
 	log.Debugf("Connected to RabbitMQ")
-	return &Rabbit{
-		Connection: conn,
-		Channel:    ch,
+	r := &Rabbit{
+		Connection:  conn,
+		Channel:     ch,
+		compression: make(map[string]common.Compression),
+	}
+	r.declareDeadLetters()
+	return r
+}
+
+func (r *Rabbit) declareDeadLetters() {
+	err := r.Channel.ExchangeDeclare(DeadLetterExchange, "fanout", true, false, false, false, nil)
+	common.FailOnError(err, "Failed to declare the dead letter exchange")
+	_, err = r.Channel.QueueDeclare(DeadLetterQueue, true, false, false, false, nil)
+	common.FailOnError(err, "Failed to declare the dead letter queue")
+	err = r.Channel.QueueBind(DeadLetterQueue, "", DeadLetterExchange, false, nil)
+	common.FailOnError(err, "Failed to bind the dead letter queue")
+}
+
+func (r *Rabbit) SetCompression(links map[string]string) {
+	for name, alg := range links {
+		c, err := common.CompressionFromName(alg)
+		if err != nil {
+			log.Fatalf("Invalid compression for the link %s: %s", name, err)
+		}
+		// Viper lower cases the keys
+		r.compression[strings.ToLower(name)] = c
 	}
 }
 
@@ -49,6 +82,7 @@ func (r *Rabbit) NewExchange(name string, exchangeType string) *Exchange {
 		Internal:    false,
 		NoWait:      false,
 		Arguments:   nil,
+		Compression: r.compression[strings.ToLower(name)],
 	}
 
 	ex.Declare()
@@ -69,7 +103,12 @@ func (r *Rabbit) NewQueue(name string) *Queue {
 		AutoDeleted:  false,
 		Exclusive:    false,
 		NoWait:       false,
-		Arguments:    nil,
+		// Queues declared before without them must be deleted, the broker refuses to change them
+		Arguments: amqp.Table{
+			"x-max-priority":         int(common.MaxPriority),
+			"x-dead-letter-exchange": DeadLetterExchange,
+		},
+		Prefetch: 2,
 	}
 
 	q.Declare()
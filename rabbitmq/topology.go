@@ -0,0 +1,66 @@
+package rabbitmq
+
+import (
+	"fmt"
+	"middleware/common"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Header with the topology of the job a message belongs to, every stage forwards it
+const TopologyHeader = "x-topology"
+
+// Nil for an empty topology, so the messages of jobs without one don't carry the header
+func TopologyHeaders(t common.Topology) amqp.Table {
+	if len(t) == 0 {
+		return nil
+	}
+	return amqp.Table{TopologyHeader: t.String()}
+}
+
+// Empty when the message doesn't carry a valid one, the partitions of the config are used then
+func TopologyFromHeaders(headers amqp.Table) common.Topology {
+	raw, ok := headers[TopologyHeader].(string)
+	if !ok {
+		return common.Topology{}
+	}
+	t, err := common.ParseTopology(raw)
+	if err != nil {
+		log.Errorf("Action: Read Topology | Result: Error | Header: %s | Error: %s", raw, err)
+		return common.Topology{}
+	}
+	return t
+}
+
+// Declares the stage two queues, and the feedback ones, a larger topology needs. The queues of the partitions
+// that go away are kept, the jobs admitted before the rescale keep using them.
+func (a *Architecture) Rescale(t common.Topology) {
+	stages := map[string]*PartitionedExchange{
+		"Q1": a.QueryOne.StageTwo,
+		"Q2": a.QueryTwo.StageTwo,
+		"Q3": a.QueryThree.StageTwo,
+		"Q4": a.QueryFour.StageTwo,
+		"Q5": a.QueryFive.StageTwo,
+		"Q6": a.QuerySix.StageTwo,
+		"Q7": a.QuerySeven.StageTwo,
+		"Q8": a.QueryEight.StageTwo,
+	}
+	for query, stage := range stages {
+		stage.grow(a.rabbit, t.Partitions(query, 0))
+	}
+	if a.QueryFive.Feedback != nil {
+		a.QueryFive.Feedback.grow(a.rabbit, t.Partitions("Q5", 0))
+	}
+}
+
+func (e *PartitionedExchange) grow(rabbit *Rabbit, count int) {
+	for name, pqs := range e.channels {
+		for i := pqs.count + 1; i <= count; i++ {
+			q := rabbit.NewQueue(fmt.Sprintf("%s_%d", name, i))
+			q.Bind(e.exchange, fmt.Sprintf("%d", i))
+			pqs.queues = append(pqs.queues, q)
+			log.Infof("Action: Rescale | Queue: %s | Result: Declared", q.Name)
+		}
+		pqs.count = max(pqs.count, count)
+	}
+}
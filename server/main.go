@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"middleware/common"
+	"middleware/rabbitmq"
 	"middleware/server/src"
 
 	"os"
@@ -48,10 +50,11 @@ func InitLogger(logLevel string) error {
 }
 
 func PrintConfig(v *viper.Viper) {
-	log.Infof("action: config | result: success | server_ip: %s | server_port: %d | log_level: %s",
+	log.Infof("action: config | result: success | server_ip: %s | server_port: %d | log_level: %s | compression: %s",
 		v.GetString("server.ip"),
 		v.GetInt("server.port"),
 		v.GetString("log.level"),
+		v.GetString("server.compression"),
 	)
 }
 
@@ -67,7 +70,46 @@ func main() {
 
 	PrintConfig(v)
 
-	server := src.NewServer(v.GetString("server.ip"), v.GetInt("server.port"))
+	var tenants []src.Tenant
+	if err := v.UnmarshalKey("server.auth.tenants", &tenants); err != nil {
+		log.Criticalf("Invalid tenants configuration: %s", err)
+	}
+
+	tlsCfg, err := common.LoadTLSConfig(v, "server.tls")
+	if err != nil {
+		log.Criticalf("Invalid TLS configuration: %s", err)
+	}
+	serverTLS, err := tlsCfg.Server()
+	if err != nil {
+		log.Fatalf("Can't load the TLS certificates: %s", err)
+	}
+
+	server := src.NewServer(src.ServerConfig{
+		Ip:           v.GetString("server.ip"),
+		Port:         v.GetInt("server.port"),
+		Compression:  v.GetString("server.compression"),
+		TextProtocol: v.GetBool("server.textProtocol"),
+		ReadTimeout:  v.GetDuration("server.readTimeout"),
+		WriteTimeout: v.GetDuration("server.writeTimeout"),
+		MaxFrameSize: v.GetUint32("server.maxFrameSize"),
+		AuthRequired: v.GetBool("server.auth.required"),
+		Tenants:      tenants,
+		TLS:          serverTLS,
+		Admission: src.AdmissionConfig{
+			MaxActiveJobs:  v.GetInt("server.admission.maxActiveJobs"),
+			MaxQueuedJobs:  v.GetInt("server.admission.maxQueuedJobs"),
+			RetryAfter:     v.GetDuration("server.admission.retryAfter"),
+			RowsPerSecond:  v.GetFloat64("server.admission.rowsPerSecond"),
+			BytesPerSecond: v.GetFloat64("server.admission.bytesPerSecond"),
+		},
+		ResultStreams: v.GetInt("server.resultStreams"),
+		Backpressure: rabbitmq.DepthConfig{
+			HighWatermark:   v.GetInt("server.backpressure.highWatermark"),
+			LowWatermark:    v.GetInt("server.backpressure.lowWatermark"),
+			Interval:        v.GetDuration("server.backpressure.interval"),
+			MaxFailedChecks: v.GetInt("server.backpressure.maxFailedChecks"),
+		},
+	})
 	if err := server.Start(); err != nil {
 		log.Criticalf("Error starting server: %s", err)
 	}
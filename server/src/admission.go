@@ -0,0 +1,128 @@
+package src
+
+import (
+	"errors"
+	"middleware/common"
+	"sync"
+	"time"
+)
+
+var ErrServerBusy = errors.New("server busy, retry later")
+
+type AdmissionConfig struct {
+	// Jobs sending data at the same time, zero means no limit
+	MaxActiveJobs int
+	// Jobs waiting for a slot, the rest are told to retry later
+	MaxQueuedJobs int
+	// Hint sent to the clients that don't fit in the queue
+	RetryAfter time.Duration
+	// Ingest limits of every client, zero means no limit
+	RowsPerSecond  float64
+	BytesPerSecond float64
+}
+
+type admissionTicket struct {
+	job      common.JobID
+	priority uint8
+	admitted chan struct{}
+}
+
+// Keeps the jobs holding a slot and a queue of the ones waiting for one, by priority and
+// then in arrival order. A job holds its slot until it releases it.
+type Admission struct {
+	maxActive int
+	maxQueued int
+	active    map[common.JobID]bool
+	queue     []*admissionTicket
+	mu        sync.Mutex
+}
+
+func NewAdmission(maxActive int, maxQueued int) *Admission {
+	return &Admission{
+		maxActive: maxActive,
+		maxQueued: maxQueued,
+		active:    make(map[common.JobID]bool),
+		queue:     make([]*admissionTicket, 0),
+	}
+}
+
+// Returns a closed channel when the job can start right away, or one that is closed
+// once it leaves the queue. Fails with ErrServerBusy when the queue is full.
+func (a *Admission) Request(job common.JobID, priority uint8) (<-chan struct{}, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ticket := &admissionTicket{job: job, priority: priority, admitted: make(chan struct{})}
+
+	if a.active[job] {
+		close(ticket.admitted)
+		return ticket.admitted, nil
+	}
+	for _, t := range a.queue {
+		if t.job == job {
+			return t.admitted, nil
+		}
+	}
+
+	if a.maxActive <= 0 || len(a.active) < a.maxActive {
+		a.active[job] = true
+		close(ticket.admitted)
+		return ticket.admitted, nil
+	}
+
+	if len(a.queue) >= a.maxQueued {
+		return nil, ErrServerBusy
+	}
+
+	// Overtakes the jobs of lower priority
+	i := len(a.queue)
+	for i > 0 && a.queue[i-1].priority < priority {
+		i--
+	}
+	a.queue = append(a.queue, nil)
+	copy(a.queue[i+1:], a.queue[i:])
+	a.queue[i] = ticket
+	return ticket.admitted, nil
+}
+
+// Position of the job in the queue starting at 1, zero when it isn't waiting
+func (a *Admission) Position(job common.JobID) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, t := range a.queue {
+		if t.job == job {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Frees the slot of the job, or its place in the queue, and lets the next one in
+func (a *Admission) Release(job common.JobID) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.active[job] {
+		delete(a.active, job)
+	} else {
+		for i, t := range a.queue {
+			if t.job == job {
+				a.queue = append(a.queue[:i], a.queue[i+1:]...)
+				break
+			}
+		}
+	}
+
+	for len(a.queue) > 0 && (a.maxActive <= 0 || len(a.active) < a.maxActive) {
+		next := a.queue[0]
+		a.queue = a.queue[1:]
+		a.active[next.job] = true
+		close(next.admitted)
+	}
+}
+
+func (a *Admission) Stats() (active int, queued int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.active), len(a.queue)
+}
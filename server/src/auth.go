@@ -0,0 +1,101 @@
+package src
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"middleware/common"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/google/uuid"
+)
+
+// Jobs of clients that connect while authentication is disabled
+const AnonymousTenant = "anonymous"
+
+// Tenant names end up in the result paths
+var tenantNameRegex = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+type Tenant struct {
+	Name string `mapstructure:"name"`
+	// Hex encoded SHA-256 of the token, so the config never holds the token itself
+	TokenSha256 string `mapstructure:"tokenSha256"`
+}
+
+type Authenticator struct {
+	names  []string
+	hashes [][]byte
+}
+
+// Without tenants nobody could connect, it's a config that was never filled in
+func NewAuthenticator(tenants []Tenant) (*Authenticator, error) {
+	if len(tenants) == 0 {
+		return nil, fmt.Errorf("authentication is required but there are no tenants")
+	}
+	a := &Authenticator{
+		names:  make([]string, 0, len(tenants)),
+		hashes: make([][]byte, 0, len(tenants)),
+	}
+	for _, t := range tenants {
+		if !tenantNameRegex.MatchString(t.Name) || t.Name == AnonymousTenant {
+			return nil, fmt.Errorf("invalid tenant name %q", t.Name)
+		}
+		hash, err := hex.DecodeString(t.TokenSha256)
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("invalid token hash for tenant %s", t.Name)
+		}
+		a.names = append(a.names, t.Name)
+		a.hashes = append(a.hashes, hash)
+	}
+	return a, nil
+}
+
+// Returns the tenant that owns the token. Every tenant is checked in constant time so
+// the answer time doesn't tell how close a guess was.
+func (a *Authenticator) Authenticate(token string) (string, bool) {
+	sum := sha256.Sum256([]byte(token))
+	tenant := ""
+	for i, hash := range a.hashes {
+		if subtle.ConstantTimeCompare(sum[:], hash) == 1 {
+			tenant = a.names[i]
+		}
+	}
+	return tenant, tenant != ""
+}
+
+func resultsPath() string {
+	return filepath.Join(".", "data", "results")
+}
+
+// The owner of every job is the tenant directory its results live in
+func loadJobOwners() (map[common.JobID]string, error) {
+	owners := make(map[common.JobID]string)
+	tenants, err := os.ReadDir(resultsPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return owners, nil
+		}
+		return nil, err
+	}
+
+	for _, tenant := range tenants {
+		if !tenant.IsDir() {
+			continue
+		}
+		jobs, err := os.ReadDir(filepath.Join(resultsPath(), tenant.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, job := range jobs {
+			jobId, err := uuid.Parse(job.Name())
+			if err != nil {
+				continue
+			}
+			owners[jobId] = tenant.Name()
+		}
+	}
+	return owners, nil
+}
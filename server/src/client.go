@@ -1,9 +1,13 @@
 package src
 
 import (
+	"bufio"
+	"encoding/csv"
+	"errors"
 	"middleware/common"
 	"middleware/worker/schema"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
@@ -11,32 +15,139 @@ import (
 )
 
 type Client struct {
-	Id         uuid.UUID
-	Connection net.Conn
+	Id          uuid.UUID
+	Connection  net.Conn
+	Compression common.Compression
+	codec       common.ClientCodec
+	// Empty until the client authenticates
+	Tenant     string
+	jobClaimed bool
+	admitted   bool
+	// Of its job, from 0 to common.MaxPriority
+	Priority uint8
+	// Stage two partitions its job was claimed with
+	Topology common.Topology
+	// Picked by the client before its job starts, the workers use their config for the rest
+	Options common.JobOptions
+	// Ingest limits, nil when unlimited
+	rows         *common.RateLimiter
+	bytes        *common.RateLimiter
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	// The results of every query are sent concurrently
+	sendMu sync.Mutex
+	in     *peekConn
 }
 
-func NewClient(conn net.Conn) *Client {
+// Reads through a buffer, so we can tell whether the client hung up without taking what it sent
+type peekConn struct {
+	net.Conn
+	in *bufio.Reader
+}
+
+func (p *peekConn) Read(b []byte) (int, error) {
+	return p.in.Read(b)
+}
+
+// How long a look at the connection of a waiting client takes
+const hangUpCheckInterval = time.Second
+
+func NewClient(conn net.Conn, readTimeout time.Duration, writeTimeout time.Duration) *Client {
+	in := &peekConn{Conn: conn, in: bufio.NewReader(conn)}
 	return &Client{
-		Id:         uuid.New(),
-		Connection: conn,
+		Id:           uuid.New(),
+		Connection:   in,
+		codec:        common.TextCodec{},
+		readTimeout:  readTimeout,
+		writeTimeout: writeTimeout,
+		in:           in,
 	}
 }
 
+// The first channel is closed if the client hangs up before stop is closed, the second one
+// once it stopped looking. Nothing else may read from the client meanwhile, and the read
+// deadline it leaves must be cleared.
+func (c *Client) watchHangUp(stop <-chan struct{}) (<-chan struct{}, <-chan struct{}) {
+	gone := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			c.Connection.SetReadDeadline(time.Now().Add(hangUpCheckInterval))
+			_, err := c.in.in.Peek(1)
+			var ne net.Error
+			if err != nil && !(errors.As(err, &ne) && ne.Timeout()) {
+				close(gone)
+				return
+			}
+			if err == nil {
+				// It already sent something, it was there a moment ago
+				select {
+				case <-stop:
+					return
+				case <-time.After(hangUpCheckInterval):
+				}
+			}
+		}
+	}()
+	return gone, done
+}
+
 func (c *Client) Close() {
 	c.Connection.Close()
 }
 
-func (c *Client) Recv() (string, error) {
-	return common.Receive(c.Connection)
+func (c *Client) Send(message string) error {
+	return c.sendFrame([]byte(message))
 }
 
-func (c *Client) Send(message string) error {
-	return common.Send(message, c.Connection)
+// A client that stops sending in the middle of a frame, or doesn't read what we send,
+// is disconnected once the deadline expires instead of holding the handler forever
+func (c *Client) RecvFrame() ([]byte, error) {
+	if c.readTimeout > 0 {
+		c.Connection.SetReadDeadline(time.Now().Add(c.readTimeout))
+	}
+	return common.ReceiveFrame(c.Connection)
+}
+
+func (c *Client) sendFrame(frame []byte) error {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if c.writeTimeout > 0 {
+		c.Connection.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	return common.SendFrame(frame, c.Connection, c.Compression)
+}
+
+func (c *Client) SendMessage(message common.ClientMessage) error {
+	frame, err := c.codec.Encode(message)
+	if err != nil {
+		return err
+	}
+	return c.sendFrame(frame)
+}
+
+func (c *Client) SendError(cause error) error {
+	return c.SendMessage(common.ClientMessage{Content: cause.Error(), Type: common.Type_Error})
+}
+
+func (c *Client) SendCompression(chosen common.Compression) error {
+	message := common.ClientMessage{Content: common.CompressionName(chosen), Type: common.Type_NegotiateCompression}
+	if err := c.SendMessage(message); err != nil {
+		return err
+	}
+	c.Compression = chosen
+	return nil
 }
 
 func (c *Client) SendId() error {
 	for retries := 0; retries < 3; retries++ {
-		if err := common.Send(c.Id.String(), c.Connection); err == nil {
+		if err := c.sendFrame([]byte(c.Id.String())); err == nil {
 			return nil
 		} else if retries == 2 {
 			log.Errorf("Failed to send ID to client %s after 3 attempts", c.Id)
@@ -48,7 +159,11 @@ func (c *Client) SendId() error {
 
 func (c *Client) SendAlive() error {
 	return common.DoWithRetry(func() error {
-		return c.Send("ALV")
+		if c.codec.Version() == common.ProtocolVersion_Text {
+			// Text health checks expect the bare tag
+			return c.Send("ALV")
+		}
+		return c.SendMessage(common.ClientMessage{Type: common.Type_ALV})
 	}, 3, 2)
 }
 
@@ -74,13 +189,9 @@ func (c *Client) SendResultsQ1(q *QueryResultStore[*schema.SOCounter], wg *sync.
 
 		message := common.ClientMessage{Content: result, Type: common.Type_Results_Q1}
 
-		messageSerialized, err := message.SerializeClientMessage()
-
-		if err != nil {
-			common.FailOnError(err, "Failed to serialize message") // UNREACHABLE
+		if err := c.SendMessage(message); err != nil {
+			return err
 		}
-
-		c.Send(messageSerialized)
 	}
 
 	log.Debug("Finished reading Q1 results file")
@@ -110,13 +221,9 @@ func (c *Client) SendResultsQ2(q *QueryResultStore[*schema.PlayedTime], wg *sync
 
 		message := common.ClientMessage{Content: result, Type: common.Type_Results_Q2}
 
-		messageSerialized, err := message.SerializeClientMessage()
-
-		if err != nil {
-			common.FailOnError(err, "Failed to serialize message") // UNREACHABLE
+		if err := c.SendMessage(message); err != nil {
+			return err
 		}
-
-		c.Send(messageSerialized)
 	}
 
 	log.Debug("Finished reading Q2 results file")
@@ -146,13 +253,9 @@ func (c *Client) SendResultsQ3(q *QueryResultStore[*schema.NamedReviewCounter],
 
 		message := common.ClientMessage{Content: result, Type: common.Type_Results_Q3}
 
-		messageSerialized, err := message.SerializeClientMessage()
-
-		if err != nil {
-			common.FailOnError(err, "Failed to serialize message") // UNREACHABLE
+		if err := c.SendMessage(message); err != nil {
+			return err
 		}
-
-		c.Send(messageSerialized)
 	}
 
 	log.Debug("Finished reading Q3 results file")
@@ -182,13 +285,9 @@ func (c *Client) SendResultsQ4(q *QueryResultStore[*schema.NamedReviewCounter],
 
 		message := common.ClientMessage{Content: result, Type: common.Type_Results_Q4}
 
-		messageSerialized, err := message.SerializeClientMessage()
-
-		if err != nil {
-			common.FailOnError(err, "Failed to serialize message") // UNREACHABLE
+		if err := c.SendMessage(message); err != nil {
+			return err
 		}
-
-		c.Send(messageSerialized)
 	}
 
 	log.Debug("Finished reading Q4 results file")
@@ -196,6 +295,38 @@ func (c *Client) SendResultsQ4(q *QueryResultStore[*schema.NamedReviewCounter],
 	return nil
 }
 
+func (c *Client) SendResultsQ4Languages(q *QueryResultStore[*schema.LanguageCount], wg *sync.WaitGroup) error {
+	log.Infof("Waiting for Q4 language breakdown to be ready")
+	defer wg.Done()
+
+	for !q.Finished {
+		time.Sleep(1 * time.Second)
+	}
+
+	log.Infof("Q4 language breakdown is ready")
+
+	q.store.Reset()
+
+	scanner, err := q.store.Scanner()
+	if err != nil {
+		return err
+	}
+
+	for scanner.Scan() {
+		result := scanner.Text()
+
+		message := common.ClientMessage{Content: result, Type: common.Type_Results_Q4_Languages}
+
+		if err := c.SendMessage(message); err != nil {
+			return err
+		}
+	}
+
+	log.Debug("Finished reading Q4 language breakdown file")
+
+	return nil
+}
+
 func (c *Client) SendResultsQ5(q *QueryResultStore[*schema.NamedReviewCounter], wg *sync.WaitGroup) error {
 	log.Infof("Waiting for Q5 results to be ready")
 	defer wg.Done()
@@ -218,29 +349,142 @@ func (c *Client) SendResultsQ5(q *QueryResultStore[*schema.NamedReviewCounter],
 
 		message := common.ClientMessage{Content: result, Type: common.Type_Results_Q5}
 
-		messageSerialized, err := message.SerializeClientMessage()
+		if err := c.SendMessage(message); err != nil {
+			return err
+		}
+	}
+
+	log.Debug("Finished reading Q5 results file")
+
+	return nil
+}
+
+func (c *Client) SendResultsQ6(q *QueryResultStore[*schema.PriceSummary], wg *sync.WaitGroup) error {
+	log.Infof("Waiting for Q6 results to be ready")
+	defer wg.Done()
+
+	for !q.Finished {
+		time.Sleep(1 * time.Second)
+	}
+
+	log.Infof("Q6 results are ready")
+
+	q.store.Reset()
+
+	scanner, err := q.store.Scanner()
+	if err != nil {
+		return err
+	}
+
+	for scanner.Scan() {
+		result := scanner.Text()
 
-		if err != nil {
-			common.FailOnError(err, "Failed to serialize message") // UNREACHABLE
+		message := common.ClientMessage{Content: result, Type: common.Type_Results_Q6}
+
+		if err := c.SendMessage(message); err != nil {
+			return err
 		}
+	}
+
+	log.Debug("Finished reading Q6 results file")
+
+	return nil
+}
 
-		c.Send(messageSerialized)
+func (c *Client) SendResultsQ7(q *QueryResultStore[*schema.CompanyRank], wg *sync.WaitGroup) error {
+	log.Infof("Waiting for Q7 results to be ready")
+	defer wg.Done()
+
+	for !q.Finished {
+		time.Sleep(1 * time.Second)
 	}
 
-	log.Debug("Finished reading Q5 results file")
+	log.Infof("Q7 results are ready")
+
+	q.store.Reset()
+
+	scanner, err := q.store.Scanner()
+	if err != nil {
+		return err
+	}
+
+	for scanner.Scan() {
+		result := scanner.Text()
+
+		message := common.ClientMessage{Content: result, Type: common.Type_Results_Q7}
+
+		if err := c.SendMessage(message); err != nil {
+			return err
+		}
+	}
+
+	log.Debug("Finished reading Q7 results file")
 
 	return nil
 }
 
-func (c *Client) SendEndWithResults() error {
-	message := common.ClientMessage{Content: c.Id.String(), Type: common.Type_EndWithResults}
-	messageSerialized, err := message.SerializeClientMessage()
+func (c *Client) SendResultsQ8(q *QueryResultStore[*schema.SentimentBucket], wg *sync.WaitGroup) error {
+	log.Infof("Waiting for Q8 results to be ready")
+	defer wg.Done()
+
+	for !q.Finished {
+		time.Sleep(1 * time.Second)
+	}
+
+	log.Infof("Q8 results are ready")
 
+	q.store.Reset()
+
+	scanner, err := q.store.Scanner()
 	if err != nil {
-		common.FailOnError(err, "Failed to serialize message") // UNREACHABLE
+		return err
+	}
+
+	for scanner.Scan() {
+		result := scanner.Text()
+
+		message := common.ClientMessage{Content: result, Type: common.Type_Results_Q8}
+
+		if err := c.SendMessage(message); err != nil {
+			return err
+		}
 	}
 
-	c.Send(messageSerialized)
+	log.Debug("Finished reading Q8 results file")
 
 	return nil
 }
+
+// Sends the provisional tops of the queries still running that changed since the last call
+func (c *Client) SendProvisional(store *ResultStore, sent map[string]*schema.ProvisionalTop) error {
+	queries := map[string]*QueryResultStore[*schema.NamedReviewCounter]{
+		"Q3": store.QueryThree,
+		"Q4": store.QueryFour,
+		"Q5": store.QueryFive,
+	}
+	for query, results := range queries {
+		t := store.Provisional.Get(query)
+		if t == nil || t == sent[query] || results.Finished {
+			continue
+		}
+
+		var line strings.Builder
+		w := csv.NewWriter(&line)
+		if err := w.Write(t.ToCSV()); err != nil {
+			return err
+		}
+		w.Flush()
+
+		message := common.ClientMessage{Content: strings.TrimSuffix(line.String(), "\n"), Type: common.Type_Results_Provisional}
+		if err := c.SendMessage(message); err != nil {
+			return err
+		}
+		sent[query] = t
+	}
+	return nil
+}
+
+func (c *Client) SendEndWithResults() error {
+	message := common.ClientMessage{Content: c.Id.String(), Type: common.Type_EndWithResults}
+	return c.SendMessage(message)
+}
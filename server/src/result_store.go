@@ -6,17 +6,28 @@ import (
 	"middleware/common"
 	"middleware/worker/schema"
 	"path/filepath"
+	"sort"
+	"sync"
 )
 
-type QueryResultStore[T schema.ToCSV] struct {
-	Finished  bool
-	store     *common.TemporaryStorage
-	idemStore *common.IdempotencyStore
-	csvWriter *csv.Writer
+type Result interface {
+	schema.ToCSV
+	common.Serializable
 }
 
-func NewQueryResultStore[T schema.ToCSV](id string, name string) (*QueryResultStore[T], error) {
-	s, err := common.NewTemporaryStorage(filepath.Join(".", "data", "results", id, fmt.Sprintf("%s.csv", name)))
+// The results arrive in whatever order the workers send them, each one is saved as it comes
+// and once the query finishes they are written in its order, so every run gives the same file
+type QueryResultStore[T Result] struct {
+	Finished    bool
+	store       *common.TemporaryStorage
+	pending     *common.IdempotencyHandlerSingleFile[T]
+	deserialize func(*common.Deserializer) (T, error)
+	csvWriter   *csv.Writer
+	before      func(a, b T) bool
+}
+
+func NewQueryResultStore[T Result](tenant string, id string, name string, deserialize func(*common.Deserializer) (T, error), before func(a, b T) bool) (*QueryResultStore[T], error) {
+	s, err := common.NewTemporaryStorage(filepath.Join(resultsPath(), tenant, id, fmt.Sprintf("%s.csv", name)))
 	if err != nil {
 		return nil, err
 	}
@@ -24,63 +35,183 @@ func NewQueryResultStore[T schema.ToCSV](id string, name string) (*QueryResultSt
 	if err != nil {
 		return nil, err
 	}
-	return &QueryResultStore[T]{store: s, csvWriter: csv.NewWriter(f), idemStore: common.NewIdempotencyStore()}, nil
+	pending, err := common.NewIdempotencyHandlerSingleFile[T](filepath.Join(resultsPath(), tenant, id, fmt.Sprintf("%s.pending", name)))
+	if err != nil {
+		return nil, err
+	}
+	// The results saved before a restart are already acked, they won't come again
+	var zero T
+	if _, err := pending.LoadSequentialState(deserialize, func(acc T, _ T) T { return acc }, zero); err != nil {
+		return nil, err
+	}
+	return &QueryResultStore[T]{
+		store:       s,
+		pending:     pending,
+		deserialize: deserialize,
+		csvWriter:   csv.NewWriter(f),
+		before:      before,
+	}, nil
 }
 
+// Saved to disk before returning, so the result can be acked
 func (q *QueryResultStore[T]) AddResult(msg T, idemId *common.IdempotencyID) error {
-	if q.idemStore.AlreadyProcessed(idemId) {
+	if q.pending.AlreadyProcessed(idemId) {
 		log.Debugf("Result: %v Already Processed. IDEMID: %s", msg.ToCSV(), idemId.String())
 		return nil
 	}
-	defer q.csvWriter.Flush()
 
-	record := msg.ToCSV()
-	log.Debugf("Received %v with IdemID %s", record, idemId.String())
-	if err := q.csvWriter.Write(record); err != nil {
+	log.Debugf("Received %v with IdemID %s", msg.ToCSV(), idemId.String())
+	return q.pending.SaveState(idemId, msg)
+}
+
+// Writes the saved results in order and marks the query as finished. They are kept after it,
+// an EOF that comes again writes the same file.
+func (q *QueryResultStore[T]) Finish() error {
+	if q.Finished {
+		return nil
+	}
+	rs, err := q.pending.ReadState(q.deserialize)
+	if err != nil {
 		return err
 	}
-	q.idemStore.Save(idemId)
+	results := make([]T, 0)
+	for r := range rs {
+		results = append(results, r)
+	}
+	sort.Slice(results, func(i, j int) bool { return q.before(results[i], results[j]) })
 
+	if _, err := q.store.Overwrite(nil); err != nil {
+		return err
+	}
+	for _, r := range results {
+		if err := q.csvWriter.Write(r.ToCSV()); err != nil {
+			return err
+		}
+	}
+	q.csvWriter.Flush()
+	if err := q.csvWriter.Error(); err != nil {
+		return err
+	}
+	q.Finished = true
 	return nil
 }
 
+// The last provisional top of each query with a streaming join. They are only kept in memory,
+// the next one replaces them and the results of the query make them useless.
+type ProvisionalTops struct {
+	mu   sync.Mutex
+	tops map[string]*schema.ProvisionalTop
+}
+
+func NewProvisionalTops() *ProvisionalTops {
+	return &ProvisionalTops{tops: make(map[string]*schema.ProvisionalTop)}
+}
+
+func (p *ProvisionalTops) Set(t *schema.ProvisionalTop) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.tops[t.Query] = t
+}
+
+// Nil until the query sends one
+func (p *ProvisionalTops) Get(query string) *schema.ProvisionalTop {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.tops[query]
+}
+
 type ResultStore struct {
 	jobID      common.JobID
+	Tenant     string
 	QueryOne   *QueryResultStore[*schema.SOCounter]
 	QueryTwo   *QueryResultStore[*schema.PlayedTime]
 	QueryThree *QueryResultStore[*schema.NamedReviewCounter]
 	QueryFour  *QueryResultStore[*schema.NamedReviewCounter]
 	QueryFive  *QueryResultStore[*schema.NamedReviewCounter]
+	QuerySix   *QueryResultStore[*schema.PriceSummary]
+	QuerySeven *QueryResultStore[*schema.CompanyRank]
+	QueryEight *QueryResultStore[*schema.SentimentBucket]
+
+	// Comes with the results of Q4 and finishes with them
+	QueryFourLanguages *QueryResultStore[*schema.LanguageCount]
+	// Come with the results of Q3 to Q5 while the job runs, if it streams
+	Provisional *ProvisionalTops
+
+	doneMu     sync.Mutex
+	done       bool
+	onFinished func(common.JobID)
 }
 
-func NewResultStore(f common.JobID) (*ResultStore, error) {
-	qs1, err := NewQueryResultStore[*schema.SOCounter](f.String(), "query_one")
+func NewResultStore(tenant string, f common.JobID) (*ResultStore, error) {
+	qs1, err := NewQueryResultStore(tenant, f.String(), "query_one", schema.SOCounterDeserialize, schema.SOCounterBefore)
+	if err != nil {
+		return nil, err
+	}
+	qs2, err := NewQueryResultStore(tenant, f.String(), "query_two", schema.PlayedTimeDeserialize, schema.PlayedTimeBefore)
+	if err != nil {
+		return nil, err
+	}
+	qs3, err := NewQueryResultStore(tenant, f.String(), "query_three", schema.NamedReviewCounterDeserialize, schema.NamedReviewCounterBefore)
+	if err != nil {
+		return nil, err
+	}
+	qs4, err := NewQueryResultStore(tenant, f.String(), "query_four", schema.NamedReviewCounterDeserialize, schema.NamedReviewCounterBefore)
+	if err != nil {
+		return nil, err
+	}
+	qs4l, err := NewQueryResultStore(tenant, f.String(), "query_four_languages", schema.LanguageCountDeserialize, schema.LanguageCountBefore)
 	if err != nil {
 		return nil, err
 	}
-	qs2, err := NewQueryResultStore[*schema.PlayedTime](f.String(), "query_two")
+	qs5, err := NewQueryResultStore(tenant, f.String(), "query_five", schema.NamedReviewCounterDeserialize, schema.NamedReviewCounterBefore)
 	if err != nil {
 		return nil, err
 	}
-	qs3, err := NewQueryResultStore[*schema.NamedReviewCounter](f.String(), "query_three")
+	qs6, err := NewQueryResultStore(tenant, f.String(), "query_six", schema.PriceSummaryDeserialize, schema.PriceSummaryBefore)
 	if err != nil {
 		return nil, err
 	}
-	qs4, err := NewQueryResultStore[*schema.NamedReviewCounter](f.String(), "query_four")
+	qs7, err := NewQueryResultStore(tenant, f.String(), "query_seven", schema.CompanyRankDeserialize, schema.CompanyRankBefore)
 	if err != nil {
 		return nil, err
 	}
-	qs5, err := NewQueryResultStore[*schema.NamedReviewCounter](f.String(), "query_five")
+	qs8, err := NewQueryResultStore(tenant, f.String(), "query_eight", schema.SentimentBucketDeserialize, schema.SentimentBucketBefore)
 	if err != nil {
 		return nil, err
 	}
 
 	return &ResultStore{
 		jobID:      f,
+		Tenant:     tenant,
 		QueryOne:   qs1,
 		QueryTwo:   qs2,
 		QueryThree: qs3,
 		QueryFour:  qs4,
 		QueryFive:  qs5,
+		QuerySix:   qs6,
+		QuerySeven: qs7,
+		QueryEight: qs8,
+
+		QueryFourLanguages: qs4l,
+		Provisional:        NewProvisionalTops(),
 	}, nil
 }
+
+func (r *ResultStore) Finished() bool {
+	return r.QueryOne.Finished && r.QueryTwo.Finished && r.QueryThree.Finished && r.QueryFour.Finished && r.QueryFourLanguages.Finished && r.QueryFive.Finished && r.QuerySix.Finished && r.QuerySeven.Finished && r.QueryEight.Finished
+}
+
+// Called after a query finishes, the last one lets the server know the job is done
+func (r *ResultStore) Done() {
+	r.doneMu.Lock()
+	defer r.doneMu.Unlock()
+
+	if r.done || !r.Finished() {
+		return
+	}
+	r.done = true
+	log.Infof("Action: Store Results %s | Result: Finished | Tenant: %s", r.jobID, r.Tenant)
+	if r.onFinished != nil {
+		r.onFinished(r.jobID)
+	}
+}
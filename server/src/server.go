@@ -1,8 +1,11 @@
 package src
 
 import (
+	"crypto/tls"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"math"
 	"math/rand"
 	"middleware/common"
 	"middleware/rabbitmq"
@@ -11,6 +14,7 @@ import (
 	"os"
 	"os/signal"
 	"reflect"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -21,12 +25,40 @@ import (
 
 var log = logging.MustGetLogger("log")
 
+type ServerConfig struct {
+	Ip   string
+	Port int
+	// Comma separated list of the compression algorithms offered to the clients
+	Compression string
+	// Accept clients that don't start with a hello and speak the old text protocol
+	TextProtocol bool
+	// Zero disables the deadline
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// Zero keeps the default of the protocol
+	MaxFrameSize uint32
+	// Clients must send the token of one of the tenants before anything else
+	AuthRequired bool
+	Tenants      []Tenant
+	// Nil serves plain TCP
+	TLS          *tls.Config
+	Admission    AdmissionConfig
+	Backpressure rabbitmq.DepthConfig
+	// Clients receiving results at the same time, the rest wait by priority. Zero means no limit.
+	ResultStreams int
+}
+
+// How often the clients waiting in the admission queue hear about their position
+const queueNoticeInterval = 5 * time.Second
+
 type Server struct {
 	Address         string
 	Port            int
 	Listener        net.Listener
 	Term            chan os.Signal
+	Rescale         chan os.Signal
 	Clients         []*Client
+	clientsMu       sync.Mutex
 	arc             *rabbitmq.Architecture
 	rand            *rand.Rand
 	ExchangeGames   *rabbitmq.Exchange
@@ -34,15 +66,83 @@ type Server struct {
 	Results         *rabbitmq.Results
 	ResultStores    map[common.JobID]*ResultStore
 	storeMu         sync.Mutex
+	compression     []common.Compression
+	projections     map[string]*schema.Projection
+	textProtocol    bool
+	readTimeout     time.Duration
+	writeTimeout    time.Duration
+	auth            *Authenticator
+	tls             *tls.Config
+	admission       *Admission
+	admissionConfig AdmissionConfig
+	streams         *Admission
+	// Nil when the depth of the queues isn't watched
+	backpressure *rabbitmq.DepthMonitor
+	// Tenant of every job, guarded by storeMu
+	owners     map[common.JobID]string
+	topologies *Topologies
 }
 
-func NewServer(ip string, port int) *Server {
-	arc := rabbitmq.CreateArchitecture(common.LoadArchitectureConfig("./architecture.yaml"))
+func NewServer(config ServerConfig) *Server {
+	arcCfg := common.LoadArchitectureConfig("./architecture.yaml")
+	arc := rabbitmq.CreateArchitecture(arcCfg)
+
+	compression := make([]common.Compression, 0)
+	for _, name := range strings.Split(config.Compression, ",") {
+		c, err := common.CompressionFromName(name)
+		if err != nil {
+			log.Fatalf("Invalid compression configuration: %s", err)
+		}
+		if c != common.Compression_None {
+			compression = append(compression, c)
+		}
+	}
+
+	projections := make(map[string]*schema.Projection)
+	for channel, columns := range schema.GameProjections {
+		p, err := schema.NewProjection[schema.Game](columns)
+		if err != nil {
+			log.Fatalf("Invalid projection for %s: %s", channel, err)
+		}
+		projections[channel] = p
+	}
+	for channel, columns := range schema.ReviewProjections {
+		p, err := schema.NewProjection[schema.Review](columns)
+		if err != nil {
+			log.Fatalf("Invalid projection for %s: %s", channel, err)
+		}
+		projections[channel] = p
+	}
+
+	var auth *Authenticator
+	if config.AuthRequired {
+		a, err := NewAuthenticator(config.Tenants)
+		if err != nil {
+			log.Fatalf("Invalid tenants configuration: %s", err)
+		}
+		auth = a
+	}
+
+	backpressure, err := arc.NewDepthMonitor(arc.MapFilterQueues(), config.Backpressure)
+	if err != nil {
+		log.Fatalf("Can't watch the depth of the queues: %s", err)
+	}
+
+	owners, err := loadJobOwners()
+	if err != nil {
+		log.Fatalf("Can't load the owners of the jobs: %s", err)
+	}
+
+	topologies, err := NewTopologies(common.TopologyFromConfig(arcCfg))
+	if err != nil {
+		log.Fatalf("Can't load the topologies of the jobs: %s", err)
+	}
 
 	server := &Server{
-		Address:         fmt.Sprintf("%s:%d", ip, port),
-		Port:            port,
+		Address:         fmt.Sprintf("%s:%d", config.Ip, config.Port),
+		Port:            config.Port,
 		Term:            make(chan os.Signal, 1),
+		Rescale:         make(chan os.Signal, 1),
 		Clients:         []*Client{},
 		arc:             arc,
 		rand:            rand.New(rand.NewSource(time.Now().UnixNano())),
@@ -51,32 +151,61 @@ func NewServer(ip string, port int) *Server {
 		Results:         arc.Results,
 		ResultStores:    make(map[uuid.UUID]*ResultStore),
 		storeMu:         sync.Mutex{},
+		compression:     compression,
+		projections:     projections,
+		textProtocol:    config.TextProtocol,
+		readTimeout:     config.ReadTimeout,
+		writeTimeout:    config.WriteTimeout,
+		auth:            auth,
+		tls:             config.TLS,
+		admission:       NewAdmission(config.Admission.MaxActiveJobs, config.Admission.MaxQueuedJobs),
+		admissionConfig: config.Admission,
+		streams:         NewAdmission(config.ResultStreams, math.MaxInt),
+		backpressure:    backpressure,
+		owners:          owners,
+		topologies:      topologies,
+	}
+
+	if config.MaxFrameSize > 0 {
+		common.MaxFrameSize = config.MaxFrameSize
 	}
 
 	signal.Notify(server.Term, syscall.SIGTERM)
+	signal.Notify(server.Rescale, syscall.SIGHUP)
 
 	return server
 }
 
 func (s *Server) Start() error {
 	go s.HandleShutdown()
+	go s.HandleRescale()
 
 	var err error
-	s.Listener, err = net.Listen("tcp", s.Address)
+	s.Listener, err = common.Listen(s.Address, s.tls)
 	common.FailOnError(err, "Failed to start server")
 	defer s.Listener.Close()
 
-	log.Infof("Server listening on %s", s.Address)
+	log.Infof("Server listening on %s | TLS: %t", s.Address, s.tls != nil)
 
 	s.ConsumeResults()
+	if s.backpressure != nil {
+		go s.backpressure.Run()
+	}
 	for {
 		conn, err := s.Listener.Accept()
 		if err != nil {
 			log.Errorf("Action: Accept connection | Result: Error | Error: %s", err)
 			break
 		}
-		client := NewClient(conn)
+		client := NewClient(conn, s.readTimeout, s.writeTimeout)
+		if s.auth == nil {
+			client.Tenant = AnonymousTenant
+		}
+		client.rows = common.NewRateLimiter(s.admissionConfig.RowsPerSecond, 0)
+		client.bytes = common.NewRateLimiter(s.admissionConfig.BytesPerSecond, 0)
+		s.clientsMu.Lock()
 		s.Clients = append(s.Clients, client)
+		s.clientsMu.Unlock()
 
 		go s.HandleConnection(client)
 	}
@@ -86,6 +215,15 @@ func (s *Server) Start() error {
 
 func (s *Server) HandleConnection(client *Client) {
 	defer client.Close()
+	defer s.RemoveClient(client)
+	// The slot is released once both files are sent, this is for the clients that leave before
+	defer s.admission.Release(client.Id)
+	defer func() {
+		// Whatever the client sent, it only takes down its own connection
+		if r := recover(); r != nil {
+			log.Criticalf("Action: Handle Client %s | Result: Panic | Error: %v", client.Id, r)
+		}
+	}()
 
 	log.Infof("Client connected: %s", client.Id)
 
@@ -98,48 +236,128 @@ func (s *Server) HandleConnection(client *Client) {
 	}
 	gamec := 1
 	reviewc := 1
+	gamesSent, reviewsSent := false, false
+	first := true
 	for {
-		message, err := client.Recv()
+		frame, err := client.RecvFrame()
 
 		if err != nil {
 			log.Errorf("Action: Receive Message from Client | Result: Error | Error: %s", err)
 			break
 		}
 
-		messageDeserialized, err := common.DeserializeClientMessage(message)
-
-		common.FailOnError(err, "Failed to deserialize message") // UNREACHABLE
-
-		switch messageDeserialized.Type {
-		case common.Type_GAMES:
-			s.Broadcast(client, messageDeserialized, &common.IdempotencyID{Origin: "SV", Sequence: uint32(gamec)})
-			gamec++
+		if first {
+			first = false
+			if common.IsBinaryFrame(frame) {
+				if err := s.Hello(client, frame); err != nil {
+					break
+				}
+				continue
+			}
+			if !s.textProtocol {
+				log.Errorf("Action: Receive Message from Client %s | Result: Error | Error: text protocol is disabled", client.Id)
+				client.SendError(errors.New("the text protocol is disabled, start with a hello"))
+				break
+			}
+		}
 
-		case common.Type_REVIEWS:
-			s.Broadcast(client, messageDeserialized, &common.IdempotencyID{Origin: "SV", Sequence: uint32(reviewc)})
-			reviewc++
+		messages, err := client.codec.Decode(frame)
 
-		case common.Type_AskForResults:
-			log.Debugf("message is Type_AskForResults")
-			s.SendResults(client, messageDeserialized)
+		if err != nil {
+			log.Errorf("Action: Decode Message from Client %s | Result: Error | Error: %s", client.Id, err)
+			client.SendError(err)
+			continue
+		}
 
-		case common.Type_CloseConnection:
-			log.Infof("Action: Received Close Connection for Client | Result: Closing_Connection")
-			s.RemoveClient(client)
-			return
-		case common.Type_HCK:
-			s.SendAlive(client)
+		for _, messageDeserialized := range messages {
+			// Health checks are the only thing we answer to strangers
+			if client.Tenant == "" && messageDeserialized.Type != common.Type_Auth && messageDeserialized.Type != common.Type_HCK {
+				log.Errorf("Action: Handle Message from Client %s | Result: Error | Error: not authenticated", client.Id)
+				client.SendError(errors.New("authentication required"))
+				return
+			}
 
-		default:
-			log.Error("Received an UNKNOWN Type message --> no broadcast")
+			switch messageDeserialized.Type {
+			case common.Type_Auth:
+				if err := s.Authenticate(client, messageDeserialized); err != nil {
+					return
+				}
+
+			case common.Type_Admit:
+				priority, err := common.ParsePriority(messageDeserialized.Content)
+				if err != nil {
+					log.Errorf("Action: Admit Job %s | Result: Error | Error: %s", client.Id, err)
+					client.SendError(err)
+					return
+				}
+				client.Priority = priority
+				if err := s.Admit(client, true); err != nil {
+					return
+				}
+
+			case common.Type_Options:
+				if err := s.SetOptions(client, messageDeserialized); err != nil {
+					return
+				}
+
+			case common.Type_GAMES:
+				if err := s.ClaimJob(client); err != nil {
+					return
+				}
+				s.Throttle(client, messageDeserialized)
+				s.WaitForQueues(client)
+				s.Broadcast(client, messageDeserialized, &common.IdempotencyID{Origin: "SV", Sequence: uint32(gamec)})
+				gamec++
+				if messageDeserialized.IsEOF() && !gamesSent {
+					gamesSent = true
+					s.IngestDone(client, reviewsSent)
+				}
+
+			case common.Type_REVIEWS:
+				if err := s.ClaimJob(client); err != nil {
+					return
+				}
+				s.Throttle(client, messageDeserialized)
+				s.WaitForQueues(client)
+				s.Broadcast(client, messageDeserialized, &common.IdempotencyID{Origin: "SV", Sequence: uint32(reviewc)})
+				reviewc++
+				if messageDeserialized.IsEOF() && !reviewsSent {
+					reviewsSent = true
+					s.IngestDone(client, gamesSent)
+				}
+
+			case common.Type_AskForResults:
+				log.Debugf("message is Type_AskForResults")
+				s.SendResults(client, messageDeserialized)
+
+			case common.Type_CloseConnection:
+				log.Infof("Action: Received Close Connection for Client | Result: Closing_Connection")
+				s.RemoveClient(client)
+				return
+			case common.Type_HCK:
+				s.SendAlive(client)
+
+			case common.Type_NegotiateCompression:
+				s.NegotiateCompression(client, messageDeserialized)
+
+			default:
+				log.Errorf("Action: Handle Message from Client %s | Result: Error | Error: unexpected message type %d", client.Id, messageDeserialized.Type)
+				client.SendError(fmt.Errorf("unexpected message type %d", messageDeserialized.Type))
+			}
 		}
 	}
 }
 
-func (s *Server) Broadcast(client *Client, message common.ClientMessage, idemId *common.IdempotencyID) {
-
-	ser := common.NewSerializer()
+// Once both files are sent the job only waits for its results, its slot goes to the next one
+func (s *Server) IngestDone(client *Client, otherSent bool) {
+	if !otherSent {
+		return
+	}
+	s.admission.Release(client.Id)
+	log.Infof("Action: Release Admission %s | Result: Success | Tenant: %s", client.Id, client.Tenant)
+}
 
+func (s *Server) Broadcast(client *Client, message common.ClientMessage, idemId *common.IdempotencyID) {
 	if message.IsEOF() {
 		var eoftt uint32 = 0
 		if message.Type == common.Type_REVIEWS {
@@ -152,13 +370,34 @@ func (s *Server) Broadcast(client *Client, message common.ClientMessage, idemId
 
 		content := make([]byte, 4)
 		binary.BigEndian.PutUint32(content, eoftt)
-		s.BroadcastData(message.Type, common.NewMessage(client.Id, idemId, common.ProtocolMessage_Control, content), true)
+		eof := common.NewMessage(client.Id, idemId, common.ProtocolMessage_Control, content)
+		s.BroadcastData(message.Type, func(string) common.Serializable { return eof }, true, client.Priority, client.Topology, client.Options)
 	} else {
-		s.BroadcastData(message.Type, common.NewMessage(client.Id, idemId, common.ProtocolMessage_Data, ser.WriteUint8(uint8(message.Type)).WriteString(message.Content).ToBytes()), false)
+		s.BroadcastData(message.Type, func(channel string) common.Serializable {
+			record := s.Project(channel, message.Content)
+			ser := common.NewSerializer()
+			return common.NewMessage(client.Id, idemId, common.ProtocolMessage_Data, ser.WriteUint8(uint8(message.Type)).WriteString(record).ToBytes())
+		}, false, client.Priority, client.Topology, client.Options)
+	}
+}
+
+// Removes the columns the channel doesn't read from the raw record
+func (s *Server) Project(channel string, record string) string {
+	p, ok := s.projections[channel]
+	if !ok {
+		return record
+	}
+	projected, err := p.Project(record)
+	if err != nil {
+		// Let the map filter deal with the malformed record as it always did
+		log.Warningf("Action: Project Record for %s | Result: Error | Error: %s", channel, err)
+		return record
 	}
+	return projected
 }
 
-func (s *Server) BroadcastData(exType int, ser common.Serializable, fanout bool) {
+// The topology travels with every message, so all the stages route the job the same way
+func (s *Server) BroadcastData(exType int, build func(channel string) common.Serializable, fanout bool, priority uint8, topology common.Topology, options common.JobOptions) {
 	var partitionedExchange *rabbitmq.PartitionedExchange
 
 	switch exType {
@@ -171,24 +410,34 @@ func (s *Server) BroadcastData(exType int, ser common.Serializable, fanout bool)
 		return
 	}
 
+	headers := rabbitmq.WithOptions(rabbitmq.TopologyHeaders(topology), options)
 	ex := partitionedExchange.GetExchange()
 	for _, key := range partitionedExchange.GetChannels() {
 		cl := partitionedExchange.GetChannelSize(key)
+		ser := build(key)
 		if fanout {
 			for i := 1; i <= cl; i++ {
-				ex.Publish(fmt.Sprintf("%s_%d", key, i), ser)
+				ex.PublishWithHeaders(fmt.Sprintf("%s_%d", key, i), ser, priority, headers)
 			}
 		} else {
-			ex.Publish(fmt.Sprintf("%s_%d", key, s.rand.Intn(cl)+1), ser)
+			ex.PublishWithHeaders(fmt.Sprintf("%s_%d", key, s.rand.Intn(cl)+1), ser, priority, headers)
 		}
 	}
 }
 
 func (s *Server) SendResults(client *Client, message common.ClientMessage) {
-	log.Debugf("Sending results to client: %s", client.Id)
+	log.Debugf("Sending results to client: %s | Tenant: %s", client.Id, client.Tenant)
 	jobId, err := uuid.Parse(message.Content)
 	if err != nil {
-		log.Errorf("Invalid JobID: %s", jobId)
+		log.Errorf("Invalid JobID: %s", message.Content)
+		client.SendError(errors.New("invalid job id"))
+		return
+	}
+
+	if owner, ok := s.JobOwner(jobId); !ok || owner != client.Tenant {
+		log.Warningf("Action: Ask For Results %s | Result: Denied | Tenant: %s | Client: %s", jobId, client.Tenant, client.Id)
+		// Same answer for missing and foreign jobs, so nobody learns which ones exist
+		client.SendError(errors.New("job not found"))
 		return
 	}
 
@@ -199,19 +448,42 @@ func (s *Server) SendResults(client *Client, message common.ClientMessage) {
 		return
 	}
 
+	// Waiting for the pipeline doesn't hold a slot, only streaming does. The provisional tops
+	// of the job go out as they come in the meantime.
+	sent := make(map[string]*schema.ProvisionalTop)
+	provisional := true
+	for !store.Finished() {
+		if provisional {
+			if err := client.SendProvisional(store, sent); err != nil {
+				log.Errorf("Action: Send Provisional Top %s | Result: Error | Error: %s", jobId, err)
+				provisional = false
+			}
+		}
+		time.Sleep(1 * time.Second)
+	}
+	// Usually released when the last results came in, not when they were stored before a restart
+	s.topologies.Release(jobId)
+	streaming, _ := s.streams.Request(jobId, client.Priority)
+	<-streaming
+	defer s.streams.Release(jobId)
+
 	var wg sync.WaitGroup
-	wg.Add(5)
+	wg.Add(9)
 
 	log.Debug("About to send Results for query")
 	go client.SendResultsQ1(store.QueryOne, &wg)
 	go client.SendResultsQ2(store.QueryTwo, &wg)
 	go client.SendResultsQ3(store.QueryThree, &wg)
 	go client.SendResultsQ4(store.QueryFour, &wg)
+	go client.SendResultsQ4Languages(store.QueryFourLanguages, &wg)
 	go client.SendResultsQ5(store.QueryFive, &wg)
+	go client.SendResultsQ6(store.QuerySix, &wg)
+	go client.SendResultsQ7(store.QuerySeven, &wg)
+	go client.SendResultsQ8(store.QueryEight, &wg)
 
 	wg.Wait()
 
-	log.Debugf("Finished sending results to client: %s", client.Id)
+	log.Debugf("Finished sending results to client: %s | Tenant: %s", client.Id, client.Tenant)
 
 	client.SendEndWithResults()
 }
@@ -220,21 +492,231 @@ func (s *Server) SendAlive(client *Client) {
 	client.SendAlive()
 }
 
+func (s *Server) Authenticate(client *Client, message common.ClientMessage) error {
+	if s.auth == nil {
+		// Nothing to check, answer as if it went well so clients with a token still work
+		return client.SendMessage(common.ClientMessage{Content: client.Tenant, Type: common.Type_Auth})
+	}
+
+	tenant, ok := s.auth.Authenticate(message.Content)
+	if !ok {
+		log.Warningf("Action: Authenticate %s | Result: Denied", client.Id)
+		client.SendError(errors.New("invalid token"))
+		return errors.New("invalid token")
+	}
+
+	client.Tenant = tenant
+	log.Infof("Action: Authenticate %s | Result: Success | Tenant: %s", client.Id, tenant)
+	return client.SendMessage(common.ClientMessage{Content: tenant, Type: common.Type_Auth})
+}
+
+// The options go with every record of the job, so they can't change once it started
+func (s *Server) SetOptions(client *Client, message common.ClientMessage) error {
+	if client.jobClaimed {
+		log.Errorf("Action: Set Job Options %s | Result: Error | Error: the job already started", client.Id)
+		client.SendError(errors.New("the job options must come before its records"))
+		return errors.New("the job already started")
+	}
+
+	options, err := common.ParseJobOptions(message.Content)
+	if err != nil {
+		log.Errorf("Action: Set Job Options %s | Result: Error | Error: %s", client.Id, err)
+		client.SendError(err)
+		return err
+	}
+
+	client.Options = options
+	log.Infof("Action: Set Job Options %s | Result: Success | Tenant: %s | Options: %s", client.Id, client.Tenant, options)
+	return nil
+}
+
+// The job of a client belongs to its tenant from the first record it sends
+func (s *Server) ClaimJob(client *Client) error {
+	if client.jobClaimed {
+		return nil
+	}
+
+	// Clients that start sending without asking for admission wait for their turn all the same
+	if err := s.Admit(client, false); err != nil {
+		return err
+	}
+
+	s.storeMu.Lock()
+	if owner, ok := s.owners[client.Id]; ok && owner != client.Tenant {
+		s.storeMu.Unlock()
+		log.Criticalf("Action: Claim Job %s | Result: Error | Tenant: %s | Owner: %s", client.Id, client.Tenant, owner)
+		client.SendError(errors.New("job owned by another tenant"))
+		return errors.New("job owned by another tenant")
+	}
+	s.owners[client.Id] = client.Tenant
+	s.storeMu.Unlock()
+
+	// Creating the store leaves the owner on disk, in the path of the results
+	if _, err := s.GetDataStore(client.Id); err != nil {
+		log.Errorf("Action: Claim Job %s | Result: Error | Tenant: %s | Error: %s", client.Id, client.Tenant, err)
+		client.SendError(errors.New("can't create the job"))
+		return err
+	}
+	topology, err := s.topologies.Assign(client.Id)
+	if err != nil {
+		log.Errorf("Action: Claim Job %s | Result: Error | Tenant: %s | Error: %s", client.Id, client.Tenant, err)
+		client.SendError(errors.New("can't create the job"))
+		return err
+	}
+	client.Topology = topology
+	client.jobClaimed = true
+	log.Infof("Action: Claim Job %s | Result: Success | Tenant: %s | Topology: %s", client.Id, client.Tenant, topology)
+	return nil
+}
+
+// Waits for a slot for the job of the client. Clients that asked for it hear about their
+// place in the queue, the rest are just held until their turn.
+func (s *Server) Admit(client *Client, explicit bool) error {
+	admitted, err := s.admission.Request(client.Id, client.Priority)
+	if err != nil {
+		active, queued := s.admission.Stats()
+		log.Warningf("Action: Admit Job %s | Result: Busy | Tenant: %s | Active: %d | Queued: %d", client.Id, client.Tenant, active, queued)
+		client.SendMessage(common.ClientMessage{Content: common.BusyContent(0, s.admissionConfig.RetryAfter), Type: common.Type_Busy})
+		return err
+	}
+
+	select {
+	case <-admitted:
+		return s.admitted(client, explicit)
+	default:
+	}
+
+	// A client that hangs up while it waits gives its place to the next one
+	stop := make(chan struct{})
+	gone, watched := client.watchHangUp(stop)
+	defer func() {
+		// Cuts its last look short, RecvFrame only sets a deadline when it has a timeout
+		close(stop)
+		client.Connection.SetReadDeadline(time.Now())
+		<-watched
+		client.Connection.SetReadDeadline(time.Time{})
+	}()
+
+	for {
+		// Zero when it was admitted since we checked, the wait below ends right away
+		if position := s.admission.Position(client.Id); position > 0 {
+			log.Infof("Action: Admit Job %s | Result: Queued | Tenant: %s | Priority: %d | Position: %d", client.Id, client.Tenant, client.Priority, position)
+			if explicit {
+				if err := client.SendMessage(common.ClientMessage{Content: common.BusyContent(position, s.admissionConfig.RetryAfter), Type: common.Type_Busy}); err != nil {
+					log.Errorf("Action: Admit Job %s | Result: Error | Error: %s", client.Id, err)
+					return err
+				}
+			}
+		}
+
+		select {
+		case <-admitted:
+			return s.admitted(client, explicit)
+		case <-gone:
+			log.Warningf("Action: Admit Job %s | Result: Client Gone | Tenant: %s", client.Id, client.Tenant)
+			s.admission.Release(client.Id)
+			return errors.New("the client hung up while queued")
+		case <-time.After(queueNoticeInterval):
+		}
+	}
+}
+
+func (s *Server) admitted(client *Client, explicit bool) error {
+	if !client.admitted {
+		client.admitted = true
+		log.Infof("Action: Admit Job %s | Result: Success | Tenant: %s | Priority: %d", client.Id, client.Tenant, client.Priority)
+	}
+	if explicit {
+		return client.SendMessage(common.ClientMessage{Content: client.Id.String(), Type: common.Type_Admit})
+	}
+	return nil
+}
+
+// Holds the reading of the client until its ingest rate is back under the limits, the
+// socket buffers fill up and the client slows down with it
+func (s *Server) Throttle(client *Client, message common.ClientMessage) {
+	rows := client.rows.Reserve(float64(strings.Count(message.Content, "\n") + 1))
+	bytes := client.bytes.Reserve(float64(len(message.Content)))
+	if wait := max(rows, bytes); wait > 0 {
+		log.Debugf("Action: Throttle Client %s | Tenant: %s | Wait: %s", client.Id, client.Tenant, wait)
+		time.Sleep(wait)
+	}
+}
+
+// Stops reading from the client while the map filter queues are too deep, so the broker
+// doesn't buffer what the workers can't keep up with
+func (s *Server) WaitForQueues(client *Client) {
+	if !s.backpressure.Paused() {
+		return
+	}
+	start := time.Now()
+	s.backpressure.Wait()
+	log.Debugf("Action: Backpressure Client %s | Tenant: %s | Wait: %s", client.Id, client.Tenant, time.Since(start))
+}
+
+func (s *Server) JobOwner(j common.JobID) (string, bool) {
+	s.storeMu.Lock()
+	defer s.storeMu.Unlock()
+	owner, ok := s.owners[j]
+	return owner, ok
+}
+
+// Switches the client to the binary protocol version agreed in the hello
+func (s *Server) Hello(client *Client, frame []byte) error {
+	codec, err := common.ServerHandshake(client.Connection, frame)
+	if err != nil {
+		log.Errorf("Action: Hello %s | Result: Error | Error: %s", client.Id, err)
+		return err
+	}
+	client.codec = codec
+	log.Infof("Action: Hello %s | Result: Success | Version: %d", client.Id, codec.Version())
+	return nil
+}
+
+func (s *Server) NegotiateCompression(client *Client, message common.ClientMessage) {
+	chosen := common.ChooseCompression(message.Content, s.compression)
+	log.Infof("Action: Negotiate Compression %s | Offered: %s | Chosen: %s", client.Id, message.Content, common.CompressionName(chosen))
+	// The answer itself always goes uncompressed
+	if err := client.SendCompression(chosen); err != nil {
+		log.Errorf("Action: Negotiate Compression %s | Result: Error | Error: %s", client.Id, err)
+	}
+}
+
 func (s *Server) GetDataStore(j common.JobID) (*ResultStore, error) {
 	s.storeMu.Lock()
 	defer s.storeMu.Unlock()
 	store, ok := s.ResultStores[j]
 	if !ok {
-		store, err := NewResultStore(j)
+		tenant, owned := s.owners[j]
+		if !owned {
+			// Results of a job nobody claimed, only visible without authentication
+			log.Warningf("Action: Get Result Store %s | Result: Unknown Owner | Tenant: %s", j, AnonymousTenant)
+			tenant = AnonymousTenant
+			s.owners[j] = tenant
+		}
+		store, err := NewResultStore(tenant, j)
 		if err != nil {
 			return nil, err
 		}
+		// The pipeline is done with the job once every result is in, even if nobody asks for them
+		store.onFinished = s.topologies.Release
 		s.ResultStores[j] = store
 		return store, nil
 	}
 	return store, nil
 }
 
+// Reloads the architecture on SIGHUP. Only the stage two partitions change and only for
+// the jobs claimed after it, the queues of new partitions are declared before any of them
+// can be routed there.
+func (s *Server) HandleRescale() {
+	for range s.Rescale {
+		topology := common.TopologyFromConfig(common.LoadArchitectureConfig("./architecture.yaml"))
+		s.arc.Rescale(topology)
+		s.topologies.Rescale(topology)
+	}
+}
+
 func (s *Server) HandleShutdown() {
 	<-s.Term
 	log.Criticalf("Received SIGTERM")
@@ -243,6 +725,8 @@ func (s *Server) HandleShutdown() {
 		s.Listener.Close()
 	}
 
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
 	for _, client := range s.Clients {
 		client.Close()
 		log.Infof("Closed connection for client: %s", client.Id)
@@ -255,6 +739,9 @@ func (s *Server) ConsumeResults() {
 	go s.ConsumeResultsQ3()
 	go s.ConsumeResultsQ4()
 	go s.ConsumeResultsQ5()
+	go s.ConsumeResultsQ6()
+	go s.ConsumeResultsQ7()
+	go s.ConsumeResultsQ8()
 }
 
 func (s *Server) ConsumeResultsQ1() {
@@ -275,8 +762,13 @@ func (s *Server) ConsumeResultsQ1() {
 			continue
 		}
 		if m.IsEOF() {
-			log.Infof("Action: Received EOF %s - %s. IdemID: %s", m.JobID(), q.ExternalName, m.IdempotencyID)
-			s.QueryOne.Finished = true
+			log.Infof("Action: Received EOF %s - %s. IdemID: %s | Tenant: %s", m.JobID(), q.ExternalName, m.IdempotencyID, s.Tenant)
+			if err := s.QueryOne.Finish(); err != nil {
+				log.Errorf("Action: Write Results %s - %s | Result: Error | Error: %s", m.JobID(), q.ExternalName, err)
+				delivery.Nack(false, true)
+				continue
+			}
+			s.Done()
 			delivery.Ack(false)
 			continue
 		}
@@ -295,7 +787,11 @@ func (s *Server) ConsumeResultsQ1() {
 			continue
 		}
 
-		s.QueryOne.AddResult(msg.(*schema.SOCounter), m.IdempotencyID)
+		if err := s.QueryOne.AddResult(msg.(*schema.SOCounter), m.IdempotencyID); err != nil {
+			log.Errorf("Action: Save Result %s - %s | Result: Error | Error: %s", m.JobID(), q.ExternalName, err)
+			delivery.Nack(false, true)
+			continue
+		}
 		delivery.Ack(false)
 	}
 }
@@ -318,8 +814,13 @@ func (s *Server) ConsumeResultsQ2() {
 			continue
 		}
 		if m.IsEOF() {
-			log.Infof("Action: Received EOF %s - %s", m.JobID(), q.ExternalName)
-			s.QueryTwo.Finished = true
+			log.Infof("Action: Received EOF %s - %s | Tenant: %s", m.JobID(), q.ExternalName, s.Tenant)
+			if err := s.QueryTwo.Finish(); err != nil {
+				log.Errorf("Action: Write Results %s - %s | Result: Error | Error: %s", m.JobID(), q.ExternalName, err)
+				delivery.Nack(false, true)
+				continue
+			}
+			s.Done()
 			delivery.Ack(false)
 			continue
 		}
@@ -338,7 +839,11 @@ func (s *Server) ConsumeResultsQ2() {
 			continue
 		}
 
-		s.QueryTwo.AddResult(msg.(*schema.PlayedTime), m.IdempotencyID)
+		if err := s.QueryTwo.AddResult(msg.(*schema.PlayedTime), m.IdempotencyID); err != nil {
+			log.Errorf("Action: Save Result %s - %s | Result: Error | Error: %s", m.JobID(), q.ExternalName, err)
+			delivery.Nack(false, true)
+			continue
+		}
 		delivery.Ack(false)
 	}
 }
@@ -361,8 +866,13 @@ func (s *Server) ConsumeResultsQ3() {
 			continue
 		}
 		if m.IsEOF() {
-			log.Infof("Action: Received EOF %s - %s", m.JobID(), q.ExternalName)
-			s.QueryThree.Finished = true
+			log.Infof("Action: Received EOF %s - %s | Tenant: %s", m.JobID(), q.ExternalName, s.Tenant)
+			if err := s.QueryThree.Finish(); err != nil {
+				log.Errorf("Action: Write Results %s - %s | Result: Error | Error: %s", m.JobID(), q.ExternalName, err)
+				delivery.Nack(false, true)
+				continue
+			}
+			s.Done()
 			delivery.Ack(false)
 			continue
 		}
@@ -375,13 +885,24 @@ func (s *Server) ConsumeResultsQ3() {
 			continue
 		}
 
+		// Replaces the one before, it isn't saved with the results
+		if t, ok := msg.(*schema.ProvisionalTop); ok {
+			s.Provisional.Set(t)
+			delivery.Ack(false)
+			continue
+		}
+
 		if reflect.TypeOf(msg) != reflect.TypeOf(&schema.NamedReviewCounter{}) {
 			log.Errorf("Action: Demarshal Result %s - %s | Result: Error | Error: Unknown Message Type %s", m.JobID(), q.ExternalName, reflect.TypeOf(msg))
 			delivery.Nack(false, true)
 			continue
 		}
 
-		s.QueryThree.AddResult(msg.(*schema.NamedReviewCounter), m.IdempotencyID)
+		if err := s.QueryThree.AddResult(msg.(*schema.NamedReviewCounter), m.IdempotencyID); err != nil {
+			log.Errorf("Action: Save Result %s - %s | Result: Error | Error: %s", m.JobID(), q.ExternalName, err)
+			delivery.Nack(false, true)
+			continue
+		}
 		delivery.Ack(false)
 	}
 }
@@ -404,8 +925,18 @@ func (s *Server) ConsumeResultsQ4() {
 			continue
 		}
 		if m.IsEOF() {
-			log.Infof("Action: Received EOF %s - %s", m.JobID(), q.ExternalName)
-			s.QueryFour.Finished = true
+			log.Infof("Action: Received EOF %s - %s | Tenant: %s", m.JobID(), q.ExternalName, s.Tenant)
+			if err := s.QueryFourLanguages.Finish(); err != nil {
+				log.Errorf("Action: Write Results %s - %s | Result: Error | Error: %s", m.JobID(), q.ExternalName, err)
+				delivery.Nack(false, true)
+				continue
+			}
+			if err := s.QueryFour.Finish(); err != nil {
+				log.Errorf("Action: Write Results %s - %s | Result: Error | Error: %s", m.JobID(), q.ExternalName, err)
+				delivery.Nack(false, true)
+				continue
+			}
+			s.Done()
 			delivery.Ack(false)
 			continue
 		}
@@ -418,13 +949,35 @@ func (s *Server) ConsumeResultsQ4() {
 			continue
 		}
 
+		// The language breakdown of the job comes in the same queue
+		if c, ok := msg.(*schema.LanguageCount); ok {
+			if err := s.QueryFourLanguages.AddResult(c, m.IdempotencyID); err != nil {
+				log.Errorf("Action: Save Result %s - %s | Result: Error | Error: %s", m.JobID(), q.ExternalName, err)
+				delivery.Nack(false, true)
+				continue
+			}
+			delivery.Ack(false)
+			continue
+		}
+
+		// Replaces the one before, it isn't saved with the results
+		if t, ok := msg.(*schema.ProvisionalTop); ok {
+			s.Provisional.Set(t)
+			delivery.Ack(false)
+			continue
+		}
+
 		if reflect.TypeOf(msg) != reflect.TypeOf(&schema.NamedReviewCounter{}) {
 			log.Errorf("Action: Demarshal Result %s - %s | Result: Error | Error: Unknown Message Type %s", m.JobID(), q.ExternalName, reflect.TypeOf(msg))
 			delivery.Nack(false, true)
 			continue
 		}
 
-		s.QueryFour.AddResult(msg.(*schema.NamedReviewCounter), m.IdempotencyID)
+		if err := s.QueryFour.AddResult(msg.(*schema.NamedReviewCounter), m.IdempotencyID); err != nil {
+			log.Errorf("Action: Save Result %s - %s | Result: Error | Error: %s", m.JobID(), q.ExternalName, err)
+			delivery.Nack(false, true)
+			continue
+		}
 		delivery.Ack(false)
 	}
 }
@@ -447,8 +1000,13 @@ func (s *Server) ConsumeResultsQ5() {
 			continue
 		}
 		if m.IsEOF() {
-			log.Infof("Action: Received EOF %s - %s", m.JobID(), q.ExternalName)
-			s.QueryFive.Finished = true
+			log.Infof("Action: Received EOF %s - %s | Tenant: %s", m.JobID(), q.ExternalName, s.Tenant)
+			if err := s.QueryFive.Finish(); err != nil {
+				log.Errorf("Action: Write Results %s - %s | Result: Error | Error: %s", m.JobID(), q.ExternalName, err)
+				delivery.Nack(false, true)
+				continue
+			}
+			s.Done()
 			delivery.Ack(false)
 			continue
 		}
@@ -461,18 +1019,187 @@ func (s *Server) ConsumeResultsQ5() {
 			continue
 		}
 
+		// Replaces the one before, it isn't saved with the results
+		if t, ok := msg.(*schema.ProvisionalTop); ok {
+			s.Provisional.Set(t)
+			delivery.Ack(false)
+			continue
+		}
+
 		if reflect.TypeOf(msg) != reflect.TypeOf(&schema.NamedReviewCounter{}) {
 			log.Errorf("Action: Demarshal Result %s - %s | Result: Error | Error: Unknown Message Type %s", m.JobID(), q.ExternalName, reflect.TypeOf(msg))
 			delivery.Nack(false, true)
 			continue
 		}
 
-		s.QueryFive.AddResult(msg.(*schema.NamedReviewCounter), m.IdempotencyID)
+		if err := s.QueryFive.AddResult(msg.(*schema.NamedReviewCounter), m.IdempotencyID); err != nil {
+			log.Errorf("Action: Save Result %s - %s | Result: Error | Error: %s", m.JobID(), q.ExternalName, err)
+			delivery.Nack(false, true)
+			continue
+		}
+		delivery.Ack(false)
+	}
+}
+
+func (s *Server) ConsumeResultsQ6() {
+	q := s.Results.QuerySix.GetQueueSingle(1)
+	chq := q.Consume()
+
+	for delivery := range chq {
+		m, err := common.MessageFromBytes(delivery.Body)
+		if err != nil {
+			log.Errorf("Action: Deserialize %s | Result: Error | Error: %s", q.ExternalName, err)
+			delivery.Nack(false, true)
+			continue
+		}
+		s, err := s.GetDataStore(m.JobID())
+		if err != nil {
+			log.Errorf("Action: Get Result Store %s - %s | Result: Error | Error: %s", m.JobID(), q.ExternalName, err)
+			delivery.Nack(false, true)
+			continue
+		}
+		if m.IsEOF() {
+			log.Infof("Action: Received EOF %s - %s | Tenant: %s", m.JobID(), q.ExternalName, s.Tenant)
+			if err := s.QuerySix.Finish(); err != nil {
+				log.Errorf("Action: Write Results %s - %s | Result: Error | Error: %s", m.JobID(), q.ExternalName, err)
+				delivery.Nack(false, true)
+				continue
+			}
+			s.Done()
+			delivery.Ack(false)
+			continue
+		}
+
+		msg, err := schema.UnmarshalMessage(m.Content)
+
+		if err != nil {
+			log.Errorf("Action: Demarshal Result %s - %s | Result: Error | Error: %s", m.JobID(), q.ExternalName, err)
+			delivery.Nack(false, true)
+			continue
+		}
+
+		if reflect.TypeOf(msg) != reflect.TypeOf(&schema.PriceSummary{}) {
+			log.Errorf("Action: Demarshal Result %s - %s | Result: Error | Error: Unknown Message Type %s", m.JobID(), q.ExternalName, reflect.TypeOf(msg))
+			delivery.Nack(false, true)
+			continue
+		}
+
+		if err := s.QuerySix.AddResult(msg.(*schema.PriceSummary), m.IdempotencyID); err != nil {
+			log.Errorf("Action: Save Result %s - %s | Result: Error | Error: %s", m.JobID(), q.ExternalName, err)
+			delivery.Nack(false, true)
+			continue
+		}
+		delivery.Ack(false)
+	}
+}
+
+func (s *Server) ConsumeResultsQ7() {
+	q := s.Results.QuerySeven.GetQueueSingle(1)
+	chq := q.Consume()
+
+	for delivery := range chq {
+		m, err := common.MessageFromBytes(delivery.Body)
+		if err != nil {
+			log.Errorf("Action: Deserialize %s | Result: Error | Error: %s", q.ExternalName, err)
+			delivery.Nack(false, true)
+			continue
+		}
+		s, err := s.GetDataStore(m.JobID())
+		if err != nil {
+			log.Errorf("Action: Get Result Store %s - %s | Result: Error | Error: %s", m.JobID(), q.ExternalName, err)
+			delivery.Nack(false, true)
+			continue
+		}
+		if m.IsEOF() {
+			log.Infof("Action: Received EOF %s - %s | Tenant: %s", m.JobID(), q.ExternalName, s.Tenant)
+			if err := s.QuerySeven.Finish(); err != nil {
+				log.Errorf("Action: Write Results %s - %s | Result: Error | Error: %s", m.JobID(), q.ExternalName, err)
+				delivery.Nack(false, true)
+				continue
+			}
+			s.Done()
+			delivery.Ack(false)
+			continue
+		}
+
+		msg, err := schema.UnmarshalMessage(m.Content)
+
+		if err != nil {
+			log.Errorf("Action: Demarshal Result %s - %s | Result: Error | Error: %s", m.JobID(), q.ExternalName, err)
+			delivery.Nack(false, true)
+			continue
+		}
+
+		if reflect.TypeOf(msg) != reflect.TypeOf(&schema.CompanyRank{}) {
+			log.Errorf("Action: Demarshal Result %s - %s | Result: Error | Error: Unknown Message Type %s", m.JobID(), q.ExternalName, reflect.TypeOf(msg))
+			delivery.Nack(false, true)
+			continue
+		}
+
+		if err := s.QuerySeven.AddResult(msg.(*schema.CompanyRank), m.IdempotencyID); err != nil {
+			log.Errorf("Action: Save Result %s - %s | Result: Error | Error: %s", m.JobID(), q.ExternalName, err)
+			delivery.Nack(false, true)
+			continue
+		}
+		delivery.Ack(false)
+	}
+}
+
+func (s *Server) ConsumeResultsQ8() {
+	q := s.Results.QueryEight.GetQueueSingle(1)
+	chq := q.Consume()
+
+	for delivery := range chq {
+		m, err := common.MessageFromBytes(delivery.Body)
+		if err != nil {
+			log.Errorf("Action: Deserialize %s | Result: Error | Error: %s", q.ExternalName, err)
+			delivery.Nack(false, true)
+			continue
+		}
+		s, err := s.GetDataStore(m.JobID())
+		if err != nil {
+			log.Errorf("Action: Get Result Store %s - %s | Result: Error | Error: %s", m.JobID(), q.ExternalName, err)
+			delivery.Nack(false, true)
+			continue
+		}
+		if m.IsEOF() {
+			log.Infof("Action: Received EOF %s - %s | Tenant: %s", m.JobID(), q.ExternalName, s.Tenant)
+			if err := s.QueryEight.Finish(); err != nil {
+				log.Errorf("Action: Write Results %s - %s | Result: Error | Error: %s", m.JobID(), q.ExternalName, err)
+				delivery.Nack(false, true)
+				continue
+			}
+			s.Done()
+			delivery.Ack(false)
+			continue
+		}
+
+		msg, err := schema.UnmarshalMessage(m.Content)
+
+		if err != nil {
+			log.Errorf("Action: Demarshal Result %s - %s | Result: Error | Error: %s", m.JobID(), q.ExternalName, err)
+			delivery.Nack(false, true)
+			continue
+		}
+
+		if reflect.TypeOf(msg) != reflect.TypeOf(&schema.SentimentBucket{}) {
+			log.Errorf("Action: Demarshal Result %s - %s | Result: Error | Error: Unknown Message Type %s", m.JobID(), q.ExternalName, reflect.TypeOf(msg))
+			delivery.Nack(false, true)
+			continue
+		}
+
+		if err := s.QueryEight.AddResult(msg.(*schema.SentimentBucket), m.IdempotencyID); err != nil {
+			log.Errorf("Action: Save Result %s - %s | Result: Error | Error: %s", m.JobID(), q.ExternalName, err)
+			delivery.Nack(false, true)
+			continue
+		}
 		delivery.Ack(false)
 	}
 }
 
 func (s *Server) RemoveClient(client *Client) {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
 	for i, c := range s.Clients {
 		if c == client {
 			s.Clients = append(s.Clients[:i], s.Clients[i+1:]...)
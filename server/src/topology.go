@@ -0,0 +1,123 @@
+package src
+
+import (
+	"errors"
+	"middleware/common"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+func topologiesPath() string {
+	return filepath.Join(".", "data", "topologies")
+}
+
+// The topology new jobs are admitted with and the one every unfinished job got. They are
+// kept on disk, so the data a job sends after a restart goes to the same partitions.
+type Topologies struct {
+	current common.Topology
+	jobs    map[common.JobID]common.Topology
+	mu      sync.Mutex
+}
+
+func NewTopologies(current common.Topology) (*Topologies, error) {
+	t := &Topologies{current: current, jobs: make(map[common.JobID]common.Topology)}
+
+	entries, err := os.ReadDir(topologiesPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return t, nil
+		}
+		return nil, err
+	}
+	for _, e := range entries {
+		job, err := uuid.Parse(e.Name())
+		if err != nil {
+			continue
+		}
+		raw, err := os.ReadFile(filepath.Join(topologiesPath(), e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		topology, err := common.ParseTopology(string(raw))
+		if err != nil {
+			return nil, err
+		}
+		t.jobs[job] = topology
+	}
+	return t, nil
+}
+
+// The topology of the job, the current one if it didn't have one yet
+func (t *Topologies) Assign(job common.JobID) (common.Topology, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if topology, ok := t.jobs[job]; ok {
+		return topology, nil
+	}
+	if err := os.MkdirAll(topologiesPath(), 0755); err != nil {
+		return nil, err
+	}
+	// A crash halfway leaves the temporary file behind and not a broken topology
+	path := filepath.Join(topologiesPath(), job.String())
+	if err := os.WriteFile(path+".tmp", []byte(t.current.String()), 0644); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return nil, err
+	}
+	t.jobs[job] = t.current
+	return t.current, nil
+}
+
+// Forgets the topology of a finished job. Once the last job of a previous topology is
+// gone, the partitions only it used can be taken down.
+func (t *Topologies) Release(job common.JobID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	topology, ok := t.jobs[job]
+	if !ok {
+		return
+	}
+	if err := os.Remove(filepath.Join(topologiesPath(), job.String())); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Errorf("Action: Release Topology %s | Result: Error | Error: %s", job, err)
+	}
+	delete(t.jobs, job)
+
+	if topology.Equal(t.current) {
+		return
+	}
+	if previous := t.previousJobs(); previous == 0 {
+		log.Infof("Action: Rescale | Result: Drained | Topology: %s", t.current)
+	} else {
+		log.Infof("Action: Rescale | Result: Draining | Jobs On Previous Topologies: %d", previous)
+	}
+}
+
+// New jobs get the given topology, the ones admitted before keep theirs
+func (t *Topologies) Rescale(next common.Topology) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if next.Equal(t.current) {
+		log.Infof("Action: Rescale | Result: Unchanged | Topology: %s", t.current)
+		return
+	}
+	log.Infof("Action: Rescale | Result: Success | From: %s | To: %s", t.current, next)
+	t.current = next
+	log.Infof("Action: Rescale | Result: Draining | Jobs On Previous Topologies: %d", t.previousJobs())
+}
+
+func (t *Topologies) previousJobs() int {
+	n := 0
+	for _, topology := range t.jobs {
+		if !topology.Equal(t.current) {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,364 @@
+package business
+
+import (
+	"errors"
+	"fmt"
+	"middleware/common"
+	"middleware/worker/controller"
+	"middleware/worker/schema"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Reduces the mapped items of a window into fewer messages. It can never return more
+// items than it received, as every output reuses the sequence of one of the inputs.
+type Combiner func(items []schema.Partitionable) []schema.Partitionable
+
+func Q1Combine(items []schema.Partitionable) []schema.Partitionable {
+	if len(items) == 0 {
+		return items
+	}
+	total := &schema.SOCounter{}
+	for _, item := range items {
+		so, ok := item.(*schema.SOCounter)
+		if !ok {
+			continue
+		}
+		if total.AppId == "" {
+			// Keep some AppID so the combined counters still spread over the partitions
+			total.AppId = so.AppId
+		}
+		schema.SOCounterAggregate(total, so)
+	}
+	return []schema.Partitionable{total}
+}
+
+func ReviewCountCombine(items []schema.Partitionable) []schema.Partitionable {
+	// Salted reviews of hot games are only combined with the ones of the same salt
+	type countKey struct {
+		appID  string
+		salt   uint8
+		salted bool
+	}
+	counts := make(map[countKey]uint32)
+	for _, item := range items {
+		switch v := item.(type) {
+		case *schema.ValidReview:
+			counts[countKey{appID: v.AppID}]++
+		case *schema.ReviewCounter:
+			counts[countKey{appID: v.AppID}] += v.Count
+		case *schema.SaltedReviewCounter:
+			counts[countKey{appID: v.AppID, salt: v.Salt, salted: true}] += v.Count
+		}
+	}
+
+	keys := make([]countKey, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	// Sorted so a replayed window generates exactly the same messages with the same sequences
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].appID != keys[j].appID {
+			return keys[i].appID < keys[j].appID
+		}
+		if keys[i].salted != keys[j].salted {
+			return !keys[i].salted
+		}
+		return keys[i].salt < keys[j].salt
+	})
+
+	r := make([]schema.Partitionable, len(keys))
+	for i, k := range keys {
+		if k.salted {
+			r[i] = &schema.SaltedReviewCounter{
+				AppID: k.appID,
+				Salt:  k.salt,
+				Count: counts[k],
+			}
+			continue
+		}
+		r[i] = &schema.ReviewCounter{
+			AppID: k.appID,
+			Count: counts[k],
+		}
+	}
+	return r
+}
+
+func ReviewTallyCombine(items []schema.Partitionable) []schema.Partitionable {
+	tallies := make(map[string]*schema.ReviewTally)
+	for _, item := range items {
+		v, ok := item.(*schema.ReviewTally)
+		if !ok {
+			continue
+		}
+		t, ok := tallies[v.AppID]
+		if !ok {
+			t = &schema.ReviewTally{AppID: v.AppID}
+			tallies[v.AppID] = t
+		}
+		t.Positive += v.Positive
+		t.Total += v.Total
+	}
+
+	appIDs := make([]string, 0, len(tallies))
+	for appID := range tallies {
+		appIDs = append(appIDs, appID)
+	}
+	// Same as the counts, a replayed window sends the same messages
+	sort.Strings(appIDs)
+
+	r := make([]schema.Partitionable, len(appIDs))
+	for i, appID := range appIDs {
+		r[i] = tallies[appID]
+	}
+	return r
+}
+
+type windowItem struct {
+	sequence uint32
+	item     schema.Partitionable
+}
+
+func (w *windowItem) Serialize() []byte {
+	b, err := schema.MarshalMessage(w.item)
+	if err != nil {
+		log.Fatalf("Action: Serialize Window Item | Result: Error | Error: %s", err)
+	}
+	s := common.NewSerializer()
+	return s.WriteUint32(w.sequence).WriteBytes(b).ToBytes()
+}
+
+func windowItemDeserialize(d *common.Deserializer) (*windowItem, error) {
+	seq, err := d.ReadUint32()
+	if err != nil {
+		return nil, err
+	}
+	m, err := schema.UnmarshalMessageDeserializer(d)
+	if err != nil {
+		return nil, err
+	}
+	p, ok := m.(schema.Partitionable)
+	if !ok {
+		return nil, &schema.UnknownTypeError{}
+	}
+	return &windowItem{sequence: seq, item: p}, nil
+}
+
+const flushFilePrefix = "flush_"
+
+// A job local window of mapped items that are combined before being forwarded.
+// Every item is appended to disk before the upstream message is acked. When the window
+// is full, the file is moved aside as a pending flush and only removed once all the
+// combined messages were sent, so a crash at any point replays the same messages.
+type CombineWindow struct {
+	combiner  Combiner
+	size      int
+	basefiles string
+	storage   *common.TemporaryStorage
+	idemStore *common.IdempotencyStore
+	items     []*windowItem
+	pending   [][]*controller.NextStageMessage
+}
+
+func NewCombineWindow(basefiles string, combiner Combiner, size int) (*CombineWindow, error) {
+	w := &CombineWindow{
+		combiner:  combiner,
+		size:      size,
+		basefiles: basefiles,
+		idemStore: common.NewIdempotencyStore(),
+		items:     make([]*windowItem, 0, size),
+		pending:   make([][]*controller.NextStageMessage, 0),
+	}
+
+	if err := w.loadPending(); err != nil {
+		return nil, err
+	}
+
+	stg, err := common.NewTemporaryStorage(w.windowPath())
+	if err != nil {
+		return nil, err
+	}
+	w.storage = stg
+
+	items, err := w.load(stg)
+	if err != nil {
+		return nil, err
+	}
+	w.items = items
+
+	return w, nil
+}
+
+func (w *CombineWindow) windowPath() string {
+	return filepath.Join(w.basefiles, "window")
+}
+
+func (w *CombineWindow) flushPath(seq uint32) string {
+	return filepath.Join(w.basefiles, fmt.Sprintf("%s%d", flushFilePrefix, seq))
+}
+
+func (w *CombineWindow) load(stg *common.TemporaryStorage) ([]*windowItem, error) {
+	items := make([]*windowItem, 0, w.size)
+	store, _, err := common.LoadSavedState(stg, windowItemDeserialize, func(_, n *windowItem) *windowItem {
+		items = append(items, n)
+		return n
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	w.idemStore.Merge(store)
+	return items, nil
+}
+
+func (w *CombineWindow) loadPending() error {
+	entries, err := os.ReadDir(w.basefiles)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	seqs := make([]uint32, 0)
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), flushFilePrefix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimPrefix(e.Name(), flushFilePrefix), 10, 32)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, uint32(seq))
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	for _, seq := range seqs {
+		stg, err := common.NewTemporaryStorage(w.flushPath(seq))
+		if err != nil {
+			return err
+		}
+		items, err := w.load(stg)
+		stg.Close()
+		if err != nil {
+			return err
+		}
+		msgs, err := w.combine(items, w.flushPath(seq))
+		if err != nil {
+			return err
+		}
+		if len(msgs) > 0 {
+			log.Infof("Action: Recover Combine Window %s | Result: Pending | Messages: %d", w.flushPath(seq), len(msgs))
+			w.pending = append(w.pending, msgs)
+		}
+	}
+	return nil
+}
+
+func (w *CombineWindow) combine(items []*windowItem, flushFile string) ([]*controller.NextStageMessage, error) {
+	if len(items) == 0 {
+		os.Remove(flushFile)
+		return nil, nil
+	}
+
+	toCombine := make([]schema.Partitionable, len(items))
+	for i, it := range items {
+		toCombine[i] = it.item
+	}
+
+	combined := w.combiner(toCombine)
+	if len(combined) > len(items) {
+		return nil, errors.New("the combiner returned more items than the ones in the window")
+	}
+
+	if len(combined) == 0 {
+		os.Remove(flushFile)
+		return nil, nil
+	}
+
+	// Upstream redeliveries can make the window arrive out of order, use the highest
+	// sequences so the ones we send are always increasing
+	seqs := make([]uint32, len(items))
+	for i, it := range items {
+		seqs[i] = it.sequence
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	seqs = seqs[len(seqs)-len(combined):]
+
+	msgs := make([]*controller.NextStageMessage, len(combined))
+	for i, c := range combined {
+		msgs[i] = &controller.NextStageMessage{
+			Message:  c,
+			Sequence: seqs[i],
+		}
+	}
+	msgs[len(msgs)-1].SentCallback = func() {
+		os.Remove(flushFile)
+	}
+	return msgs, nil
+}
+
+func (w *CombineWindow) AlreadyProcessed(idempotencyID *common.IdempotencyID) bool {
+	return w.idemStore.AlreadyProcessed(idempotencyID)
+}
+
+func (w *CombineWindow) Add(item schema.Partitionable, idempotencyID *common.IdempotencyID) error {
+	wi := &windowItem{sequence: idempotencyID.Sequence, item: item}
+	if err := common.SaveState(idempotencyID, wi, w.storage); err != nil {
+		return err
+	}
+	w.idemStore.Save(idempotencyID)
+	w.items = append(w.items, wi)
+	return nil
+}
+
+func (w *CombineWindow) IsFull() bool {
+	return len(w.items) >= w.size
+}
+
+// Moves the current window aside and returns the combined messages of all the
+// flushes that weren't confirmed as sent, oldest first.
+func (w *CombineWindow) Flush() ([]*controller.NextStageMessage, error) {
+	if len(w.items) > 0 {
+		flushFile := w.flushPath(w.items[0].sequence)
+		w.storage.Close()
+		if err := os.Rename(w.windowPath(), flushFile); err != nil {
+			return nil, err
+		}
+		stg, err := common.NewTemporaryStorage(w.windowPath())
+		if err != nil {
+			return nil, err
+		}
+		w.storage = stg
+
+		msgs, err := w.combine(w.items, flushFile)
+		if err != nil {
+			return nil, err
+		}
+		w.items = make([]*windowItem, 0, w.size)
+		if len(msgs) > 0 {
+			w.pending = append(w.pending, msgs)
+		}
+	}
+
+	return w.TakePending(), nil
+}
+
+func (w *CombineWindow) TakePending() []*controller.NextStageMessage {
+	r := make([]*controller.NextStageMessage, 0)
+	for _, p := range w.pending {
+		r = append(r, p...)
+	}
+	w.pending = w.pending[:0]
+	return r
+}
+
+func (w *CombineWindow) Shutdown(delete bool) {
+	w.storage.Close()
+	if delete {
+		os.RemoveAll(w.basefiles)
+	}
+}
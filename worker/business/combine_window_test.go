@@ -0,0 +1,115 @@
+package business_test
+
+import (
+	"fmt"
+	"middleware/common"
+	"middleware/worker/business"
+	"middleware/worker/controller"
+	"middleware/worker/schema"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func init() {
+	os.RemoveAll(filepath.Join(".", "test_files"))
+}
+
+func reviewMessage(appId string) []byte {
+	s := common.NewSerializer()
+	return s.WriteUint8(common.Type_Review).WriteString(fmt.Sprintf("%s,Game %s,Good game,1,0", appId, appId)).ToBytes()
+}
+
+func countCombined(t *testing.T, counts map[string]uint32, msgs []*controller.NextStageMessage, lastSeq *uint32) {
+	for _, m := range msgs {
+		rc, ok := m.Message.(*schema.ReviewCounter)
+		if !ok {
+			t.Fatalf("Expected a ReviewCounter, got %T", m.Message)
+		}
+		if m.Sequence <= *lastSeq {
+			t.Fatalf("Sequences are not increasing: %d after %d", m.Sequence, *lastSeq)
+		}
+		*lastSeq = m.Sequence
+		counts[rc.AppID] += rc.Count
+	}
+}
+
+func TestCombineReviews(t *testing.T) {
+	mf, err := business.NewMapFilterReviews(filepath.Join(".", "test_files", "combine"), "normal", "Q3R", 1, business.Q3MapReviews, nil)
+	FatalOnError(err, t, "Cannot create map filter")
+	FatalOnError(mf.EnableCombiner(business.ReviewCountCombine, 10), t, "Cannot create window")
+
+	counts := make(map[string]uint32)
+	var lastSeq uint32 = 0
+	sent := 0
+	for i := 1; i <= 95; i++ {
+		msgs, err := mf.HandleMultiple(reviewMessage(fmt.Sprint(i%3)), &common.IdempotencyID{Origin: "SV", Sequence: uint32(i)})
+		FatalOnError(err, t, "Cannot handle review")
+		sent += len(msgs)
+		countCombined(t, counts, msgs, &lastSeq)
+		for _, m := range msgs {
+			if m.SentCallback != nil {
+				m.SentCallback()
+			}
+		}
+	}
+
+	cr, _ := mf.NextStage()
+	rest := make([]*controller.NextStageMessage, 0)
+	for m := range cr {
+		rest = append(rest, m)
+	}
+	countCombined(t, counts, rest, &lastSeq)
+	sent += len(rest)
+
+	if counts["0"] != 31 || counts["1"] != 32 || counts["2"] != 32 {
+		t.Fatalf("Wrong combined counts: %v", counts)
+	}
+
+	if sent > 30 {
+		t.Fatalf("Expected at most 3 messages per window, sent %d", sent)
+	}
+}
+
+func TestCombineReviewsInterrupted(t *testing.T) {
+	base := filepath.Join(".", "test_files", "combine")
+	mf, err := business.NewMapFilterReviews(base, "interrupted", "Q3R", 1, business.Q3MapReviews, nil)
+	FatalOnError(err, t, "Cannot create map filter")
+	FatalOnError(mf.EnableCombiner(business.ReviewCountCombine, 10), t, "Cannot create window")
+
+	var lost []*controller.NextStageMessage
+	for i := 1; i <= 15; i++ {
+		msgs, err := mf.HandleMultiple(reviewMessage(fmt.Sprint(i%2)), &common.IdempotencyID{Origin: "SV", Sequence: uint32(i)})
+		FatalOnError(err, t, "Cannot handle review")
+		// Never confirm these as sent, as if we crashed before publishing them
+		lost = append(lost, msgs...)
+	}
+	if len(lost) != 2 {
+		t.Fatalf("Expected the first window to be flushed into 2 messages, got %d", len(lost))
+	}
+	mf.Shutdown(false)
+
+	mf, err = business.NewMapFilterReviews(base, "interrupted", "Q3R", 1, business.Q3MapReviews, nil)
+	FatalOnError(err, t, "Cannot create map filter")
+	FatalOnError(mf.EnableCombiner(business.ReviewCountCombine, 10), t, "Cannot create window")
+
+	counts := make(map[string]uint32)
+	var lastSeq uint32 = 0
+	for i := 15; i <= 20; i++ {
+		// 15 is a redelivery of the last message, it must be ignored
+		msgs, err := mf.HandleMultiple(reviewMessage(fmt.Sprint(i%2)), &common.IdempotencyID{Origin: "SV", Sequence: uint32(i)})
+		FatalOnError(err, t, "Cannot handle review")
+		countCombined(t, counts, msgs, &lastSeq)
+	}
+
+	cr, _ := mf.NextStage()
+	rest := make([]*controller.NextStageMessage, 0)
+	for m := range cr {
+		rest = append(rest, m)
+	}
+	countCombined(t, counts, rest, &lastSeq)
+
+	if counts["0"] != 10 || counts["1"] != 10 {
+		t.Fatalf("Wrong combined counts after recovery: %v", counts)
+	}
+}
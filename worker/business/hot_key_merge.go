@@ -0,0 +1,144 @@
+package business
+
+import (
+	"fmt"
+	"middleware/common"
+	"middleware/worker/controller"
+	"middleware/worker/schema"
+	"path/filepath"
+	"sort"
+)
+
+// Origin of the counters of the hot games once their partials are added up
+const hotKeyMergeOrigin = "HOT_KEYS"
+
+// Sits in front of a stage three handler. The counters of hot games come in parts from
+// several stage two partitions; they are kept aside and only handed to the query, as
+// whole NamedReviewCounters, once every partition finished.
+type HotKeyMerge struct {
+	inner   controller.Handler
+	storage *common.IdempotencyHandlerSingleFile[*schema.HotReviewCounter]
+}
+
+func NewHotKeyMerge(inner controller.Handler, base string, query string, id string, partition int) (*HotKeyMerge, error) {
+	basefiles := filepath.Join(".", base, fmt.Sprintf("hot_keys_%s_%d", query, partition), id)
+
+	s, err := common.NewIdempotencyHandlerSingleFile[*schema.HotReviewCounter](
+		filepath.Join(basefiles, "partials"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = s.LoadOverwriteState(schema.HotReviewCounterDeserialize); err != nil {
+		return nil, err
+	}
+
+	return &HotKeyMerge{inner: inner, storage: s}, nil
+}
+
+func (m *HotKeyMerge) Handle(protocolData []byte, idempotencyID *common.IdempotencyID) (*controller.NextStageMessage, error) {
+	p, err := schema.UnmarshalMessage(protocolData)
+	if err != nil {
+		return nil, err
+	}
+
+	var partial *schema.HotReviewCounter
+	switch v := p.(type) {
+	case *schema.HotReviewCounter:
+		partial = v
+	case *schema.ReviewCounter:
+		// From a partition without the game, the name comes with the one that has it
+		partial = &schema.HotReviewCounter{AppID: v.AppID, Count: v.Count}
+	default:
+		return m.inner.Handle(protocolData, idempotencyID)
+	}
+
+	if m.storage.AlreadyProcessed(idempotencyID) {
+		log.Debugf("Action: Saving Hot Key Partial | Result: Already processed | IdempotencyID: %s", idempotencyID)
+		return nil, nil
+	}
+	return nil, m.storage.SaveState(idempotencyID, partial)
+}
+
+// Adds up the partials and hands the totals to the query in AppID order, with sequences
+// of their own so the query drops the ones it got before a restart
+func (m *HotKeyMerge) merge() error {
+	partials, err := m.storage.ReadState(schema.HotReviewCounterDeserialize)
+	if err != nil {
+		return err
+	}
+
+	totals := make(map[string]*schema.HotReviewCounter)
+	for p := range partials {
+		t, ok := totals[p.AppID]
+		if !ok {
+			t = &schema.HotReviewCounter{AppID: p.AppID}
+			totals[p.AppID] = t
+		}
+		if p.Name != "" {
+			t.Name = p.Name
+		}
+		t.Count += p.Count
+	}
+
+	ids := make([]string, 0, len(totals))
+	for id, t := range totals {
+		// Partials of games that didn't pass the filters of the query
+		if t.Name != "" {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	for i, id := range ids {
+		data, err := schema.MarshalMessage(&schema.NamedReviewCounter{Name: totals[id].Name, Count: totals[id].Count, AppID: id})
+		if err != nil {
+			return err
+		}
+		if _, err := m.inner.Handle(data, &common.IdempotencyID{Origin: hotKeyMergeOrigin, Sequence: uint32(i + 1)}); err != nil {
+			return err
+		}
+	}
+	if len(ids) > 0 {
+		log.Infof("Action: Merge Hot Keys | Result: Success | Games: %d", len(ids))
+	}
+	return nil
+}
+
+func (m *HotKeyMerge) NextStage() (<-chan *controller.NextStageMessage, <-chan error) {
+	if err := m.merge(); err != nil {
+		cr := make(chan *controller.NextStageMessage)
+		ce := make(chan error, 1)
+		close(cr)
+		ce <- err
+		close(ce)
+		return cr, ce
+	}
+	return m.inner.NextStage()
+}
+
+func (m *HotKeyMerge) EndPhase() (<-chan *controller.NextStageMessage, <-chan error) {
+	return endPhase(m.inner)
+}
+
+// For the handlers in front of another one, the end of its phase if it has one
+func endPhase(h controller.Handler) (<-chan *controller.NextStageMessage, <-chan error) {
+	if p, ok := h.(controller.PhasedHandler); ok {
+		return p.EndPhase()
+	}
+	cr := make(chan *controller.NextStageMessage)
+	ce := make(chan error)
+	close(cr)
+	close(ce)
+	return cr, ce
+}
+
+func (m *HotKeyMerge) Shutdown(delete bool) {
+	m.inner.Shutdown(delete)
+	m.storage.Close()
+	if delete {
+		if err := m.storage.Delete(); err != nil {
+			log.Errorf("Action: Deleting Hot Key Partials | Result: Error | Error: %s", err)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package business
+
+import (
+	"middleware/common"
+	"middleware/worker/schema"
+	"path/filepath"
+)
+
+type HotKeysConfig struct {
+	// Reviews of a game a map filter sees before it spreads the rest, zero disables it
+	Threshold uint32
+	// Salts the reviews of a hot game are spread over
+	Fanout int
+	Width  int
+	Depth  int
+}
+
+type hotKeyState struct {
+	appID    string
+	sequence uint32
+}
+
+func (s *hotKeyState) Serialize() []byte {
+	se := common.NewSerializer()
+	return se.WriteString(s.appID).WriteUint32(s.sequence).ToBytes()
+}
+
+func hotKeyStateDeserialize(d *common.Deserializer) (*hotKeyState, error) {
+	app, err := d.ReadString()
+	if err != nil {
+		return nil, err
+	}
+	seq, err := d.ReadUint32()
+	if err != nil {
+		return nil, err
+	}
+	return &hotKeyState{appID: app, sequence: seq}, nil
+}
+
+// Spots the games with too many reviews for one stage two partition and salts the rest of
+// their reviews. The salt only depends on the sequence of the message and on the one the
+// game became hot at, which is saved, so a message redelivered after a restart goes to the
+// same partition it went to the first time.
+type HotKeys struct {
+	cfg      HotKeysConfig
+	sketch   *common.CountMinSketch
+	promoted map[string]uint32
+	storage  *common.IdempotencyHandlerSingleFile[*hotKeyState]
+}
+
+func NewHotKeys(basefiles string, cfg HotKeysConfig) (*HotKeys, error) {
+	s, err := common.NewIdempotencyHandlerSingleFile[*hotKeyState](filepath.Join(basefiles, "hot_keys"))
+	if err != nil {
+		return nil, err
+	}
+	if _, err = s.LoadOverwriteState(hotKeyStateDeserialize); err != nil {
+		return nil, err
+	}
+
+	promoted := make(map[string]uint32)
+	saved, err := s.ReadState(hotKeyStateDeserialize)
+	if err != nil {
+		return nil, err
+	}
+	for k := range saved {
+		promoted[k.appID] = k.sequence
+	}
+
+	return &HotKeys{
+		cfg:      cfg,
+		sketch:   common.NewCountMinSketch(cfg.Width, cfg.Depth),
+		promoted: promoted,
+		storage:  s,
+	}, nil
+}
+
+// Returns the mapped review as is, or salted when its game is hot
+func (h *HotKeys) Spread(m schema.Partitionable, idempotencyID *common.IdempotencyID) (schema.Partitionable, error) {
+	r, ok := m.(*schema.ValidReview)
+	if !ok {
+		return m, nil
+	}
+
+	at, hot := h.promoted[r.AppID]
+	if !hot {
+		if h.sketch.Add(r.AppID, 1) < h.cfg.Threshold {
+			return m, nil
+		}
+		at = idempotencyID.Sequence
+		if err := h.storage.SaveState(idempotencyID, &hotKeyState{appID: r.AppID, sequence: at}); err != nil {
+			return nil, err
+		}
+		h.promoted[r.AppID] = at
+		log.Infof("Action: Hot Key | AppID: %s | Result: Salted | Sequence: %d | Fanout: %d", r.AppID, at, h.cfg.Fanout)
+	}
+
+	if idempotencyID.Sequence < at {
+		// Went out before the game was hot
+		return m, nil
+	}
+	salt := uint8(0)
+	if idempotencyID.Sequence != at {
+		salt = uint8(idempotencyID.Sequence % uint32(max(h.cfg.Fanout, 1)))
+	}
+	return &schema.SaltedReviewCounter{AppID: r.AppID, Salt: salt, Count: 1}, nil
+}
+
+func (h *HotKeys) Shutdown(delete bool) {
+	h.storage.Close()
+	if delete {
+		h.storage.Delete()
+	}
+}
@@ -0,0 +1,146 @@
+package business_test
+
+import (
+	"middleware/common"
+	"middleware/worker/business"
+	"middleware/worker/controller"
+	"middleware/worker/schema"
+	"path/filepath"
+	"testing"
+)
+
+func TestHotKeysSaltSurvivesRestart(t *testing.T) {
+	base := filepath.Join(".", "test_files", "hot_keys")
+	cfg := business.HotKeysConfig{Threshold: 3, Fanout: 3, Width: 64, Depth: 4}
+	h, err := business.NewHotKeys(base, cfg)
+	if err != nil {
+		t.Fatalf("Can't create the hot keys: %s", err)
+	}
+
+	salts := make(map[uint32]int)
+	for seq := uint32(1); seq <= 10; seq++ {
+		m, err := h.Spread(&schema.ValidReview{AppID: "blockbuster"}, &common.IdempotencyID{Origin: "SV", Sequence: seq})
+		if err != nil {
+			t.Fatalf("Can't spread a review: %s", err)
+		}
+		salts[seq] = -1
+		if s, ok := m.(*schema.SaltedReviewCounter); ok {
+			salts[seq] = int(s.Salt)
+		}
+	}
+
+	if salts[2] != -1 || salts[3] != 0 {
+		t.Fatalf("Expected the game to turn hot at the third review with the first salt, got %v", salts)
+	}
+
+	// Redelivered after a restart, everything goes where it went before
+	h.Shutdown(false)
+	h, err = business.NewHotKeys(base, cfg)
+	if err != nil {
+		t.Fatalf("Can't load the hot keys: %s", err)
+	}
+	defer h.Shutdown(true)
+	for seq := uint32(1); seq <= 10; seq++ {
+		m, _ := h.Spread(&schema.ValidReview{AppID: "blockbuster"}, &common.IdempotencyID{Origin: "SV", Sequence: seq})
+		salt := -1
+		if s, ok := m.(*schema.SaltedReviewCounter); ok {
+			salt = int(s.Salt)
+		}
+		if salt != salts[seq] {
+			t.Fatalf("Review %d went to salt %d after the restart and to %d before", seq, salt, salts[seq])
+		}
+	}
+}
+
+type collectCounters struct {
+	counters []*schema.NamedReviewCounter
+}
+
+func (c *collectCounters) Handle(protocolData []byte, idempotencyID *common.IdempotencyID) (*controller.NextStageMessage, error) {
+	p, err := schema.UnmarshalMessage(protocolData)
+	if err != nil {
+		return nil, err
+	}
+	c.counters = append(c.counters, p.(*schema.NamedReviewCounter))
+	return nil, nil
+}
+
+func (c *collectCounters) NextStage() (<-chan *controller.NextStageMessage, <-chan error) {
+	cr := make(chan *controller.NextStageMessage)
+	ce := make(chan error)
+	close(cr)
+	close(ce)
+	return cr, ce
+}
+
+func (c *collectCounters) Shutdown(delete bool) {}
+
+func drainJoin(t *testing.T, j *business.Join, origin string, to controller.Handler) {
+	cr, ce := j.NextStage()
+	for r := range cr {
+		if r.Message == nil {
+			continue
+		}
+		data, err := schema.MarshalMessage(r.Message)
+		if err != nil {
+			t.Fatalf("Can't marshal %v: %s", r.Message, err)
+		}
+		if _, err := to.Handle(data, &common.IdempotencyID{Origin: origin, Sequence: r.Sequence}); err != nil {
+			t.Fatalf("Can't handle %v: %s", r.Message, err)
+		}
+		if r.SentCallback != nil {
+			r.SentCallback()
+		}
+	}
+	if err := <-ce; err != nil {
+		t.Fatalf("Join failed: %s", err)
+	}
+}
+
+func TestHotKeyPartialsMergedBeforeQuery(t *testing.T) {
+	base := filepath.Join(".", "test_files", "hot_key_merge")
+	owner, err := business.NewJoin(base, "qtest", "id", 1, 100)
+	if err != nil {
+		t.Fatalf("Can't create join: %s", err)
+	}
+	other, err := business.NewJoin(base, "qtest", "id", 2, 100)
+	if err != nil {
+		t.Fatalf("Can't create join: %s", err)
+	}
+
+	owner.AddGame(&schema.GameName{AppID: "1", Name: "Blockbuster"}, &common.IdempotencyID{Origin: "G", Sequence: 1})
+	owner.AddGame(&schema.GameName{AppID: "2", Name: "Indie"}, &common.IdempotencyID{Origin: "G", Sequence: 2})
+	owner.AddReview(&schema.ValidReview{AppID: "1"}, &common.IdempotencyID{Origin: "R", Sequence: 1})
+	owner.AddReview(&schema.ValidReview{AppID: "2"}, &common.IdempotencyID{Origin: "R", Sequence: 2})
+	owner.AddSaltedCount(&schema.SaltedReviewCounter{AppID: "1", Salt: 0, Count: 5}, &common.IdempotencyID{Origin: "R", Sequence: 3})
+	other.AddSaltedCount(&schema.SaltedReviewCounter{AppID: "1", Salt: 1, Count: 7}, &common.IdempotencyID{Origin: "R", Sequence: 4})
+	// A game filtered out by the query, nobody has its name
+	other.AddSaltedCount(&schema.SaltedReviewCounter{AppID: "3", Salt: 1, Count: 9}, &common.IdempotencyID{Origin: "R", Sequence: 5})
+
+	inner := &collectCounters{}
+	merge, err := business.NewHotKeyMerge(inner, base, "qtest", "id", 1)
+	if err != nil {
+		t.Fatalf("Can't create the merge: %s", err)
+	}
+	defer merge.Shutdown(true)
+
+	drainJoin(t, owner, "S2_1", merge)
+	drainJoin(t, other, "S2_2", merge)
+	owner.Shutdown(true)
+	other.Shutdown(true)
+
+	if len(inner.counters) != 1 || inner.counters[0].Name != "Indie" {
+		t.Fatalf("Expected only the cold game before the merge, got %v", inner.counters)
+	}
+	cr, _ := merge.NextStage()
+	for range cr {
+	}
+
+	counts := make(map[string]uint32)
+	for _, c := range inner.counters {
+		counts[c.Name] = c.Count
+	}
+	if len(counts) != 2 || counts["Blockbuster"] != 13 || counts["Indie"] != 1 {
+		t.Fatalf("Expected Blockbuster with 13 reviews and Indie with 1, got %v", counts)
+	}
+}
@@ -4,17 +4,42 @@ import (
 	"fmt"
 	"middleware/common"
 	"middleware/worker/controller"
+	"middleware/worker/controller/enums"
 	"middleware/worker/schema"
 	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
 )
 
 type Join struct {
 	reviewStorage *common.IdempotencyHandlerMultipleFiles[*CountState]
 	gameStorage   *common.IdempotencyHandlerSingleFile[*schema.GameName]
-	basefiles     string
+	// Reviews of hot games, kept apart so they don't all land in the same bucket
+	saltedStorage *common.IdempotencyHandlerSingleFile[*CountState]
+	// Review counts by AppID, for the buckets that weren't spilled
+	table *common.JoinCache[string, uint32]
+	// Buckets that didn't fit in the table, their counts are read from disk at the end
+	spilled        map[string]bool
+	spilledStorage *common.TemporaryStorage
+	// Only when streaming. Names are loaded once every game arrived, from then on every
+	// count that changes is sent to stage three as an upsert
+	upserts   *FileSequence
+	upsertSeq uint32
+	names     map[string]string
+	// Rank error of the sketch of counts sent after the games, zero sends none
+	sketchError float64
+	// Only for a distributed percentile, the games with fewer reviews aren't sent
+	percentile *common.IdempotencyHandlerSingleFile[*schema.PercentileThreshold]
+	threshold  *schema.PercentileThreshold
+	// Only for a language breakdown, the counts of the map filters routed to this partition
+	languages *languageTallies
+	basefiles string
 }
 
+// Sequences the end of the phase takes: the histogram, the end of the results and its EOF
+const phaseSequences = 3
+
 func NewJoin(base string, query string, id string, partition int, bufSize int) (*Join, error) {
 	basefiles := filepath.Join(".", base, fmt.Sprintf("%s_%d", query, partition), "join", id)
 
@@ -26,10 +51,6 @@ func NewJoin(base string, query string, id string, partition int, bufSize int) (
 		return nil, err
 	}
 
-	if err = r.LoadState(CountStateDeserialize); err != nil {
-		return nil, err
-	}
-
 	g, err := common.NewIdempotencyHandlerSingleFile[*schema.GameName](
 		filepath.Join(basefiles, "games"),
 	)
@@ -43,11 +64,108 @@ func NewJoin(base string, query string, id string, partition int, bufSize int) (
 		return nil, err
 	}
 
-	return &Join{
-		reviewStorage: r,
-		gameStorage:   g,
-		basefiles:     basefiles,
-	}, nil
+	s, err := common.NewIdempotencyHandlerSingleFile[*CountState](
+		filepath.Join(basefiles, "salted"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = s.LoadOverwriteState(CountStateDeserialize); err != nil {
+		return nil, err
+	}
+
+	sp, err := common.NewTemporaryStorage(filepath.Join(basefiles, "spilled"))
+	if err != nil {
+		return nil, err
+	}
+
+	q := &Join{
+		reviewStorage:  r,
+		gameStorage:    g,
+		saltedStorage:  s,
+		table:          common.NewJoinCache[string, uint32](bufSize),
+		spilled:        make(map[string]bool),
+		spilledStorage: sp,
+		basefiles:      basefiles,
+	}
+
+	if err = q.loadSpilled(); err != nil {
+		return nil, err
+	}
+
+	// Rebuilds the table from the buckets that weren't spilled before the restart
+	var cacheErr error
+	err = r.LoadStateVisiting(CountStateDeserialize, func(bucket string, cs *CountState) {
+		if cacheErr == nil {
+			cacheErr = q.cache(bucket, cs.appID, cs.count)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if cacheErr != nil {
+		return nil, cacheErr
+	}
+
+	return q, nil
+}
+
+func (q *Join) loadSpilled() error {
+	scanner, err := q.spilledStorage.Scanner()
+	if err != nil {
+		return err
+	}
+	for scanner.Scan() {
+		if bucket := strings.TrimSpace(scanner.Text()); bucket != "" {
+			q.spilled[bucket] = true
+		}
+	}
+	return scanner.Err()
+}
+
+// Adds the count to the table. When a new AppID doesn't fit, the bucket with the most
+// AppIDs in the table is spilled: it's marked on disk and its AppIDs leave the table.
+func (q *Join) cache(bucket string, appID string, count uint32) error {
+	if q.spilled[bucket] {
+		return nil
+	}
+	c, _ := q.table.Get(appID)
+	for !q.table.TryPut(appID, c+count) {
+		spilled, err := q.spill(bucket)
+		if err != nil {
+			return err
+		}
+		if spilled == bucket {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (q *Join) spill(incoming string) (string, error) {
+	sizes := make(map[string]int)
+	q.table.Each(func(appID string, _ uint32) {
+		sizes[q.reviewStorage.GetFileName(appID)]++
+	})
+
+	bucket := incoming
+	for b, size := range sizes {
+		if size > sizes[bucket] || (size == sizes[bucket] && b < bucket) {
+			bucket = b
+		}
+	}
+
+	// The mark goes first, if we crash before it the table is rebuilt with the bucket
+	if _, err := q.spilledStorage.AppendLine([]byte(bucket)); err != nil {
+		return "", err
+	}
+	q.spilled[bucket] = true
+	removed := q.table.RemoveIf(func(appID string, _ uint32) bool {
+		return q.reviewStorage.GetFileName(appID) == bucket
+	})
+	log.Infof("Action: Spilling Join Bucket | Bucket: %s | Result: Success | AppIDs: %d", bucket, removed)
+	return bucket, nil
 }
 
 func (q *Join) AddReview(r *schema.ValidReview, idempotencyID *common.IdempotencyID) error {
@@ -62,9 +180,181 @@ func (q *Join) AddReview(r *schema.ValidReview, idempotencyID *common.Idempotenc
 		return err
 	}
 
+	return q.cache(q.reviewStorage.GetFileName(r.AppID), r.AppID, 1)
+}
+
+func (q *Join) AddReviewCount(r *schema.ReviewCounter, idempotencyID *common.IdempotencyID) error {
+	if q.reviewStorage.AlreadyProcessed(idempotencyID) {
+		log.Debugf("Action: Saving Review Count to Join | Result: Already processed | IdempotencyID: %s", idempotencyID)
+		return nil
+	}
+
+	err := q.reviewStorage.SaveState(idempotencyID, &CountState{appID: r.AppID, count: r.Count}, r.AppID)
+	if err != nil {
+		log.Debugf("Action: Saving Review Count to Join | Result: Error | Error: %s", err)
+		return err
+	}
+
+	return q.cache(q.reviewStorage.GetFileName(r.AppID), r.AppID, r.Count)
+}
+
+// Sends provisional counts before the reviews end. Their sequences come before the ones
+// of NextStage, which still sends every count as usual.
+func (q *Join) EnableStreaming() error {
+	fs, err := NewFileSequence(filepath.Join(q.basefiles, "upserts"))
+	if err != nil {
+		return err
+	}
+	q.upserts = fs
+	q.upsertSeq = fs.LastConfirmedSent()
 	return nil
 }
 
+// Sends a quantile sketch of the counts after them, so stage three can find a percentile
+// without sorting every game
+func (q *Join) EnableQuantileSketch(epsilon float64) {
+	q.sketchError = epsilon
+}
+
+// Adds up the language counts of the map filters and sends them after the games
+func (q *Join) EnableLanguageBreakdown() error {
+	l, err := newLanguageTallies(q.basefiles)
+	if err != nil {
+		return err
+	}
+	q.languages = l
+	return nil
+}
+
+// Sends a histogram of the counts when the reviews end and waits for stage three to tell
+// back the percentile, only the games at or over it are sent then
+func (q *Join) EnableDistributedPercentile() error {
+	s, err := common.NewIdempotencyHandlerSingleFile[*schema.PercentileThreshold](filepath.Join(q.basefiles, "percentile"))
+	if err != nil {
+		return err
+	}
+	t, err := s.LoadOverwriteState(schema.PercentileThresholdDeserialize)
+	if err != nil {
+		return err
+	}
+	q.percentile = s
+	q.threshold = t
+	return nil
+}
+
+func (q *Join) SetThreshold(t *schema.PercentileThreshold, idempotencyID *common.IdempotencyID) error {
+	if q.percentile.AlreadyProcessed(idempotencyID) {
+		log.Debugf("Action: Saving Percentile Threshold | Result: Already processed | IdempotencyID: %s", idempotencyID)
+		return nil
+	}
+	if err := q.percentile.SaveState(idempotencyID, t); err != nil {
+		return err
+	}
+	q.threshold = t
+	log.Infof("Action: Saving Percentile Threshold | Result: Success | Count: %d", t.Count)
+	return nil
+}
+
+func (q *Join) EndPhase() (<-chan *controller.NextStageMessage, <-chan error) {
+	cr := make(chan *controller.NextStageMessage)
+	ce := make(chan error, 1)
+	go func() {
+		defer close(cr)
+		defer close(ce)
+
+		// Sent again after a restart, with the same sequence
+		histogram := &schema.CountHistogram{Games: make(map[uint32]uint32)}
+		err := q.probe(func(game *schema.GameName, count uint32) {
+			if count > 0 {
+				histogram.Games[count]++
+			}
+		})
+		if err != nil {
+			ce <- err
+			return
+		}
+
+		cr <- &controller.NextStageMessage{
+			Message:  histogram,
+			Sequence: q.upsertSeq + 1,
+		}
+		cr <- &controller.NextStageMessage{
+			Message:  nil,
+			Sequence: q.upsertSeq + 2,
+		}
+	}()
+	return cr, ce
+}
+
+func (q *Join) TokenComplete(token enums.TokenName) {
+	if q.upserts == nil || q.names != nil || token != enums.MF_GAMES {
+		return
+	}
+
+	games, err := q.gameStorage.ReadState(schema.GameNameDeserialize)
+	if err != nil {
+		log.Errorf("Action: Loading Games to Stream Join | Result: Error | Error: %s", err)
+		return
+	}
+	names := make(map[string]string)
+	for game := range games {
+		names[game.AppID] = game.Name
+	}
+	q.names = names
+	log.Infof("Action: Loading Games to Stream Join | Result: Success | Games: %d", len(names))
+}
+
+// The current count of the game, if it's known without going to disk
+func (q *Join) upsert(appID string) *controller.NextStageMessage {
+	if q.names == nil {
+		return nil
+	}
+	name, ok := q.names[appID]
+	if !ok {
+		return nil
+	}
+	count, ok := q.table.Get(appID)
+	if !ok {
+		return nil
+	}
+
+	// Saved before it's sent, so a sequence is never reused after a restart
+	q.upserts.Sent()
+	q.upsertSeq++
+	return &controller.NextStageMessage{
+		Message:  &schema.ReviewCounterUpsert{AppID: appID, Name: name, Count: count},
+		Sequence: q.upsertSeq,
+	}
+}
+
+func (q *Join) AddSaltedCount(r *schema.SaltedReviewCounter, idempotencyID *common.IdempotencyID) error {
+	if q.saltedStorage.AlreadyProcessed(idempotencyID) {
+		log.Debugf("Action: Saving Salted Count to Join | Result: Already processed | IdempotencyID: %s", idempotencyID)
+		return nil
+	}
+
+	err := q.saltedStorage.SaveState(idempotencyID, &CountState{appID: r.AppID, count: r.Count})
+	if err != nil {
+		log.Debugf("Action: Saving Salted Count to Join | Result: Error | Error: %s", err)
+		return err
+	}
+
+	return nil
+}
+
+// Counts of the hot games seen by this partition, only a few games get salted
+func (q *Join) saltedCounts() (map[string]uint32, error) {
+	salted, err := q.saltedStorage.ReadState(CountStateDeserialize)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]uint32)
+	for s := range salted {
+		counts[s.appID] += s.count
+	}
+	return counts, nil
+}
+
 func (q *Join) AddGame(r *schema.GameName, idempotencyID *common.IdempotencyID) error {
 	if q.gameStorage.AlreadyProcessed(idempotencyID) {
 		log.Debugf("Action: Saving Game to Join | Result: Already processed | IdempotencyID: %s", idempotencyID)
@@ -85,11 +375,12 @@ func (q *Join) NextStage() (<-chan *controller.NextStageMessage, <-chan error) {
 		defer close(cr)
 		defer close(ce)
 
-		games, err := q.gameStorage.ReadState(schema.GameNameDeserialize)
+		salted, err := q.saltedCounts()
 		if err != nil {
 			ce <- err
 			return
 		}
+
 		fs, err := NewFileSequence(filepath.Join(q.basefiles, "sent_lines"))
 		if err != nil {
 			ce <- err
@@ -98,29 +389,92 @@ func (q *Join) NextStage() (<-chan *controller.NextStageMessage, <-chan error) {
 		defer fs.Shutdown(true)
 
 		var line uint32 = 1
-		for game := range games {
+		// After the upserts, that won't grow anymore
+		offset := q.upsertSeq
+		if q.percentile != nil {
+			offset += phaseSequences
+		}
+		var sketch *common.KLLSketch
+		if q.sketchError > 0 {
+			sketch = common.NewKLLSketch(q.sketchError)
+		}
+		send := func(game *schema.GameName, count uint32) {
+			if q.threshold != nil && count < q.threshold.Count {
+				return
+			}
+			_, hot := salted[game.AppID]
+			// Games without reviews never make it to the percentile, hot ones are added up at stage three
+			if sketch != nil && !hot && count > 0 {
+				sketch.Add(count)
+			}
 			if line > fs.LastConfirmedSent() {
-				reviews, err := q.reviewStorage.ReadSerialState(
-					game.AppID,
-					CountStateDeserialize,
-					func(cs1, cs2 *CountState) *CountState {
-						if cs2.appID == game.AppID {
-							return CountStateAggregate(cs1, cs2)
-						}
-						return cs1
-					},
-					&CountState{appID: game.AppID, count: 0},
-				)
-				if err != nil {
-					ce <- err
-					return
+				var m schema.Partitionable = &schema.NamedReviewCounter{
+					Name:  game.Name,
+					Count: count,
+					AppID: game.AppID,
 				}
-				cr <- &controller.NextStageMessage{
-					Message: &schema.NamedReviewCounter{
+				if partial, hot := salted[game.AppID]; hot {
+					// The other partitions may have part of its reviews, stage three adds them up
+					m = &schema.HotReviewCounter{
+						AppID: game.AppID,
 						Name:  game.Name,
-						Count: reviews.count,
+						Count: count + partial,
+					}
+				}
+				cr <- &controller.NextStageMessage{
+					Message:      m,
+					Sequence:     offset + line,
+					SentCallback: fs.Sent,
+				}
+			}
+			delete(salted, game.AppID)
+			line++
+		}
+
+		if err := q.probe(send); err != nil {
+			ce <- err
+			return
+		}
+
+		// Partials of the hot games that live in other partitions, sorted so a restart
+		// sends them with the same sequences
+		partials := make([]string, 0, len(salted))
+		for appID := range salted {
+			partials = append(partials, appID)
+		}
+		sort.Strings(partials)
+		for _, appID := range partials {
+			if line > fs.LastConfirmedSent() {
+				cr <- &controller.NextStageMessage{
+					Message: &schema.ReviewCounter{
+						AppID: appID,
+						Count: salted[appID],
 					},
-					Sequence:     line,
+					Sequence:     offset + line,
+					SentCallback: fs.Sent,
+				}
+			}
+			line++
+		}
+
+		if q.languages != nil {
+			for _, c := range q.languages.Sorted() {
+				if line > fs.LastConfirmedSent() {
+					cr <- &controller.NextStageMessage{
+						Message:      c,
+						Sequence:     offset + line,
+						SentCallback: fs.Sent,
+					}
+				}
+				line++
+			}
+		}
+
+		if sketch != nil {
+			if line > fs.LastConfirmedSent() {
+				cr <- &controller.NextStageMessage{
+					Message:      &schema.QuantileSketch{Sketch: sketch},
+					Sequence:     offset + line,
 					SentCallback: fs.Sent,
 				}
 			}
@@ -129,7 +483,7 @@ func (q *Join) NextStage() (<-chan *controller.NextStageMessage, <-chan error) {
 
 		cr <- &controller.NextStageMessage{
 			Message:      nil,
-			Sequence:     line,
+			Sequence:     offset + line,
 			SentCallback: nil,
 		}
 	}()
@@ -137,24 +491,103 @@ func (q *Join) NextStage() (<-chan *controller.NextStageMessage, <-chan error) {
 	return cr, ce
 }
 
+// Visits every game with its count. The games of spilled buckets wait until the whole
+// file was read, so every bucket is read from disk only once.
+func (q *Join) probe(visit func(game *schema.GameName, count uint32)) error {
+	games, err := q.gameStorage.ReadState(schema.GameNameDeserialize)
+	if err != nil {
+		return err
+	}
+
+	deferred := make(map[string][]*schema.GameName)
+	for game := range games {
+		bucket := q.reviewStorage.GetFileName(game.AppID)
+		if q.spilled[bucket] {
+			deferred[bucket] = append(deferred[bucket], game)
+			continue
+		}
+		count, _ := q.table.Get(game.AppID)
+		visit(game, count)
+	}
+
+	buckets := make([]string, 0, len(deferred))
+	for bucket := range deferred {
+		buckets = append(buckets, bucket)
+	}
+	sort.Strings(buckets)
+	for _, bucket := range buckets {
+		counts := make(map[string]uint32)
+		err := q.reviewStorage.ReadFile(bucket, CountStateDeserialize, func(cs *CountState) {
+			counts[cs.appID] += cs.count
+		})
+		if err != nil {
+			return err
+		}
+		for _, game := range deferred[bucket] {
+			visit(game, counts[game.AppID])
+		}
+	}
+	return nil
+}
+
 func (q *Join) Handle(protocolData []byte, idempotencyID *common.IdempotencyID) (*controller.NextStageMessage, error) {
 	p, err := schema.UnmarshalMessage(protocolData)
 	if err != nil {
 		return nil, err
 	}
 	if reflect.TypeOf(p) == reflect.TypeOf(&schema.ValidReview{}) {
-		return nil, q.AddReview(p.(*schema.ValidReview), idempotencyID)
+		r := p.(*schema.ValidReview)
+		fresh := !q.reviewStorage.AlreadyProcessed(idempotencyID)
+		if err := q.AddReview(r, idempotencyID); err != nil || !fresh {
+			return nil, err
+		}
+		return q.upsert(r.AppID), nil
+	}
+
+	if reflect.TypeOf(p) == reflect.TypeOf(&schema.ReviewCounter{}) {
+		r := p.(*schema.ReviewCounter)
+		fresh := !q.reviewStorage.AlreadyProcessed(idempotencyID)
+		if err := q.AddReviewCount(r, idempotencyID); err != nil || !fresh {
+			return nil, err
+		}
+		return q.upsert(r.AppID), nil
+	}
+
+	if reflect.TypeOf(p) == reflect.TypeOf(&schema.SaltedReviewCounter{}) {
+		return nil, q.AddSaltedCount(p.(*schema.SaltedReviewCounter), idempotencyID)
 	}
 
 	if reflect.TypeOf(p) == reflect.TypeOf(&schema.GameName{}) {
 		return nil, q.AddGame(p.(*schema.GameName), idempotencyID)
 	}
+
+	if reflect.TypeOf(p) == reflect.TypeOf(&schema.LanguageCount{}) && q.languages != nil {
+		return nil, q.languages.Save(p.(*schema.LanguageCount), idempotencyID)
+	}
+
+	if reflect.TypeOf(p) == reflect.TypeOf(&schema.PercentileThreshold{}) && q.percentile != nil {
+		return nil, q.SetThreshold(p.(*schema.PercentileThreshold), idempotencyID)
+	}
 	return nil, &schema.UnknownTypeError{}
 }
 
 func (q *Join) Shutdown(delete bool) {
 	q.gameStorage.Close()
 	q.reviewStorage.Close()
+	q.saltedStorage.Close()
+	q.spilledStorage.Close()
+	if q.upserts != nil {
+		q.upserts.Shutdown(delete)
+	}
+	if q.languages != nil {
+		q.languages.Shutdown(delete)
+	}
+	if q.percentile != nil {
+		q.percentile.Close()
+		if delete {
+			q.percentile.Delete()
+		}
+	}
 	if delete {
 		err := q.gameStorage.Delete()
 		if err != nil {
@@ -165,5 +598,15 @@ func (q *Join) Shutdown(delete bool) {
 		if err != nil {
 			log.Errorf("Action: Deleting JOIN Game File | Result: Error | Error: %s", err)
 		}
+
+		err = q.saltedStorage.Delete()
+		if err != nil {
+			log.Errorf("Action: Deleting JOIN Salted File | Result: Error | Error: %s", err)
+		}
+
+		err = q.spilledStorage.Delete()
+		if err != nil {
+			log.Errorf("Action: Deleting JOIN Spilled File | Result: Error | Error: %s", err)
+		}
 	}
 }
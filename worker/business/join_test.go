@@ -5,6 +5,7 @@ import (
 	"math/rand"
 	"middleware/common"
 	"middleware/worker/business"
+	"middleware/worker/controller/enums"
 	"middleware/worker/schema"
 	"os"
 	"path/filepath"
@@ -221,3 +222,128 @@ func TestJoinMultipleOriginsInterrupted(t *testing.T) {
 		}
 	}
 }
+
+func TestJoinSpillsBucketsOverBuffer(t *testing.T) {
+	base := filepath.Join(".", "test_files", "spill")
+	ga := 60
+	// Much smaller than the AppIDs, most buckets end up on disk
+	h, err := business.NewJoin(base, "qtest", "id", 1, 8)
+	if err != nil {
+		t.Fatalf("Cant create join: %s", err)
+	}
+
+	ri := 0
+	for j := 0; j < ga; j++ {
+		h.AddGame(&schema.GameName{AppID: fmt.Sprint(j), Name: fmt.Sprint(j)}, &common.IdempotencyID{Origin: "AG", Sequence: uint32(j)})
+		for i := ga - j; i > 0; i-- {
+			h.AddReview(&schema.ValidReview{AppID: fmt.Sprint(j)}, &common.IdempotencyID{Origin: "AR", Sequence: uint32(ri)})
+			ri++
+		}
+	}
+
+	// Crashes halfway through the results and picks up after a restart
+	seen := make(map[string]bool)
+	for round := 0; round < 2; round++ {
+		cr, ce := h.NextStage()
+		for r := range cr {
+			if r.Message == nil {
+				if err := <-ce; err != nil {
+					t.Fatalf("There was an error while making the next stage %s", err)
+				}
+				break
+			}
+			m := r.Message.(*schema.NamedReviewCounter)
+			if seen[m.Name] {
+				t.Fatalf("Game %s sent twice", m.Name)
+			}
+			seen[m.Name] = true
+			nc, _ := strconv.Atoi(m.Name)
+			if int(m.Count) != ga-nc {
+				t.Fatalf("Game %s with count %d", m.Name, m.Count)
+			}
+			r.SentCallback()
+			if round == 0 && len(seen) == ga/2 {
+				break
+			}
+		}
+
+		h.Shutdown(round == 1)
+		if round == 0 {
+			h, err = business.NewJoin(base, "qtest", "id", 1, 8)
+			if err != nil {
+				t.Fatalf("Cant load join: %s", err)
+			}
+		}
+	}
+
+	if len(seen) != ga {
+		t.Fatalf("Expected %d games, got %d", ga, len(seen))
+	}
+}
+
+func TestJoinStreamingUpsertsBeforeFinalCounts(t *testing.T) {
+	base := filepath.Join(".", "test_files", "streaming")
+	h, err := business.NewJoin(base, "qtest", "id", 1, 100)
+	if err != nil {
+		t.Fatalf("Cant create join: %s", err)
+	}
+	if err := h.EnableStreaming(); err != nil {
+		t.Fatalf("Cant enable streaming: %s", err)
+	}
+
+	// Whether the review was sent on as an upsert
+	review := func(appID string, seq uint32) bool {
+		data, _ := schema.MarshalMessage(&schema.ValidReview{AppID: appID})
+		out, err := h.Handle(data, &common.IdempotencyID{Origin: "AR", Sequence: seq})
+		if err != nil {
+			t.Fatalf("Cant handle review: %s", err)
+		}
+		if out == nil {
+			return false
+		}
+		u := out.Message.(*schema.ReviewCounterUpsert)
+		if u.AppID != appID || out.Sequence != seq-1 {
+			t.Fatalf("Unexpected upsert %v with sequence %d", u, out.Sequence)
+		}
+		return true
+	}
+
+	h.AddGame(&schema.GameName{AppID: "1", Name: "One"}, &common.IdempotencyID{Origin: "AG", Sequence: 1})
+	if review("1", 1) {
+		t.Fatalf("Expected no upserts before having every game")
+	}
+	h.TokenComplete(enums.MF_GAMES)
+	if !review("1", 2) || !review("1", 3) {
+		t.Fatalf("Expected an upsert for every review once every game arrived")
+	}
+
+	// The join restarts and keeps counting its upserts from where it was
+	h.Shutdown(false)
+	h, err = business.NewJoin(base, "qtest", "id", 1, 100)
+	if err != nil {
+		t.Fatalf("Cant load join: %s", err)
+	}
+	if err := h.EnableStreaming(); err != nil {
+		t.Fatalf("Cant enable streaming: %s", err)
+	}
+	h.TokenComplete(enums.MF_GAMES)
+	if !review("1", 4) {
+		t.Fatalf("Expected an upsert after the restart")
+	}
+	defer h.Shutdown(true)
+
+	cr, ce := h.NextStage()
+	for r := range cr {
+		if r.Message == nil {
+			break
+		}
+		m := r.Message.(*schema.NamedReviewCounter)
+		if m.Count != 4 || r.Sequence != 4 {
+			t.Fatalf("Expected the final count of 4 after the upserts, got %v with sequence %d", m, r.Sequence)
+		}
+		r.SentCallback()
+	}
+	if err := <-ce; err != nil {
+		t.Fatalf("There was an error while making the next stage %s", err)
+	}
+}
@@ -0,0 +1,153 @@
+package business
+
+import (
+	"fmt"
+	"hash/fnv"
+	"middleware/common"
+	"middleware/worker/schema"
+	"sync"
+	"unicode"
+
+	"github.com/pemistahl/lingua-go"
+)
+
+type LanguageCacheConfig struct {
+	// Texts whose language is remembered, zero disables the cache
+	Size int
+	// Detectors, each with its own cache, kept for the language options of the jobs. At least one
+	Detectors int
+	// Texts with fewer letters have no language, the detector isn't asked about them. The ones
+	// without letters never get to it, even with zero
+	MinLetters int
+	// Texts with only ASCII characters are taken as english when the detector knows it.
+	// Much cheaper, but a spanish text without accents passes as english.
+	ASCIIAsEnglish bool
+	// Lookups between two logs of the hit rate, zero logs none. Report logs it too when a job
+	// finishes, the logs are the only place it shows up
+	ReportEvery int
+}
+
+type cachedLanguage struct {
+	language string
+	target   bool
+}
+
+// Sits in front of the detector. Reviews repeat the same short texts a lot, so the language
+// of the last texts is kept by the hash of their content, and the ones the detector can't
+// tell anything about aren't sent to it at all. Shared by the jobs with the same options.
+type LanguageCache struct {
+	classify ClassifyLanguage
+	cfg      LanguageCacheConfig
+	// Only set when the ASCII texts are taken as english
+	english *cachedLanguage
+
+	mu      sync.Mutex
+	entries *common.LRUCache[uint64, cachedLanguage]
+	// Lookups answered by the cache, by the detector and by the pre checks
+	hits      uint64
+	misses    uint64
+	prechecks uint64
+}
+
+func NewLanguageCache(o LanguageOptions, classify ClassifyLanguage, cfg LanguageCacheConfig) *LanguageCache {
+	c := &LanguageCache{
+		classify: classify,
+		cfg:      cfg,
+		entries:  common.NewLRUCache[uint64, cachedLanguage](cfg.Size),
+	}
+	if cfg.ASCIIAsEnglish && common.Contains(o.Languages, lingua.English) {
+		c.english = &cachedLanguage{language: languageName(lingua.English), target: common.Contains(o.Targets, lingua.English)}
+	}
+	return c
+}
+
+// The answer of the cheap checks, if they have one
+func (c *LanguageCache) precheck(s string) (cachedLanguage, bool) {
+	letters := 0
+	ascii := true
+	for _, r := range s {
+		if unicode.IsLetter(r) {
+			letters++
+		}
+		if r > unicode.MaxASCII {
+			ascii = false
+		}
+	}
+	if letters == 0 || letters < c.cfg.MinLetters {
+		// Empty, emojis or a couple of letters
+		return cachedLanguage{language: schema.UnknownLanguage}, true
+	}
+	if ascii && c.english != nil {
+		return *c.english, true
+	}
+	return cachedLanguage{}, false
+}
+
+func (c *LanguageCache) Classify(s string) (string, bool) {
+	if l, ok := c.precheck(s); ok {
+		c.count(&c.prechecks)
+		return l.language, l.target
+	}
+	if c.cfg.Size <= 0 {
+		c.count(&c.misses)
+		return c.classify(s)
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	key := h.Sum64()
+
+	c.mu.Lock()
+	l, ok := c.entries.Get(key)
+	c.mu.Unlock()
+	if ok {
+		c.count(&c.hits)
+		return l.language, l.target
+	}
+
+	// Not holding the lock, the other jobs keep using the cache meanwhile
+	language, target := c.classify(s)
+	c.mu.Lock()
+	c.entries.Put(key, cachedLanguage{language: language, target: target})
+	c.mu.Unlock()
+	c.count(&c.misses)
+	return language, target
+}
+
+func (c *LanguageCache) count(counter *uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	*counter++
+	lookups := c.hits + c.misses + c.prechecks
+	if c.cfg.ReportEvery > 0 && lookups%uint64(c.cfg.ReportEvery) == 0 {
+		c.logStats("Language Cache")
+	}
+}
+
+// Logs the stats so far, they are shared with the other jobs using the same options
+func (c *LanguageCache) Report(job string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.logStats(fmt.Sprintf("Language Cache %s", job))
+}
+
+func (c *LanguageCache) logStats(action string) {
+	log.Infof("Action: %s | Result: Success | Lookups: %d | Hits: %d | Misses: %d | Prechecks: %d | Hit Rate: %.2f%% | Size: %d",
+		action, c.hits+c.misses+c.prechecks, c.hits, c.misses, c.prechecks, c.hitRate(), c.entries.Len())
+}
+
+// Of the lookups that got to the cache, in percent
+func (c *LanguageCache) hitRate() float64 {
+	if c.hits+c.misses == 0 {
+		return 0
+	}
+	return 100 * float64(c.hits) / float64(c.hits+c.misses)
+}
+
+// Lookups answered by the cache, by the detector and by the pre checks
+func (c *LanguageCache) Stats() (hits uint64, misses uint64, prechecks uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses, c.prechecks
+}
@@ -0,0 +1,71 @@
+package business_test
+
+import (
+	"middleware/common"
+	"middleware/worker/business"
+	"middleware/worker/schema"
+	"testing"
+)
+
+func TestLanguageCacheSkipsTheDetector(t *testing.T) {
+	InitConfig()
+	common.Config.Set("query.four.languages", "english,spanish")
+	common.Config.Set("query.four.targets", "english")
+	common.Config.Set("query.four.minRelativeDistance", 0.9)
+	o, err := business.LanguageOptionsFor(nil)
+	FatalOnError(err, t, "Cannot read the options")
+
+	calls := 0
+	classify := func(s string) (string, bool) {
+		calls++
+		return "spanish", false
+	}
+
+	c := business.NewLanguageCache(o, classify, business.LanguageCacheConfig{Size: 2, MinLetters: 3})
+	texts := []string{"good game", "good game", "¡muy bueno!", "good game", "gg", "", "👍👍👍", "¡muy bueno!"}
+	for _, s := range texts {
+		c.Classify(s)
+	}
+	if calls != 2 {
+		t.Fatalf("Expected the detector to see the two different texts once, it saw %d", calls)
+	}
+	if hits, misses, prechecks := c.Stats(); hits != 3 || misses != 2 || prechecks != 3 {
+		t.Fatalf("Expected 3 hits, 2 misses and 3 prechecks, got %d %d %d", hits, misses, prechecks)
+	}
+	if language, target := c.Classify("gg"); language != schema.UnknownLanguage || target {
+		t.Fatalf("Expected a short text to have no language, got %s %t", language, target)
+	}
+
+	// Past its size the oldest text is detected again
+	c.Classify("another one")
+	c.Classify("and another")
+	c.Classify("good game")
+	if calls != 5 {
+		t.Fatalf("Expected the evicted text to be detected again, the detector was called %d times", calls)
+	}
+
+	ascii := business.NewLanguageCache(o, classify, business.LanguageCacheConfig{Size: 2, MinLetters: 3, ASCIIAsEnglish: true})
+	if language, target := ascii.Classify("es un juego"); language != "english" || !target {
+		t.Fatalf("Expected an ASCII text to be english, got %s %t", language, target)
+	}
+	if language, _ := ascii.Classify("¡muy bueno!"); language != "spanish" {
+		t.Fatalf("Expected a text with accents to go to the detector, got %s", language)
+	}
+	if calls != 6 {
+		t.Fatalf("Expected only the text with accents to reach the detector, it was called %d times", calls)
+	}
+
+	// Without a minimum the short texts go to the detector, the ones without letters still don't
+	off := business.NewLanguageCache(o, classify, business.LanguageCacheConfig{Size: 2})
+	if language, _ := off.Classify("gg"); language != "spanish" {
+		t.Fatalf("Expected a short text to go to the detector, got %s", language)
+	}
+	for _, s := range []string{"", "👍👍👍"} {
+		if language, target := off.Classify(s); language != schema.UnknownLanguage || target {
+			t.Fatalf("Expected a text without letters to have no language, got %s %t", language, target)
+		}
+	}
+	if _, _, prechecks := off.Stats(); prechecks != 2 || calls != 7 {
+		t.Fatalf("Expected 2 prechecks and the detector to be called once, got %d prechecks and %d calls", prechecks, calls)
+	}
+}
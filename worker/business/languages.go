@@ -0,0 +1,354 @@
+package business
+
+import (
+	"fmt"
+	"middleware/common"
+	"middleware/worker/controller"
+	"middleware/worker/schema"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pemistahl/lingua-go"
+)
+
+// Classifies a text, the name of its language and whether it's one the query wants
+type ClassifyLanguage func(string) (language string, target bool)
+
+type LanguageOptions struct {
+	// The detector only tells these apart, at least two
+	Languages []lingua.Language
+	Targets   []lingua.Language
+	// Between 0 and 0.99, texts whose two likeliest languages are closer have no language
+	MinRelativeDistance float64
+}
+
+func parseLanguages(s string) ([]lingua.Language, error) {
+	languages := make([]lingua.Language, 0)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		found := false
+		for _, l := range lingua.AllLanguages() {
+			if strings.EqualFold(l.String(), name) || strings.EqualFold(l.IsoCode639_1().String(), name) {
+				if !common.Contains(languages, l) {
+					languages = append(languages, l)
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown language %q", name)
+		}
+	}
+	return languages, nil
+}
+
+// The options of the job, with the config of query four for the ones it doesn't set
+func LanguageOptionsFor(options common.JobOptions) (LanguageOptions, error) {
+	languages, err := parseLanguages(options.Get(common.OptionLanguages, common.Config.GetString("query.four.languages")))
+	if err != nil {
+		return LanguageOptions{}, err
+	}
+	if len(languages) < 2 {
+		return LanguageOptions{}, fmt.Errorf("the detector needs at least two languages, got %d", len(languages))
+	}
+
+	targets, err := parseLanguages(options.Get(common.OptionTargetLanguages, common.Config.GetString("query.four.targets")))
+	if err != nil {
+		return LanguageOptions{}, err
+	}
+	if len(targets) == 0 {
+		return LanguageOptions{}, fmt.Errorf("no target languages")
+	}
+	for _, t := range targets {
+		if !common.Contains(languages, t) {
+			return LanguageOptions{}, fmt.Errorf("the target language %s isn't one the detector knows", t)
+		}
+	}
+
+	distance, err := strconv.ParseFloat(options.Get(common.OptionMinRelativeDistance, common.Config.GetString("query.four.minRelativeDistance")), 64)
+	if err != nil {
+		return LanguageOptions{}, fmt.Errorf("invalid min relative distance: %w", err)
+	}
+	if distance < 0 || distance > 0.99 {
+		return LanguageOptions{}, fmt.Errorf("the min relative distance must be between 0 and 0.99, got %g", distance)
+	}
+
+	return LanguageOptions{Languages: languages, Targets: targets, MinRelativeDistance: distance}, nil
+}
+
+func languageName(l lingua.Language) string {
+	return strings.ToLower(l.String())
+}
+
+func (o LanguageOptions) String() string {
+	names := func(ls []lingua.Language) string {
+		r := make([]string, len(ls))
+		for i, l := range ls {
+			r[i] = languageName(l)
+		}
+		sort.Strings(r)
+		return strings.Join(r, ",")
+	}
+	return fmt.Sprintf("languages=%s;targets=%s;minRelativeDistance=%g", names(o.Languages), names(o.Targets), o.MinRelativeDistance)
+}
+
+func NewLanguageClassifier(o LanguageOptions) ClassifyLanguage {
+	detector := lingua.NewLanguageDetectorBuilder().
+		FromLanguages(o.Languages...).
+		WithMinimumRelativeDistance(o.MinRelativeDistance).
+		Build()
+
+	return func(s string) (string, bool) {
+		lang, exists := detector.DetectLanguageOf(s)
+		if !exists {
+			return schema.UnknownLanguage, false
+		}
+		return languageName(lang), common.Contains(o.Targets, lang)
+	}
+}
+
+// Jobs with the same options share a detector and its cache, they are safe to use concurrently.
+// The clients pick the options, so only the last cfg.Detectors used are kept, the jobs still
+// running with an evicted one keep it until they finish.
+var (
+	classifiersMu sync.Mutex
+	classifiers   *common.LRUCache[string, *LanguageCache]
+)
+
+func LanguageClassifierFor(o LanguageOptions, cfg LanguageCacheConfig) *LanguageCache {
+	classifiersMu.Lock()
+	defer classifiersMu.Unlock()
+
+	if classifiers == nil {
+		classifiers = common.NewLRUCache[string, *LanguageCache](cfg.Detectors)
+	}
+	c, ok := classifiers.Get(o.String())
+	if !ok {
+		c = NewLanguageCache(o, NewLanguageClassifier(o), cfg)
+		classifiers.Put(o.String(), c)
+	}
+	return c
+}
+
+// Only keeps the target languages
+func TargetLanguages(classify ClassifyLanguage) DetectLanguage {
+	return func(s string) bool {
+		_, target := classify(s)
+		return target
+	}
+}
+
+// Counts of every language saved line by line and added up in memory
+type languageTallies struct {
+	storage *common.IdempotencyHandlerSingleFile[*schema.LanguageCount]
+	counts  map[string]uint32
+}
+
+func newLanguageTallies(basefiles string) (*languageTallies, error) {
+	s, err := common.NewIdempotencyHandlerSingleFile[*schema.LanguageCount](filepath.Join(basefiles, "languages"))
+	if err != nil {
+		return nil, err
+	}
+
+	l := &languageTallies{storage: s, counts: make(map[string]uint32)}
+	_, err = s.LoadSequentialState(
+		schema.LanguageCountDeserialize,
+		func(acc *schema.LanguageCount, line *schema.LanguageCount) *schema.LanguageCount {
+			l.counts[line.Language] += line.Reviews
+			return acc
+		},
+		nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *languageTallies) Save(c *schema.LanguageCount, idempotencyID *common.IdempotencyID) error {
+	if l.storage.AlreadyProcessed(idempotencyID) {
+		log.Debugf("Action: Saving Language Count | Result: Already processed | IdempotencyID: %s", idempotencyID)
+		return nil
+	}
+	if err := l.storage.SaveState(idempotencyID, c); err != nil {
+		return err
+	}
+	l.counts[c.Language] += c.Reviews
+	return nil
+}
+
+// By language, so a restart sends them with the same sequences
+func (l *languageTallies) Sorted() []*schema.LanguageCount {
+	r := make([]*schema.LanguageCount, 0, len(l.counts))
+	for language, reviews := range l.counts {
+		r = append(r, &schema.LanguageCount{Language: language, Reviews: reviews})
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].Language < r[j].Language })
+	return r
+}
+
+func (l *languageTallies) Shutdown(delete bool) {
+	l.storage.Close()
+	if delete {
+		if err := l.storage.Delete(); err != nil {
+			log.Errorf("Action: Deleting Language Counts File | Result: Error | Error: %s", err)
+		}
+	}
+}
+
+// Whether the job wants the languages of its reviews counted, the config of query four if it
+// doesn't say
+func LanguageBreakdownFor(options common.JobOptions) (bool, error) {
+	enabled, err := strconv.ParseBool(options.Get(common.OptionLanguageBreakdown, common.Config.GetString("query.four.languageBreakdown")))
+	if err != nil {
+		return false, fmt.Errorf("invalid language breakdown: %w", err)
+	}
+	return enabled, nil
+}
+
+// Language counts of a batch of reviews and the sequence of the last one
+type languageBatch struct {
+	sequence uint32
+	counts   *common.ArraySerialize[*schema.LanguageCount]
+}
+
+func (b *languageBatch) Serialize() []byte {
+	se := common.NewSerializer()
+	return se.WriteUint32(b.sequence).WriteBytes(b.counts.Serialize()).ToBytes()
+}
+
+func languageBatchDeserialize(d *common.Deserializer) (*languageBatch, error) {
+	seq, err := d.ReadUint32()
+	if err != nil {
+		return nil, err
+	}
+	counts, err := common.ReadArray(schema.LanguageCountDeserialize)(d)
+	if err != nil {
+		return nil, err
+	}
+	return &languageBatch{sequence: seq, counts: counts}, nil
+}
+
+// Counts the languages a map filter finds while it filters. The counts are saved once every
+// batch of reviews and when the reviews end, the ones of a batch that wasn't saved are lost
+// if the worker goes down, the reviews were already acked.
+type LanguageBreakdown struct {
+	storage   *common.IdempotencyHandlerSingleFile[*languageBatch]
+	saved     map[string]uint32
+	batch     map[string]uint32
+	batchSize int
+	reviews   int
+	// Of the last review counted, the counts are sent after it
+	last     *common.IdempotencyID
+	sequence uint32
+	seen     *common.IdempotencyStore
+}
+
+func NewLanguageBreakdown(basefiles string, batchSize int) (*LanguageBreakdown, error) {
+	s, err := common.NewIdempotencyHandlerSingleFile[*languageBatch](filepath.Join(basefiles, "languages"))
+	if err != nil {
+		return nil, err
+	}
+
+	b := &LanguageBreakdown{
+		storage:   s,
+		saved:     make(map[string]uint32),
+		batch:     make(map[string]uint32),
+		batchSize: max(batchSize, 1),
+		seen:      common.NewIdempotencyStore(),
+	}
+	_, err = s.LoadSequentialState(
+		languageBatchDeserialize,
+		func(acc *languageBatch, line *languageBatch) *languageBatch {
+			for _, c := range line.counts.Arr {
+				b.saved[c.Language] += c.Reviews
+			}
+			b.sequence = max(b.sequence, line.sequence)
+			return acc
+		},
+		nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Counts the language the filter found for a review, empty when it didn't run the detector
+func (b *LanguageBreakdown) Count(language string, idempotencyID *common.IdempotencyID) error {
+	if b.storage.AlreadyProcessed(idempotencyID) || b.seen.AlreadyProcessed(idempotencyID) {
+		log.Debugf("Action: Counting Language | Result: Already processed | IdempotencyID: %s", idempotencyID)
+		return nil
+	}
+	b.seen.Save(idempotencyID)
+	b.last = idempotencyID
+	b.sequence = max(b.sequence, idempotencyID.Sequence)
+	if language != "" {
+		b.batch[language]++
+	}
+
+	b.reviews++
+	if b.reviews < b.batchSize {
+		return nil
+	}
+	return b.save()
+}
+
+func (b *LanguageBreakdown) save() error {
+	if b.last == nil || b.reviews == 0 {
+		return nil
+	}
+	counts := make([]*schema.LanguageCount, 0, len(b.batch))
+	for language, reviews := range b.batch {
+		counts = append(counts, &schema.LanguageCount{Language: language, Reviews: reviews})
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i].Language < counts[j].Language })
+	line := &languageBatch{sequence: b.sequence, counts: &common.ArraySerialize[*schema.LanguageCount]{Arr: counts}}
+	if err := b.storage.SaveState(b.last, line); err != nil {
+		return err
+	}
+	for _, c := range counts {
+		b.saved[c.Language] += c.Reviews
+	}
+	b.batch = make(map[string]uint32)
+	b.reviews = 0
+	return nil
+}
+
+// Saves the batch in progress. By language, numbered after the last review counted, so a
+// restart sends them with the same sequences.
+func (b *LanguageBreakdown) Counts() ([]*controller.NextStageMessage, error) {
+	if err := b.save(); err != nil {
+		return nil, err
+	}
+	languages := make([]string, 0, len(b.saved))
+	for language := range b.saved {
+		languages = append(languages, language)
+	}
+	sort.Strings(languages)
+
+	r := make([]*controller.NextStageMessage, len(languages))
+	for i, language := range languages {
+		r[i] = &controller.NextStageMessage{
+			Message:  &schema.LanguageCount{Language: language, Reviews: b.saved[language]},
+			Sequence: b.sequence + uint32(i+1),
+		}
+	}
+	return r, nil
+}
+
+func (b *LanguageBreakdown) Shutdown(delete bool) {
+	b.storage.Close()
+	if delete {
+		if err := b.storage.Delete(); err != nil {
+			log.Errorf("Action: Deleting Language Breakdown File | Result: Error | Error: %s", err)
+		}
+	}
+}
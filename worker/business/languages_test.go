@@ -0,0 +1,159 @@
+package business_test
+
+import (
+	"fmt"
+	"middleware/common"
+	"middleware/worker/business"
+	"middleware/worker/controller"
+	"middleware/worker/schema"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestQ4LanguageOptions(t *testing.T) {
+	InitConfig()
+	common.Config.Set("query.four.languages", "english,spanish")
+	common.Config.Set("query.four.targets", "english")
+	common.Config.Set("query.four.minRelativeDistance", 0.9)
+
+	o, err := business.LanguageOptionsFor(nil)
+	FatalOnError(err, t, "Cannot read the default options")
+	if o.String() != "languages=english,spanish;targets=english;minRelativeDistance=0.9" {
+		t.Fatalf("Unexpected default options %s", o)
+	}
+
+	o, err = business.LanguageOptionsFor(common.JobOptions{
+		common.OptionLanguages:       "EN, es,Portuguese",
+		common.OptionTargetLanguages: "spanish,portuguese",
+	})
+	FatalOnError(err, t, "Cannot read the options of the job")
+	if o.String() != "languages=english,portuguese,spanish;targets=portuguese,spanish;minRelativeDistance=0.9" {
+		t.Fatalf("Unexpected options of the job %s", o)
+	}
+
+	invalid := []common.JobOptions{
+		{common.OptionLanguages: "english"},
+		{common.OptionLanguages: "english,klingon"},
+		{common.OptionTargetLanguages: "french"},
+		{common.OptionMinRelativeDistance: "1.5"},
+	}
+	for _, options := range invalid {
+		if _, err := business.LanguageOptionsFor(options); err == nil {
+			t.Fatalf("Expected the options %s to be rejected", options)
+		}
+	}
+}
+
+func TestQ4LanguageBreakdown(t *testing.T) {
+	InitConfig()
+	common.Config.Set("query.four.positive", false)
+	base := filepath.Join("test_files", "languages")
+
+	// The text is the language, so the test doesn't depend on the detector
+	classify := func(s string) (string, bool) {
+		if s == "" {
+			return schema.UnknownLanguage, false
+		}
+		return s, s == "english"
+	}
+	reviews := []*schema.Review{
+		{AppID: "1", ReviewText: "english", ReviewScore: -1},
+		{AppID: "1", ReviewText: "spanish", ReviewScore: -1},
+		{AppID: "2", ReviewText: "english", ReviewScore: -1},
+		{AppID: "2", ReviewText: "", ReviewScore: -1},
+		// Filtered by its score before the detector sees it
+		{AppID: "3", ReviewText: "english", ReviewScore: 1},
+	}
+
+	newMapFilter := func() *business.MapFilterReviews {
+		mf, err := business.NewMapFilterReviews(base, "id", "Q4R", 1, business.Q4MapReviews, nil)
+		FatalOnError(err, t, "Cannot create the map filter")
+		FatalOnError(mf.EnableLanguageBreakdown(classify, business.Q4FilterReviewsBuilder, 2), t, "Cannot enable the language breakdown")
+		FatalOnError(mf.EnableHotKeys(business.HotKeysConfig{Threshold: 1, Fanout: 2, Width: 16, Depth: 2}), t, "Cannot enable the hot keys")
+		if !mf.Stateless() {
+			t.Fatalf("Expected the map filter to still run in the pool")
+		}
+		return mf
+	}
+
+	// Like the pool, Do runs for every review at once and Settle in the order they came
+	filter := func(mf *business.MapFilterReviews) int {
+		outs := make([]*controller.NextStageMessage, len(reviews))
+		var wg sync.WaitGroup
+		for i, r := range reviews {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				out, err := mf.Do(r, &common.IdempotencyID{Origin: "SV", Sequence: uint32(i + 1)})
+				if err != nil {
+					t.Errorf("Cannot filter the review: %s", err)
+				}
+				outs[i] = out
+			}()
+		}
+		wg.Wait()
+
+		passed := 0
+		for i, out := range outs {
+			out, err := mf.Settle(out, &common.IdempotencyID{Origin: "SV", Sequence: uint32(i + 1)})
+			FatalOnError(err, t, "Cannot settle the review")
+			if out != nil {
+				passed++
+			}
+		}
+		return passed
+	}
+
+	mf := newMapFilter()
+	if passed := filter(mf); passed != 2 {
+		t.Fatalf("Expected the two negative english reviews to pass, got %d", passed)
+	}
+
+	// Everything comes again after a restart, nothing is counted twice. The last review wasn't
+	// in a full batch yet, it's counted again.
+	mf.Shutdown(false)
+	mf = newMapFilter()
+	defer mf.Shutdown(true)
+	filter(mf)
+
+	join, err := business.NewJoin(base, "query_four", "id", 1, 10)
+	FatalOnError(err, t, "Cannot create the join")
+	defer join.Shutdown(true)
+	FatalOnError(join.EnableLanguageBreakdown(), t, "Cannot enable the language breakdown of the join")
+
+	cr, ce := mf.NextStage()
+	for r := range cr {
+		if r.Sequence <= uint32(len(reviews)) {
+			t.Fatalf("Expected the counts to come after the last review, got the sequence %d", r.Sequence)
+		}
+		data, err := schema.MarshalMessage(r.Message)
+		FatalOnError(err, t, "Cannot marshal the counts")
+		// The counts come twice, like after a restart of the map filter in the middle
+		for range 2 {
+			_, err = join.Handle(data, &common.IdempotencyID{Origin: "MFRQ4_1", Sequence: r.Sequence})
+			FatalOnError(err, t, "Cannot handle the counts")
+		}
+	}
+	FatalOnError(<-ce, t, "Cannot make the next stage of the map filter")
+
+	final, err := business.NewQ4(base, "id", 1, 5000, 10)
+	FatalOnError(err, t, "Cannot create the stage three")
+	defer final.Shutdown(true)
+	cr, ce = join.NextStage()
+	drainPhase(t, cr, ce, "Q4S2_1", final)
+
+	counts := make([]string, 0)
+	cr, ce = final.NextStage()
+	for r := range cr {
+		if r.Message != nil {
+			counts = append(counts, fmt.Sprint(r.Message.(*schema.LanguageCount).ToCSV()))
+		}
+	}
+	FatalOnError(<-ce, t, "Cannot make the next stage")
+
+	expected := []string{"[english 2]", "[spanish 1]", "[unknown 1]"}
+	if fmt.Sprint(counts) != fmt.Sprint(expected) {
+		t.Fatalf("Expected the breakdown %v, got %v", expected, counts)
+	}
+}
@@ -2,11 +2,13 @@ package business
 
 import (
 	"fmt"
+	"math"
 	"middleware/common"
 	"middleware/worker/controller"
 	"middleware/worker/schema"
 	"path/filepath"
 	"reflect"
+	"sync"
 )
 
 type FilterGame func(*schema.Game) bool
@@ -20,6 +22,7 @@ type MapFilterGames struct {
 	Mapper    MapGame
 	basefiles string
 	state     *common.IdempotencyHandlerSingleFile[*NullState]
+	window    *CombineWindow
 }
 
 func NewMapFilterGames(base string, id string, query string, partition int, mapper MapGame, filter FilterGame) (*MapFilterGames, error) {
@@ -73,12 +76,83 @@ func (mf *MapFilterGames) Handle(protocolData []byte, idempotencyID *common.Idem
 	return nil, &schema.UnknownTypeError{}
 }
 
+// Pre aggregates the mapped values in a window of the given size before forwarding them.
+func (mf *MapFilterGames) EnableCombiner(combiner Combiner, size int) error {
+	if size <= 1 {
+		return nil
+	}
+	w, err := NewCombineWindow(filepath.Join(mf.basefiles, "combine"), combiner, size)
+	if err != nil {
+		return err
+	}
+	mf.window = w
+	return nil
+}
+
+// Without a combine window every message is mapped on its own
+func (mf *MapFilterGames) Stateless() bool {
+	return mf.window == nil
+}
+
+func (mf *MapFilterGames) HandleMultiple(protocolData []byte, idempotencyID *common.IdempotencyID) ([]*controller.NextStageMessage, error) {
+	if mf.window == nil {
+		out, err := mf.Handle(protocolData, idempotencyID)
+		if err != nil || out == nil {
+			return nil, err
+		}
+		return []*controller.NextStageMessage{out}, nil
+	}
+
+	// Anything that couldn't be confirmed as sent before a restart goes first
+	pending := mf.window.TakePending()
+
+	if mf.window.AlreadyProcessed(idempotencyID) {
+		log.Debugf("Action: Combining %s | Result: Already processed | IdempotencyID: %s", mf.basefiles, idempotencyID)
+		return pending, nil
+	}
+
+	out, err := mf.Handle(protocolData, idempotencyID)
+	if err != nil {
+		return nil, err
+	}
+	if out == nil || out.Message == nil {
+		return pending, nil
+	}
+
+	if err = mf.window.Add(out.Message, idempotencyID); err != nil {
+		return nil, err
+	}
+
+	if !mf.window.IsFull() {
+		return pending, nil
+	}
+
+	flushed, err := mf.window.Flush()
+	if err != nil {
+		return nil, err
+	}
+	return append(pending, flushed...), nil
+}
+
 func (mf *MapFilterGames) NextStage() (<-chan *controller.NextStageMessage, <-chan error) {
 	cr := make(chan *controller.NextStageMessage, 1)
 	ce := make(chan error, 1)
 	go func() {
 		defer close(cr)
 		defer close(ce)
+
+		if mf.window == nil {
+			return
+		}
+
+		flushed, err := mf.window.Flush()
+		if err != nil {
+			ce <- err
+			return
+		}
+		for _, m := range flushed {
+			cr <- m
+		}
 	}()
 
 	return cr, ce
@@ -86,6 +160,9 @@ func (mf *MapFilterGames) NextStage() (<-chan *controller.NextStageMessage, <-ch
 
 func (mf *MapFilterGames) Shutdown(delete bool) {
 	mf.state.Close()
+	if mf.window != nil {
+		mf.window.Shutdown(delete)
+	}
 	if delete {
 		mf.state.Delete()
 	}
@@ -96,6 +173,16 @@ type MapFilterReviews struct {
 	Mapper    MapReview
 	basefiles string
 	state     *common.IdempotencyHandlerSingleFile[*NullState]
+	window    *CombineWindow
+	hotKeys   *HotKeys
+	languages *LanguageBreakdown
+	// The filter is built for every review with a detector that tells the language it found
+	languageFilter func(DetectLanguage) FilterReview
+	classify       ClassifyLanguage
+	// Its stats are logged when the job finishes, if set
+	LanguageCache *LanguageCache
+	// Language Do found for each review until it's settled, Do may run in the pool
+	detected sync.Map
 }
 
 func NewMapFilterReviews(base string, id string, query string, partition int, mapper MapReview, filter FilterReview) (*MapFilterReviews, error) {
@@ -121,15 +208,10 @@ func NewMapFilterReviews(base string, id string, query string, partition int, ma
 	}, nil
 }
 
+// Filters and maps the review without touching the hot keys or the language counts, Settle
+// updates them with what it found
 func (mf *MapFilterReviews) Do(r *schema.Review, idempotencyID *common.IdempotencyID) (*controller.NextStageMessage, error) {
-	if mf.Filter == nil {
-		return &controller.NextStageMessage{
-			Message:  mf.Mapper(r),
-			Sequence: idempotencyID.Sequence,
-		}, nil
-	}
-	ok := mf.Filter(r)
-	if !ok {
+	if !mf.filter(r, idempotencyID) {
 		return nil, nil
 	}
 	return &controller.NextStageMessage{
@@ -138,6 +220,42 @@ func (mf *MapFilterReviews) Do(r *schema.Review, idempotencyID *common.Idempoten
 	}, nil
 }
 
+func (mf *MapFilterReviews) filter(r *schema.Review, idempotencyID *common.IdempotencyID) bool {
+	if mf.languages == nil {
+		return mf.Filter == nil || mf.Filter(r)
+	}
+	// Empty when the filter didn't run the detector on the review
+	language := ""
+	pass := mf.languageFilter(func(s string) bool {
+		l, target := mf.classify(s)
+		language = l
+		return target
+	})(r)
+	mf.detected.Store(*idempotencyID, language)
+	return pass
+}
+
+// Counts the language Do found and salts the review when its game is hot. Called with the
+// output of Do in the order the messages arrived, even the ones the filter dropped.
+func (mf *MapFilterReviews) Settle(out *controller.NextStageMessage, idempotencyID *common.IdempotencyID) (*controller.NextStageMessage, error) {
+	if mf.languages != nil {
+		language, _ := mf.detected.LoadAndDelete(*idempotencyID)
+		l, _ := language.(string)
+		if err := mf.languages.Count(l, idempotencyID); err != nil {
+			return nil, err
+		}
+	}
+	if out == nil || out.Message == nil || mf.hotKeys == nil {
+		return out, nil
+	}
+	m, err := mf.hotKeys.Spread(out.Message, idempotencyID)
+	if err != nil {
+		return nil, err
+	}
+	out.Message = m
+	return out, nil
+}
+
 func (mf *MapFilterReviews) Handle(protocolData []byte, idempotencyID *common.IdempotencyID) (*controller.NextStageMessage, error) {
 	p, err := schema.UnmarshalMessage(protocolData)
 	if err != nil {
@@ -149,12 +267,129 @@ func (mf *MapFilterReviews) Handle(protocolData []byte, idempotencyID *common.Id
 	return nil, &schema.UnknownTypeError{}
 }
 
+// Pre aggregates the mapped values in a window of the given size before forwarding them.
+func (mf *MapFilterReviews) EnableCombiner(combiner Combiner, size int) error {
+	if size <= 1 {
+		return nil
+	}
+	w, err := NewCombineWindow(filepath.Join(mf.basefiles, "combine"), combiner, size)
+	if err != nil {
+		return err
+	}
+	mf.window = w
+	return nil
+}
+
+// Salts the reviews of the games that turn out to be hot, see HotKeys
+func (mf *MapFilterReviews) EnableHotKeys(cfg HotKeysConfig) error {
+	if cfg.Threshold == 0 {
+		return nil
+	}
+	cfg.Fanout = min(max(cfg.Fanout, 1), math.MaxUint8)
+	h, err := NewHotKeys(mf.basefiles, cfg)
+	if err != nil {
+		return err
+	}
+	mf.hotKeys = h
+	return nil
+}
+
+// Counts the languages the filter finds, see LanguageBreakdown. It replaces the filter by
+// the one the builder makes with the detector of the breakdown.
+func (mf *MapFilterReviews) EnableLanguageBreakdown(classify ClassifyLanguage, builder func(DetectLanguage) FilterReview, batchSize int) error {
+	b, err := NewLanguageBreakdown(mf.basefiles, batchSize)
+	if err != nil {
+		return err
+	}
+	mf.languages = b
+	mf.classify = classify
+	mf.languageFilter = builder
+	return nil
+}
+
+// Without a combine window every message is mapped on its own, the hot keys and the
+// language counts are only updated in Settle
+func (mf *MapFilterReviews) Stateless() bool {
+	return mf.window == nil
+}
+
+// Handle and then Settle, for the runtimes that don't use the pool
+func (mf *MapFilterReviews) handleAndSettle(protocolData []byte, idempotencyID *common.IdempotencyID) (*controller.NextStageMessage, error) {
+	out, err := mf.Handle(protocolData, idempotencyID)
+	if err != nil {
+		return nil, err
+	}
+	return mf.Settle(out, idempotencyID)
+}
+
+func (mf *MapFilterReviews) HandleMultiple(protocolData []byte, idempotencyID *common.IdempotencyID) ([]*controller.NextStageMessage, error) {
+	if mf.window == nil {
+		out, err := mf.handleAndSettle(protocolData, idempotencyID)
+		if err != nil || out == nil {
+			return nil, err
+		}
+		return []*controller.NextStageMessage{out}, nil
+	}
+
+	// Anything that couldn't be confirmed as sent before a restart goes first
+	pending := mf.window.TakePending()
+
+	if mf.window.AlreadyProcessed(idempotencyID) {
+		log.Debugf("Action: Combining %s | Result: Already processed | IdempotencyID: %s", mf.basefiles, idempotencyID)
+		return pending, nil
+	}
+
+	out, err := mf.handleAndSettle(protocolData, idempotencyID)
+	if err != nil {
+		return nil, err
+	}
+	if out == nil || out.Message == nil {
+		return pending, nil
+	}
+
+	if err = mf.window.Add(out.Message, idempotencyID); err != nil {
+		return nil, err
+	}
+
+	if !mf.window.IsFull() {
+		return pending, nil
+	}
+
+	flushed, err := mf.window.Flush()
+	if err != nil {
+		return nil, err
+	}
+	return append(pending, flushed...), nil
+}
+
 func (mf *MapFilterReviews) NextStage() (<-chan *controller.NextStageMessage, <-chan error) {
 	cr := make(chan *controller.NextStageMessage, 1)
 	ce := make(chan error, 1)
 	go func() {
 		defer close(cr)
 		defer close(ce)
+
+		if mf.window != nil {
+			flushed, err := mf.window.Flush()
+			if err != nil {
+				ce <- err
+				return
+			}
+			for _, m := range flushed {
+				cr <- m
+			}
+		}
+
+		if mf.languages != nil {
+			counts, err := mf.languages.Counts()
+			if err != nil {
+				ce <- err
+				return
+			}
+			for _, m := range counts {
+				cr <- m
+			}
+		}
 	}()
 
 	return cr, ce
@@ -162,7 +397,19 @@ func (mf *MapFilterReviews) NextStage() (<-chan *controller.NextStageMessage, <-
 
 func (mf *MapFilterReviews) Shutdown(delete bool) {
 	mf.state.Close()
+	if mf.window != nil {
+		mf.window.Shutdown(delete)
+	}
+	if mf.hotKeys != nil {
+		mf.hotKeys.Shutdown(delete)
+	}
+	if mf.languages != nil {
+		mf.languages.Shutdown(delete)
+	}
 	if delete {
 		mf.state.Delete()
+		if mf.LanguageCache != nil {
+			mf.LanguageCache.Report(filepath.Base(mf.basefiles))
+		}
 	}
 }
@@ -20,8 +20,9 @@ func NewHeap() *MinHeap {
 
 func (h MinHeap) Len() int { return len(h) }
 
+// Ascending, the reverse of the order of the results so ties always come out the same way
 func (h MinHeap) Less(i, j int) bool {
-	return h[i].Review.Count < h[j].Review.Count
+	return schema.NamedReviewCounterBefore(&h[j].Review, &h[i].Review)
 }
 
 func (h MinHeap) Swap(i, j int) {
@@ -39,3 +40,42 @@ func (h *MinHeap) Pop() interface{} {
 	*h = old[0 : n-1]
 	return x
 }
+
+// Min heap of any type, for container/heap, ordered by less
+type Heap[T any] struct {
+	items []T
+	less  func(a, b T) bool
+}
+
+func NewGenericHeap[T any](less func(a, b T) bool) *Heap[T] {
+	h := &Heap[T]{items: make([]T, 0), less: less}
+	heap.Init(h)
+	return h
+}
+
+func (h *Heap[T]) Len() int { return len(h.items) }
+
+func (h *Heap[T]) Less(i, j int) bool {
+	return h.less(h.items[i], h.items[j])
+}
+
+func (h *Heap[T]) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+}
+
+func (h *Heap[T]) Push(x interface{}) {
+	h.items = append(h.items, x.(T))
+}
+
+func (h *Heap[T]) Pop() interface{} {
+	old := h.items
+	n := len(old)
+	x := old[n-1]
+	h.items = old[0 : n-1]
+	return x
+}
+
+// The smallest one, the heap must not be empty
+func (h *Heap[T]) Peek() T {
+	return h.items[0]
+}
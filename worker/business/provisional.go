@@ -0,0 +1,170 @@
+package business
+
+import (
+	"fmt"
+	"middleware/common"
+	"middleware/worker/controller"
+	"middleware/worker/schema"
+	"sort"
+	"strconv"
+)
+
+// Orders the provisional counts of a query the way its results are, without the games it
+// wouldn't send
+type ProvisionalRank func(games []*schema.NamedReviewCounter) []*schema.NamedReviewCounter
+
+func sortCounters(games []*schema.NamedReviewCounter) []*schema.NamedReviewCounter {
+	sort.Slice(games, func(i, j int) bool { return schema.NamedReviewCounterBefore(games[i], games[j]) })
+	return games
+}
+
+// The games with the most reviews, as many as the query sends
+func Q3ProvisionalRank(top int) ProvisionalRank {
+	return func(games []*schema.NamedReviewCounter) []*schema.NamedReviewCounter {
+		games = sortCounters(games)
+		return games[:min(top, len(games))]
+	}
+}
+
+// The games over the threshold
+func Q4ProvisionalRank(over int) ProvisionalRank {
+	return func(games []*schema.NamedReviewCounter) []*schema.NamedReviewCounter {
+		kept := make([]*schema.NamedReviewCounter, 0)
+		for _, g := range games {
+			if g.Count > uint32(over) {
+				kept = append(kept, g)
+			}
+		}
+		return sortCounters(kept)
+	}
+}
+
+// The games at or over the percentile of the counts seen so far
+func Q5ProvisionalRank(percentile int) ProvisionalRank {
+	return func(games []*schema.NamedReviewCounter) []*schema.NamedReviewCounter {
+		counts := make([]uint32, 0, len(games))
+		for _, g := range games {
+			if g.Count > 0 {
+				counts = append(counts, g.Count)
+			}
+		}
+		if len(counts) == 0 {
+			return nil
+		}
+		sort.Slice(counts, func(i, j int) bool { return counts[i] < counts[j] })
+		threshold := counts[min(Q5CalculatePi(len(counts), uint32(percentile)), len(counts)-1)]
+
+		kept := make([]*schema.NamedReviewCounter, 0)
+		for _, g := range games {
+			if g.Count > 0 && g.Count >= threshold {
+				kept = append(kept, g)
+			}
+		}
+		return sortCounters(kept)
+	}
+}
+
+// Whether the job streams the counts of its joins, the config of the workers if it doesn't say
+func StreamingFor(options common.JobOptions) (bool, error) {
+	enabled, err := strconv.ParseBool(options.Get(common.OptionStreaming, common.Config.GetString("streamingJoin.enabled")))
+	if err != nil {
+		return false, fmt.Errorf("invalid streaming: %w", err)
+	}
+	return enabled, nil
+}
+
+// Sits in front of a stage three handler fed by streaming joins. Their upserts only make
+// a provisional top, kept in memory and sent with the results from time to time, the query
+// itself only gets the final counts. An upsert replaces the last one of its game, and the
+// first final count of a join retracts every upsert it sent, as it's about to send them all
+// for real.
+type Provisional struct {
+	inner controller.Handler
+	query string
+	rank  ProvisionalRank
+	top   int
+	every int
+
+	counts    map[string]map[string]*schema.ReviewCounterUpsert
+	idemStore *common.IdempotencyStore
+	received  int
+}
+
+func NewProvisional(inner controller.Handler, query string, rank ProvisionalRank, top int, every int) *Provisional {
+	return &Provisional{
+		inner:     inner,
+		query:     query,
+		rank:      rank,
+		top:       top,
+		every:     max(every, 1),
+		counts:    make(map[string]map[string]*schema.ReviewCounterUpsert),
+		idemStore: common.NewIdempotencyStore(),
+	}
+}
+
+func (p *Provisional) Handle(protocolData []byte, idempotencyID *common.IdempotencyID) (*controller.NextStageMessage, error) {
+	m, err := schema.UnmarshalMessage(protocolData)
+	if err != nil {
+		return nil, err
+	}
+
+	u, ok := m.(*schema.ReviewCounterUpsert)
+	if !ok {
+		delete(p.counts, idempotencyID.Origin)
+		return p.inner.Handle(protocolData, idempotencyID)
+	}
+
+	// Lost after a restart, the next upserts bring it back
+	if p.idemStore.AlreadyProcessed(idempotencyID) {
+		return nil, nil
+	}
+	p.idemStore.Save(idempotencyID)
+
+	counts, ok := p.counts[idempotencyID.Origin]
+	if !ok {
+		counts = make(map[string]*schema.ReviewCounterUpsert)
+		p.counts[idempotencyID.Origin] = counts
+	}
+	counts[u.AppID] = u
+
+	p.received++
+	if p.received%p.every != 0 {
+		return nil, nil
+	}
+	top := p.Top()
+	log.Debugf("Action: Provisional Top %s | Result: Success | Upserts: %d | Games: %d", p.query, p.received, len(top.Games))
+	// The server keeps the last top apart from the results, its sequence only has to grow
+	return &controller.NextStageMessage{
+		Message:  top,
+		Sequence: uint32(p.received),
+	}, nil
+}
+
+// The games the query would send now, at most top of them
+func (p *Provisional) Top() *schema.ProvisionalTop {
+	all := make([]*schema.NamedReviewCounter, 0)
+	for _, counts := range p.counts {
+		for _, u := range counts {
+			all = append(all, &schema.NamedReviewCounter{AppID: u.AppID, Name: u.Name, Count: u.Count})
+		}
+	}
+	games := p.rank(all)
+	return &schema.ProvisionalTop{
+		Query:   p.query,
+		Upserts: uint32(p.received),
+		Games:   games[:min(p.top, len(games))],
+	}
+}
+
+func (p *Provisional) NextStage() (<-chan *controller.NextStageMessage, <-chan error) {
+	p.counts = make(map[string]map[string]*schema.ReviewCounterUpsert)
+	return p.inner.NextStage()
+}
+
+func (p *Provisional) EndPhase() (<-chan *controller.NextStageMessage, <-chan error) {
+	return endPhase(p.inner)
+}
+
+func (p *Provisional) Shutdown(delete bool) {
+	p.inner.Shutdown(delete)
+}
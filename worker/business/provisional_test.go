@@ -0,0 +1,97 @@
+package business_test
+
+import (
+	"middleware/common"
+	"middleware/worker/business"
+	"middleware/worker/controller"
+	"middleware/worker/schema"
+	"testing"
+)
+
+// Stage three handler that takes everything and sends nothing
+type discard struct{}
+
+func (discard) Handle([]byte, *common.IdempotencyID) (*controller.NextStageMessage, error) {
+	return nil, nil
+}
+
+func (discard) NextStage() (<-chan *controller.NextStageMessage, <-chan error) {
+	cr := make(chan *controller.NextStageMessage)
+	ce := make(chan error)
+	close(cr)
+	close(ce)
+	return cr, ce
+}
+
+func (discard) Shutdown(bool) {}
+
+// Sends an upsert of every count and returns the top of the last one
+func provisionalTop(t *testing.T, rank business.ProvisionalRank, counts []uint32) *schema.ProvisionalTop {
+	p := business.NewProvisional(discard{}, "Q", rank, 3, len(counts))
+	var out *controller.NextStageMessage
+	for i, c := range counts {
+		data, err := schema.MarshalMessage(&schema.ReviewCounterUpsert{AppID: string(rune('a' + i)), Name: string(rune('A' + i)), Count: c})
+		if err != nil {
+			t.Fatalf("Can't marshal an upsert: %s", err)
+		}
+		out, err = p.Handle(data, &common.IdempotencyID{Origin: "Q5S2_1", Sequence: uint32(i + 1)})
+		if err != nil {
+			t.Fatalf("Can't handle an upsert: %s", err)
+		}
+		if i < len(counts)-1 && out != nil {
+			t.Fatalf("Expected a top every %d upserts, got one after %d", len(counts), i+1)
+		}
+	}
+	if out == nil {
+		t.Fatalf("Expected a top after %d upserts", len(counts))
+	}
+
+	// It goes to the server as it is
+	data, err := schema.MarshalMessage(out.Message)
+	if err != nil {
+		t.Fatalf("Can't marshal the top: %s", err)
+	}
+	m, err := schema.UnmarshalMessage(data)
+	if err != nil {
+		t.Fatalf("Can't unmarshal the top: %s", err)
+	}
+	return m.(*schema.ProvisionalTop)
+}
+
+func names(top *schema.ProvisionalTop) []string {
+	n := make([]string, len(top.Games))
+	for i, g := range top.Games {
+		n[i] = g.Name
+	}
+	return n
+}
+
+func TestProvisionalTopsRankLikeTheirQuery(t *testing.T) {
+	counts := []uint32{4, 1, 9, 2, 7, 3, 0, 8, 5, 6}
+
+	cases := []struct {
+		name     string
+		rank     business.ProvisionalRank
+		expected []string
+	}{
+		// Its own top is shorter than the provisional one
+		{"Q3", business.Q3ProvisionalRank(2), []string{"C", "H"}},
+		// Only over the threshold, and no more than the provisional top
+		{"Q4", business.Q4ProvisionalRank(6), []string{"C", "H", "E"}},
+		// The 80th percentile of the nine games with reviews is 8
+		{"Q5", business.Q5ProvisionalRank(80), []string{"C", "H"}},
+	}
+
+	for _, c := range cases {
+		top := provisionalTop(t, c.rank, counts)
+		got := names(top)
+		if top.Upserts != uint32(len(counts)) || len(got) != len(c.expected) {
+			t.Fatalf("%s: expected %v after %d upserts, got %v after %d", c.name, c.expected, len(counts), got, top.Upserts)
+		}
+		for i := range got {
+			if got[i] != c.expected[i] {
+				t.Fatalf("%s: expected %v, got %v", c.name, c.expected, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package business
+
+import (
+	"fmt"
+	"middleware/common"
+	"middleware/worker/controller"
+	"middleware/worker/schema"
+	"path/filepath"
+	"sort"
+)
+
+func q8Granularity() string {
+	return common.Config.GetString("query.eight.granularity")
+}
+
+// Games without a release date we can read can't be placed in time
+func Q8FilterGames(r *schema.Game) bool {
+	if _, err := extractPeriod(r.ReleaseDate, q8Granularity()); err != nil {
+		return false
+	}
+	return len(distinctNames(r.Genres)) > 0
+}
+
+func Q8MapGames(r *schema.Game) schema.Partitionable {
+	period, _ := extractPeriod(r.ReleaseDate, q8Granularity())
+	return &schema.DatedGame{
+		AppID:  r.AppID,
+		Period: period,
+		Genres: distinctNames(r.Genres),
+	}
+}
+
+// Same tallies as Q7, the positive and the negative reviews of a game
+func Q8FilterReviews(r *schema.Review) bool {
+	return Q7FilterReviews(r)
+}
+
+func Q8MapReviews(r *schema.Review) schema.Partitionable {
+	return Q7MapReviews(r)
+}
+
+func sentimentKey(genre string, period string) string {
+	return genre + "|" + period
+}
+
+func sortedBuckets(buckets map[string]*schema.SentimentBucket) []*schema.SentimentBucket {
+	r := make([]*schema.SentimentBucket, 0, len(buckets))
+	for _, b := range buckets {
+		r = append(r, b)
+	}
+	sort.Slice(r, func(i, j int) bool { return schema.SentimentBucketBefore(r[i], r[j]) })
+	return r
+}
+
+// Sends the buckets in order with the sequences of their lines, so a restart sends the
+// same ones again
+func sendBuckets(basefiles string, read func() ([]*schema.SentimentBucket, error)) (<-chan *controller.NextStageMessage, <-chan error) {
+	ch := make(chan *controller.NextStageMessage)
+	ce := make(chan error, 1)
+
+	go func() {
+		defer close(ch)
+		defer close(ce)
+
+		buckets, err := read()
+		if err != nil {
+			ce <- err
+			return
+		}
+
+		fs, err := NewFileSequence(filepath.Join(basefiles, "sent_lines"))
+		if err != nil {
+			ce <- err
+			return
+		}
+		defer fs.Shutdown(true)
+
+		var line uint32 = 1
+		for _, b := range buckets {
+			if line > fs.LastConfirmedSent() {
+				ch <- &controller.NextStageMessage{
+					Message:      b,
+					Sequence:     line,
+					SentCallback: fs.Sent,
+				}
+			}
+			line++
+		}
+
+		ch <- &controller.NextStageMessage{
+			Message:      nil,
+			Sequence:     line,
+			SentCallback: nil,
+		}
+	}()
+
+	return ch, ce
+}
+
+// Stage two, joins the reviews of each game with its release period and genres
+type SentimentJoin struct {
+	gameStorage *common.IdempotencyHandlerSingleFile[*schema.DatedGame]
+	reviews     *reviewTallies
+	basefiles   string
+}
+
+func NewSentimentJoin(base string, id string, partition int) (*SentimentJoin, error) {
+	basefiles := filepath.Join(".", base, fmt.Sprintf("query_eight_%d", partition), "join", id)
+
+	g, err := common.NewIdempotencyHandlerSingleFile[*schema.DatedGame](filepath.Join(basefiles, "games"))
+	if err != nil {
+		return nil, err
+	}
+
+	// The games are read at the end, for now only the IdempotencyID
+	if _, err = g.LoadOverwriteState(schema.DatedGameDeserialize); err != nil {
+		return nil, err
+	}
+
+	r, err := newReviewTallies(basefiles)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SentimentJoin{
+		gameStorage: g,
+		reviews:     r,
+		basefiles:   basefiles,
+	}, nil
+}
+
+func (q *SentimentJoin) AddGame(g *schema.DatedGame, idempotencyID *common.IdempotencyID) error {
+	if q.gameStorage.AlreadyProcessed(idempotencyID) {
+		log.Debugf("Action: Saving Game to Sentiment Join | Result: Already processed | IdempotencyID: %s", idempotencyID)
+		return nil
+	}
+	return q.gameStorage.SaveState(idempotencyID, g)
+}
+
+// Games without reviews don't show up in the buckets
+func (q *SentimentJoin) buckets() ([]*schema.SentimentBucket, error) {
+	games, err := q.gameStorage.ReadState(schema.DatedGameDeserialize)
+	if err != nil {
+		return nil, err
+	}
+
+	buckets := make(map[string]*schema.SentimentBucket)
+	for g := range games {
+		r, ok := q.reviews.byGame[g.AppID]
+		if !ok {
+			continue
+		}
+		for _, genre := range g.Genres {
+			key := sentimentKey(genre, g.Period)
+			b, ok := buckets[key]
+			if !ok {
+				b = &schema.SentimentBucket{Genre: genre, Period: g.Period}
+				buckets[key] = b
+			}
+			b.Merge(&schema.SentimentBucket{Games: 1, Positive: r.Positive, Negative: r.Total - r.Positive})
+		}
+	}
+	return sortedBuckets(buckets), nil
+}
+
+func (q *SentimentJoin) NextStage() (<-chan *controller.NextStageMessage, <-chan error) {
+	return sendBuckets(q.basefiles, q.buckets)
+}
+
+func (q *SentimentJoin) Handle(protocolData []byte, idempotencyID *common.IdempotencyID) (*controller.NextStageMessage, error) {
+	p, err := schema.UnmarshalMessage(protocolData)
+	if err != nil {
+		return nil, err
+	}
+
+	switch v := p.(type) {
+	case *schema.DatedGame:
+		return nil, q.AddGame(v, idempotencyID)
+	case *schema.ReviewTally:
+		return nil, q.reviews.Save(v, idempotencyID)
+	}
+	return nil, &schema.UnknownTypeError{}
+}
+
+func (q *SentimentJoin) Shutdown(delete bool) {
+	q.gameStorage.Close()
+	q.reviews.Shutdown(delete)
+	if delete {
+		if err := q.gameStorage.Delete(); err != nil {
+			log.Errorf("Action: Deleting Sentiment Join Games File | Result: Error | Error: %s", err)
+		}
+	}
+}
+
+// Stage three, adds up the buckets of every join partition
+type Q8 struct {
+	buckets   map[string]*schema.SentimentBucket
+	storage   *common.IdempotencyHandlerSingleFile[*schema.SentimentBucket]
+	basefiles string
+}
+
+func NewQ8(base string, id string, partition int) (*Q8, error) {
+	basefiles := filepath.Join(".", base, fmt.Sprintf("query_eight_%d", partition), "stage_three", id)
+
+	s, err := common.NewIdempotencyHandlerSingleFile[*schema.SentimentBucket](filepath.Join(basefiles, "results"))
+	if err != nil {
+		return nil, err
+	}
+
+	q := &Q8{
+		buckets:   make(map[string]*schema.SentimentBucket),
+		storage:   s,
+		basefiles: basefiles,
+	}
+
+	_, err = s.LoadSequentialState(
+		schema.SentimentBucketDeserialize,
+		func(acc *schema.SentimentBucket, line *schema.SentimentBucket) *schema.SentimentBucket {
+			q.merge(line)
+			return acc
+		},
+		nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *Q8) merge(b *schema.SentimentBucket) {
+	key := sentimentKey(b.Genre, b.Period)
+	m, ok := q.buckets[key]
+	if !ok {
+		m = &schema.SentimentBucket{Genre: b.Genre, Period: b.Period}
+		q.buckets[key] = m
+	}
+	m.Merge(b)
+}
+
+func (q *Q8) sorted() ([]*schema.SentimentBucket, error) {
+	return sortedBuckets(q.buckets), nil
+}
+
+func (q *Q8) NextStage() (<-chan *controller.NextStageMessage, <-chan error) {
+	return sendBuckets(q.basefiles, q.sorted)
+}
+
+func (q *Q8) Handle(protocolData []byte, idempotencyID *common.IdempotencyID) (*controller.NextStageMessage, error) {
+	if q.storage.AlreadyProcessed(idempotencyID) {
+		log.Debugf("Action: Saving Sentiment Bucket | Result: Already processed | IdempotencyID: %s", idempotencyID)
+		return nil, nil
+	}
+	p, err := schema.UnmarshalMessage(protocolData)
+	if err != nil {
+		return nil, err
+	}
+
+	b, ok := p.(*schema.SentimentBucket)
+	if !ok {
+		return nil, &schema.UnknownTypeError{}
+	}
+	if err := q.storage.SaveState(idempotencyID, b); err != nil {
+		return nil, err
+	}
+	q.merge(b)
+	return nil, nil
+}
+
+func (q *Q8) Shutdown(delete bool) {
+	q.storage.Close()
+	if delete {
+		if err := q.storage.Delete(); err != nil {
+			log.Errorf("Action: Deleting Sentiment Buckets File | Result: Error | Error: %s", err)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package business_test
+
+import (
+	"fmt"
+	"middleware/common"
+	"middleware/worker/business"
+	"middleware/worker/schema"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestQ8Periods(t *testing.T) {
+	InitConfig()
+	game := &schema.Game{AppID: "1", ReleaseDate: "Nov 1, 2019", Genres: []string{"Indie"}}
+
+	expected := map[string]string{
+		"year":    "2019",
+		"quarter": "2019-Q4",
+		"decade":  "2010",
+	}
+	for granularity, period := range expected {
+		common.Config.Set("query.eight.granularity", granularity)
+		if !business.Q8FilterGames(game) {
+			t.Fatalf("Expected the game to pass with the granularity %s", granularity)
+		}
+		if p := business.Q8MapGames(game).(*schema.DatedGame).Period; p != period {
+			t.Fatalf("Expected the period %s with the granularity %s, got %s", period, granularity, p)
+		}
+	}
+
+	if business.Q8FilterGames(&schema.Game{ReleaseDate: "Coming soon", Genres: []string{"Indie"}}) {
+		t.Fatalf("Expected a game without a release date to be filtered")
+	}
+	common.Config.Set("query.eight.granularity", "month")
+	if business.Q8FilterGames(game) {
+		t.Fatalf("Expected an unknown granularity to filter every game")
+	}
+}
+
+func TestQ8SentimentTrend(t *testing.T) {
+	InitConfig()
+	common.Config.Set("query.eight.granularity", "quarter")
+	base := filepath.Join("test_files", "query_eight")
+
+	games := []*schema.Game{
+		{AppID: "1", ReleaseDate: "Jan 2, 2015", Genres: []string{"Indie", "Action"}},
+		{AppID: "2", ReleaseDate: "May 20, 2015", Genres: []string{"Indie"}},
+		{AppID: "3", ReleaseDate: "Nov 1, 2019", Genres: []string{"Indie", " Indie"}},
+		{AppID: "4", ReleaseDate: "Coming soon", Genres: []string{"Indie"}},
+		{AppID: "5", ReleaseDate: "Dec 3, 2015", Genres: []string{"Action"}},
+	}
+	scores := map[string][]int{
+		"1": {1, 1, -1},
+		"2": {-1, -1, 0},
+		"3": {1},
+		"4": {1, 1},
+	}
+
+	partitionOf := func(appID string) int {
+		id, _ := strconv.Atoi(appID)
+		return id % 2
+	}
+	inputs := make([][][]byte, 2)
+	for _, g := range games {
+		if !business.Q8FilterGames(g) {
+			continue
+		}
+		data, err := schema.MarshalMessage(business.Q8MapGames(g))
+		FatalOnError(err, t, "Cannot marshal the game")
+		inputs[partitionOf(g.AppID)] = append(inputs[partitionOf(g.AppID)], data)
+	}
+	for appID, s := range scores {
+		for _, score := range s {
+			r := &schema.Review{AppID: appID, ReviewScore: score}
+			if !business.Q8FilterReviews(r) {
+				continue
+			}
+			data, err := schema.MarshalMessage(business.Q8MapReviews(r))
+			FatalOnError(err, t, "Cannot marshal the review")
+			inputs[partitionOf(appID)] = append(inputs[partitionOf(appID)], data)
+		}
+	}
+
+	joins := make([]*business.SentimentJoin, 2)
+	for p := range joins {
+		j, err := business.NewSentimentJoin(base, "id", p+1)
+		FatalOnError(err, t, "Cannot create the join")
+		for i, data := range inputs[p] {
+			_, err := j.Handle(data, &common.IdempotencyID{Origin: "MF", Sequence: uint32(i + 1)})
+			FatalOnError(err, t, "Cannot handle the input")
+		}
+		joins[p] = j
+	}
+
+	// The first partition restarts and gets everything again
+	joins[0].Shutdown(false)
+	j, err := business.NewSentimentJoin(base, "id", 1)
+	FatalOnError(err, t, "Cannot load the join")
+	for i, data := range inputs[0] {
+		_, err := j.Handle(data, &common.IdempotencyID{Origin: "MF", Sequence: uint32(i + 1)})
+		FatalOnError(err, t, "Cannot handle the input again")
+	}
+	joins[0] = j
+
+	final, err := business.NewQ8(base, "id", 1)
+	FatalOnError(err, t, "Cannot create the stage three")
+	defer final.Shutdown(true)
+	for p, j := range joins {
+		cr, ce := j.NextStage()
+		drainPhase(t, cr, ce, fmt.Sprintf("S2_%d", p), final)
+		j.Shutdown(true)
+	}
+
+	buckets := make([]string, 0)
+	cr, ce := final.NextStage()
+	for r := range cr {
+		if r.Message != nil {
+			buckets = append(buckets, fmt.Sprint(r.Message.(*schema.SentimentBucket).ToCSV()))
+		}
+	}
+	FatalOnError(<-ce, t, "Cannot make the next stage")
+
+	expected := []string{
+		"[Action 2015-Q1 1 2 1 0.6667]",
+		"[Indie 2015-Q1 1 2 1 0.6667]",
+		"[Indie 2015-Q2 1 0 2 0.0000]",
+		"[Indie 2019-Q4 1 1 0 1.0000]",
+	}
+	if fmt.Sprint(buckets) != fmt.Sprint(expected) {
+		t.Fatalf("Expected the buckets %v, got %v", expected, buckets)
+	}
+}
@@ -118,7 +118,7 @@ func NewNamedReviewCounterBatchManager(base string) *NamedReviewCounterBatchMana
 
 func (m *NamedReviewCounterBatchManager) saveCurrentBatch() error {
 	return m.currBatch.Save(func(x *schema.NamedReviewCounter, y *schema.NamedReviewCounter) bool {
-		return x.Count < y.Count
+		return schema.NamedReviewCounterBefore(y, x)
 	})
 }
 
@@ -186,7 +186,11 @@ type Q5 struct {
 	JobId         string
 	Storage       *common.IdempotencyHandlerSingleFile[*schema.NamedReviewCounter]
 	sortedStorage *common.TemporaryStorage
-	basefiles     string
+	// Only in approximate mode, the sketches of the stage two partitions
+	sketches *common.IdempotencyHandlerSingleFile[*schema.QuantileSketch]
+	// Only in distributed mode, the histograms of the stage two partitions
+	histograms *common.IdempotencyHandlerSingleFile[*schema.CountHistogram]
+	basefiles  string
 }
 
 func NewQ5(base string, id string, partition int, pctOver int, bufSize int) (*Q5, error) {
@@ -213,6 +217,118 @@ func NewQ5(base string, id string, partition int, pctOver int, bufSize int) (*Q5
 	}, nil
 }
 
+// Finds the percentile merging the sketches sent by stage two instead of sorting the
+// games, which are then sent as they were received
+func (q *Q5) EnableApproximate() error {
+	s, err := common.NewIdempotencyHandlerSingleFile[*schema.QuantileSketch](filepath.Join(q.basefiles, "sketches"))
+	if err != nil {
+		return err
+	}
+	if _, err = s.LoadOverwriteState(schema.QuantileSketchDeserialize); err != nil {
+		return err
+	}
+	q.sketches = s
+	return nil
+}
+
+// Finds the percentile from the histograms of stage two and tells it back, so only the
+// games at or over it are sent and sorted here
+func (q *Q5) EnableDistributed() error {
+	s, err := common.NewIdempotencyHandlerSingleFile[*schema.CountHistogram](filepath.Join(q.basefiles, "histograms"))
+	if err != nil {
+		return err
+	}
+	if _, err = s.LoadOverwriteState(schema.CountHistogramDeserialize); err != nil {
+		return err
+	}
+	q.histograms = s
+	return nil
+}
+
+func (q *Q5) distributedQuantile() (uint32, uint32, error) {
+	histograms, err := q.histograms.ReadState(schema.CountHistogramDeserialize)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	games := make(map[uint32]uint32)
+	var n uint32
+	for h := range histograms {
+		for count, g := range h.Games {
+			games[count] += g
+			n += g
+		}
+	}
+
+	counts := make([]uint32, 0, len(games))
+	for count := range games {
+		counts = append(counts, count)
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i] < counts[j] })
+
+	// The same game the sorted file would have at the index
+	index := uint32(Q5CalculatePi(int(n), q.state.PercentileOver))
+	var seen uint32
+	for _, count := range counts {
+		seen += games[count]
+		if seen > index {
+			return count, n, nil
+		}
+	}
+	return 0, n, nil
+}
+
+func (q *Q5) EndPhase() (<-chan *controller.NextStageMessage, <-chan error) {
+	cr := make(chan *controller.NextStageMessage)
+	ce := make(chan error, 1)
+
+	go func() {
+		defer close(cr)
+		defer close(ce)
+
+		val, n, err := q.distributedQuantile()
+		if err != nil {
+			ce <- err
+			return
+		}
+		log.Infof("Action: Distributed Percentile %d | Result: Success | Games: %d | Value: %d", q.state.PercentileOver, n, val)
+
+		cr <- &controller.NextStageMessage{
+			Message:  &schema.PercentileThreshold{Count: val},
+			Sequence: 1,
+			Feedback: true,
+		}
+		cr <- &controller.NextStageMessage{
+			Message:  nil,
+			Sequence: 2,
+		}
+	}()
+
+	return cr, ce
+}
+
+func (q *Q5) approximateQuantile() (uint32, uint32, error) {
+	sketches, err := q.sketches.ReadState(schema.QuantileSketchDeserialize)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var merged *common.KLLSketch
+	for s := range sketches {
+		if merged == nil {
+			merged = s.Sketch
+			continue
+		}
+		merged.Merge(s.Sketch)
+	}
+	if merged == nil {
+		return 0, 0, nil
+	}
+
+	index := Q5CalculatePi(int(merged.N()), q.state.PercentileOver)
+	return merged.Quantile(uint32(index)), merged.N(), nil
+}
+
 func (q *Q5) Q5Quantile() (int, error) {
 	sortedResultFileName := filepath.Join(q.basefiles, "results.sorted")
 	os.Remove(sortedResultFileName)
@@ -385,7 +501,60 @@ func (q *Q5) getQuantileVal(at_idx int) (uint32, error) {
 	return val, nil
 }
 
+func (q *Q5) nextStageApproximate() (<-chan *controller.NextStageMessage, <-chan error) {
+	cr := make(chan *controller.NextStageMessage, q.state.bufSize)
+	ce := make(chan error, 1)
+
+	go func() {
+		defer close(cr)
+		defer close(ce)
+
+		val, n, err := q.approximateQuantile()
+		if err != nil {
+			ce <- err
+			return
+		}
+		log.Infof("Action: Approximate Percentile %d | Result: Success | Games: %d | Value: %d", q.state.PercentileOver, n, val)
+
+		nrcs, err := q.Storage.ReadState(schema.NamedReviewCounterDeserialize)
+		if err != nil {
+			ce <- err
+			return
+		}
+
+		fs, err := NewFileSequence(filepath.Join(q.basefiles, "sent_lines"))
+		if err != nil {
+			ce <- err
+			return
+		}
+		var line uint32 = 1
+		defer fs.Shutdown(true)
+
+		for nrc := range nrcs {
+			if line > fs.LastConfirmedSent() && nrc.Count >= val {
+				cr <- &controller.NextStageMessage{
+					Message:      nrc,
+					Sequence:     line,
+					SentCallback: fs.Sent,
+				}
+			}
+			line++
+		}
+
+		cr <- &controller.NextStageMessage{
+			Message:      nil,
+			Sequence:     line,
+			SentCallback: nil,
+		}
+	}()
+
+	return cr, ce
+}
+
 func (q *Q5) NextStage() (<-chan *controller.NextStageMessage, <-chan error) {
+	if q.sketches != nil {
+		return q.nextStageApproximate()
+	}
 	cr := make(chan *controller.NextStageMessage, q.state.bufSize)
 	ce := make(chan error, 1)
 
@@ -399,7 +568,13 @@ func (q *Q5) NextStage() (<-chan *controller.NextStageMessage, <-chan error) {
 			return
 		}
 
-		val, err := q.getQuantileVal(idx)
+		var val uint32
+		if q.histograms != nil {
+			// Stage two only sent the games at or over it
+			val, _, err = q.distributedQuantile()
+		} else {
+			val, err = q.getQuantileVal(idx)
+		}
 		if err != nil {
 			ce <- err
 			return
@@ -454,7 +629,54 @@ func (q *Q5) NextStage() (<-chan *controller.NextStageMessage, <-chan error) {
 	return cr, ce
 }
 
+// Saves the sketches, and the hot games as sketches of their own as no partition had their
+// whole count. Returns whether there's nothing else to do with the message.
+func (q *Q5) handleSketch(protocolData []byte, idempotencyID *common.IdempotencyID) (bool, error) {
+	p, err := schema.UnmarshalMessage(protocolData)
+	if err != nil {
+		return true, err
+	}
+
+	var sketch *schema.QuantileSketch
+	handled := false
+	switch v := p.(type) {
+	case *schema.QuantileSketch:
+		sketch = v
+		handled = true
+	case *schema.NamedReviewCounter:
+		if idempotencyID.Origin != hotKeyMergeOrigin || v.Count == 0 {
+			return false, nil
+		}
+		sketch = &schema.QuantileSketch{Sketch: common.NewKLLSketch(0)}
+		sketch.Sketch.Add(v.Count)
+	default:
+		return false, nil
+	}
+
+	if q.sketches.AlreadyProcessed(idempotencyID) {
+		log.Debugf("Action: Saving Sketch | Result: Already processed | IdempotencyID: %s", idempotencyID)
+		return handled, nil
+	}
+	return handled, q.sketches.SaveState(idempotencyID, sketch)
+}
+
 func (q *Q5) Handle(protocolData []byte, idempotencyID *common.IdempotencyID) (*controller.NextStageMessage, error) {
+	if q.sketches != nil {
+		if handled, err := q.handleSketch(protocolData, idempotencyID); handled || err != nil {
+			return nil, err
+		}
+	}
+
+	if q.histograms != nil {
+		if h, err := schema.UnmarshalMessage(protocolData); err == nil && reflect.TypeOf(h) == reflect.TypeOf(&schema.CountHistogram{}) {
+			if q.histograms.AlreadyProcessed(idempotencyID) {
+				log.Debugf("Action: Saving Histogram | Result: Already processed | IdempotencyID: %s", idempotencyID)
+				return nil, nil
+			}
+			return nil, q.histograms.SaveState(idempotencyID, h.(*schema.CountHistogram))
+		}
+	}
+
 	if q.Storage.AlreadyProcessed(idempotencyID) {
 		log.Debugf("Action: Saving Game Percentile %d | Result: Already processed | IdempotencyID: %s", q.state.PercentileOver, idempotencyID)
 		return nil, nil
@@ -472,6 +694,18 @@ func (q *Q5) Handle(protocolData []byte, idempotencyID *common.IdempotencyID) (*
 
 func (q *Q5) Shutdown(delete bool) {
 	q.Storage.Close()
+	if q.sketches != nil {
+		q.sketches.Close()
+		if delete {
+			q.sketches.Delete()
+		}
+	}
+	if q.histograms != nil {
+		q.histograms.Close()
+		if delete {
+			q.histograms.Delete()
+		}
+	}
 	if delete {
 		err := q.Storage.Delete()
 		if err != nil {
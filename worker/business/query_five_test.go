@@ -4,9 +4,11 @@ import (
 	"fmt"
 	"middleware/common"
 	"middleware/worker/business"
+	"middleware/worker/controller"
 	"middleware/worker/schema"
 	"os"
 	"path/filepath"
+	"sort"
 	"testing"
 
 	"golang.org/x/exp/rand"
@@ -297,3 +299,130 @@ func TestQ5CorrectResultsInterrupted(t *testing.T) {
 		}
 	}
 }
+
+func TestQ5ApproximateFromSketches(t *testing.T) {
+	q5, err := business.NewQ5("test_files", "approximate", 1, 90, 10)
+	FatalOnError(err, t, "Cannot create Q5")
+	FatalOnError(q5.EnableApproximate(), t, "Cannot enable the approximate mode")
+	defer q5.Shutdown(true)
+
+	// Two stage two partitions with games of 1 to 1000 reviews
+	for p := 0; p < 2; p++ {
+		origin := fmt.Sprintf("S2_%d", p)
+		sketch := common.NewKLLSketch(0.01)
+		var seq uint32 = 1
+		for c := uint32(p + 1); c <= 1000; c += 2 {
+			data, _ := schema.MarshalMessage(&schema.NamedReviewCounter{Name: fmt.Sprint(c), Count: c})
+			_, err := q5.Handle(data, &common.IdempotencyID{Origin: origin, Sequence: seq})
+			FatalOnError(err, t, "Cannot handle a game")
+			sketch.Add(c)
+			seq++
+		}
+		data, _ := schema.MarshalMessage(&schema.QuantileSketch{Sketch: sketch})
+		_, err := q5.Handle(data, &common.IdempotencyID{Origin: origin, Sequence: seq})
+		FatalOnError(err, t, "Cannot handle a sketch")
+	}
+
+	cr, ce := q5.NextStage()
+	sent := 0
+	for r := range cr {
+		if r.Message == nil {
+			continue
+		}
+		if c := r.Message.(*schema.NamedReviewCounter).Count; c < 880 {
+			t.Fatalf("Expected only games around the 90th percentile or over, got one with %d", c)
+		}
+		sent++
+		r.SentCallback()
+	}
+	FatalOnError(<-ce, t, "Cannot make the next stage")
+
+	if sent < 80 || sent > 120 {
+		t.Fatalf("Expected about 100 games over the 90th percentile, got %d", sent)
+	}
+}
+
+func drainPhase(t *testing.T, cr <-chan *controller.NextStageMessage, ce <-chan error, origin string, to controller.Handler) {
+	for r := range cr {
+		if r.Message == nil {
+			continue
+		}
+		data, err := schema.MarshalMessage(r.Message)
+		FatalOnError(err, t, "Cannot marshal a message")
+		_, err = to.Handle(data, &common.IdempotencyID{Origin: origin, Sequence: r.Sequence})
+		FatalOnError(err, t, "Cannot handle a message")
+		if r.SentCallback != nil {
+			r.SentCallback()
+		}
+	}
+	FatalOnError(<-ce, t, "Cannot send the messages")
+}
+
+func TestQ5DistributedMatchesExact(t *testing.T) {
+	base := filepath.Join("test_files", "distributed")
+	joins := make([]*business.Join, 2)
+	counts := make([]int, 0)
+	for p := range joins {
+		j, err := business.NewJoin(base, "query_five", "id", p+1, 100)
+		FatalOnError(err, t, "Cannot create the join")
+		FatalOnError(j.EnableDistributedPercentile(), t, "Cannot enable the distributed percentile")
+		joins[p] = j
+
+		var seq uint32 = 1
+		for g := 0; g < 50; g++ {
+			appID := fmt.Sprintf("%d-%d", p, g)
+			j.AddGame(&schema.GameName{AppID: appID, Name: appID}, &common.IdempotencyID{Origin: "G", Sequence: uint32(g + 1)})
+			// Plenty of ties, and games without reviews that never count
+			reviews := (g * 7) % 23
+			for r := 0; r < reviews; r++ {
+				j.AddReview(&schema.ValidReview{AppID: appID}, &common.IdempotencyID{Origin: "R", Sequence: seq})
+				seq++
+			}
+			if reviews > 0 {
+				counts = append(counts, reviews)
+			}
+		}
+	}
+
+	q5, err := business.NewQ5(base, "id", 1, 90, 10)
+	FatalOnError(err, t, "Cannot create Q5")
+	FatalOnError(q5.EnableDistributed(), t, "Cannot enable the distributed mode")
+	defer q5.Shutdown(true)
+
+	for p, j := range joins {
+		cr, ce := j.EndPhase()
+		drainPhase(t, cr, ce, fmt.Sprintf("S2_%d", p), q5)
+	}
+	for p, j := range joins {
+		cr, ce := q5.EndPhase()
+		drainPhase(t, cr, ce, "S3", j)
+		cr, ce = j.NextStage()
+		drainPhase(t, cr, ce, fmt.Sprintf("S2_%d", p), q5)
+		j.Shutdown(true)
+	}
+
+	sort.Ints(counts)
+	exact := counts[business.Q5CalculatePi(len(counts), 90)]
+	expected := 0
+	for _, c := range counts {
+		if c >= exact {
+			expected++
+		}
+	}
+
+	cr, ce := q5.NextStage()
+	sent := 0
+	for r := range cr {
+		if r.Message == nil {
+			continue
+		}
+		if c := r.Message.(*schema.NamedReviewCounter).Count; int(c) < exact {
+			t.Fatalf("Expected games with at least %d reviews, got one with %d", exact, c)
+		}
+		sent++
+	}
+	FatalOnError(<-ce, t, "Cannot make the next stage")
+	if sent != expected {
+		t.Fatalf("Expected the %d games of the exact percentile, got %d", expected, sent)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"middleware/worker/schema"
 	"path/filepath"
 	"reflect"
+	"sort"
 )
 
 type DetectLanguage func(string) bool
@@ -46,6 +47,7 @@ type Q4State struct {
 type Q4 struct {
 	state     *Q4State
 	storage   *common.IdempotencyHandlerSingleFile[*schema.NamedReviewCounter]
+	languages *languageTallies
 	basefiles string
 }
 
@@ -64,12 +66,18 @@ func NewQ4(base string, id string, partition int, over int, bufSize int) (*Q4, e
 		return nil, err
 	}
 
+	l, err := newLanguageTallies(basefiles)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Q4{
 		state: &Q4State{
 			Over:    uint32(over),
 			bufSize: bufSize,
 		},
 		storage:   s,
+		languages: l,
 		basefiles: basefiles,
 	}, nil
 }
@@ -99,6 +107,12 @@ func (q *Q4) NextStage() (<-chan *controller.NextStageMessage, <-chan error) {
 			ce <- err
 			return
 		}
+		// Only the games over the threshold are here, few enough to sort them in memory
+		games := make([]*schema.NamedReviewCounter, 0)
+		for rc := range s {
+			games = append(games, rc)
+		}
+		sort.Slice(games, func(i, j int) bool { return schema.NamedReviewCounterBefore(games[i], games[j]) })
 
 		fs, err := NewFileSequence(filepath.Join(q.basefiles, "sent_lines"))
 		if err != nil {
@@ -108,7 +122,7 @@ func (q *Q4) NextStage() (<-chan *controller.NextStageMessage, <-chan error) {
 		defer fs.Shutdown(true)
 
 		var line uint32 = 1
-		for rc := range s {
+		for _, rc := range games {
 			if line > fs.LastConfirmedSent() {
 				cr <- &controller.NextStageMessage{
 					Message:      rc,
@@ -119,6 +133,18 @@ func (q *Q4) NextStage() (<-chan *controller.NextStageMessage, <-chan error) {
 			line++
 		}
 
+		// The language breakdown of the job goes with the results
+		for _, c := range q.languages.Sorted() {
+			if line > fs.LastConfirmedSent() {
+				cr <- &controller.NextStageMessage{
+					Message:      c,
+					Sequence:     line,
+					SentCallback: fs.Sent,
+				}
+			}
+			line++
+		}
+
 		cr <- &controller.NextStageMessage{
 			Message:      nil,
 			Sequence:     line,
@@ -130,15 +156,19 @@ func (q *Q4) NextStage() (<-chan *controller.NextStageMessage, <-chan error) {
 }
 
 func (q *Q4) Handle(protocolData []byte, idempotencyID *common.IdempotencyID) (*controller.NextStageMessage, error) {
-	if q.storage.AlreadyProcessed(idempotencyID) {
-		log.Debugf("Action: Saving Game Over %d | Result: Already processed | IdempotencyID: %s", q.state.Over, idempotencyID)
-		return nil, nil
-	}
-
 	p, err := schema.UnmarshalMessage(protocolData)
 	if err != nil {
 		return nil, err
 	}
+	// Kept apart from the games, with idempotency of their own
+	if c, ok := p.(*schema.LanguageCount); ok {
+		return nil, q.languages.Save(c, idempotencyID)
+	}
+
+	if q.storage.AlreadyProcessed(idempotencyID) {
+		log.Debugf("Action: Saving Game Over %d | Result: Already processed | IdempotencyID: %s", q.state.Over, idempotencyID)
+		return nil, nil
+	}
 	if reflect.TypeOf(p) == reflect.TypeOf(&schema.NamedReviewCounter{}) {
 		return nil, q.Insert(p.(*schema.NamedReviewCounter), idempotencyID)
 	}
@@ -147,4 +177,5 @@ func (q *Q4) Handle(protocolData []byte, idempotencyID *common.IdempotencyID) (*
 
 func (q *Q4) Shutdown(delete bool) {
 	q.storage.Close()
+	q.languages.Shutdown(delete)
 }
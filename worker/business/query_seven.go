@@ -0,0 +1,517 @@
+package business
+
+import (
+	"fmt"
+	"middleware/common"
+	"middleware/worker/controller"
+	"middleware/worker/schema"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Without blanks or repeated names, a game counts once for each of its companies or genres
+func distinctNames(names []string) []string {
+	r := make([]string, 0, len(names))
+	seen := make(map[string]bool)
+	for _, n := range names {
+		if n = strings.TrimSpace(n); n != "" && !seen[n] {
+			seen[n] = true
+			r = append(r, n)
+		}
+	}
+	return r
+}
+
+func Q7FilterGames(r *schema.Game) bool {
+	return len(distinctNames(r.Developers)) > 0 || len(distinctNames(r.Publishers)) > 0
+}
+
+func Q7MapGames(r *schema.Game) schema.Partitionable {
+	return &schema.GameCompanies{
+		AppID:      r.AppID,
+		Developers: distinctNames(r.Developers),
+		Publishers: distinctNames(r.Publishers),
+	}
+}
+
+// Reviews without a score are neither positive nor negative
+func Q7FilterReviews(r *schema.Review) bool {
+	return r.ReviewScore != 0
+}
+
+func Q7MapReviews(r *schema.Review) schema.Partitionable {
+	t := &schema.ReviewTally{AppID: r.AppID, Total: 1}
+	if r.ReviewScore > 0 {
+		t.Positive = 1
+	}
+	return t
+}
+
+func companyKey(kind string, name string) string {
+	return kind + "|" + name
+}
+
+func sortedTallies(tallies map[string]*schema.CompanyTally) []*schema.CompanyTally {
+	r := make([]*schema.CompanyTally, 0, len(tallies))
+	for _, t := range tallies {
+		r = append(r, t)
+	}
+	sort.Slice(r, func(i, j int) bool {
+		if r[i].Kind != r[j].Kind {
+			return r[i].Kind < r[j].Kind
+		}
+		return r[i].Name < r[j].Name
+	})
+	return r
+}
+
+// Sends the tallies in order with the sequences of their lines, so a restart sends the
+// same ones again
+func sendTallies(basefiles string, read func() ([]*schema.CompanyTally, error)) (<-chan *controller.NextStageMessage, <-chan error) {
+	ch := make(chan *controller.NextStageMessage)
+	ce := make(chan error, 1)
+
+	go func() {
+		defer close(ch)
+		defer close(ce)
+
+		tallies, err := read()
+		if err != nil {
+			ce <- err
+			return
+		}
+
+		fs, err := NewFileSequence(filepath.Join(basefiles, "sent_lines"))
+		if err != nil {
+			ce <- err
+			return
+		}
+		defer fs.Shutdown(true)
+
+		var line uint32 = 1
+		for _, t := range tallies {
+			if line > fs.LastConfirmedSent() {
+				ch <- &controller.NextStageMessage{
+					Message:      t,
+					Sequence:     line,
+					SentCallback: fs.Sent,
+				}
+			}
+			line++
+		}
+
+		ch <- &controller.NextStageMessage{
+			Message:      nil,
+			Sequence:     line,
+			SentCallback: nil,
+		}
+	}()
+
+	return ch, ce
+}
+
+// Positive and total reviews of every game of a join partition
+type reviewTallies struct {
+	storage *common.IdempotencyHandlerSingleFile[*schema.ReviewTally]
+	byGame  map[string]*schema.ReviewTally
+}
+
+func newReviewTallies(basefiles string) (*reviewTallies, error) {
+	s, err := common.NewIdempotencyHandlerSingleFile[*schema.ReviewTally](filepath.Join(basefiles, "reviews"))
+	if err != nil {
+		return nil, err
+	}
+
+	r := &reviewTallies{storage: s, byGame: make(map[string]*schema.ReviewTally)}
+	_, err = s.LoadSequentialState(
+		schema.ReviewTallyDeserialize,
+		func(acc *schema.ReviewTally, line *schema.ReviewTally) *schema.ReviewTally {
+			r.add(line)
+			return acc
+		},
+		nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *reviewTallies) add(t *schema.ReviewTally) {
+	g, ok := r.byGame[t.AppID]
+	if !ok {
+		g = &schema.ReviewTally{AppID: t.AppID}
+		r.byGame[t.AppID] = g
+	}
+	g.Positive += t.Positive
+	g.Total += t.Total
+}
+
+func (r *reviewTallies) Save(t *schema.ReviewTally, idempotencyID *common.IdempotencyID) error {
+	if r.storage.AlreadyProcessed(idempotencyID) {
+		log.Debugf("Action: Saving Reviews to Join | Result: Already processed | IdempotencyID: %s", idempotencyID)
+		return nil
+	}
+	if err := r.storage.SaveState(idempotencyID, t); err != nil {
+		return err
+	}
+	r.add(t)
+	return nil
+}
+
+func (r *reviewTallies) Shutdown(delete bool) {
+	r.storage.Close()
+	if delete {
+		if err := r.storage.Delete(); err != nil {
+			log.Errorf("Action: Deleting Join Reviews File | Result: Error | Error: %s", err)
+		}
+	}
+}
+
+// Stage two, joins the reviews of each game with its companies. The tallies of the games
+// are added up per company before they are sent, repartitioned by company.
+type CompanyJoin struct {
+	gameStorage *common.IdempotencyHandlerSingleFile[*schema.GameCompanies]
+	reviews     *reviewTallies
+	basefiles   string
+}
+
+func NewCompanyJoin(base string, id string, partition int) (*CompanyJoin, error) {
+	basefiles := filepath.Join(".", base, fmt.Sprintf("query_seven_%d", partition), "join", id)
+
+	g, err := common.NewIdempotencyHandlerSingleFile[*schema.GameCompanies](filepath.Join(basefiles, "games"))
+	if err != nil {
+		return nil, err
+	}
+
+	// The games are read at the end, for now only the IdempotencyID
+	if _, err = g.LoadOverwriteState(schema.GameCompaniesDeserialize); err != nil {
+		return nil, err
+	}
+
+	r, err := newReviewTallies(basefiles)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CompanyJoin{
+		gameStorage: g,
+		reviews:     r,
+		basefiles:   basefiles,
+	}, nil
+}
+
+func (q *CompanyJoin) AddGame(g *schema.GameCompanies, idempotencyID *common.IdempotencyID) error {
+	if q.gameStorage.AlreadyProcessed(idempotencyID) {
+		log.Debugf("Action: Saving Game to Company Join | Result: Already processed | IdempotencyID: %s", idempotencyID)
+		return nil
+	}
+	return q.gameStorage.SaveState(idempotencyID, g)
+}
+
+func (q *CompanyJoin) companyTallies() ([]*schema.CompanyTally, error) {
+	games, err := q.gameStorage.ReadState(schema.GameCompaniesDeserialize)
+	if err != nil {
+		return nil, err
+	}
+
+	tallies := make(map[string]*schema.CompanyTally)
+	add := func(kind string, name string, r *schema.ReviewTally) {
+		key := companyKey(kind, name)
+		t, ok := tallies[key]
+		if !ok {
+			t = &schema.CompanyTally{Kind: kind, Name: name}
+			tallies[key] = t
+		}
+		t.Positive += r.Positive
+		t.Total += r.Total
+	}
+	for g := range games {
+		r, ok := q.reviews.byGame[g.AppID]
+		if !ok {
+			continue
+		}
+		for _, d := range g.Developers {
+			add(schema.CompanyDeveloper, d, r)
+		}
+		for _, p := range g.Publishers {
+			add(schema.CompanyPublisher, p, r)
+		}
+	}
+	return sortedTallies(tallies), nil
+}
+
+func (q *CompanyJoin) NextStage() (<-chan *controller.NextStageMessage, <-chan error) {
+	return sendTallies(q.basefiles, q.companyTallies)
+}
+
+func (q *CompanyJoin) Handle(protocolData []byte, idempotencyID *common.IdempotencyID) (*controller.NextStageMessage, error) {
+	p, err := schema.UnmarshalMessage(protocolData)
+	if err != nil {
+		return nil, err
+	}
+
+	switch v := p.(type) {
+	case *schema.GameCompanies:
+		return nil, q.AddGame(v, idempotencyID)
+	case *schema.ReviewTally:
+		return nil, q.reviews.Save(v, idempotencyID)
+	}
+	return nil, &schema.UnknownTypeError{}
+}
+
+func (q *CompanyJoin) Shutdown(delete bool) {
+	q.gameStorage.Close()
+	q.reviews.Shutdown(delete)
+	if delete {
+		if err := q.gameStorage.Delete(); err != nil {
+			log.Errorf("Action: Deleting Company Join Games File | Result: Error | Error: %s", err)
+		}
+	}
+}
+
+// Stage three, adds up the tallies of its companies from every join partition. Only the
+// companies with enough reviews go on to the leaderboards.
+type Q7Aggregate struct {
+	tallies    map[string]*schema.CompanyTally
+	minReviews uint32
+	storage    *common.IdempotencyHandlerSingleFile[*schema.CompanyTally]
+	basefiles  string
+}
+
+func NewQ7Aggregate(base string, id string, partition int, minReviews int) (*Q7Aggregate, error) {
+	basefiles := filepath.Join(".", base, fmt.Sprintf("query_seven_%d", partition), "aggregate", id)
+
+	s, err := common.NewIdempotencyHandlerSingleFile[*schema.CompanyTally](filepath.Join(basefiles, "tallies"))
+	if err != nil {
+		return nil, err
+	}
+
+	q := &Q7Aggregate{
+		tallies:    make(map[string]*schema.CompanyTally),
+		minReviews: uint32(max(minReviews, 0)),
+		storage:    s,
+		basefiles:  basefiles,
+	}
+
+	_, err = s.LoadSequentialState(
+		schema.CompanyTallyDeserialize,
+		func(acc *schema.CompanyTally, line *schema.CompanyTally) *schema.CompanyTally {
+			q.add(line)
+			return acc
+		},
+		nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *Q7Aggregate) add(c *schema.CompanyTally) {
+	key := companyKey(c.Kind, c.Name)
+	t, ok := q.tallies[key]
+	if !ok {
+		t = &schema.CompanyTally{Kind: c.Kind, Name: c.Name}
+		q.tallies[key] = t
+	}
+	t.Positive += c.Positive
+	t.Total += c.Total
+}
+
+func (q *Q7Aggregate) qualifying() ([]*schema.CompanyTally, error) {
+	tallies := make([]*schema.CompanyTally, 0, len(q.tallies))
+	for _, t := range sortedTallies(q.tallies) {
+		if t.Total >= q.minReviews {
+			tallies = append(tallies, t)
+		}
+	}
+	return tallies, nil
+}
+
+func (q *Q7Aggregate) NextStage() (<-chan *controller.NextStageMessage, <-chan error) {
+	return sendTallies(q.basefiles, q.qualifying)
+}
+
+func (q *Q7Aggregate) Handle(protocolData []byte, idempotencyID *common.IdempotencyID) (*controller.NextStageMessage, error) {
+	if q.storage.AlreadyProcessed(idempotencyID) {
+		log.Debugf("Action: Saving Company Tally | Result: Already processed | IdempotencyID: %s", idempotencyID)
+		return nil, nil
+	}
+	p, err := schema.UnmarshalMessage(protocolData)
+	if err != nil {
+		return nil, err
+	}
+
+	c, ok := p.(*schema.CompanyTally)
+	if !ok {
+		return nil, &schema.UnknownTypeError{}
+	}
+	if err := q.storage.SaveState(idempotencyID, c); err != nil {
+		return nil, err
+	}
+	q.add(c)
+	return nil, nil
+}
+
+func (q *Q7Aggregate) Shutdown(delete bool) {
+	q.storage.Close()
+	if delete {
+		if err := q.storage.Delete(); err != nil {
+			log.Errorf("Action: Deleting Company Tallies File | Result: Error | Error: %s", err)
+		}
+	}
+}
+
+type q7Board struct {
+	kind    string
+	ranking string
+	top     *TopK[*schema.CompanyTally]
+}
+
+// Stage four, the top companies of each kind by positive reviews and by positive ratio
+type Q7 struct {
+	boards    []*q7Board
+	N         int
+	storage   *common.IdempotencyHandlerSingleFile[*common.ArraySerialize[*schema.CompanyTally]]
+	basefiles string
+}
+
+func NewQ7(base string, id string, partition int, top int) (*Q7, error) {
+	basefiles := filepath.Join(".", base, fmt.Sprintf("query_seven_%d", partition), "top", id)
+
+	s, err := common.NewIdempotencyHandlerSingleFile[*common.ArraySerialize[*schema.CompanyTally]](
+		filepath.Join(basefiles, "results"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := s.LoadOverwriteState(common.ReadArray(schema.CompanyTallyDeserialize))
+	if err != nil {
+		return nil, err
+	}
+
+	// In the order of the results
+	boards := make([]*q7Board, 0, 4)
+	for _, kind := range []string{schema.CompanyDeveloper, schema.CompanyPublisher} {
+		boards = append(boards,
+			&q7Board{kind: kind, ranking: schema.RankingPositive, top: NewTopK(top, schema.CompanyPositiveBefore)},
+			&q7Board{kind: kind, ranking: schema.RankingRatio, top: NewTopK(top, schema.CompanyRatioBefore)},
+		)
+	}
+
+	q := &Q7{
+		boards:    boards,
+		N:         top,
+		storage:   s,
+		basefiles: basefiles,
+	}
+	if state != nil {
+		for _, t := range state.Arr {
+			q.push(t)
+		}
+	}
+	return q, nil
+}
+
+func (q *Q7) push(t *schema.CompanyTally) bool {
+	changed := false
+	for _, b := range q.boards {
+		if b.kind == t.Kind && b.top.Push(t) {
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Every company in any of the leaderboards, pushing them again rebuilds all of them
+func (q *Q7) leaders() []*schema.CompanyTally {
+	seen := make(map[string]*schema.CompanyTally)
+	for _, b := range q.boards {
+		for _, t := range b.top.Sorted() {
+			seen[companyKey(t.Kind, t.Name)] = t
+		}
+	}
+	return sortedTallies(seen)
+}
+
+// Like Q3, only saves the leaderboards when the company gets into one
+func (q *Q7) Insert(t *schema.CompanyTally, idempotencyID *common.IdempotencyID) error {
+	if !q.push(t) {
+		return nil
+	}
+	return q.storage.SaveState(idempotencyID, &common.ArraySerialize[*schema.CompanyTally]{Arr: q.leaders()})
+}
+
+func (q *Q7) NextStage() (<-chan *controller.NextStageMessage, <-chan error) {
+	ch := make(chan *controller.NextStageMessage, q.N)
+	ce := make(chan error, 1)
+
+	go func() {
+		defer close(ch)
+		defer close(ce)
+
+		fs, err := NewFileSequence(filepath.Join(q.basefiles, "sent_lines"))
+		if err != nil {
+			ce <- err
+			return
+		}
+		defer fs.Shutdown(true)
+
+		var line uint32 = 1
+		for _, b := range q.boards {
+			for i, t := range b.top.Sorted() {
+				if line > fs.LastConfirmedSent() {
+					ch <- &controller.NextStageMessage{
+						Message: &schema.CompanyRank{
+							Kind:     b.kind,
+							Ranking:  b.ranking,
+							Position: uint32(i + 1),
+							Name:     t.Name,
+							Positive: t.Positive,
+							Total:    t.Total,
+						},
+						Sequence:     line,
+						SentCallback: fs.Sent,
+					}
+				}
+				line++
+			}
+		}
+
+		ch <- &controller.NextStageMessage{
+			Message:      nil,
+			Sequence:     line,
+			SentCallback: nil,
+		}
+	}()
+
+	return ch, ce
+}
+
+func (q *Q7) Handle(protocolData []byte, idempotencyID *common.IdempotencyID) (*controller.NextStageMessage, error) {
+	if q.storage.AlreadyProcessed(idempotencyID) {
+		log.Debugf("Action: Saving Company Leaderboards | Result: Already processed | IdempotencyID: %s", idempotencyID)
+		return nil, nil
+	}
+	p, err := schema.UnmarshalMessage(protocolData)
+	if err != nil {
+		return nil, err
+	}
+
+	if t, ok := p.(*schema.CompanyTally); ok {
+		return nil, q.Insert(t, idempotencyID)
+	}
+	return nil, &schema.UnknownTypeError{}
+}
+
+func (q *Q7) Shutdown(delete bool) {
+	q.storage.Close()
+	if delete {
+		if err := q.storage.Delete(); err != nil {
+			log.Errorf("Action: Deleting Company Leaderboards File | Result: Error | Error: %s", err)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package business_test
+
+import (
+	"fmt"
+	"middleware/common"
+	"middleware/worker/business"
+	"middleware/worker/schema"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestQ7Leaderboards(t *testing.T) {
+	base := filepath.Join("test_files", "query_seven")
+
+	games := []*schema.Game{
+		{AppID: "1", Developers: []string{"A"}, Publishers: []string{"P"}},
+		{AppID: "2", Developers: []string{"A", "B"}, Publishers: []string{"P"}},
+		{AppID: "3", Developers: []string{"B"}, Publishers: []string{"Q", " Q "}},
+		{AppID: "4", Developers: []string{" "}},
+		{AppID: "5", Developers: []string{"C"}, Publishers: []string{"P"}},
+		{AppID: "6", Developers: []string{"D"}, Publishers: []string{"P"}},
+	}
+	scores := map[string][]int{
+		"1": {1, 1, -1},
+		"2": {1, -1, -1, -1},
+		"3": {1, 1, 1, 0},
+		"4": {1},
+		"6": {1, 1, 1, 1},
+	}
+
+	// Both sides of a game go to the same partition, like the hashing of its AppID
+	partitionOf := func(appID string) int {
+		id, _ := strconv.Atoi(appID)
+		return id % 2
+	}
+	inputs := make([][][]byte, 2)
+	for _, g := range games {
+		if !business.Q7FilterGames(g) {
+			continue
+		}
+		data, err := schema.MarshalMessage(business.Q7MapGames(g))
+		FatalOnError(err, t, "Cannot marshal the game")
+		inputs[partitionOf(g.AppID)] = append(inputs[partitionOf(g.AppID)], data)
+	}
+	reviews := make([]schema.Partitionable, 0)
+	for appID, s := range scores {
+		for _, score := range s {
+			r := &schema.Review{AppID: appID, ReviewScore: score}
+			if business.Q7FilterReviews(r) {
+				reviews = append(reviews, business.Q7MapReviews(r))
+			}
+		}
+	}
+	for _, r := range business.ReviewTallyCombine(reviews) {
+		data, err := schema.MarshalMessage(r)
+		FatalOnError(err, t, "Cannot marshal the reviews")
+		appID := r.(*schema.ReviewTally).AppID
+		inputs[partitionOf(appID)] = append(inputs[partitionOf(appID)], data)
+	}
+
+	joins := make([]*business.CompanyJoin, 2)
+	for p := range joins {
+		j, err := business.NewCompanyJoin(base, "id", p+1)
+		FatalOnError(err, t, "Cannot create the join")
+		for i, data := range inputs[p] {
+			_, err := j.Handle(data, &common.IdempotencyID{Origin: "MF", Sequence: uint32(i + 1)})
+			FatalOnError(err, t, "Cannot handle the input")
+		}
+		joins[p] = j
+	}
+
+	// The second partition restarts and gets everything again
+	joins[1].Shutdown(false)
+	j, err := business.NewCompanyJoin(base, "id", 2)
+	FatalOnError(err, t, "Cannot load the join")
+	for i, data := range inputs[1] {
+		_, err := j.Handle(data, &common.IdempotencyID{Origin: "MF", Sequence: uint32(i + 1)})
+		FatalOnError(err, t, "Cannot handle the input again")
+	}
+	joins[1] = j
+
+	aggregates := make([]*business.Q7Aggregate, 2)
+	for p := range aggregates {
+		a, err := business.NewQ7Aggregate(base, "id", p+1, 4)
+		FatalOnError(err, t, "Cannot create the aggregate")
+		aggregates[p] = a
+	}
+	for p, j := range joins {
+		cr, ce := j.NextStage()
+		for r := range cr {
+			if r.Message == nil {
+				continue
+			}
+			c := r.Message.(*schema.CompanyTally)
+			data, err := schema.MarshalMessage(c)
+			FatalOnError(err, t, "Cannot marshal the tally")
+			_, err = aggregates[len(c.Name)%2].Handle(data, &common.IdempotencyID{Origin: fmt.Sprintf("S2_%d", p), Sequence: r.Sequence})
+			FatalOnError(err, t, "Cannot handle the tally")
+			r.SentCallback()
+		}
+		FatalOnError(<-ce, t, "Cannot make the next stage")
+		j.Shutdown(true)
+	}
+
+	final, err := business.NewQ7(base, "id", 1, 2)
+	FatalOnError(err, t, "Cannot create the leaderboards")
+	for p, a := range aggregates {
+		cr, ce := a.NextStage()
+		drainPhase(t, cr, ce, fmt.Sprintf("S3_%d", p), final)
+		a.Shutdown(true)
+	}
+
+	// Restarting keeps the leaderboards
+	final.Shutdown(false)
+	final, err = business.NewQ7(base, "id", 1, 2)
+	FatalOnError(err, t, "Cannot load the leaderboards")
+	defer final.Shutdown(true)
+
+	ranks := make([]string, 0)
+	cr, ce := final.NextStage()
+	for r := range cr {
+		if r.Message != nil {
+			ranks = append(ranks, fmt.Sprint(r.Message.(*schema.CompanyRank).ToCSV()))
+		}
+	}
+	FatalOnError(<-ce, t, "Cannot make the next stage")
+
+	expected := []string{
+		"[developer positive 1 B 4 7 0.5714]",
+		"[developer positive 2 D 4 4 1.0000]",
+		"[developer ratio 1 D 4 4 1.0000]",
+		"[developer ratio 2 B 4 7 0.5714]",
+		"[publisher positive 1 P 7 11 0.6364]",
+		"[publisher ratio 1 P 7 11 0.6364]",
+	}
+	if fmt.Sprint(ranks) != fmt.Sprint(expected) {
+		t.Fatalf("Expected the leaderboards %v, got %v", expected, ranks)
+	}
+}
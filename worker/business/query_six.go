@@ -0,0 +1,224 @@
+package business
+
+import (
+	"fmt"
+	"middleware/common"
+	"middleware/worker/controller"
+	"middleware/worker/schema"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Games without a price we can read don't count for any group
+func Q6Filter(r *schema.Game) bool {
+	if _, err := r.PriceCents(); err != nil {
+		return false
+	}
+	_, err := r.DiscountPercent()
+	return err == nil
+}
+
+func Q6Map(r *schema.Game) schema.Partitionable {
+	price, _ := r.PriceCents()
+	discount, _ := r.DiscountPercent()
+
+	genres := make([]string, 0, len(r.Genres))
+	for _, g := range r.Genres {
+		if g = strings.TrimSpace(g); g != "" {
+			genres = append(genres, g)
+		}
+	}
+
+	var year uint32
+	if y, err := r.ReleaseYear(); err == nil && y > 0 {
+		year = uint32(y)
+	}
+
+	return &schema.PricedGame{
+		AppID:      r.AppID,
+		Year:       year,
+		Price:      price,
+		Discounted: discount > 0,
+		Genres:     genres,
+	}
+}
+
+// Stage three sends the summaries, stage two the stats it got so far
+const q6StageThree = "stage_three"
+
+type Q6 struct {
+	groups    map[string]*schema.PriceStats
+	summarize bool
+	storage   *common.IdempotencyHandlerSingleFile[*common.ArraySerialize[*schema.PriceStats]]
+	basefiles string
+}
+
+func NewQ6(base string, id string, partition int, stage string) (*Q6, error) {
+	basefiles := filepath.Join(".", base, fmt.Sprintf("query_six_%d", partition), stage, id)
+
+	s, err := common.NewIdempotencyHandlerSingleFile[*common.ArraySerialize[*schema.PriceStats]](
+		filepath.Join(basefiles, "results"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &Q6{
+		groups:    make(map[string]*schema.PriceStats),
+		summarize: stage == q6StageThree,
+		storage:   s,
+		basefiles: basefiles,
+	}
+
+	// Every line has the stats a message added, they are merged as they are read
+	_, err = s.LoadSequentialState(
+		common.ReadArray(schema.PriceStatsDeserialize),
+		func(acc *common.ArraySerialize[*schema.PriceStats], line *common.ArraySerialize[*schema.PriceStats]) *common.ArraySerialize[*schema.PriceStats] {
+			q.merge(line.Arr)
+			return acc
+		},
+		&common.ArraySerialize[*schema.PriceStats]{},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func priceGroupKey(kind string, name string) string {
+	return kind + "|" + name
+}
+
+func (q *Q6) merge(stats []*schema.PriceStats) {
+	for _, s := range stats {
+		key := priceGroupKey(s.Kind, s.Name)
+		g, ok := q.groups[key]
+		if !ok {
+			g = &schema.PriceStats{Kind: s.Kind, Name: s.Name, Prices: make(map[uint32]uint32)}
+			q.groups[key] = g
+		}
+		g.Merge(s)
+	}
+}
+
+// The stats a game adds to each of its genres and to its release year
+func priceGameStats(p *schema.PricedGame) []*schema.PriceStats {
+	var discounted uint32
+	if p.Discounted {
+		discounted = 1
+	}
+	single := func(kind string, name string) *schema.PriceStats {
+		return &schema.PriceStats{Kind: kind, Name: name, Discounted: discounted, Prices: map[uint32]uint32{p.Price: 1}}
+	}
+
+	stats := make([]*schema.PriceStats, 0, len(p.Genres)+1)
+	seen := make(map[string]bool)
+	for _, g := range p.Genres {
+		if !seen[g] {
+			seen[g] = true
+			stats = append(stats, single(schema.PriceGroupGenre, g))
+		}
+	}
+	if p.Year > 0 {
+		stats = append(stats, single(schema.PriceGroupYear, strconv.Itoa(int(p.Year))))
+	}
+	return stats
+}
+
+func (q *Q6) Insert(stats []*schema.PriceStats, idempotencyID *common.IdempotencyID) error {
+	err := q.storage.SaveState(idempotencyID, &common.ArraySerialize[*schema.PriceStats]{Arr: stats})
+	if err != nil {
+		return err
+	}
+	q.merge(stats)
+	return nil
+}
+
+func (q *Q6) sortedGroups() []*schema.PriceStats {
+	groups := make([]*schema.PriceStats, 0, len(q.groups))
+	for _, g := range q.groups {
+		groups = append(groups, g)
+	}
+	// Same order as the summaries
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Kind != groups[j].Kind {
+			return groups[i].Kind < groups[j].Kind
+		}
+		return groups[i].Name < groups[j].Name
+	})
+	return groups
+}
+
+func (q *Q6) NextStage() (<-chan *controller.NextStageMessage, <-chan error) {
+	// A few genres and years, they all fit in the channel
+	groups := q.sortedGroups()
+	ch := make(chan *controller.NextStageMessage, len(groups)+1)
+	ce := make(chan error, 1)
+
+	go func() {
+		defer close(ch)
+		defer close(ce)
+
+		fs, err := NewFileSequence(filepath.Join(q.basefiles, "sent_lines"))
+		if err != nil {
+			ce <- err
+			return
+		}
+		defer fs.Shutdown(true)
+
+		var line uint32 = 1
+		for _, g := range groups {
+			if line > fs.LastConfirmedSent() {
+				var m schema.Partitionable = g
+				if q.summarize {
+					m = g.Summary()
+				}
+				ch <- &controller.NextStageMessage{
+					Message:      m,
+					Sequence:     line,
+					SentCallback: fs.Sent,
+				}
+			}
+			line++
+		}
+
+		ch <- &controller.NextStageMessage{
+			Message:      nil,
+			Sequence:     line,
+			SentCallback: nil,
+		}
+	}()
+
+	return ch, ce
+}
+
+func (q *Q6) Handle(protocolData []byte, idempotencyID *common.IdempotencyID) (*controller.NextStageMessage, error) {
+	if q.storage.AlreadyProcessed(idempotencyID) {
+		log.Debugf("Action: Saving Price Stats | Result: Already processed | IdempotencyID: %s", idempotencyID)
+		return nil, nil
+	}
+	p, err := schema.UnmarshalMessage(protocolData)
+	if err != nil {
+		return nil, err
+	}
+
+	switch v := p.(type) {
+	case *schema.PricedGame:
+		return nil, q.Insert(priceGameStats(v), idempotencyID)
+	case *schema.PriceStats:
+		return nil, q.Insert([]*schema.PriceStats{v}, idempotencyID)
+	}
+	return nil, &schema.UnknownTypeError{}
+}
+
+func (q *Q6) Shutdown(delete bool) {
+	q.storage.Close()
+	if delete {
+		err := q.storage.Delete()
+		if err != nil {
+			log.Errorf("Action: Deleting Price Stats File | Result: Error | Error: %s", err)
+		}
+	}
+}
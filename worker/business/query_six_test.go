@@ -0,0 +1,79 @@
+package business_test
+
+import (
+	"fmt"
+	"middleware/common"
+	"middleware/worker/business"
+	"middleware/worker/schema"
+	"path/filepath"
+	"testing"
+)
+
+func TestQ6PriceSummaries(t *testing.T) {
+	base := filepath.Join("test_files", "query_six")
+
+	games := []*schema.Game{
+		{AppID: "1", ReleaseDate: "Jan 2, 2018", Price: "9.99", Discount: "0", Genres: []string{"Indie", "Action"}},
+		{AppID: "2", ReleaseDate: "Mar 5, 2018", Price: "19.99", Discount: "50", Genres: []string{"Indie"}},
+		{AppID: "3", ReleaseDate: "Jul 1, 2019", Price: "0.0", Discount: "0", Genres: []string{"Indie"}},
+		{AppID: "4", ReleaseDate: "Coming soon", Price: "4.99", Discount: "10", Genres: []string{"Action"}},
+		{AppID: "5", ReleaseDate: "Jul 1, 2019", Price: "free", Discount: "0", Genres: []string{"Indie"}},
+	}
+
+	partitions := make([]*business.Q6, 2)
+	for p := range partitions {
+		q, err := business.NewQ6(base, "id", p+1, "stage_two")
+		FatalOnError(err, t, "Cannot create the stage two")
+		partitions[p] = q
+	}
+	for i, g := range games {
+		if !business.Q6Filter(g) {
+			continue
+		}
+		data, err := schema.MarshalMessage(business.Q6Map(g))
+		FatalOnError(err, t, "Cannot marshal the priced game")
+		_, err = partitions[i%2].Handle(data, &common.IdempotencyID{Origin: "MF", Sequence: uint32(i + 1)})
+		FatalOnError(err, t, "Cannot handle the priced game")
+	}
+
+	// The second partition restarts and gets everything again
+	partitions[1].Shutdown(false)
+	q, err := business.NewQ6(base, "id", 2, "stage_two")
+	FatalOnError(err, t, "Cannot load the stage two")
+	partitions[1] = q
+	for i, g := range games {
+		if i%2 == 1 && business.Q6Filter(g) {
+			data, _ := schema.MarshalMessage(business.Q6Map(g))
+			_, err := q.Handle(data, &common.IdempotencyID{Origin: "MF", Sequence: uint32(i + 1)})
+			FatalOnError(err, t, "Cannot handle the priced game again")
+		}
+	}
+
+	final, err := business.NewQ6(base, "id", 1, "stage_three")
+	FatalOnError(err, t, "Cannot create the stage three")
+	defer final.Shutdown(true)
+	for p, q := range partitions {
+		cr, ce := q.NextStage()
+		drainPhase(t, cr, ce, fmt.Sprintf("S2_%d", p), final)
+		q.Shutdown(true)
+	}
+
+	summaries := make([]string, 0)
+	cr, ce := final.NextStage()
+	for r := range cr {
+		if r.Message != nil {
+			summaries = append(summaries, fmt.Sprint(r.Message.(*schema.PriceSummary).ToCSV()))
+		}
+	}
+	FatalOnError(<-ce, t, "Cannot make the next stage")
+
+	expected := []string{
+		"[genre Action 2 7.49 4.99 9.99 0.5000]",
+		"[genre Indie 3 9.99 9.99 19.99 0.3333]",
+		"[year 2018 2 14.99 9.99 19.99 0.5000]",
+		"[year 2019 1 0.00 0.00 0.00 0.0000]",
+	}
+	if fmt.Sprint(summaries) != fmt.Sprint(expected) {
+		t.Fatalf("Expected the summaries %v, got %v", expected, summaries)
+	}
+}
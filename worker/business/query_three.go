@@ -7,7 +7,6 @@ import (
 	"middleware/worker/schema"
 	"path/filepath"
 	"reflect"
-	"sort"
 )
 
 func Q3FilterGames(r *schema.Game) bool {
@@ -35,14 +34,15 @@ func Q3MapReviews(r *schema.Review) schema.Partitionable {
 }
 
 type Q3State struct {
-	Top []*schema.NamedReviewCounter
+	Top *TopK[*schema.NamedReviewCounter]
 	N   int
 }
 
 func (s *Q3State) Serialize() []byte {
 	se := common.NewSerializer()
-	serializables := make([]common.Serializable, len(s.Top))
-	for i, pt := range s.Top {
+	top := s.Top.Sorted()
+	serializables := make([]common.Serializable, len(top))
+	for i, pt := range top {
 		serializables[i] = pt
 	}
 	return se.WriteArray(serializables).ToBytes()
@@ -75,28 +75,28 @@ func NewQ3(base string, id string, partition int, top int) (*Q3, error) {
 		return nil, err
 	}
 
+	t := NewTopK(top, schema.NamedReviewCounterBefore)
+	for _, rc := range state.Arr {
+		t.Push(rc)
+	}
+
 	return &Q3{
 		state: &Q3State{
-			Top: state.Arr,
+			Top: t,
 			N:   top,
 		},
 		storage: s,
 	}, nil
 }
 
+// Like Q2, only saves the top when the game gets into it
 func (q *Q3) Insert(rc *schema.NamedReviewCounter, idempotencyID *common.IdempotencyID) error {
-	q.state.Top = append(q.state.Top, rc)
-
-	sort.Slice(q.state.Top, func(i, j int) bool {
-		return q.state.Top[i].Count > q.state.Top[j].Count
-	})
-
-	if len(q.state.Top) > q.state.N {
-		q.state.Top = q.state.Top[:q.state.N]
+	if !q.state.Top.Push(rc) {
+		return nil
 	}
 
 	err := q.storage.SaveState(idempotencyID, &common.ArraySerialize[*schema.NamedReviewCounter]{
-		Arr: q.state.Top,
+		Arr: q.state.Top.Sorted(),
 	})
 
 	if err != nil {
@@ -122,7 +122,7 @@ func (q *Q3) NextStage() (<-chan *controller.NextStageMessage, <-chan error) {
 		defer fs.Shutdown(true)
 
 		var line uint32 = 1
-		for _, pt := range q.state.Top {
+		for _, pt := range q.state.Top.Sorted() {
 			if line > fs.LastConfirmedSent() {
 				ch <- &controller.NextStageMessage{
 					Message:      pt,
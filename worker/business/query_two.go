@@ -7,41 +7,56 @@ import (
 	"middleware/worker/schema"
 	"path/filepath"
 	"reflect"
-	"sort"
+	"strconv"
 	"time"
 )
 
-func extractDecade(s string) (int, error) {
+// Granularities of the release periods
+const (
+	PeriodYear    = "year"
+	PeriodQuarter = "quarter"
+	PeriodDecade  = "decade"
+)
+
+// The period of a release date, like 2015, 2015-Q2 or 2010 for its decade. The labels of
+// a granularity sort in time order.
+func extractPeriod(s string, granularity string) (string, error) {
 	parsedDate, err := time.Parse("Jan 2, 2006", s)
 	if err != nil {
-		return 0, nil
+		return "", err
 	}
 
-	// Extract the year
 	year := parsedDate.Year()
-
-	// Calculate the decade
-	return year / 10 * 10, nil
+	switch granularity {
+	case PeriodYear:
+		return strconv.Itoa(year), nil
+	case PeriodQuarter:
+		return fmt.Sprintf("%d-Q%d", year, (int(parsedDate.Month())-1)/3+1), nil
+	case PeriodDecade:
+		return strconv.Itoa(year / 10 * 10), nil
+	}
+	return "", fmt.Errorf("unknown period granularity %s", granularity)
 }
 
 func Q2Filter(r *schema.Game) bool {
-	decade, err := extractDecade(r.ReleaseDate)
+	decade, err := extractPeriod(r.ReleaseDate, PeriodDecade)
 	if err != nil {
-		log.Error("Can't extract decade from: %s", r.ReleaseDate)
+		log.Debugf("Can't extract decade from: %s", r.ReleaseDate)
 		return false
 	}
-	return common.ContainsCaseInsensitive(r.Genres, common.Config.GetString("query.two.category")) && decade == common.Config.GetInt("query.two.decade")
+	return common.ContainsCaseInsensitive(r.Genres, common.Config.GetString("query.two.category")) && decade == strconv.Itoa(common.Config.GetInt("query.two.decade"))
 }
 
 func Q2Map(r *schema.Game) schema.Partitionable {
 	return &schema.PlayedTime{
 		AveragePlaytimeForever: r.AveragePlaytimeForever,
 		Name:                   r.Name,
+		AppID:                  r.AppID,
 	}
 }
 
 type Q2State struct {
-	Top []*schema.PlayedTime
+	Top *TopK[*schema.PlayedTime]
 	N   int
 }
 
@@ -73,9 +88,14 @@ func NewQ2(base string, stage string, id string, partition int, top int) (*Q2, e
 		}
 	}
 
+	t := NewTopK(top, schema.PlayedTimeBefore)
+	for _, pt := range state.Arr {
+		t.Push(pt)
+	}
+
 	return &Q2{
 		state: &Q2State{
-			Top: state.Arr,
+			Top: t,
 			N:   top,
 		},
 		storage:   s,
@@ -83,18 +103,15 @@ func NewQ2(base string, stage string, id string, partition int, top int) (*Q2, e
 	}, nil
 }
 
+// Only saves the top when the game gets into it. The ones that don't aren't marked as
+// processed, but they can't get in later either, the top only gets better
 func (q *Q2) Insert(games *schema.PlayedTime, idempotencyID *common.IdempotencyID) error {
-	q.state.Top = append(q.state.Top, games)
-
-	sort.Slice(q.state.Top, func(i, j int) bool {
-		return q.state.Top[i].AveragePlaytimeForever > q.state.Top[j].AveragePlaytimeForever
-	})
-
-	if len(q.state.Top) > q.state.N {
-		q.state.Top = q.state.Top[:q.state.N]
+	if !q.state.Top.Push(games) {
+		return nil
 	}
+
 	err := q.storage.SaveState(idempotencyID, &common.ArraySerialize[*schema.PlayedTime]{
-		Arr: q.state.Top,
+		Arr: q.state.Top.Sorted(),
 	})
 
 	if err != nil {
@@ -118,7 +135,7 @@ func (q *Q2) NextStage() (<-chan *controller.NextStageMessage, <-chan error) {
 		defer fs.Shutdown(true)
 
 		var line uint32 = 1
-		for _, pt := range q.state.Top {
+		for _, pt := range q.state.Top.Sorted() {
 			if line > fs.LastConfirmedSent() {
 				ch <- &controller.NextStageMessage{
 					Message:      pt,
@@ -2,7 +2,10 @@ package business_test
 
 import (
 	"middleware/common"
+	"middleware/worker/business"
 	"middleware/worker/schema"
+	"reflect"
+	"sort"
 	"testing"
 )
 
@@ -72,3 +75,221 @@ func TestNamedReviewCounterSerialize(t *testing.T) {
 		t.Fatalf(`The game Count was not properly deserialized. %d`, nrcDes.Count)
 	}
 }
+
+func TestProjectionKeepsQueryColumns(t *testing.T) {
+	ts := `20200,"Galactic Bowling","Oct 21, 2008","0 - 20000",0,0,19.99,0,0,"A long description","['English']","[]","","https://header.jpg","http://www.galacticbowling.net","","",True,False,False,0,"",0,6,11,"",30,0,"",12.5,0,0,0,"Perpetual FX Creative","Perpetual FX Creative","Single-player,Multi-player","Casual,Indie,Sports","Indie,Casual,Sports,Bowling","https://screenshot.jpg","http://movie.mp4"`
+
+	p, err := schema.NewProjection[schema.Game](schema.GameProjections["MFG_Q2"])
+	if err != nil {
+		t.Fatalf("Error while creating the projection: %s", err)
+	}
+
+	projected, err := p.Project(ts)
+	if err != nil {
+		t.Fatalf("Error while projecting the csv line: %s", err)
+	}
+
+	if len(projected) >= len(ts) {
+		t.Fatalf("The projected line is not smaller than the original one")
+	}
+
+	g, err := schema.StrParse[schema.Game](projected)
+	if err != nil {
+		t.Fatalf("Error while reading the projected csv line: %s", err)
+	}
+
+	if g.AppID != "20200" || g.Name != "Galactic Bowling" || g.ReleaseDate != "Oct 21, 2008" || g.AveragePlaytimeForever != 12.5 || len(g.Genres) != 3 {
+		t.Fatalf("The projected columns were not kept: %+v", g)
+	}
+
+	if g.AboutTheGame != "" || g.Windows {
+		t.Fatalf("The projection kept columns the query doesn't read: %+v", g)
+	}
+
+	// The AppID breaks the ties of the Q2 top
+	pt := business.Q2Map(g).(*schema.PlayedTime)
+	if pt.AppID != "20200" || pt.Name != "Galactic Bowling" || pt.AveragePlaytimeForever != 12.5 {
+		t.Fatalf("Q2Map lost columns of the projected game: %+v", pt)
+	}
+}
+
+// Every channel gives its map and filter functions the same answers with the projected
+// record as with the whole one, so the projections keep every column they read
+func TestProjectionsKeepWhatTheQueriesRead(t *testing.T) {
+	InitConfig()
+	common.Config.Set("query.two.category", "indie")
+	common.Config.Set("query.two.decade", 2000)
+	common.Config.Set("query.three.category", "indie")
+	common.Config.Set("query.four.category", "indie")
+	common.Config.Set("query.four.positive", false)
+	common.Config.Set("query.five.category", "indie")
+	common.Config.Set("query.eight.granularity", "quarter")
+
+	// Every column the queries read has a value that isn't the zero one
+	game := `20200,"Galactic Bowling","Oct 21, 2008","0 - 20000",0,0,19.99,25,0,"A long description","['English']","[]","","https://header.jpg","http://www.galacticbowling.net","","",True,True,True,0,"",0,6,11,"",30,0,"",12.5,0,0,0,"Perpetual FX Creative","Perpetual Publishing","Single-player,Multi-player","Casual,Indie,Sports","Indie,Casual,Sports,Bowling","https://screenshot.jpg","http://movie.mp4"`
+	review := `10,Counter-Strike,"Great game, would play again",-1,1`
+
+	games := map[string]struct {
+		filters []business.FilterGame
+		maps    []business.MapGame
+	}{
+		"MFG_Q1": {nil, []business.MapGame{business.Q1Map}},
+		"MFG_Q2": {[]business.FilterGame{business.Q2Filter}, []business.MapGame{business.Q2Map}},
+		"MFG_Q3": {[]business.FilterGame{business.Q3FilterGames}, []business.MapGame{business.Q3MapGames}},
+		"MFG_Q4": {[]business.FilterGame{business.Q4FilterGames}, []business.MapGame{business.Q4MapGames}},
+		"MFG_Q5": {[]business.FilterGame{business.Q5FilterGames}, []business.MapGame{business.Q5MapGames}},
+		"MFG_Q6": {[]business.FilterGame{business.Q6Filter}, []business.MapGame{business.Q6Map}},
+		"MFG_Q7": {[]business.FilterGame{business.Q7FilterGames}, []business.MapGame{business.Q7MapGames}},
+		"MFG_Q8": {[]business.FilterGame{business.Q8FilterGames}, []business.MapGame{business.Q8MapGames}},
+	}
+	// Any text has a language, so the filter only passes if the text is kept
+	hasText := business.Q4FilterReviewsBuilder(func(s string) bool { return s != "" })
+	reviews := map[string]struct {
+		filters []business.FilterReview
+		maps    []business.MapReview
+	}{
+		"MFR_Q3": {[]business.FilterReview{business.Q3FilterReviews}, []business.MapReview{business.Q3MapReviews}},
+		"MFR_Q4": {[]business.FilterReview{hasText}, []business.MapReview{business.Q4MapReviews}},
+		"MFR_Q5": {[]business.FilterReview{business.Q5FilterReviews}, []business.MapReview{business.Q5MapReviews}},
+		"MFR_Q7": {[]business.FilterReview{business.Q7FilterReviews}, []business.MapReview{business.Q7MapReviews}},
+		"MFR_Q8": {[]business.FilterReview{business.Q8FilterReviews}, []business.MapReview{business.Q8MapReviews}},
+	}
+
+	if len(games) != len(schema.GameProjections) || len(reviews) != len(schema.ReviewProjections) {
+		t.Fatalf("Every projection needs its functions here, got %d of %d game and %d of %d review ones",
+			len(games), len(schema.GameProjections), len(reviews), len(schema.ReviewProjections))
+	}
+
+	for channel, columns := range schema.GameProjections {
+		f, ok := games[channel]
+		if !ok {
+			t.Fatalf("No functions for the channel %s", channel)
+		}
+		whole, projected := parseProjected[schema.Game](t, columns, game)
+		for i, filter := range f.filters {
+			if !filter(whole) {
+				t.Fatalf("The filter %d of %s drops the whole game, the test can't tell anything", i, channel)
+			}
+			if !filter(projected) {
+				t.Fatalf("The filter %d of %s drops the projected game, it reads a column %v doesn't keep", i, channel, columns)
+			}
+		}
+		for i, mapper := range f.maps {
+			if w, p := mapper(whole), mapper(projected); !reflect.DeepEqual(w, p) {
+				t.Fatalf("The map %d of %s reads a column %v doesn't keep: %+v != %+v", i, channel, columns, w, p)
+			}
+		}
+	}
+
+	for channel, columns := range schema.ReviewProjections {
+		f, ok := reviews[channel]
+		if !ok {
+			t.Fatalf("No functions for the channel %s", channel)
+		}
+		whole, projected := parseProjected[schema.Review](t, columns, review)
+		for i, filter := range f.filters {
+			if !filter(whole) {
+				t.Fatalf("The filter %d of %s drops the whole review, the test can't tell anything", i, channel)
+			}
+			if !filter(projected) {
+				t.Fatalf("The filter %d of %s drops the projected review, it reads a column %v doesn't keep", i, channel, columns)
+			}
+		}
+		for i, mapper := range f.maps {
+			if w, p := mapper(whole), mapper(projected); !reflect.DeepEqual(w, p) {
+				t.Fatalf("The map %d of %s reads a column %v doesn't keep: %+v != %+v", i, channel, columns, w, p)
+			}
+		}
+	}
+}
+
+func parseProjected[T any](t *testing.T, columns []string, record string) (*T, *T) {
+	p, err := schema.NewProjection[T](columns)
+	FatalOnError(err, t, "Cannot create the projection")
+	projected, err := p.Project(record)
+	FatalOnError(err, t, "Cannot project the record")
+
+	w, err := schema.StrParse[T](record)
+	FatalOnError(err, t, "Cannot read the whole record")
+	r, err := schema.StrParse[T](projected)
+	FatalOnError(err, t, "Cannot read the projected record")
+	return w, r
+}
+
+func TestProjectionDropsReviewText(t *testing.T) {
+	ts := `10,Counter-Strike,"Great game, would play again",1,1`
+
+	p, err := schema.NewProjection[schema.Review](schema.ReviewProjections["MFR_Q3"])
+	if err != nil {
+		t.Fatalf("Error while creating the projection: %s", err)
+	}
+
+	projected, err := p.Project(ts)
+	if err != nil {
+		t.Fatalf("Error while projecting the csv line: %s", err)
+	}
+
+	r, err := schema.StrParse[schema.Review](projected)
+	if err != nil {
+		t.Fatalf("Error while reading the projected csv line: %s", err)
+	}
+
+	if r.AppID != "10" || r.ReviewScore != 1 {
+		t.Fatalf("The projected columns were not kept: %+v", r)
+	}
+
+	if r.ReviewText != "" || r.AppName != "" || r.ReviewVotes != 0 {
+		t.Fatalf("The projection kept columns the query doesn't read: %+v", r)
+	}
+}
+
+func TestProjectionUnknownColumn(t *testing.T) {
+	if _, err := schema.NewProjection[schema.Review]([]string{"AppID", "Language"}); err == nil {
+		t.Fatalf("Expected an error for an unknown column")
+	}
+}
+
+func TestResultsTotalOrder(t *testing.T) {
+	games := []*schema.NamedReviewCounter{
+		{Name: "B", Count: 3, AppID: "2"},
+		{Name: "A", Count: 3, AppID: "9"},
+		{Name: "B", Count: 3, AppID: "1"},
+		{Name: "C", Count: 5, AppID: "3"},
+	}
+	expected := []string{"3", "9", "1", "2"}
+	for round := 0; round < 4; round++ {
+		sorted := append([]*schema.NamedReviewCounter{}, games...)
+		sort.Slice(sorted, func(i, j int) bool { return schema.NamedReviewCounterBefore(sorted[i], sorted[j]) })
+		for i, g := range sorted {
+			if g.AppID != expected[i] {
+				t.Fatalf("Expected the games in order %v, got %v at %d", expected, g.AppID, i)
+			}
+		}
+		// Rotate so they come in another order
+		games = append(games[1:], games[0])
+	}
+}
+
+func FuzzUnmarshalMessage(f *testing.F) {
+	s := common.NewSerializer()
+	f.Add(s.WriteUint8(common.Type_Review).WriteString(`10,Counter-Strike,"Great game",1,1`).ToBytes())
+	for _, m := range []any{
+		&schema.SOCounter{AppId: "10", Windows: 1},
+		&schema.PlayedTime{Name: "Game", AveragePlaytimeForever: 10, AppID: "10"},
+		&schema.GameName{AppID: "10", Name: "Game"},
+		&schema.ValidReview{AppID: "10"},
+		&schema.ReviewCounter{AppID: "10", Count: 2},
+		&schema.NamedReviewCounter{Name: "Game", Count: 2, AppID: "10"},
+	} {
+		b, _ := schema.MarshalMessage(m)
+		f.Add(b)
+	}
+	f.Add([]byte{})
+	// A KLL sketch with huge level lengths
+	f.Add([]byte("\v\x00\x00\x00 00,00000000000000,,0000000,,0,,0"))
+
+	// Only checks nothing panics, the queues may carry anything
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		schema.UnmarshalMessage(raw)
+	})
+}
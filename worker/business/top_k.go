@@ -0,0 +1,53 @@
+package business
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// The best n values seen so far. The worst of them sits at the root of a min heap, so a
+// new value only has to beat it to get in, without sorting the whole top every time.
+type TopK[T any] struct {
+	n      int
+	better func(a, b T) bool
+	heap   *Heap[T]
+}
+
+// better must be a strict total order, ties broken by something unique like the name, so
+// the same values give the same top whatever order they arrive in
+func NewTopK[T any](n int, better func(a, b T) bool) *TopK[T] {
+	return &TopK[T]{
+		n:      n,
+		better: better,
+		heap:   NewGenericHeap(func(a, b T) bool { return better(b, a) }),
+	}
+}
+
+// Adds the value if it makes it into the top, telling whether the top changed
+func (t *TopK[T]) Push(v T) bool {
+	if t.n <= 0 {
+		return false
+	}
+	if t.heap.Len() < t.n {
+		heap.Push(t.heap, v)
+		return true
+	}
+	if !t.better(v, t.heap.Peek()) {
+		return false
+	}
+	t.heap.items[0] = v
+	heap.Fix(t.heap, 0)
+	return true
+}
+
+func (t *TopK[T]) Len() int {
+	return t.heap.Len()
+}
+
+// The top from best to worst
+func (t *TopK[T]) Sorted() []T {
+	sorted := make([]T, len(t.heap.items))
+	copy(sorted, t.heap.items)
+	sort.Slice(sorted, func(i, j int) bool { return t.better(sorted[i], sorted[j]) })
+	return sorted
+}
@@ -0,0 +1,69 @@
+package business_test
+
+import (
+	"fmt"
+	"math/rand"
+	"middleware/common"
+	"middleware/worker/business"
+	"middleware/worker/schema"
+	"path/filepath"
+	"testing"
+)
+
+func TestTopKSameTopWhateverTheOrder(t *testing.T) {
+	games := make([]*schema.NamedReviewCounter, 0)
+	for i := 0; i < 100; i++ {
+		// Lots of ties on the count
+		games = append(games, &schema.NamedReviewCounter{Name: fmt.Sprintf("game %02d", i), Count: uint32(i % 7)})
+	}
+
+	var expected []*schema.NamedReviewCounter
+	r := rand.New(rand.NewSource(0))
+	for round := 0; round < 5; round++ {
+		top := business.NewTopK(5, schema.NamedReviewCounterBefore)
+		for _, i := range r.Perm(len(games)) {
+			top.Push(games[i])
+		}
+		sorted := top.Sorted()
+		if expected == nil {
+			expected = sorted
+		}
+		for i := range sorted {
+			if sorted[i] != expected[i] {
+				t.Fatalf("Expected the same top in every order, got %v and %v", sorted, expected)
+			}
+		}
+	}
+
+	if expected[0].Name != "game 06" || expected[4].Name != "game 34" {
+		t.Fatalf("Expected the games with 6 reviews by name, got %v", expected)
+	}
+}
+
+func TestQ2TopSurvivesRestart(t *testing.T) {
+	base := filepath.Join("test_files", "top_k")
+	q, err := business.NewQ2(base, "s3", "id", 1, 3)
+	FatalOnError(err, t, "Cannot create Q2")
+
+	for i := 0; i < 10; i++ {
+		pt := &schema.PlayedTime{Name: fmt.Sprintf("game %d", i), AveragePlaytimeForever: float64(i)}
+		FatalOnError(q.Insert(pt, &common.IdempotencyID{Origin: "S2", Sequence: uint32(i + 1)}), t, "Cannot insert")
+	}
+	q.Shutdown(false)
+
+	q, err = business.NewQ2(base, "s3", "id", 1, 3)
+	FatalOnError(err, t, "Cannot load Q2")
+	defer q.Shutdown(true)
+
+	names := make([]string, 0)
+	cr, ce := q.NextStage()
+	for r := range cr {
+		if r.Message != nil {
+			names = append(names, r.Message.(*schema.PlayedTime).Name)
+		}
+	}
+	FatalOnError(<-ce, t, "Cannot make the next stage")
+	if fmt.Sprint(names) != "[game 9 game 8 game 7]" {
+		t.Fatalf("Expected the 3 games with most playtime after the restart, got %v", names)
+	}
+}
@@ -15,6 +15,13 @@ var TokensNeeded = map[string][]enums.TokenName{
 	"Q4_STAGE_3":         {enums.SINGLE_STREAM_EOF},
 	"Q5_STAGE_2":         {enums.MF_GAMES, enums.MF_REVIEWS},
 	"Q5_STAGE_3":         {enums.SINGLE_STREAM_EOF},
+	"Q6_STAGE_2":         {enums.MF_GAMES},
+	"Q6_STAGE_3":         {enums.SINGLE_STREAM_EOF},
+	"Q7_STAGE_2":         {enums.MF_GAMES, enums.MF_REVIEWS},
+	"Q7_STAGE_3":         {enums.SINGLE_STREAM_EOF},
+	"Q7_STAGE_4":         {enums.SINGLE_STREAM_EOF},
+	"Q8_STAGE_2":         {enums.MF_GAMES, enums.MF_REVIEWS},
+	"Q8_STAGE_3":         {enums.SINGLE_STREAM_EOF},
 }
 
 var TokenToSend = map[string]enums.TokenName{
@@ -30,4 +37,11 @@ var TokenToSend = map[string]enums.TokenName{
 	"Q4_STAGE_3":         enums.SINGLE_STREAM_EOF,
 	"Q5_STAGE_2":         enums.SINGLE_STREAM_EOF,
 	"Q5_STAGE_3":         enums.SINGLE_STREAM_EOF,
+	"Q6_STAGE_2":         enums.SINGLE_STREAM_EOF,
+	"Q6_STAGE_3":         enums.SINGLE_STREAM_EOF,
+	"Q7_STAGE_2":         enums.SINGLE_STREAM_EOF,
+	"Q7_STAGE_3":         enums.SINGLE_STREAM_EOF,
+	"Q7_STAGE_4":         enums.SINGLE_STREAM_EOF,
+	"Q8_STAGE_2":         enums.SINGLE_STREAM_EOF,
+	"Q8_STAGE_3":         enums.SINGLE_STREAM_EOF,
 }
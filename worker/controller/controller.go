@@ -10,6 +10,7 @@ import (
 	"os"
 	"os/signal"
 	"reflect"
+	"runtime"
 	"sync"
 	"syscall"
 	"time"
@@ -26,7 +27,9 @@ const (
 	Routing_Unicast
 )
 
-type HandlerFactory func(job common.JobID) (Handler, EOFValidator, error)
+// The topology is the one the job was admitted with, empty for the jobs that don't carry one.
+// The options are the ones its client picked, only the map filters get them.
+type HandlerFactory func(job common.JobID, topology common.Topology, options common.JobOptions) (Handler, EOFValidator, error)
 
 type EOFValidator interface {
 	Finish(receivedEOFs map[enums.TokenName]uint) (*EOFMessage, bool)
@@ -35,8 +38,8 @@ type EOFValidator interface {
 type Protocol interface {
 	Unmarshal(rawData []byte) (DataMessage, error)
 	Marshal(common.JobID, *common.IdempotencyID, common.Serializable) (common.Serializable, error)
-	Route(partitionKey string) (routingKey string)
-	Broadcast() (routes []string)
+	Route(partitionKey string, topology common.Topology) (routingKey string)
+	Broadcast(topology common.Topology) (routes []string)
 }
 
 type DataMessage interface {
@@ -58,17 +61,32 @@ type messageToSend struct {
 	JobID    common.JobID
 	Body     schema.Partitionable
 	Ack      *amqp.Delivery
+	// Of the job, the next stages keep serving it before the lower ones
+	Priority uint8
+	Topology common.Topology
+	Options  common.JobOptions
+	Feedback bool
+}
+
+// The job travels with its topology and options, so every stage builds its handlers with them
+func (m *messageToSend) headers() amqp.Table {
+	return rabbitmq.WithOptions(rabbitmq.TopologyHeaders(m.Topology), m.Options)
 }
 
 type messageFromQueue struct {
 	Delivery amqp.Delivery
 	Message  DataMessage
+	// Called by the runtime once it handled the message
+	Done func()
 }
 
 type Controller struct {
 	name    string
 	rcvFrom []*rabbitmq.Queue
 	to      []*rabbitmq.Exchange
+	// Where the messages for the stage before go, with the protocol that partitions it
+	feedback         *rabbitmq.Exchange
+	feedbackProtocol Protocol
 
 	protocol Protocol
 
@@ -79,6 +97,8 @@ type Controller struct {
 	txFinish          chan<- *HandlerRuntime
 	rxFinish          <-chan *HandlerRuntime
 	runtimeWG         sync.WaitGroup
+	scheduler         *common.FairQueue[*messageFromQueue]
+	pool              *workerPool
 	ManagerConnection net.Conn
 	Listener          net.Listener
 }
@@ -102,7 +122,26 @@ func NewController(controllerName string, from []*rabbitmq.Queue, to []*rabbitmq
 		rxFinish: h,
 	}
 
-	c.Listener, err = net.Listen("tcp", fmt.Sprintf(":%s", common.Config.GetString("worker.port")))
+	// The jobs share the input queues, so we read ahead and take turns between them instead
+	// of handling the messages in the order they were published
+	window := common.Config.GetInt("scheduler.window")
+	c.scheduler = common.NewFairQueue[*messageFromQueue](window, common.Config.GetInt("scheduler.quantum"), common.Config.GetInt("scheduler.inFlight"))
+	for _, q := range from {
+		q.Prefetch = max(q.Prefetch, window)
+	}
+
+	poolSize := common.Config.GetInt("handlerPool")
+	if poolSize == 0 {
+		poolSize = runtime.NumCPU()
+	}
+	c.pool = newWorkerPool(poolSize)
+
+	tlsCfg, err := common.LoadTLSConfig(common.Config, "worker.tls")
+	common.FailOnError(err, "Invalid TLS configuration")
+	serverTLS, err := tlsCfg.Server()
+	common.FailOnError(err, "Failed to load the TLS certificates")
+
+	c.Listener, err = common.Listen(fmt.Sprintf(":%s", common.Config.GetString("worker.port")), serverTLS)
 	common.FailOnError(err, "Failed to connect to listener")
 
 	log.Infof("Worker listening on port %s", fmt.Sprintf(":%s", common.Config.GetString("worker.port")))
@@ -124,10 +163,18 @@ func NewController(controllerName string, from []*rabbitmq.Queue, to []*rabbitmq
 	return c
 }
 
-func (q *Controller) getHandler(j common.JobID) (*HandlerRuntime, error) {
+func (q *Controller) WithFeedback(to *rabbitmq.Exchange, protocol Protocol) *Controller {
+	q.feedback = to
+	q.feedbackProtocol = protocol
+	return q
+}
+
+func (q *Controller) getHandler(j common.JobID, d *amqp.Delivery) (*HandlerRuntime, error) {
 	v, ok := q.handlers[j]
 	if !ok {
-		h, eof, err := q.factory(j)
+		topology := rabbitmq.TopologyFromHeaders(d.Headers)
+		options := rabbitmq.OptionsFromHeaders(d.Headers)
+		h, eof, err := q.factory(j, topology, options)
 		if err != nil {
 			return nil, err
 		}
@@ -137,6 +184,9 @@ func (q *Controller) getHandler(j common.JobID) (*HandlerRuntime, error) {
 			h,
 			eof,
 			q.txFwd,
+			q.pool,
+			topology,
+			options,
 		)
 		if err != nil {
 			return nil, err
@@ -148,16 +198,26 @@ func (q *Controller) getHandler(j common.JobID) (*HandlerRuntime, error) {
 	return v, nil
 }
 
-func (q *Controller) publish(routing string, m common.Serializable) {
+func (q *Controller) publish(routing string, m common.Serializable, priority uint8, headers amqp.Table) {
 	for _, ex := range q.to {
-		ex.Publish(routing, m)
+		ex.PublishWithHeaders(routing, m, priority, headers)
 	}
 }
 
-func (q *Controller) broadcast(m common.Serializable) {
-	rks := q.protocol.Broadcast()
+func (q *Controller) broadcast(m common.Serializable, priority uint8, topology common.Topology, headers amqp.Table) {
+	rks := q.protocol.Broadcast(topology)
 	for _, k := range rks {
-		q.publish(k, m)
+		q.publish(k, m, priority, headers)
+	}
+}
+
+func (q *Controller) broadcastFeedback(m common.Serializable, priority uint8, topology common.Topology, headers amqp.Table) {
+	if q.feedback == nil {
+		log.Errorf("Action: Sending Feedback %s | Result: Error | Error: the controller has nowhere to send it", q.name)
+		return
+	}
+	for _, k := range q.feedbackProtocol.Broadcast(topology) {
+		q.feedback.PublishWithHeaders(k, m, priority, headers)
 	}
 }
 
@@ -232,6 +292,9 @@ func (q *Controller) removeInactiveHandlersTask(s *sync.WaitGroup, rxFinish <-ch
 		case <-timer.C:
 			for id := range q.handlers {
 				h := q.handlers[id]
+				if h.awaiting.Load() {
+					continue
+				}
 				h.Mark++
 				if h.Mark == 3 {
 					// Give 2 passes for a little leeway in how much we want to wait
@@ -255,6 +318,9 @@ func (q *Controller) closingTask(s *sync.WaitGroup) {
 	// At this point, absolutely no handler runtime is running. We can close this safely
 	close(q.txFinish)
 	close(q.txFwd)
+	if q.pool != nil {
+		q.pool.Close()
+	}
 	log.Debugf("Shut down controller")
 }
 
@@ -268,14 +334,18 @@ func (q *Controller) sendForwardTask(s *sync.WaitGroup) {
 		}
 
 		if mts.Routing.Type == Routing_Broadcast {
-			q.broadcast(m)
+			if mts.Feedback {
+				q.broadcastFeedback(m, mts.Priority, mts.Topology, mts.headers())
+			} else {
+				q.broadcast(m, mts.Priority, mts.Topology, mts.headers())
+			}
 			if mts.Ack != nil {
 				mts.Ack.Ack(false)
 			}
 		}
 
 		if mts.Routing.Type == Routing_Unicast {
-			q.publish(q.protocol.Route(mts.Routing.Key), m)
+			q.publish(q.protocol.Route(mts.Routing.Key, mts.Topology), m, mts.Priority, mts.headers())
 			if mts.Ack != nil {
 				mts.Ack.Ack(false)
 			}
@@ -289,6 +359,30 @@ func (q *Controller) sendForwardTask(s *sync.WaitGroup) {
 	log.Debugf("Sent all pending messages")
 }
 
+func (q *Controller) dispatchTask(done chan<- bool) {
+	defer close(done)
+
+	for {
+		job, m, ok := q.scheduler.Pop()
+		if !ok {
+			break
+		}
+
+		h, err := q.getHandler(job, &m.Delivery)
+		if err != nil {
+			log.Errorf("Error while getting a handler for JobID: %s Error: %s", job, err)
+			m.Delivery.Nack(false, true)
+			q.scheduler.Done(job)
+			continue
+		}
+
+		m.Done = func() { q.scheduler.Done(job) }
+		h.Tx <- m
+	}
+
+	log.Debugf("Dispatched all pending messages")
+}
+
 func (c *Controller) listenManagerTask(s *sync.WaitGroup) {
 	defer s.Done()
 	for {
@@ -322,6 +416,9 @@ func (q *Controller) Start() {
 	end.Add(1)
 	go q.removeInactiveHandlersTask(&end, f)
 
+	dispatched := make(chan bool)
+	go q.dispatchTask(dispatched)
+
 	cases := make([]reflect.SelectCase, len(q.rcvFrom))
 	for i, ch := range q.rcvFrom {
 		cases[i] = reflect.SelectCase{
@@ -350,20 +447,15 @@ mainloop:
 			continue
 		}
 
-		h, err := q.getHandler(dm.JobID())
-		if err != nil {
-			log.Errorf("Error while getting a handler for Queue %s, JobID: %s Error: %s", q.rcvFrom[chosen].ExternalName, dm.JobID(), err)
-			d.Nack(false, true)
-			continue
-		}
-
-		h.Tx <- &messageFromQueue{
+		q.scheduler.Push(dm.JobID(), &messageFromQueue{
 			Delivery: d,
 			Message:  dm,
-		}
+		}, len(d.Body), d.Priority)
 
 	}
 	log.Debugf("Ending main loop")
+	q.scheduler.Close()
+	<-dispatched
 	// We have sent everything in flight, finalize the handlers
 	f <- true
 	close(f)
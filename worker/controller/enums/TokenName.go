@@ -8,6 +8,8 @@ const (
 	MF_GAMES //For these two, we need an amount of EOFS equal to the partition
 	MF_REVIEWS
 	SINGLE_STREAM_EOF //For these, we need an amount of EOFS equal to the partition
+	COUNTS_EOF        //Stage two sent what stage three needs to tell it back what to send, one per partition
+	PERCENTILE_EOF    //Stage three told stage two back, just one
 	TokenName_end
 )
 
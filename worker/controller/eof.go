@@ -104,6 +104,16 @@ func (e *EOFState) SaveState(token enums.TokenName, idempotencyId *common.Idempo
 type EOFChecker struct {
 	Needed map[enums.TokenName]uint
 	ToSend enums.TokenName
+	Phase  *EOFPhase
+}
+
+// A round the handler goes through once some of its inputs ended and before it can finish,
+// e.g. a join that sends its counts and waits to be told back which games to send
+type EOFPhase struct {
+	Needed map[enums.TokenName]uint
+	ToSend enums.TokenName
+	// The token goes back to the stage before instead of to the next one
+	Feedback bool
 }
 
 func matchLength[T any, S any](a []T, b []S) []S {
@@ -150,6 +160,31 @@ func (c *EOFChecker) AddCondition(s enums.TokenName, n uint) *EOFChecker {
 	return c
 }
 
+func (c *EOFChecker) WithPhase(p *EOFPhase) *EOFChecker {
+	c.Phase = p
+	return c
+}
+
+func (c *EOFChecker) PhaseEnded(receivedEOFs map[enums.TokenName]uint) (*EOFMessage, bool) {
+	if c.Phase == nil {
+		return nil, false
+	}
+	for k, n := range c.Phase.Needed {
+		if receivedEOFs[k] < n {
+			return nil, false
+		}
+	}
+	return &EOFMessage{
+		TokenName: c.Phase.ToSend,
+	}, true
+}
+
+// Whether every EOF of the token the checker waits for arrived
+func (c *EOFChecker) Complete(token enums.TokenName, receivedEOFs map[enums.TokenName]uint) bool {
+	n, ok := c.Needed[token]
+	return ok && receivedEOFs[token] >= n
+}
+
 func (c *EOFChecker) Finish(receivedEOFs map[enums.TokenName]uint) (*EOFMessage, bool) {
 	for k := range c.Needed {
 		if receivedEOFs[k] < c.Needed[k] {
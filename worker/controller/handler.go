@@ -2,8 +2,11 @@ package controller
 
 import (
 	"middleware/common"
+	"middleware/worker/controller/enums"
 	"middleware/worker/schema"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
@@ -16,6 +19,8 @@ type NextStageMessage struct {
 	Message      schema.Partitionable
 	Sequence     uint32
 	SentCallback func()
+	// Sent back to every partition of the stage before instead of to the next stage
+	Feedback bool
 }
 
 type Handler interface {
@@ -24,6 +29,38 @@ type Handler interface {
 	Shutdown(delete bool)
 }
 
+// Handlers that can answer a single input with more than one output (e.g. when flushing
+// a combine window). The delivery is acked after the last one is sent.
+type MultiHandler interface {
+	HandleMultiple(protocolData []byte, idempotencyID *common.IdempotencyID) ([]*NextStageMessage, error)
+}
+
+// Handlers whose Handle keeps no state between messages, so it can run for several of
+// them at once in the worker pool of the controller. Their outputs are still forwarded
+// and acked in the order the messages arrived.
+type StatelessHandler interface {
+	Stateless() bool
+}
+
+// Stateless handlers that still keep a little state, like counts of what Handle found. In
+// the pool Handle leaves it alone and Settle updates it with every output, one at a time
+// and in the order the messages arrived, before the output is forwarded.
+type SettlingHandler interface {
+	Settle(out *NextStageMessage, idempotencyID *common.IdempotencyID) (*NextStageMessage, error)
+}
+
+// Handlers that can get going once one of their inputs ended, before the others do (e.g.
+// a join that has every game). They are told again after a restart and on repeated EOFs.
+type TokenListener interface {
+	TokenComplete(token enums.TokenName)
+}
+
+// Handlers whose EOF checker has a phase. What they send when it ends goes out before its
+// token, like the results of NextStage go before the EOF.
+type PhasedHandler interface {
+	EndPhase() (<-chan *NextStageMessage, <-chan error)
+}
+
 type HandlerRuntime struct {
 	JobId          common.JobID
 	Tx             chan<- *messageFromQueue
@@ -40,6 +77,21 @@ type HandlerRuntime struct {
 	removeOnCleanup bool
 	finish          chan bool
 	sequenceCounter uint32
+	// Its phase ended and it waits for the stage after it to answer, it's not inactive
+	awaiting atomic.Bool
+	// Of the last message received, every message of a job carries the same one. Read by the
+	// emits of the pool while the next messages arrive
+	priority atomic.Uint32
+	// The job was admitted with, it's forwarded with everything the job sends
+	topology common.Topology
+	options  common.JobOptions
+
+	// Nil unless the handler is stateless and the controller has a pool
+	pool *workerPool
+	// Results of the pool in arrival order and how many of them weren't forwarded yet
+	pooled   chan *pooledResult
+	inPool   sync.WaitGroup
+	emitDone chan bool
 
 	r *rand.Rand
 }
@@ -50,6 +102,9 @@ func NewHandlerRuntime(
 	handler Handler,
 	validator EOFValidator,
 	send chan<- *messageToSend,
+	pool *workerPool,
+	topology common.Topology,
+	options common.JobOptions,
 ) (*HandlerRuntime, error) {
 	eof, err := NewEOFState(common.Config.GetString("metasavepath"), filepath.Join(controllerName, j.String()))
 	if err != nil {
@@ -72,9 +127,26 @@ func NewHandlerRuntime(
 		removeOnCleanup: false,
 		finish:          make(chan bool, 1),
 		Mark:            0,
+		topology:        topology,
+		options:         options,
 		r:               r,
 	}
 
+	if s, ok := handler.(StatelessHandler); ok && s.Stateless() && pool != nil {
+		c.pool = pool
+		c.pooled = make(chan *pooledResult, cap(ch))
+		c.emitDone = make(chan bool)
+		go c.emitPooled()
+	}
+
+	for token := range eof.Received {
+		c.notifyComplete(token)
+	}
+	if _, _, ended := c.phaseEnded(); ended {
+		_, finished := validator.Finish(eof.Received)
+		c.awaiting.Store(!finished)
+	}
+
 	go c.Start()
 	return c, nil
 }
@@ -107,6 +179,10 @@ func (h *HandlerRuntime) sendForward(m *messageToSend) {
 				Body:     m.Body,
 				Callback: nil,
 				Ack:      nil,
+				Priority: m.Priority,
+				Topology: m.Topology,
+				Options:  m.Options,
+				Feedback: m.Feedback,
 			}
 			h.txFwd <- cpy
 		}
@@ -120,6 +196,10 @@ func (h *HandlerRuntime) Start() {
 	//	- We finalize the job for this handler
 	//	- An external force closed the channel for receiving messages
 	defer func() {
+		if h.pool != nil {
+			close(h.pooled)
+			<-h.emitDone
+		}
 		log.Infof("Action: Handler Runtime Finalizing %s - %s", h.ControllerName, h.JobId)
 		h.finish <- true
 		close(h.finish)
@@ -130,47 +210,138 @@ func (h *HandlerRuntime) Start() {
 		// Even if it's a repeated EOF message, it shouldn't be too big of a problem
 		// to restart the cleaning cycle
 		h.Mark = 0
+		h.priority.Store(uint32(msg.Delivery.Priority))
 
-		if !msg.Message.IsEOF() {
-			h.handleDataMessage(msg)
+		if h.pool != nil && !msg.Message.IsEOF() {
+			h.submit(msg)
 			continue
 		}
 
-		eof, err := EOFMessageFromBytes(msg.Message.Data())
-		if err != nil {
-			msg.Delivery.Nack(false, true)
+		// The EOF must come after everything received before it
+		h.inPool.Wait()
+		h.handleMessage(msg)
+		if msg.Done != nil {
+			msg.Done()
 		}
-		updated := h.eofs.Update(eof.TokenName, msg.Message.IdemID())
-
-		msgFwd, finished := h.validateEOF.Finish(h.eofs.Received)
-		if updated && finished {
-			ok := h.handleNextStage()
-			if ok {
-				h.sequenceCounter += 1
-				h.sendForward(h.broadcast(&NextStageMessage{
-					Message:  msgFwd,
-					Sequence: h.sequenceCounter,
-					SentCallback: func() {
-						// This guarantees that the only one that can trigger the EOF forward
-						// sequence is the last one that has arrived, if there are others that are
-						// repeated, they will not generate the sequence, as they will never update
-						// and we will missing a token to start the sequence
-						h.eofs.SaveState(eof.TokenName, msg.Message.IdemID())
-						// Ack the EOF that generated the send forward to after everything was written
-						msg.Delivery.Ack(false)
-						h.signalFinish()
-					},
-				}, nil))
-			}
-		} else if updated && !finished {
+	}
+	h.inPool.Wait()
+}
+
+func (h *HandlerRuntime) submit(msg *messageFromQueue) {
+	r := &pooledResult{msg: msg, done: make(chan struct{})}
+	h.inPool.Add(1)
+	h.pool.Submit(func() {
+		r.out, r.err = h.handler.Handle(msg.Message.Data(), msg.Message.IdemID())
+		close(r.done)
+	})
+	h.pooled <- r
+}
+
+// Forwards the results of the pool in the order the messages arrived, so the sequences
+// and acks of every origin keep their order
+func (h *HandlerRuntime) emitPooled() {
+	defer close(h.emitDone)
+	settler, settles := h.handler.(SettlingHandler)
+	for r := range h.pooled {
+		<-r.done
+		if r.err == nil && settles {
+			r.out, r.err = settler.Settle(r.out, r.msg.Message.IdemID())
+		}
+		h.forward(r.msg, r.out, r.err)
+		if r.msg.Done != nil {
+			r.msg.Done()
+		}
+		h.inPool.Done()
+	}
+}
+
+func (h *HandlerRuntime) handleMessage(msg *messageFromQueue) {
+	if !msg.Message.IsEOF() {
+		h.handleDataMessage(msg)
+		return
+	}
+
+	eof, err := EOFMessageFromBytes(msg.Message.Data())
+	if err != nil {
+		msg.Delivery.Nack(false, true)
+	}
+	_, _, phaseBefore := h.phaseEnded()
+	updated := h.eofs.Update(eof.TokenName, msg.Message.IdemID())
+	h.notifyComplete(eof.TokenName)
+
+	msgFwd, finished := h.validateEOF.Finish(h.eofs.Received)
+	if phaseFwd, phase, ended := h.phaseEnded(); updated && !finished && !phaseBefore && ended {
+		h.handlePhase(msg, eof, phaseFwd, phase.Feedback)
+		return
+	}
+
+	if updated && finished {
+		h.awaiting.Store(false)
+		ok := h.handleNextStage()
+		if ok {
+			h.sequenceCounter += 1
+			h.sendForward(h.broadcast(&NextStageMessage{
+				Message:  msgFwd,
+				Sequence: h.sequenceCounter,
+				SentCallback: func() {
+					// This guarantees that the only one that can trigger the EOF forward
+					// sequence is the last one that has arrived, if there are others that are
+					// repeated, they will not generate the sequence, as they will never update
+					// and we will missing a token to start the sequence
+					h.eofs.SaveState(eof.TokenName, msg.Message.IdemID())
+					// Ack the EOF that generated the send forward to after everything was written
+					msg.Delivery.Ack(false)
+					h.signalFinish()
+				},
+			}, nil))
+		}
+	} else if updated && !finished {
+		h.eofs.SaveState(eof.TokenName, msg.Message.IdemID())
+		msg.Delivery.Ack(false)
+	} else if !updated && finished {
+		h.signalFinish()
+		msg.Delivery.Ack(false)
+	} else {
+		msg.Delivery.Ack(false)
+	}
+}
+
+func (h *HandlerRuntime) phaseEnded() (*EOFMessage, *EOFPhase, bool) {
+	c, ok := h.validateEOF.(*EOFChecker)
+	if !ok {
+		return nil, nil, false
+	}
+	m, ended := c.PhaseEnded(h.eofs.Received)
+	return m, c.Phase, ended
+}
+
+// The EOF that ended the phase is saved and acked once its token went out
+func (h *HandlerRuntime) handlePhase(msg *messageFromQueue, eof *EOFMessage, fwd *EOFMessage, feedback bool) {
+	if p, ok := h.handler.(PhasedHandler); ok && !h.sendAll(p.EndPhase()) {
+		return
+	}
+
+	log.Infof("Action: Ending Phase %s - %s | Token: %d | Feedback: %t", h.ControllerName, h.JobId, fwd.TokenName, feedback)
+	h.awaiting.Store(true)
+	h.sequenceCounter += 1
+	h.sendForward(h.broadcast(&NextStageMessage{
+		Message:  fwd,
+		Sequence: h.sequenceCounter,
+		Feedback: feedback,
+		SentCallback: func() {
 			h.eofs.SaveState(eof.TokenName, msg.Message.IdemID())
 			msg.Delivery.Ack(false)
-		} else if !updated && finished {
-			h.signalFinish()
-			msg.Delivery.Ack(false)
-		} else {
-			msg.Delivery.Ack(false)
-		}
+		},
+	}, nil))
+}
+
+func (h *HandlerRuntime) notifyComplete(token enums.TokenName) {
+	l, ok := h.handler.(TokenListener)
+	if !ok {
+		return
+	}
+	if c, ok := h.validateEOF.(*EOFChecker); ok && c.Complete(token, h.eofs.Received) {
+		l.TokenComplete(token)
 	}
 }
 
@@ -188,10 +359,19 @@ func (h *HandlerRuntime) Finish() {
 }
 
 func (h *HandlerRuntime) handleDataMessage(msg *messageFromQueue) {
+	if mh, ok := h.handler.(MultiHandler); ok {
+		h.handleDataMessageMultiple(mh, msg)
+		return
+	}
 	out, err := h.handler.Handle(msg.Message.Data(), msg.Message.IdemID())
+	h.forward(msg, out, err)
+}
+
+func (h *HandlerRuntime) forward(msg *messageFromQueue, out *NextStageMessage, err error) {
 	if err != nil {
 		log.Errorf("Action: Handling Message %s - %s| Result: Error | Error: %s | Data: %s", h.ControllerName, h.JobId, err, msg.Message.Data())
 		msg.Delivery.Nack(false, true)
+		return
 	}
 	if out != nil {
 		h.sendForward(h.unicast(out, &msg.Delivery))
@@ -200,9 +380,38 @@ func (h *HandlerRuntime) handleDataMessage(msg *messageFromQueue) {
 	}
 }
 
+func (h *HandlerRuntime) handleDataMessageMultiple(mh MultiHandler, msg *messageFromQueue) {
+	outs, err := mh.HandleMultiple(msg.Message.Data(), msg.Message.IdemID())
+	if err != nil {
+		log.Errorf("Action: Handling Message %s - %s| Result: Error | Error: %s | Data: %s", h.ControllerName, h.JobId, err, msg.Message.Data())
+		msg.Delivery.Nack(false, true)
+		return
+	}
+
+	toSend := make([]*messageToSend, 0, len(outs))
+	for _, out := range outs {
+		if m := h.unicast(out, nil); m != nil {
+			toSend = append(toSend, m)
+		}
+	}
+
+	if len(toSend) == 0 {
+		msg.Delivery.Ack(false)
+		return
+	}
+
+	// Only ack the upstream message once everything it generated was published
+	toSend[len(toSend)-1].Ack = &msg.Delivery
+	for _, m := range toSend {
+		h.sendForward(m)
+	}
+}
+
 func (h *HandlerRuntime) handleNextStage() bool {
-	cr, ce := h.handler.NextStage()
+	return h.sendAll(h.handler.NextStage())
+}
 
+func (h *HandlerRuntime) sendAll(cr <-chan *NextStageMessage, ce <-chan error) bool {
 sendLoop:
 	for {
 		select {
@@ -230,6 +439,9 @@ func (h *HandlerRuntime) unicast(m *NextStageMessage, d *amqp.Delivery) *message
 	if m.Message == nil {
 		return nil
 	}
+	if m.Feedback {
+		return h.broadcast(m, d)
+	}
 	return &messageToSend{
 		JobID:    h.JobId,
 		Sequence: m.Sequence,
@@ -240,6 +452,9 @@ func (h *HandlerRuntime) unicast(m *NextStageMessage, d *amqp.Delivery) *message
 			Type: Routing_Unicast,
 			Key:  m.Message.PartitionKey(),
 		},
+		Priority: uint8(h.priority.Load()),
+		Topology: h.topology,
+		Options:  h.options,
 	}
 }
 
@@ -251,7 +466,11 @@ func (h *HandlerRuntime) broadcast(m *NextStageMessage, d *amqp.Delivery) *messa
 		Routing: routing{
 			Type: Routing_Broadcast,
 		},
-		Body: m.Message,
-		Ack:  d,
+		Body:     m.Message,
+		Ack:      d,
+		Priority: uint8(h.priority.Load()),
+		Topology: h.topology,
+		Options:  h.options,
+		Feedback: m.Feedback,
 	}
 }
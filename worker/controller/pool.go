@@ -0,0 +1,40 @@
+package controller
+
+// Goroutines shared by the runtimes of every job of a controller, to run the handlers
+// that keep no state between messages on more than one core
+type workerPool struct {
+	tasks chan func()
+}
+
+// Nil when there is nothing to gain from it
+func newWorkerPool(size int) *workerPool {
+	if size <= 1 {
+		return nil
+	}
+	p := &workerPool{tasks: make(chan func(), size)}
+	for i := 0; i < size; i++ {
+		go func() {
+			for task := range p.tasks {
+				task()
+			}
+		}()
+	}
+	return p
+}
+
+func (p *workerPool) Submit(task func()) {
+	p.tasks <- task
+}
+
+func (p *workerPool) Close() {
+	close(p.tasks)
+}
+
+// Result of a message handled in the pool, forwarded once every message received before
+// it was forwarded
+type pooledResult struct {
+	msg  *messageFromQueue
+	out  *NextStageMessage
+	err  error
+	done chan struct{}
+}
@@ -0,0 +1,142 @@
+package controller
+
+import (
+	"fmt"
+	"middleware/common"
+	"middleware/worker/controller/enums"
+	"middleware/worker/schema"
+	"path/filepath"
+	"sync"
+	// The package has a testing constant of its own
+	gotesting "testing"
+	"time"
+
+	"github.com/google/uuid"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/spf13/viper"
+)
+
+// Records the deliveries acked, in order
+type ackRecorder struct {
+	mu    sync.Mutex
+	acked []uint64
+}
+
+func (a *ackRecorder) Ack(tag uint64, multiple bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.acked = append(a.acked, tag)
+	return nil
+}
+
+func (a *ackRecorder) Nack(tag uint64, multiple bool, requeue bool) error {
+	return fmt.Errorf("delivery %d nacked", tag)
+}
+
+func (a *ackRecorder) Reject(tag uint64, requeue bool) error {
+	return fmt.Errorf("delivery %d rejected", tag)
+}
+
+// The later a message arrives the sooner it's handled. Without outputs the runtime acks the
+// messages itself, with them it's done once they are published.
+type slowFirst struct {
+	n        int
+	outputs  bool
+	mu       sync.Mutex
+	finished int
+	// How many messages were handled when NextStage was called
+	handledAtEOF int
+}
+
+func (s *slowFirst) Stateless() bool { return true }
+
+func (s *slowFirst) Handle(data []byte, id *common.IdempotencyID) (*NextStageMessage, error) {
+	time.Sleep(time.Duration(s.n-int(id.Sequence)) * 5 * time.Millisecond)
+	s.mu.Lock()
+	s.finished++
+	s.mu.Unlock()
+	if !s.outputs {
+		return nil, nil
+	}
+	return &NextStageMessage{Message: &schema.LanguageCount{Language: string(data)}, Sequence: id.Sequence}, nil
+}
+
+func (s *slowFirst) NextStage() (<-chan *NextStageMessage, <-chan error) {
+	s.mu.Lock()
+	s.handledAtEOF = s.finished
+	s.mu.Unlock()
+	cr := make(chan *NextStageMessage)
+	ce := make(chan error)
+	close(cr)
+	close(ce)
+	return cr, ce
+}
+
+func (s *slowFirst) Shutdown(bool) {}
+
+func TestPoolKeepsArrivalOrder(t *gotesting.T) {
+	common.Config = viper.New()
+	common.Config.Set("metasavepath", filepath.Join("test_files", "pool"))
+
+	for _, outputs := range []bool{true, false} {
+		const n = 8
+		job := uuid.New()
+		h := &slowFirst{n: n, outputs: outputs}
+		eof := &EOFChecker{Needed: map[enums.TokenName]uint{enums.MF_REVIEWS: 1}, ToSend: enums.COUNTS_EOF}
+		sent := make(chan *messageToSend, 2*n)
+		pool := newWorkerPool(n)
+
+		rt, err := NewHandlerRuntime("POOL_TEST", job, h, eof, sent, pool, common.Topology{}, nil)
+		if err != nil {
+			t.Fatalf("Can't create the runtime: %s", err)
+		}
+		if rt.pool == nil {
+			t.Fatalf("Expected the stateless handler to run in the pool")
+		}
+
+		acks := &ackRecorder{}
+		for i := 1; i <= n; i++ {
+			rt.Tx <- &messageFromQueue{
+				Delivery: amqp.Delivery{Acknowledger: acks, DeliveryTag: uint64(i)},
+				Message:  common.NewMessage(job, &common.IdempotencyID{Origin: "T", Sequence: uint32(i)}, common.ProtocolMessage_Data, []byte(fmt.Sprint(i))),
+			}
+		}
+		token := &EOFMessage{TokenName: enums.MF_REVIEWS}
+		rt.Tx <- &messageFromQueue{
+			Delivery: amqp.Delivery{Acknowledger: acks, DeliveryTag: n + 1},
+			Message:  common.NewMessage(job, &common.IdempotencyID{Origin: "T", Sequence: n + 1}, common.ProtocolMessage_Control, token.Serialize()),
+		}
+
+		// What the controller would do: publish, then ack what the message says
+		for i := 1; outputs && i <= n; i++ {
+			m := <-sent
+			c, ok := m.Body.(*schema.LanguageCount)
+			if !ok || c.Language != fmt.Sprint(i) || m.Sequence != uint32(i) {
+				t.Fatalf("Expected the output of message %d, got %v with sequence %d", i, m.Body, m.Sequence)
+			}
+			m.Ack.Ack(false)
+		}
+		m := <-sent
+		if _, ok := m.Body.(*EOFMessage); !ok {
+			t.Fatalf("Expected the EOF after every output, got %v", m.Body)
+		}
+		if h.handledAtEOF != n {
+			t.Fatalf("Expected the EOF to be handled after the %d messages before it, it came after %d", n, h.handledAtEOF)
+		}
+		m.Callback()
+
+		if len(acks.acked) != n+1 {
+			t.Fatalf("Expected %d acks, got %v", n+1, acks.acked)
+		}
+		for i, tag := range acks.acked {
+			if tag != uint64(i+1) {
+				t.Fatalf("Expected the acks in arrival order, got %v", acks.acked)
+			}
+		}
+
+		close(rt.Tx)
+		<-rt.finish
+		pool.Close()
+		rt.eofs.storage.Delete()
+	}
+}
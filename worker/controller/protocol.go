@@ -1,10 +1,10 @@
 package controller
 
 import (
-	"hash/fnv"
 	"middleware/common"
 	"middleware/worker/schema"
 	"strconv"
+	"sync"
 )
 
 const (
@@ -13,7 +13,35 @@ const (
 )
 
 type NodeProtocol struct {
+	// Used for the jobs that don't carry a topology
 	PartitionAmount uint
+	// Whose stage two partitions of the job topology are routed to, empty to always use the amount above
+	Query string
+
+	// One per partition amount seen, the jobs of before and after a rescale use different ones
+	rings map[int]*common.HashRing
+	mu    sync.Mutex
+}
+
+func (p *NodeProtocol) partitions(topology common.Topology) int {
+	if p.Query == "" {
+		return int(p.PartitionAmount)
+	}
+	return topology.Partitions(p.Query, int(p.PartitionAmount))
+}
+
+func (p *NodeProtocol) ring(partitions int) *common.HashRing {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.rings == nil {
+		p.rings = make(map[int]*common.HashRing)
+	}
+	r, ok := p.rings[partitions]
+	if !ok {
+		r = common.NewHashRing(partitions, common.VirtualNodes)
+		p.rings[partitions] = r
+	}
+	return r
 }
 
 func (p *NodeProtocol) Unmarshal(rawData []byte) (DataMessage, error) {
@@ -35,23 +63,16 @@ func (p *NodeProtocol) Marshal(j common.JobID, idemId *common.IdempotencyID, d c
 	return common.NewMessage(j, idemId, t, data), nil
 }
 
-func (p *NodeProtocol) Route(partitionKey string) (routingKey string) {
-	// Create a new FNV-1a hash
-	h := fnv.New32a()
-	h.Write([]byte(partitionKey))
-
-	// Get the hash value as an unsigned integer
-	hashValue := h.Sum32()
-
-	// Map the hash value to a number between 1 and N
-	// Add 1 to ensure it's in the range [1, N]
-	return strconv.Itoa(int(hashValue%uint32(p.PartitionAmount)) + 1)
+// Consistent hashing, so changing the partitions only moves the keys it has to
+func (p *NodeProtocol) Route(partitionKey string, topology common.Topology) (routingKey string) {
+	return strconv.Itoa(p.ring(p.partitions(topology)).Locate(partitionKey))
 }
 
-func (p *NodeProtocol) Broadcast() []string {
-	numbers := make([]string, 0, p.PartitionAmount)
+func (p *NodeProtocol) Broadcast(topology common.Topology) []string {
+	n := p.partitions(topology)
+	numbers := make([]string, 0, n)
 
-	for i := 1; i <= int(p.PartitionAmount); i++ {
+	for i := 1; i <= n; i++ {
 		numbers = append(numbers, strconv.Itoa(i))
 	}
 
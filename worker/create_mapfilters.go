@@ -6,8 +6,6 @@ import (
 	"middleware/rabbitmq"
 	"middleware/worker/business"
 	"middleware/worker/controller"
-
-	"github.com/pemistahl/lingua-go"
 )
 
 func CreateMFGQ1(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *rabbitmq.Architecture) *controller.Controller {
@@ -21,8 +19,9 @@ func CreateMFGQ1(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *
 		},
 		&controller.NodeProtocol{
 			PartitionAmount: uint(arcCfg.QueryOne.StageTwo.PartitionAmount),
+			Query:           "Q1",
 		},
-		func(jobId common.JobID) (controller.Handler, controller.EOFValidator, error) {
+		func(jobId common.JobID, topology common.Topology, options common.JobOptions) (controller.Handler, controller.EOFValidator, error) {
 
 			mf, err := business.NewMapFilterGames(
 				common.Config.GetString("savepath"),
@@ -37,6 +36,10 @@ func CreateMFGQ1(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *
 				return nil, nil, err
 			}
 
+			if err = mf.EnableCombiner(business.Q1Combine, common.Config.GetInt("combineWindow")); err != nil {
+				return nil, nil, err
+			}
+
 			return mf, controller.NewEOFChecker("MAP_FILTER_GAMES", 1), nil
 		},
 	)
@@ -53,8 +56,9 @@ func CreateMFGQ2(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *
 		},
 		&controller.NodeProtocol{
 			PartitionAmount: uint(arcCfg.QueryTwo.StageTwo.PartitionAmount),
+			Query:           "Q2",
 		},
-		func(jobId common.JobID) (controller.Handler, controller.EOFValidator, error) {
+		func(jobId common.JobID, topology common.Topology, options common.JobOptions) (controller.Handler, controller.EOFValidator, error) {
 			mf, err := business.NewMapFilterGames(
 				common.Config.GetString("savepath"),
 				jobId.String(),
@@ -84,8 +88,9 @@ func CreateMFGQ3(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *
 		},
 		&controller.NodeProtocol{
 			PartitionAmount: uint(arcCfg.QueryThree.StageTwo.PartitionAmount),
+			Query:           "Q3",
 		},
-		func(jobId common.JobID) (controller.Handler, controller.EOFValidator, error) {
+		func(jobId common.JobID, topology common.Topology, options common.JobOptions) (controller.Handler, controller.EOFValidator, error) {
 			mf, err := business.NewMapFilterGames(
 				common.Config.GetString("savepath"),
 				jobId.String(),
@@ -115,8 +120,9 @@ func CreateMFGQ4(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *
 		},
 		&controller.NodeProtocol{
 			PartitionAmount: uint(arcCfg.QueryFour.StageTwo.PartitionAmount),
+			Query:           "Q4",
 		},
-		func(jobId common.JobID) (controller.Handler, controller.EOFValidator, error) {
+		func(jobId common.JobID, topology common.Topology, options common.JobOptions) (controller.Handler, controller.EOFValidator, error) {
 			mf, err := business.NewMapFilterGames(
 				common.Config.GetString("savepath"),
 				jobId.String(),
@@ -146,8 +152,9 @@ func CreateMFGQ5(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *
 		},
 		&controller.NodeProtocol{
 			PartitionAmount: uint(arcCfg.QueryFive.StageTwo.PartitionAmount),
+			Query:           "Q5",
 		},
-		func(jobId common.JobID) (controller.Handler, controller.EOFValidator, error) {
+		func(jobId common.JobID, topology common.Topology, options common.JobOptions) (controller.Handler, controller.EOFValidator, error) {
 			mf, err := business.NewMapFilterGames(
 				common.Config.GetString("savepath"),
 				jobId.String(),
@@ -177,8 +184,9 @@ func CreateMFRQ3(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *
 		},
 		&controller.NodeProtocol{
 			PartitionAmount: uint(arcCfg.QueryThree.StageTwo.PartitionAmount),
+			Query:           "Q3",
 		},
-		func(jobId common.JobID) (controller.Handler, controller.EOFValidator, error) {
+		func(jobId common.JobID, topology common.Topology, options common.JobOptions) (controller.Handler, controller.EOFValidator, error) {
 			mf, err := business.NewMapFilterReviews(
 				common.Config.GetString("savepath"),
 				jobId.String(),
@@ -192,21 +200,23 @@ func CreateMFRQ3(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *
 				return nil, nil, err
 			}
 
+			if err = mf.EnableCombiner(business.ReviewCountCombine, common.Config.GetInt("combineWindow")); err != nil {
+				return nil, nil, err
+			}
+
+			if err = mf.EnableHotKeys(hotKeysConfig()); err != nil {
+				return nil, nil, err
+			}
+
 			return mf, controller.NewEOFChecker("MAP_FILTER_REVIEWS", 1), nil
 		},
 	)
 }
 
 func CreateMFRQ4(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *rabbitmq.Architecture) *controller.Controller {
-	detector := lingua.NewLanguageDetectorBuilder().
-		FromLanguages(lingua.English, lingua.Spanish).
-		WithMinimumRelativeDistance(0.9).
-		Build()
-
-	f := func(s string) bool {
-		lang, exists := detector.DetectLanguageOf(s)
-		return exists && lang == lingua.English
-	}
+	// The worker ones, checked before any job needs them
+	_, err := business.LanguageOptionsFor(nil)
+	common.FailOnError(err, "Invalid language detection config for query four")
 
 	return controller.NewController(
 		fmt.Sprintf("MFRQ4_%d", cfg.ReadFromPartition),
@@ -218,21 +228,48 @@ func CreateMFRQ4(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *
 		},
 		&controller.NodeProtocol{
 			PartitionAmount: uint(arcCfg.QueryFour.StageTwo.PartitionAmount),
+			Query:           "Q4",
 		},
-		func(jobId common.JobID) (controller.Handler, controller.EOFValidator, error) {
+		func(jobId common.JobID, topology common.Topology, options common.JobOptions) (controller.Handler, controller.EOFValidator, error) {
+			// The server checked what the job set, only a mix with our config can be wrong here
+			languages, err := business.LanguageOptionsFor(options)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid language options for the job: %w", err)
+			}
+
 			mf, err := business.NewMapFilterReviews(
 				common.Config.GetString("savepath"),
 				jobId.String(),
 				"Q4R",
 				cfg.ReadFromPartition,
 				business.Q4MapReviews,
-				business.Q4FilterReviewsBuilder(f),
+				nil,
 			)
 
 			if err != nil {
 				return nil, nil, err
 			}
 
+			cache := business.LanguageClassifierFor(languages, languageCacheConfig())
+			classify := cache.Classify
+			breakdown, err := business.LanguageBreakdownFor(options)
+			if err != nil {
+				return nil, nil, err
+			}
+			if breakdown {
+				err = mf.EnableLanguageBreakdown(classify, business.Q4FilterReviewsBuilder, common.Config.GetInt("query.four.languageBreakdownBatch"))
+				if err != nil {
+					return nil, nil, err
+				}
+			} else {
+				mf.Filter = business.Q4FilterReviewsBuilder(business.TargetLanguages(classify))
+			}
+			mf.LanguageCache = cache
+
+			if err = mf.EnableHotKeys(hotKeysConfig()); err != nil {
+				return nil, nil, err
+			}
+
 			return mf, controller.NewEOFChecker("MAP_FILTER_REVIEWS", 1), nil
 		},
 	)
@@ -249,8 +286,9 @@ func CreateMFRQ5(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *
 		},
 		&controller.NodeProtocol{
 			PartitionAmount: uint(arcCfg.QueryFive.StageTwo.PartitionAmount),
+			Query:           "Q5",
 		},
-		func(jobId common.JobID) (controller.Handler, controller.EOFValidator, error) {
+		func(jobId common.JobID, topology common.Topology, options common.JobOptions) (controller.Handler, controller.EOFValidator, error) {
 			mf, err := business.NewMapFilterReviews(
 				common.Config.GetString("savepath"),
 				jobId.String(),
@@ -264,6 +302,204 @@ func CreateMFRQ5(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *
 				return nil, nil, err
 			}
 
+			if err = mf.EnableCombiner(business.ReviewCountCombine, common.Config.GetInt("combineWindow")); err != nil {
+				return nil, nil, err
+			}
+
+			// The distributed percentile needs the whole count of every game in one partition
+			if common.Config.GetString("query.five.mode") != "distributed" {
+				if err = mf.EnableHotKeys(hotKeysConfig()); err != nil {
+					return nil, nil, err
+				}
+			}
+
+			return mf, controller.NewEOFChecker("MAP_FILTER_REVIEWS", 1), nil
+		},
+	)
+}
+
+func hotKeysConfig() business.HotKeysConfig {
+	return business.HotKeysConfig{
+		Threshold: common.Config.GetUint32("hotKeys.threshold"),
+		Fanout:    common.Config.GetInt("hotKeys.fanout"),
+		Width:     common.Config.GetInt("hotKeys.sketchWidth"),
+		Depth:     common.Config.GetInt("hotKeys.sketchDepth"),
+	}
+}
+
+func languageCacheConfig() business.LanguageCacheConfig {
+	return business.LanguageCacheConfig{
+		Size:           common.Config.GetInt("languageCache.size"),
+		Detectors:      common.Config.GetInt("languageCache.detectors"),
+		MinLetters:     common.Config.GetInt("languageCache.minLetters"),
+		ASCIIAsEnglish: common.Config.GetBool("languageCache.asciiAsEnglish"),
+		ReportEvery:    common.Config.GetInt("languageCache.reportEvery"),
+	}
+}
+
+func CreateMFGQ6(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *rabbitmq.Architecture) *controller.Controller {
+	return controller.NewController(
+		fmt.Sprintf("MFGQ6_%d", cfg.ReadFromPartition),
+		[]*rabbitmq.Queue{
+			arc.MapFilter.Games.GetQueue("MFG_Q6", cfg.ReadFromPartition),
+		},
+		[]*rabbitmq.Exchange{
+			arc.QuerySix.StageTwo.GetExchange(),
+		},
+		&controller.NodeProtocol{
+			PartitionAmount: uint(arcCfg.QuerySix.StageTwo.PartitionAmount),
+			Query:           "Q6",
+		},
+		func(jobId common.JobID, topology common.Topology, options common.JobOptions) (controller.Handler, controller.EOFValidator, error) {
+			mf, err := business.NewMapFilterGames(
+				common.Config.GetString("savepath"),
+				jobId.String(),
+				"Q6G",
+				cfg.ReadFromPartition,
+				business.Q6Map,
+				business.Q6Filter,
+			)
+
+			if err != nil {
+				return nil, nil, err
+			}
+
+			return mf, controller.NewEOFChecker("MAP_FILTER_GAMES", 1), nil
+		},
+	)
+}
+
+func CreateMFGQ7(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *rabbitmq.Architecture) *controller.Controller {
+	return controller.NewController(
+		fmt.Sprintf("MFGQ7_%d", cfg.ReadFromPartition),
+		[]*rabbitmq.Queue{
+			arc.MapFilter.Games.GetQueue("MFG_Q7", cfg.ReadFromPartition),
+		},
+		[]*rabbitmq.Exchange{
+			arc.QuerySeven.StageTwo.GetExchange(),
+		},
+		&controller.NodeProtocol{
+			PartitionAmount: uint(arcCfg.QuerySeven.StageTwo.PartitionAmount),
+			Query:           "Q7",
+		},
+		func(jobId common.JobID, topology common.Topology, options common.JobOptions) (controller.Handler, controller.EOFValidator, error) {
+			mf, err := business.NewMapFilterGames(
+				common.Config.GetString("savepath"),
+				jobId.String(),
+				"Q7G",
+				cfg.ReadFromPartition,
+				business.Q7MapGames,
+				business.Q7FilterGames,
+			)
+
+			if err != nil {
+				return nil, nil, err
+			}
+
+			return mf, controller.NewEOFChecker("MAP_FILTER_GAMES", 1), nil
+		},
+	)
+}
+
+func CreateMFRQ7(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *rabbitmq.Architecture) *controller.Controller {
+	return controller.NewController(
+		fmt.Sprintf("MFRQ7_%d", cfg.ReadFromPartition),
+		[]*rabbitmq.Queue{
+			arc.MapFilter.Reviews.GetQueue("MFR_Q7", cfg.ReadFromPartition),
+		},
+		[]*rabbitmq.Exchange{
+			arc.QuerySeven.StageTwo.GetExchange(),
+		},
+		&controller.NodeProtocol{
+			PartitionAmount: uint(arcCfg.QuerySeven.StageTwo.PartitionAmount),
+			Query:           "Q7",
+		},
+		func(jobId common.JobID, topology common.Topology, options common.JobOptions) (controller.Handler, controller.EOFValidator, error) {
+			mf, err := business.NewMapFilterReviews(
+				common.Config.GetString("savepath"),
+				jobId.String(),
+				"Q7R",
+				cfg.ReadFromPartition,
+				business.Q7MapReviews,
+				business.Q7FilterReviews,
+			)
+
+			if err != nil {
+				return nil, nil, err
+			}
+
+			if err = mf.EnableCombiner(business.ReviewTallyCombine, common.Config.GetInt("combineWindow")); err != nil {
+				return nil, nil, err
+			}
+
+			return mf, controller.NewEOFChecker("MAP_FILTER_REVIEWS", 1), nil
+		},
+	)
+}
+
+func CreateMFGQ8(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *rabbitmq.Architecture) *controller.Controller {
+	return controller.NewController(
+		fmt.Sprintf("MFGQ8_%d", cfg.ReadFromPartition),
+		[]*rabbitmq.Queue{
+			arc.MapFilter.Games.GetQueue("MFG_Q8", cfg.ReadFromPartition),
+		},
+		[]*rabbitmq.Exchange{
+			arc.QueryEight.StageTwo.GetExchange(),
+		},
+		&controller.NodeProtocol{
+			PartitionAmount: uint(arcCfg.QueryEight.StageTwo.PartitionAmount),
+			Query:           "Q8",
+		},
+		func(jobId common.JobID, topology common.Topology, options common.JobOptions) (controller.Handler, controller.EOFValidator, error) {
+			mf, err := business.NewMapFilterGames(
+				common.Config.GetString("savepath"),
+				jobId.String(),
+				"Q8G",
+				cfg.ReadFromPartition,
+				business.Q8MapGames,
+				business.Q8FilterGames,
+			)
+
+			if err != nil {
+				return nil, nil, err
+			}
+
+			return mf, controller.NewEOFChecker("MAP_FILTER_GAMES", 1), nil
+		},
+	)
+}
+
+func CreateMFRQ8(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *rabbitmq.Architecture) *controller.Controller {
+	return controller.NewController(
+		fmt.Sprintf("MFRQ8_%d", cfg.ReadFromPartition),
+		[]*rabbitmq.Queue{
+			arc.MapFilter.Reviews.GetQueue("MFR_Q8", cfg.ReadFromPartition),
+		},
+		[]*rabbitmq.Exchange{
+			arc.QueryEight.StageTwo.GetExchange(),
+		},
+		&controller.NodeProtocol{
+			PartitionAmount: uint(arcCfg.QueryEight.StageTwo.PartitionAmount),
+			Query:           "Q8",
+		},
+		func(jobId common.JobID, topology common.Topology, options common.JobOptions) (controller.Handler, controller.EOFValidator, error) {
+			mf, err := business.NewMapFilterReviews(
+				common.Config.GetString("savepath"),
+				jobId.String(),
+				"Q8R",
+				cfg.ReadFromPartition,
+				business.Q8MapReviews,
+				business.Q8FilterReviews,
+			)
+
+			if err != nil {
+				return nil, nil, err
+			}
+
+			if err = mf.EnableCombiner(business.ReviewTallyCombine, common.Config.GetInt("combineWindow")); err != nil {
+				return nil, nil, err
+			}
+
 			return mf, controller.NewEOFChecker("MAP_FILTER_REVIEWS", 1), nil
 		},
 	)
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"middleware/common"
+	"middleware/rabbitmq"
+	"middleware/worker/business"
+	"middleware/worker/controller"
+)
+
+func CreateQ7S4(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *rabbitmq.Architecture) *controller.Controller {
+	return controller.NewController(
+		fmt.Sprintf("Q7S4_%d", cfg.ReadFromPartition),
+		[]*rabbitmq.Queue{
+			arc.QuerySeven.StageFour.GetQueueSingle(1),
+		},
+		[]*rabbitmq.Exchange{
+			arc.Results.QuerySeven.GetExchange(),
+		},
+		&controller.NodeProtocol{
+			PartitionAmount: 1,
+		},
+		func(jobId common.JobID, topology common.Topology, options common.JobOptions) (controller.Handler, controller.EOFValidator, error) {
+			h, err := business.NewQ7(
+				common.Config.GetString("savepath"),
+				jobId.String(),
+				cfg.ReadFromPartition,
+				common.Config.GetInt("query.seven.top"),
+			)
+			if err != nil {
+				return nil, nil, err
+			}
+			return h, controller.NewEOFChecker("Q7_STAGE_4", uint(arcCfg.QuerySeven.StageThree.PartitionAmount)), nil
+		},
+	)
+}
@@ -6,6 +6,7 @@ import (
 	"middleware/rabbitmq"
 	"middleware/worker/business"
 	"middleware/worker/controller"
+	"middleware/worker/controller/enums"
 )
 
 func CreateQ1S3(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *rabbitmq.Architecture) *controller.Controller {
@@ -20,12 +21,12 @@ func CreateQ1S3(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *r
 		&controller.NodeProtocol{
 			PartitionAmount: 1,
 		},
-		func(jobId common.JobID) (controller.Handler, controller.EOFValidator, error) {
+		func(jobId common.JobID, topology common.Topology, options common.JobOptions) (controller.Handler, controller.EOFValidator, error) {
 			h, err := business.NewQ1(common.Config.GetString("savepath"), jobId.String(), cfg.ReadFromPartition, "stage_three")
 			if err != nil {
 				return nil, nil, err
 			}
-			return h, controller.NewEOFChecker("Q1_STAGE_3", uint(arcCfg.QueryOne.StageTwo.PartitionAmount)), nil
+			return h, controller.NewEOFChecker("Q1_STAGE_3", uint(topology.Partitions("Q1", arcCfg.QueryOne.StageTwo.PartitionAmount))), nil
 		},
 	)
 }
@@ -42,7 +43,7 @@ func CreateQ2S3(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *r
 		&controller.NodeProtocol{
 			PartitionAmount: 1,
 		},
-		func(jobId common.JobID) (controller.Handler, controller.EOFValidator, error) {
+		func(jobId common.JobID, topology common.Topology, options common.JobOptions) (controller.Handler, controller.EOFValidator, error) {
 			h, err := business.NewQ2(
 				common.Config.GetString("savepath"),
 				"stage_three",
@@ -55,7 +56,7 @@ func CreateQ2S3(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *r
 				return nil, nil, err
 			}
 
-			return h, controller.NewEOFChecker("Q2_STAGE_3", uint(arcCfg.QueryTwo.StageTwo.PartitionAmount)), nil
+			return h, controller.NewEOFChecker("Q2_STAGE_3", uint(topology.Partitions("Q2", arcCfg.QueryTwo.StageTwo.PartitionAmount))), nil
 		},
 	)
 }
@@ -72,7 +73,7 @@ func CreateQ3S3(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *r
 		&controller.NodeProtocol{
 			PartitionAmount: 1,
 		},
-		func(jobId common.JobID) (controller.Handler, controller.EOFValidator, error) {
+		func(jobId common.JobID, topology common.Topology, options common.JobOptions) (controller.Handler, controller.EOFValidator, error) {
 			h, err := business.NewQ3(
 				common.Config.GetString("savepath"),
 				jobId.String(),
@@ -84,7 +85,18 @@ func CreateQ3S3(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *r
 				return nil, nil, err
 			}
 
-			return h, controller.NewEOFChecker("Q3_STAGE_3", uint(arcCfg.QueryThree.StageTwo.PartitionAmount)), nil
+			// Hot games come in parts from the stage two partitions
+			merge, err := business.NewHotKeyMerge(h, common.Config.GetString("savepath"), "query_three", jobId.String(), cfg.ReadFromPartition)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			streaming, err := provisional(merge, options, "Q3", business.Q3ProvisionalRank(common.Config.GetInt("query.three.top")))
+			if err != nil {
+				return nil, nil, err
+			}
+
+			return streaming, controller.NewEOFChecker("Q3_STAGE_3", uint(topology.Partitions("Q3", arcCfg.QueryThree.StageTwo.PartitionAmount))), nil
 		},
 	)
 }
@@ -101,7 +113,7 @@ func CreateQ4S3(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *r
 		&controller.NodeProtocol{
 			PartitionAmount: 1,
 		},
-		func(jobId common.JobID) (controller.Handler, controller.EOFValidator, error) {
+		func(jobId common.JobID, topology common.Topology, options common.JobOptions) (controller.Handler, controller.EOFValidator, error) {
 			h, err := business.NewQ4(
 				common.Config.GetString("savepath"),
 				jobId.String(),
@@ -114,13 +126,24 @@ func CreateQ4S3(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *r
 				return nil, nil, err
 			}
 
-			return h, controller.NewEOFChecker("Q4_STAGE_3", uint(arcCfg.QueryFour.StageTwo.PartitionAmount)), nil
+			// Hot games come in parts from the stage two partitions
+			merge, err := business.NewHotKeyMerge(h, common.Config.GetString("savepath"), "query_four", jobId.String(), cfg.ReadFromPartition)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			streaming, err := provisional(merge, options, "Q4", business.Q4ProvisionalRank(common.Config.GetInt("query.four.over")))
+			if err != nil {
+				return nil, nil, err
+			}
+
+			return streaming, controller.NewEOFChecker("Q4_STAGE_3", uint(topology.Partitions("Q4", arcCfg.QueryFour.StageTwo.PartitionAmount))), nil
 		},
 	)
 }
 
 func CreateQ5S3(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *rabbitmq.Architecture) *controller.Controller {
-	return controller.NewController(
+	c := controller.NewController(
 		fmt.Sprintf("Q5S3_%d", cfg.ReadFromPartition),
 		[]*rabbitmq.Queue{
 			arc.QueryFive.StageThree.GetQueueSingle(1),
@@ -131,7 +154,7 @@ func CreateQ5S3(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *r
 		&controller.NodeProtocol{
 			PartitionAmount: 1,
 		},
-		func(jobId common.JobID) (controller.Handler, controller.EOFValidator, error) {
+		func(jobId common.JobID, topology common.Topology, options common.JobOptions) (controller.Handler, controller.EOFValidator, error) {
 			h, err := business.NewQ5(
 				common.Config.GetString("savepath"),
 				jobId.String(),
@@ -144,7 +167,123 @@ func CreateQ5S3(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *r
 				return nil, nil, err
 			}
 
-			return h, controller.NewEOFChecker("Q5_STAGE_3", uint(arcCfg.QueryFive.StageTwo.PartitionAmount)), nil
+			partitions := uint(topology.Partitions("Q5", arcCfg.QueryFive.StageTwo.PartitionAmount))
+			eof := controller.NewEOFChecker("Q5_STAGE_3", partitions)
+
+			switch common.Config.GetString("query.five.mode") {
+			case "approximate":
+				if err = h.EnableApproximate(); err != nil {
+					return nil, nil, err
+				}
+			case "distributed":
+				if err = h.EnableDistributed(); err != nil {
+					return nil, nil, err
+				}
+				// Tells the percentile back once every partition sent its histogram
+				eof.WithPhase(&controller.EOFPhase{
+					Needed:   map[enums.TokenName]uint{enums.COUNTS_EOF: partitions},
+					ToSend:   enums.PERCENTILE_EOF,
+					Feedback: true,
+				})
+			}
+
+			// Hot games come in parts from the stage two partitions
+			merge, err := business.NewHotKeyMerge(h, common.Config.GetString("savepath"), "query_five", jobId.String(), cfg.ReadFromPartition)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			streaming, err := provisional(merge, options, "Q5", business.Q5ProvisionalRank(common.Config.GetInt("query.five.percentile")))
+			if err != nil {
+				return nil, nil, err
+			}
+
+			return streaming, eof, nil
+		},
+	)
+
+	return c.WithFeedback(arc.QueryFive.Feedback.GetExchange(), &controller.NodeProtocol{
+		PartitionAmount: uint(arcCfg.QueryFive.StageTwo.PartitionAmount),
+		Query:           "Q5",
+	})
+}
+
+// For the jobs with streaming joins, stage three also sends provisional tops of their upserts
+func provisional(h controller.Handler, options common.JobOptions, query string, rank business.ProvisionalRank) (controller.Handler, error) {
+	streaming, err := business.StreamingFor(options)
+	if err != nil || !streaming {
+		return h, err
+	}
+	return business.NewProvisional(h, query, rank, common.Config.GetInt("streamingJoin.top"), common.Config.GetInt("streamingJoin.every")), nil
+}
+
+func CreateQ6S3(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *rabbitmq.Architecture) *controller.Controller {
+	return controller.NewController(
+		fmt.Sprintf("Q6S3_%d", cfg.ReadFromPartition),
+		[]*rabbitmq.Queue{
+			arc.QuerySix.StageThree.GetQueueSingle(1),
+		},
+		[]*rabbitmq.Exchange{
+			arc.Results.QuerySix.GetExchange(),
+		},
+		&controller.NodeProtocol{
+			PartitionAmount: 1,
+		},
+		func(jobId common.JobID, topology common.Topology, options common.JobOptions) (controller.Handler, controller.EOFValidator, error) {
+			h, err := business.NewQ6(common.Config.GetString("savepath"), jobId.String(), cfg.ReadFromPartition, "stage_three")
+			if err != nil {
+				return nil, nil, err
+			}
+			return h, controller.NewEOFChecker("Q6_STAGE_3", uint(topology.Partitions("Q6", arcCfg.QuerySix.StageTwo.PartitionAmount))), nil
+		},
+	)
+}
+
+func CreateQ7S3(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *rabbitmq.Architecture) *controller.Controller {
+	return controller.NewController(
+		fmt.Sprintf("Q7S3_%d", cfg.ReadFromPartition),
+		[]*rabbitmq.Queue{
+			arc.QuerySeven.StageThree.GetQueueSingle(cfg.ReadFromPartition),
+		},
+		[]*rabbitmq.Exchange{
+			arc.QuerySeven.StageFour.GetExchange(),
+		},
+		&controller.NodeProtocol{
+			PartitionAmount: 1,
+		},
+		func(jobId common.JobID, topology common.Topology, options common.JobOptions) (controller.Handler, controller.EOFValidator, error) {
+			h, err := business.NewQ7Aggregate(
+				common.Config.GetString("savepath"),
+				jobId.String(),
+				cfg.ReadFromPartition,
+				common.Config.GetInt("query.seven.minReviews"),
+			)
+			if err != nil {
+				return nil, nil, err
+			}
+			return h, controller.NewEOFChecker("Q7_STAGE_3", uint(topology.Partitions("Q7", arcCfg.QuerySeven.StageTwo.PartitionAmount))), nil
+		},
+	)
+}
+
+func CreateQ8S3(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *rabbitmq.Architecture) *controller.Controller {
+	return controller.NewController(
+		fmt.Sprintf("Q8S3_%d", cfg.ReadFromPartition),
+		[]*rabbitmq.Queue{
+			arc.QueryEight.StageThree.GetQueueSingle(1),
+		},
+		[]*rabbitmq.Exchange{
+			arc.Results.QueryEight.GetExchange(),
+		},
+		&controller.NodeProtocol{
+			PartitionAmount: 1,
+		},
+		func(jobId common.JobID, topology common.Topology, options common.JobOptions) (controller.Handler, controller.EOFValidator, error) {
+			h, err := business.NewQ8(common.Config.GetString("savepath"), jobId.String(), cfg.ReadFromPartition)
+			if err != nil {
+				return nil, nil, err
+			}
+			return h, controller.NewEOFChecker("Q8_STAGE_3", uint(topology.Partitions("Q8", arcCfg.QueryEight.StageTwo.PartitionAmount))), nil
 		},
 	)
 }
@@ -6,6 +6,7 @@ import (
 	"middleware/rabbitmq"
 	"middleware/worker/business"
 	"middleware/worker/controller"
+	"middleware/worker/controller/enums"
 )
 
 func CreateQ1S2(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *rabbitmq.Architecture) *controller.Controller {
@@ -20,7 +21,7 @@ func CreateQ1S2(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *r
 		&controller.NodeProtocol{
 			PartitionAmount: 1,
 		},
-		func(jobId common.JobID) (controller.Handler, controller.EOFValidator, error) {
+		func(jobId common.JobID, topology common.Topology, options common.JobOptions) (controller.Handler, controller.EOFValidator, error) {
 			h, err := business.NewQ1(common.Config.GetString("savepath"), jobId.String(), cfg.ReadFromPartition, "stage_two")
 			if err != nil {
 				return nil, nil, err
@@ -42,7 +43,7 @@ func CreateQ2S2(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *r
 		&controller.NodeProtocol{
 			PartitionAmount: 1,
 		},
-		func(jobId common.JobID) (controller.Handler, controller.EOFValidator, error) {
+		func(jobId common.JobID, topology common.Topology, options common.JobOptions) (controller.Handler, controller.EOFValidator, error) {
 			h, err := business.NewQ2(
 				common.Config.GetString("savepath"),
 				"stage_two",
@@ -72,7 +73,7 @@ func CreateQ3S2(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *r
 		&controller.NodeProtocol{
 			PartitionAmount: 1,
 		},
-		func(jobId common.JobID) (controller.Handler, controller.EOFValidator, error) {
+		func(jobId common.JobID, topology common.Topology, options common.JobOptions) (controller.Handler, controller.EOFValidator, error) {
 			h, err := business.NewJoin(
 				common.Config.GetString("savepath"),
 				"query_three",
@@ -85,6 +86,16 @@ func CreateQ3S2(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *r
 				return nil, nil, err
 			}
 
+			streaming, err := business.StreamingFor(options)
+			if err != nil {
+				return nil, nil, err
+			}
+			if streaming {
+				if err = h.EnableStreaming(); err != nil {
+					return nil, nil, err
+				}
+			}
+
 			return h,
 				controller.NewEOFChecker(
 					"Q3_STAGE_2",
@@ -108,7 +119,7 @@ func CreateQ4S2(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *r
 		&controller.NodeProtocol{
 			PartitionAmount: 1,
 		},
-		func(jobId common.JobID) (controller.Handler, controller.EOFValidator, error) {
+		func(jobId common.JobID, topology common.Topology, options common.JobOptions) (controller.Handler, controller.EOFValidator, error) {
 			h, err := business.NewJoin(
 				common.Config.GetString("savepath"),
 				"query_four",
@@ -121,6 +132,27 @@ func CreateQ4S2(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *r
 				return nil, nil, err
 			}
 
+			streaming, err := business.StreamingFor(options)
+			if err != nil {
+				return nil, nil, err
+			}
+			if streaming {
+				if err = h.EnableStreaming(); err != nil {
+					return nil, nil, err
+				}
+			}
+
+			// The map filters send the languages of the reviews with them
+			breakdown, err := business.LanguageBreakdownFor(options)
+			if err != nil {
+				return nil, nil, err
+			}
+			if breakdown {
+				if err = h.EnableLanguageBreakdown(); err != nil {
+					return nil, nil, err
+				}
+			}
+
 			return h,
 				controller.NewEOFChecker(
 					"Q4_STAGE_2",
@@ -136,6 +168,7 @@ func CreateQ5S2(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *r
 		fmt.Sprintf("Q5S2_%d", cfg.ReadFromPartition),
 		[]*rabbitmq.Queue{
 			arc.QueryFive.StageTwo.GetQueueSingle(cfg.ReadFromPartition),
+			arc.QueryFive.Feedback.GetQueueSingle(cfg.ReadFromPartition),
 		},
 		[]*rabbitmq.Exchange{
 			arc.QueryFive.StageThree.GetExchange(),
@@ -143,7 +176,7 @@ func CreateQ5S2(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *r
 		&controller.NodeProtocol{
 			PartitionAmount: 1,
 		},
-		func(jobId common.JobID) (controller.Handler, controller.EOFValidator, error) {
+		func(jobId common.JobID, topology common.Topology, options common.JobOptions) (controller.Handler, controller.EOFValidator, error) {
 			h, err := business.NewJoin(
 				common.Config.GetString("savepath"),
 				"query_five",
@@ -156,11 +189,119 @@ func CreateQ5S2(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *r
 				return nil, nil, err
 			}
 
+			eof := controller.NewEOFChecker(
+				"Q5_STAGE_2",
+				uint(arcCfg.MapFilter.QueryFiveGames.PartitionAmount),
+				uint(arcCfg.MapFilter.QueryFiveReviews.PartitionAmount),
+			)
+
+			switch common.Config.GetString("query.five.mode") {
+			case "approximate":
+				h.EnableQuantileSketch(common.Config.GetFloat64("query.five.sketchError"))
+			case "distributed":
+				if err = h.EnableDistributedPercentile(); err != nil {
+					return nil, nil, err
+				}
+				// Sends the histogram once the reviews end, and the games once stage three answers
+				eof.AddCondition(enums.PERCENTILE_EOF, 1).WithPhase(&controller.EOFPhase{
+					Needed: map[enums.TokenName]uint{
+						enums.MF_GAMES:   uint(arcCfg.MapFilter.QueryFiveGames.PartitionAmount),
+						enums.MF_REVIEWS: uint(arcCfg.MapFilter.QueryFiveReviews.PartitionAmount),
+					},
+					ToSend: enums.COUNTS_EOF,
+				})
+			}
+
+			streaming, err := business.StreamingFor(options)
+			if err != nil {
+				return nil, nil, err
+			}
+			if streaming {
+				if err = h.EnableStreaming(); err != nil {
+					return nil, nil, err
+				}
+			}
+
+			return h, eof, nil
+		},
+	)
+}
+
+func CreateQ6S2(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *rabbitmq.Architecture) *controller.Controller {
+	return controller.NewController(
+		fmt.Sprintf("Q6S2_%d", cfg.ReadFromPartition),
+		[]*rabbitmq.Queue{
+			arc.QuerySix.StageTwo.GetQueueSingle(cfg.ReadFromPartition),
+		},
+		[]*rabbitmq.Exchange{
+			arc.QuerySix.StageThree.GetExchange(),
+		},
+		&controller.NodeProtocol{
+			PartitionAmount: 1,
+		},
+		func(jobId common.JobID, topology common.Topology, options common.JobOptions) (controller.Handler, controller.EOFValidator, error) {
+			h, err := business.NewQ6(common.Config.GetString("savepath"), jobId.String(), cfg.ReadFromPartition, "stage_two")
+			if err != nil {
+				return nil, nil, err
+			}
+			return h, controller.NewEOFChecker("Q6_STAGE_2", uint(arcCfg.MapFilter.QuerySixGames.PartitionAmount)), nil
+		},
+	)
+}
+
+func CreateQ7S2(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *rabbitmq.Architecture) *controller.Controller {
+	return controller.NewController(
+		fmt.Sprintf("Q7S2_%d", cfg.ReadFromPartition),
+		[]*rabbitmq.Queue{
+			arc.QuerySeven.StageTwo.GetQueueSingle(cfg.ReadFromPartition),
+		},
+		[]*rabbitmq.Exchange{
+			arc.QuerySeven.StageThree.GetExchange(),
+		},
+		// Repartitioned by company, stage three doesn't rescale with the topology
+		&controller.NodeProtocol{
+			PartitionAmount: uint(arcCfg.QuerySeven.StageThree.PartitionAmount),
+		},
+		func(jobId common.JobID, topology common.Topology, options common.JobOptions) (controller.Handler, controller.EOFValidator, error) {
+			h, err := business.NewCompanyJoin(common.Config.GetString("savepath"), jobId.String(), cfg.ReadFromPartition)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			return h,
+				controller.NewEOFChecker(
+					"Q7_STAGE_2",
+					uint(arcCfg.MapFilter.QuerySevenGames.PartitionAmount),
+					uint(arcCfg.MapFilter.QuerySevenReviews.PartitionAmount),
+				),
+				nil
+		},
+	)
+}
+
+func CreateQ8S2(cfg *ControllerConfig, arcCfg *common.ArchitectureConfig, arc *rabbitmq.Architecture) *controller.Controller {
+	return controller.NewController(
+		fmt.Sprintf("Q8S2_%d", cfg.ReadFromPartition),
+		[]*rabbitmq.Queue{
+			arc.QueryEight.StageTwo.GetQueueSingle(cfg.ReadFromPartition),
+		},
+		[]*rabbitmq.Exchange{
+			arc.QueryEight.StageThree.GetExchange(),
+		},
+		&controller.NodeProtocol{
+			PartitionAmount: 1,
+		},
+		func(jobId common.JobID, topology common.Topology, options common.JobOptions) (controller.Handler, controller.EOFValidator, error) {
+			h, err := business.NewSentimentJoin(common.Config.GetString("savepath"), jobId.String(), cfg.ReadFromPartition)
+			if err != nil {
+				return nil, nil, err
+			}
+
 			return h,
 				controller.NewEOFChecker(
-					"Q5_STAGE_2",
-					uint(arcCfg.MapFilter.QueryFiveGames.PartitionAmount),
-					uint(arcCfg.MapFilter.QueryFiveReviews.PartitionAmount),
+					"Q8_STAGE_2",
+					uint(arcCfg.MapFilter.QueryEightGames.PartitionAmount),
+					uint(arcCfg.MapFilter.QueryEightReviews.PartitionAmount),
 				),
 				nil
 		},
@@ -19,9 +19,14 @@ var controllerFactories = map[string]ControllerFactory{
 	"MFGQ3": CreateMFGQ3,
 	"MFGQ4": CreateMFGQ4,
 	"MFGQ5": CreateMFGQ5,
+	"MFGQ6": CreateMFGQ6,
+	"MFGQ7": CreateMFGQ7,
+	"MFGQ8": CreateMFGQ8,
 	"MFRQ3": CreateMFRQ3,
 	"MFRQ4": CreateMFRQ4,
 	"MFRQ5": CreateMFRQ5,
+	"MFRQ7": CreateMFRQ7,
+	"MFRQ8": CreateMFRQ8,
 	"Q1S2":  CreateQ1S2,
 	"Q1S3":  CreateQ1S3,
 	"Q2S2":  CreateQ2S2,
@@ -32,6 +37,13 @@ var controllerFactories = map[string]ControllerFactory{
 	"Q4S3":  CreateQ4S3,
 	"Q5S2":  CreateQ5S2,
 	"Q5S3":  CreateQ5S3,
+	"Q6S2":  CreateQ6S2,
+	"Q6S3":  CreateQ6S3,
+	"Q7S2":  CreateQ7S2,
+	"Q7S3":  CreateQ7S3,
+	"Q7S4":  CreateQ7S4,
+	"Q8S2":  CreateQ8S2,
+	"Q8S3":  CreateQ8S3,
 }
 
 func main() {
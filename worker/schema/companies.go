@@ -0,0 +1,246 @@
+package schema
+
+import (
+	"fmt"
+	"middleware/common"
+)
+
+// Kinds of company of the Q7 leaderboards
+const (
+	CompanyDeveloper = "developer"
+	CompanyPublisher = "publisher"
+)
+
+// Metrics each leaderboard ranks by
+const (
+	RankingPositive = "positive"
+	RankingRatio    = "ratio"
+)
+
+type GameCompanies struct {
+	AppID      string
+	Developers []string
+	Publishers []string
+}
+
+func writeStrings(se *common.Serializer, strs []string) {
+	se.WriteUint32(uint32(len(strs)))
+	for _, s := range strs {
+		se.WriteString(s)
+	}
+}
+
+func readStrings(d *common.Deserializer) ([]string, error) {
+	n, err := d.ReadUint32()
+	if err != nil {
+		return nil, err
+	}
+	strs := make([]string, 0, min(n, uint32(d.Buf.Len())))
+	for i := uint32(0); i < n; i++ {
+		s, err := d.ReadString()
+		if err != nil {
+			return nil, err
+		}
+		strs = append(strs, s)
+	}
+	return strs, nil
+}
+
+func (g *GameCompanies) Serialize() []byte {
+	se := common.NewSerializer()
+	se.WriteString(g.AppID)
+	writeStrings(&se, g.Developers)
+	writeStrings(&se, g.Publishers)
+	return se.ToBytes()
+}
+
+func (g *GameCompanies) PartitionKey() string {
+	return g.AppID
+}
+
+func GameCompaniesDeserialize(d *common.Deserializer) (*GameCompanies, error) {
+	id, err := d.ReadString()
+	if err != nil {
+		return nil, err
+	}
+	developers, err := readStrings(d)
+	if err != nil {
+		return nil, err
+	}
+	publishers, err := readStrings(d)
+	if err != nil {
+		return nil, err
+	}
+	return &GameCompanies{AppID: id, Developers: developers, Publishers: publishers}, nil
+}
+
+// Positive and total reviews of a game. A map filter sends one per review, the join adds them up
+type ReviewTally struct {
+	AppID    string
+	Positive uint32
+	Total    uint32
+}
+
+func (r *ReviewTally) Serialize() []byte {
+	se := common.NewSerializer()
+	return se.WriteString(r.AppID).WriteUint32(r.Positive).WriteUint32(r.Total).ToBytes()
+}
+
+func (r *ReviewTally) PartitionKey() string {
+	return r.AppID
+}
+
+func ReviewTallyDeserialize(d *common.Deserializer) (*ReviewTally, error) {
+	id, err := d.ReadString()
+	if err != nil {
+		return nil, err
+	}
+	positive, err := d.ReadUint32()
+	if err != nil {
+		return nil, err
+	}
+	total, err := d.ReadUint32()
+	if err != nil {
+		return nil, err
+	}
+	return &ReviewTally{AppID: id, Positive: positive, Total: total}, nil
+}
+
+// Reviews of every game of a developer or publisher, partitioned by the company so each
+// one is added up in a single partition
+type CompanyTally struct {
+	Kind     string
+	Name     string
+	Positive uint32
+	Total    uint32
+}
+
+func (c *CompanyTally) Ratio() float64 {
+	if c.Total == 0 {
+		return 0
+	}
+	return float64(c.Positive) / float64(c.Total)
+}
+
+func (c *CompanyTally) Serialize() []byte {
+	se := common.NewSerializer()
+	return se.WriteString(c.Kind).WriteString(c.Name).WriteUint32(c.Positive).WriteUint32(c.Total).ToBytes()
+}
+
+func (c *CompanyTally) PartitionKey() string {
+	return c.Kind + c.Name
+}
+
+func CompanyTallyDeserialize(d *common.Deserializer) (*CompanyTally, error) {
+	kind, err := d.ReadString()
+	if err != nil {
+		return nil, err
+	}
+	name, err := d.ReadString()
+	if err != nil {
+		return nil, err
+	}
+	positive, err := d.ReadUint32()
+	if err != nil {
+		return nil, err
+	}
+	total, err := d.ReadUint32()
+	if err != nil {
+		return nil, err
+	}
+	return &CompanyTally{Kind: kind, Name: name, Positive: positive, Total: total}, nil
+}
+
+// More positive reviews first, then by name
+func CompanyPositiveBefore(a, b *CompanyTally) bool {
+	if a.Positive != b.Positive {
+		return a.Positive > b.Positive
+	}
+	return a.Name < b.Name
+}
+
+// Higher positive ratio first, then more reviews and by name. The ratios are compared
+// multiplied out so equal ones tie exactly.
+func CompanyRatioBefore(a, b *CompanyTally) bool {
+	l := uint64(a.Positive) * uint64(b.Total)
+	r := uint64(b.Positive) * uint64(a.Total)
+	if l != r {
+		return l > r
+	}
+	if a.Total != b.Total {
+		return a.Total > b.Total
+	}
+	return a.Name < b.Name
+}
+
+// Q7 result, a place of the leaderboard of a kind of company by a ranking
+type CompanyRank struct {
+	Kind     string
+	Ranking  string
+	Position uint32
+	Name     string
+	Positive uint32
+	Total    uint32
+}
+
+// The order of the Q7 results: each leaderboard from the first place down
+func CompanyRankBefore(a, b *CompanyRank) bool {
+	if a.Kind != b.Kind {
+		return a.Kind < b.Kind
+	}
+	if a.Ranking != b.Ranking {
+		return a.Ranking < b.Ranking
+	}
+	return a.Position < b.Position
+}
+
+func (c *CompanyRank) Serialize() []byte {
+	se := common.NewSerializer()
+	return se.WriteString(c.Kind).WriteString(c.Ranking).WriteUint32(c.Position).
+		WriteString(c.Name).WriteUint32(c.Positive).WriteUint32(c.Total).ToBytes()
+}
+
+func (c *CompanyRank) PartitionKey() string {
+	return c.Kind + c.Ranking
+}
+
+func (c *CompanyRank) ToCSV() []string {
+	ratio := (&CompanyTally{Positive: c.Positive, Total: c.Total}).Ratio()
+	return []string{
+		c.Kind,
+		c.Ranking,
+		fmt.Sprintf("%d", c.Position),
+		c.Name,
+		fmt.Sprintf("%d", c.Positive),
+		fmt.Sprintf("%d", c.Total),
+		fmt.Sprintf("%.4f", ratio),
+	}
+}
+
+func CompanyRankDeserialize(d *common.Deserializer) (*CompanyRank, error) {
+	kind, err := d.ReadString()
+	if err != nil {
+		return nil, err
+	}
+	ranking, err := d.ReadString()
+	if err != nil {
+		return nil, err
+	}
+	position, err := d.ReadUint32()
+	if err != nil {
+		return nil, err
+	}
+	name, err := d.ReadString()
+	if err != nil {
+		return nil, err
+	}
+	positive, err := d.ReadUint32()
+	if err != nil {
+		return nil, err
+	}
+	total, err := d.ReadUint32()
+	if err != nil {
+		return nil, err
+	}
+	return &CompanyRank{Kind: kind, Ranking: ranking, Position: position, Name: name, Positive: positive, Total: total}, nil
+}
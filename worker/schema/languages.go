@@ -0,0 +1,49 @@
+package schema
+
+import (
+	"fmt"
+	"middleware/common"
+)
+
+// Language of the texts the detector wasn't sure enough about
+const UnknownLanguage = "unknown"
+
+// Reviews the Q4 detector classified in a language. Each stage sends the ones it counted
+// and the next one adds them up, until the server gets the breakdown of the whole job.
+type LanguageCount struct {
+	Language string
+	Reviews  uint32
+}
+
+// The order of the breakdown: the most common languages first
+func LanguageCountBefore(a, b *LanguageCount) bool {
+	if a.Reviews != b.Reviews {
+		return a.Reviews > b.Reviews
+	}
+	return a.Language < b.Language
+}
+
+func (l *LanguageCount) Serialize() []byte {
+	se := common.NewSerializer()
+	return se.WriteString(l.Language).WriteUint32(l.Reviews).ToBytes()
+}
+
+func (l *LanguageCount) PartitionKey() string {
+	return l.Language
+}
+
+func (l *LanguageCount) ToCSV() []string {
+	return []string{l.Language, fmt.Sprintf("%d", l.Reviews)}
+}
+
+func LanguageCountDeserialize(d *common.Deserializer) (*LanguageCount, error) {
+	language, err := d.ReadString()
+	if err != nil {
+		return nil, err
+	}
+	reviews, err := d.ReadUint32()
+	if err != nil {
+		return nil, err
+	}
+	return &LanguageCount{Language: language, Reviews: reviews}, nil
+}
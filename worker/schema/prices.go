@@ -0,0 +1,286 @@
+package schema
+
+import (
+	"fmt"
+	"math"
+	"middleware/common"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The dataset has the prices in dollars, they travel in cents so they add up exactly
+func (g *Game) PriceCents() (uint32, error) {
+	p, err := strconv.ParseFloat(strings.TrimSpace(g.Price), 64)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(p) || p < 0 || p*100 > math.MaxUint32 {
+		return 0, fmt.Errorf("invalid price %s", g.Price)
+	}
+	return uint32(math.Round(p * 100)), nil
+}
+
+// Percentage off the price, 0 when the game isn't discounted
+func (g *Game) DiscountPercent() (uint32, error) {
+	d, err := strconv.ParseFloat(strings.TrimSpace(g.Discount), 64)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(d) || d < 0 || d > 100 {
+		return 0, fmt.Errorf("invalid discount %s", g.Discount)
+	}
+	return uint32(math.Round(d)), nil
+}
+
+func (g *Game) ReleaseYear() (int, error) {
+	date, err := time.Parse("Jan 2, 2006", g.ReleaseDate)
+	if err != nil {
+		return 0, err
+	}
+	return date.Year(), nil
+}
+
+// Groups of the price analytics
+const (
+	PriceGroupGenre = "genre"
+	PriceGroupYear  = "year"
+)
+
+type PricedGame struct {
+	AppID string
+	// 0 when the release date can't be read
+	Year       uint32
+	Price      uint32
+	Discounted bool
+	Genres     []string
+}
+
+func (p *PricedGame) Serialize() []byte {
+	se := common.NewSerializer()
+	se.WriteString(p.AppID).WriteUint32(p.Year).WriteUint32(p.Price).WriteBool(p.Discounted)
+	se.WriteUint32(uint32(len(p.Genres)))
+	for _, g := range p.Genres {
+		se.WriteString(g)
+	}
+	return se.ToBytes()
+}
+
+func (p *PricedGame) PartitionKey() string {
+	return p.AppID
+}
+
+func PricedGameDeserialize(d *common.Deserializer) (*PricedGame, error) {
+	id, err := d.ReadString()
+	if err != nil {
+		return nil, err
+	}
+	year, err := d.ReadUint32()
+	if err != nil {
+		return nil, err
+	}
+	price, err := d.ReadUint32()
+	if err != nil {
+		return nil, err
+	}
+	discounted, err := d.ReadBool()
+	if err != nil {
+		return nil, err
+	}
+	n, err := d.ReadUint32()
+	if err != nil {
+		return nil, err
+	}
+	genres := make([]string, 0, min(n, uint32(d.Buf.Len())))
+	for i := uint32(0); i < n; i++ {
+		g, err := d.ReadString()
+		if err != nil {
+			return nil, err
+		}
+		genres = append(genres, g)
+	}
+	return &PricedGame{AppID: id, Year: year, Price: price, Discounted: discounted, Genres: genres}, nil
+}
+
+// Prices of the games of a genre or a release year, as games per price in cents so the
+// partials of every partition merge into the exact median and p90
+type PriceStats struct {
+	Kind       string
+	Name       string
+	Discounted uint32
+	Prices     map[uint32]uint32
+}
+
+func (p *PriceStats) Games() uint32 {
+	var n uint32
+	for _, g := range p.Prices {
+		n += g
+	}
+	return n
+}
+
+func (p *PriceStats) Merge(o *PriceStats) {
+	p.Discounted += o.Discounted
+	for price, g := range o.Prices {
+		p.Prices[price] += g
+	}
+}
+
+func (p *PriceStats) sortedPrices() []uint32 {
+	prices := make([]uint32, 0, len(p.Prices))
+	for price := range p.Prices {
+		prices = append(prices, price)
+	}
+	sort.Slice(prices, func(i, j int) bool { return prices[i] < prices[j] })
+	return prices
+}
+
+// Nearest rank: the lowest price with at least the given fraction of the games at or under it
+func (p *PriceStats) percentile(prices []uint32, n uint32, fraction float64) uint32 {
+	rank := uint32(math.Ceil(fraction * float64(n)))
+	var seen uint32
+	for _, price := range prices {
+		seen += p.Prices[price]
+		if seen >= max(rank, 1) {
+			return price
+		}
+	}
+	return 0
+}
+
+func (p *PriceStats) Summary() *PriceSummary {
+	n := p.Games()
+	s := &PriceSummary{Kind: p.Kind, Name: p.Name, Games: n}
+	if n == 0 {
+		return s
+	}
+
+	prices := p.sortedPrices()
+	var total float64
+	for _, price := range prices {
+		total += float64(price) * float64(p.Prices[price])
+	}
+	s.Average = total / float64(n) / 100
+	s.Median = float64(p.percentile(prices, n, 0.5)) / 100
+	s.P90 = float64(p.percentile(prices, n, 0.9)) / 100
+	s.DiscountedShare = float64(p.Discounted) / float64(n)
+	return s
+}
+
+func (p *PriceStats) Serialize() []byte {
+	prices := p.sortedPrices()
+	se := common.NewSerializer()
+	se.WriteString(p.Kind).WriteString(p.Name).WriteUint32(p.Discounted).WriteUint32(uint32(len(prices)))
+	for _, price := range prices {
+		se.WriteUint32(price).WriteUint32(p.Prices[price])
+	}
+	return se.ToBytes()
+}
+
+func (p *PriceStats) PartitionKey() string {
+	return p.Kind + p.Name
+}
+
+func PriceStatsDeserialize(d *common.Deserializer) (*PriceStats, error) {
+	kind, err := d.ReadString()
+	if err != nil {
+		return nil, err
+	}
+	name, err := d.ReadString()
+	if err != nil {
+		return nil, err
+	}
+	discounted, err := d.ReadUint32()
+	if err != nil {
+		return nil, err
+	}
+	n, err := d.ReadUint32()
+	if err != nil {
+		return nil, err
+	}
+	prices := make(map[uint32]uint32, min(n, uint32(d.Buf.Len())))
+	for i := uint32(0); i < n; i++ {
+		price, err := d.ReadUint32()
+		if err != nil {
+			return nil, err
+		}
+		g, err := d.ReadUint32()
+		if err != nil {
+			return nil, err
+		}
+		prices[price] = g
+	}
+	return &PriceStats{Kind: kind, Name: name, Discounted: discounted, Prices: prices}, nil
+}
+
+// Q6 result of a genre or release year, the prices in dollars
+type PriceSummary struct {
+	Kind            string
+	Name            string
+	Games           uint32
+	Average         float64
+	Median          float64
+	P90             float64
+	DiscountedShare float64
+}
+
+// The order of the Q6 results: the genres and then the years, each by name
+func PriceSummaryBefore(a, b *PriceSummary) bool {
+	if a.Kind != b.Kind {
+		return a.Kind < b.Kind
+	}
+	return a.Name < b.Name
+}
+
+func (p *PriceSummary) Serialize() []byte {
+	se := common.NewSerializer()
+	return se.WriteString(p.Kind).WriteString(p.Name).WriteUint32(p.Games).
+		WriteFloat64(p.Average).WriteFloat64(p.Median).WriteFloat64(p.P90).WriteFloat64(p.DiscountedShare).ToBytes()
+}
+
+func (p *PriceSummary) PartitionKey() string {
+	return p.Kind + p.Name
+}
+
+func (p *PriceSummary) ToCSV() []string {
+	return []string{
+		p.Kind,
+		p.Name,
+		fmt.Sprintf("%d", p.Games),
+		fmt.Sprintf("%.2f", p.Average),
+		fmt.Sprintf("%.2f", p.Median),
+		fmt.Sprintf("%.2f", p.P90),
+		fmt.Sprintf("%.4f", p.DiscountedShare),
+	}
+}
+
+func PriceSummaryDeserialize(d *common.Deserializer) (*PriceSummary, error) {
+	kind, err := d.ReadString()
+	if err != nil {
+		return nil, err
+	}
+	name, err := d.ReadString()
+	if err != nil {
+		return nil, err
+	}
+	games, err := d.ReadUint32()
+	if err != nil {
+		return nil, err
+	}
+	values := make([]float64, 4)
+	for i := range values {
+		if values[i], err = d.ReadFloat64(); err != nil {
+			return nil, err
+		}
+	}
+	return &PriceSummary{
+		Kind:            kind,
+		Name:            name,
+		Games:           games,
+		Average:         values[0],
+		Median:          values[1],
+		P90:             values[2],
+		DiscountedShare: values[3],
+	}, nil
+}
@@ -0,0 +1,74 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Columns read by the map and filter functions of each map filter channel. The server
+// blanks every other column of the raw records before publishing them, so the heavy
+// ones (like the review text) only travel to the queries that need them.
+var GameProjections = map[string][]string{
+	"MFG_Q1": {"AppID", "Windows", "Mac", "Linux"},                                 // Q1Map
+	"MFG_Q2": {"AppID", "Name", "ReleaseDate", "AveragePlaytimeForever", "Genres"}, // Q2Filter, Q2Map
+	"MFG_Q3": {"AppID", "Name", "Genres"},                                          // Q3FilterGames, Q3MapGames
+	"MFG_Q4": {"AppID", "Name", "Genres"},                                          // Q4FilterGames, Q4MapGames
+	"MFG_Q5": {"AppID", "Name", "Genres"},                                          // Q5FilterGames, Q5MapGames
+	"MFG_Q6": {"AppID", "ReleaseDate", "Price", "Discount", "Genres"},              // Q6Filter, Q6Map
+	"MFG_Q7": {"AppID", "Developers", "Publishers"},                                // Q7FilterGames, Q7MapGames
+	"MFG_Q8": {"AppID", "ReleaseDate", "Genres"},                                   // Q8FilterGames, Q8MapGames
+}
+
+var ReviewProjections = map[string][]string{
+	"MFR_Q3": {"AppID", "ReviewScore"},               // Q3FilterReviews, Q3MapReviews
+	"MFR_Q4": {"AppID", "ReviewText", "ReviewScore"}, // Q4FilterReviewsBuilder, Q4MapReviews
+	"MFR_Q5": {"AppID", "ReviewScore"},               // Q5FilterReviews, Q5MapReviews
+	"MFR_Q7": {"AppID", "ReviewScore"},               // Q7FilterReviews, Q7MapReviews
+	"MFR_Q8": {"AppID", "ReviewScore"},               // Q8FilterReviews, Q8MapReviews
+}
+
+// Keeps the position of every column so StrParse reads projected records as usual,
+// the removed ones are left empty and parsed as their zero value.
+type Projection struct {
+	keep []bool
+}
+
+func NewProjection[T any](columns []string) (*Projection, error) {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	p := &Projection{keep: make([]bool, t.NumField())}
+	for _, column := range columns {
+		field, ok := t.FieldByName(column)
+		if !ok {
+			return nil, fmt.Errorf("%s has no column %s", t.Name(), column)
+		}
+		p.keep[field.Index[0]] = true
+	}
+	return p, nil
+}
+
+func (p *Projection) Project(record string) (string, error) {
+	row, err := csv.NewReader(strings.NewReader(record)).Read()
+	if err != nil {
+		return "", err
+	}
+
+	for i := range row {
+		if i >= len(p.keep) || !p.keep[i] {
+			row[i] = ""
+		}
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if err = w.Write(row); err != nil {
+		return "", err
+	}
+	w.Flush()
+	if err = w.Error(); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
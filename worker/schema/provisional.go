@@ -0,0 +1,53 @@
+package schema
+
+import (
+	"fmt"
+	"middleware/common"
+)
+
+// The games a query would send if the reviews ended now, in its order. Stage three sends one
+// from time to time while the joins stream their counts, each replaces the one before.
+type ProvisionalTop struct {
+	Query string
+	// Stage three got before this top
+	Upserts uint32
+	Games   []*NamedReviewCounter
+}
+
+func (t *ProvisionalTop) Serialize() []byte {
+	games := make([]common.Serializable, len(t.Games))
+	for i, g := range t.Games {
+		games[i] = g
+	}
+	se := common.NewSerializer()
+	return se.WriteString(t.Query).WriteUint32(t.Upserts).WriteArray(games).ToBytes()
+}
+
+func (t *ProvisionalTop) PartitionKey() string {
+	return t.Query
+}
+
+// The query and the upserts, then the name and count of every game
+func (t *ProvisionalTop) ToCSV() []string {
+	row := []string{t.Query, fmt.Sprintf("%d", t.Upserts)}
+	for _, g := range t.Games {
+		row = append(row, g.ToCSV()...)
+	}
+	return row
+}
+
+func ProvisionalTopDeserialize(d *common.Deserializer) (*ProvisionalTop, error) {
+	query, err := d.ReadString()
+	if err != nil {
+		return nil, err
+	}
+	upserts, err := d.ReadUint32()
+	if err != nil {
+		return nil, err
+	}
+	games, err := common.ReadArray(NamedReviewCounterDeserialize)(d)
+	if err != nil {
+		return nil, err
+	}
+	return &ProvisionalTop{Query: query, Upserts: upserts, Games: games.Arr}, nil
+}
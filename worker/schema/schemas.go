@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"middleware/common"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -83,6 +84,11 @@ func (s *SOCounter) PartitionKey() string {
 	return s.AppId
 }
 
+// Q1 has a single result, by AppId in case there's ever more
+func SOCounterBefore(a, b *SOCounter) bool {
+	return a.AppId < b.AppId
+}
+
 func (s *SOCounter) ToCSV() []string {
 	return []string{
 		fmt.Sprintf("%d", s.Windows),
@@ -128,11 +134,23 @@ func SOCounterAggregate(old *SOCounter, new *SOCounter) *SOCounter {
 type PlayedTime struct {
 	AveragePlaytimeForever float64
 	Name                   string
+	AppID                  string
 }
 
 func (p *PlayedTime) Serialize() []byte {
 	se := common.NewSerializer()
-	return se.WriteFloat64(p.AveragePlaytimeForever).WriteString(p.Name).ToBytes()
+	return se.WriteFloat64(p.AveragePlaytimeForever).WriteString(p.Name).WriteString(p.AppID).ToBytes()
+}
+
+// The order of the Q2 results: more playtime first, then by name and AppID
+func PlayedTimeBefore(a, b *PlayedTime) bool {
+	if a.AveragePlaytimeForever != b.AveragePlaytimeForever {
+		return a.AveragePlaytimeForever > b.AveragePlaytimeForever
+	}
+	if a.Name != b.Name {
+		return a.Name < b.Name
+	}
+	return a.AppID < b.AppID
 }
 
 func (p *PlayedTime) PartitionKey() string {
@@ -155,9 +173,14 @@ func PlayedTimeDeserialize(d *common.Deserializer) (*PlayedTime, error) {
 	if err != nil {
 		return nil, err
 	}
+	id, err := d.ReadString()
+	if err != nil {
+		return nil, err
+	}
 	return &PlayedTime{
 		AveragePlaytimeForever: pt,
 		Name:                   n,
+		AppID:                  id,
 	}, nil
 }
 
@@ -247,14 +270,237 @@ func ReviewCounterDeserialize(d *common.Deserializer) (*ReviewCounter, error) {
 	}, nil
 }
 
+// Reviews of a hot game spread by the map filters over more than one partition. The first
+// salt goes to the partition of the game, so it always learns the game is hot.
+type SaltedReviewCounter struct {
+	AppID string
+	Salt  uint8
+	Count uint32
+}
+
+func (c *SaltedReviewCounter) Serialize() []byte {
+	se := common.NewSerializer()
+	return se.WriteString(c.AppID).WriteUint8(c.Salt).WriteUint32(c.Count).ToBytes()
+}
+
+func (c *SaltedReviewCounter) PartitionKey() string {
+	if c.Salt == 0 {
+		return c.AppID
+	}
+	return fmt.Sprintf("%s#%d", c.AppID, c.Salt)
+}
+
+func SaltedReviewCounterDeserialize(d *common.Deserializer) (*SaltedReviewCounter, error) {
+	id, err := d.ReadString()
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := d.ReadUint8()
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := d.ReadUint32()
+	if err != nil {
+		return nil, err
+	}
+
+	return &SaltedReviewCounter{
+		AppID: id,
+		Salt:  s,
+		Count: c,
+	}, nil
+}
+
+// Count of a hot game at the partition that has it, the partials of the other partitions
+// are added to it before it becomes a NamedReviewCounter
+type HotReviewCounter struct {
+	AppID string
+	Name  string
+	Count uint32
+}
+
+func (c *HotReviewCounter) Serialize() []byte {
+	se := common.NewSerializer()
+	return se.WriteString(c.AppID).WriteString(c.Name).WriteUint32(c.Count).ToBytes()
+}
+
+func (c *HotReviewCounter) PartitionKey() string {
+	return c.AppID
+}
+
+func HotReviewCounterDeserialize(d *common.Deserializer) (*HotReviewCounter, error) {
+	id, err := d.ReadString()
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := d.ReadString()
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := d.ReadUint32()
+	if err != nil {
+		return nil, err
+	}
+
+	return &HotReviewCounter{
+		AppID: id,
+		Name:  n,
+		Count: c,
+	}, nil
+}
+
+// Provisional count of a game sent by a streaming join, it replaces the one sent before
+type ReviewCounterUpsert struct {
+	AppID string
+	Name  string
+	Count uint32
+}
+
+func (c *ReviewCounterUpsert) Serialize() []byte {
+	se := common.NewSerializer()
+	return se.WriteString(c.AppID).WriteString(c.Name).WriteUint32(c.Count).ToBytes()
+}
+
+func (c *ReviewCounterUpsert) PartitionKey() string {
+	return c.AppID
+}
+
+func ReviewCounterUpsertDeserialize(d *common.Deserializer) (*ReviewCounterUpsert, error) {
+	id, err := d.ReadString()
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := d.ReadString()
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := d.ReadUint32()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ReviewCounterUpsert{
+		AppID: id,
+		Name:  n,
+		Count: c,
+	}, nil
+}
+
+// Review counts of the games a stage two partition sent, for an approximate percentile
+type QuantileSketch struct {
+	Sketch *common.KLLSketch
+}
+
+func (c *QuantileSketch) Serialize() []byte {
+	return c.Sketch.Serialize()
+}
+
+func (c *QuantileSketch) PartitionKey() string {
+	return "sketch"
+}
+
+func QuantileSketchDeserialize(d *common.Deserializer) (*QuantileSketch, error) {
+	s, err := common.KLLSketchDeserialize(d)
+	if err != nil {
+		return nil, err
+	}
+	return &QuantileSketch{Sketch: s}, nil
+}
+
+// How many games of a stage two partition have each review count
+type CountHistogram struct {
+	Games map[uint32]uint32
+}
+
+func (c *CountHistogram) Serialize() []byte {
+	counts := make([]uint32, 0, len(c.Games))
+	for count := range c.Games {
+		counts = append(counts, count)
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i] < counts[j] })
+
+	se := common.NewSerializer()
+	se.WriteUint32(uint32(len(counts)))
+	for _, count := range counts {
+		se.WriteUint32(count).WriteUint32(c.Games[count])
+	}
+	return se.ToBytes()
+}
+
+func (c *CountHistogram) PartitionKey() string {
+	return "histogram"
+}
+
+func CountHistogramDeserialize(d *common.Deserializer) (*CountHistogram, error) {
+	n, err := d.ReadUint32()
+	if err != nil {
+		return nil, err
+	}
+
+	// Every entry takes 8 bytes, a corrupt length can't make it allocate more than what's left
+	games := make(map[uint32]uint32, min(n, uint32(d.Buf.Len()/8)))
+	for i := uint32(0); i < n; i++ {
+		count, err := d.ReadUint32()
+		if err != nil {
+			return nil, err
+		}
+		g, err := d.ReadUint32()
+		if err != nil {
+			return nil, err
+		}
+		games[count] = g
+	}
+	return &CountHistogram{Games: games}, nil
+}
+
+// Review count of the percentile, stage two only sends the games with at least as many
+type PercentileThreshold struct {
+	Count uint32
+}
+
+func (c *PercentileThreshold) Serialize() []byte {
+	se := common.NewSerializer()
+	return se.WriteUint32(c.Count).ToBytes()
+}
+
+func (c *PercentileThreshold) PartitionKey() string {
+	return "threshold"
+}
+
+func PercentileThresholdDeserialize(d *common.Deserializer) (*PercentileThreshold, error) {
+	c, err := d.ReadUint32()
+	if err != nil {
+		return nil, err
+	}
+	return &PercentileThreshold{Count: c}, nil
+}
+
 type NamedReviewCounter struct {
 	Name  string
 	Count uint32
+	AppID string
 }
 
 func (c *NamedReviewCounter) Serialize() []byte {
 	se := common.NewSerializer()
-	return se.WriteString(c.Name).WriteUint32(c.Count).ToBytes()
+	return se.WriteString(c.Name).WriteUint32(c.Count).WriteString(c.AppID).ToBytes()
+}
+
+// The order of the Q3, Q4 and Q5 results: more reviews first, then by name and AppID
+func NamedReviewCounterBefore(a, b *NamedReviewCounter) bool {
+	if a.Count != b.Count {
+		return a.Count > b.Count
+	}
+	if a.Name != b.Name {
+		return a.Name < b.Name
+	}
+	return a.AppID < b.AppID
 }
 
 func (c *NamedReviewCounter) PartitionKey() string {
@@ -279,9 +525,15 @@ func NamedReviewCounterDeserialize(d *common.Deserializer) (*NamedReviewCounter,
 		return nil, err
 	}
 
+	id, err := d.ReadString()
+	if err != nil {
+		return nil, err
+	}
+
 	return &NamedReviewCounter{
 		Name:  n,
 		Count: c,
+		AppID: id,
 	}, nil
 }
 
@@ -307,6 +559,10 @@ func StrParse[T any](s string) (*T, error) {
 func mapCSVToStruct(row []string, result interface{}) error {
 	v := reflect.ValueOf(result).Elem()
 
+	if len(row) > v.NumField() {
+		return fmt.Errorf("the record has %d columns, expected at most %d", len(row), v.NumField())
+	}
+
 	for i := range row {
 		// Just assume that the field are in order
 		field := v.Field(i)
@@ -323,12 +579,21 @@ func setFieldValue(field reflect.Value, value string) error {
 	case reflect.String:
 		field.SetString(value)
 	case reflect.Int:
+		if value == "" {
+			// Column removed by a projection
+			field.SetInt(0)
+			return nil
+		}
 		intValue, err := strconv.Atoi(value)
 		if err != nil {
 			return err
 		}
 		field.SetInt(int64(intValue))
 	case reflect.Float64:
+		if value == "" {
+			field.SetFloat(0)
+			return nil
+		}
 		floatValue, err := strconv.ParseFloat(value, 64)
 		if err != nil {
 			return err
@@ -361,6 +626,40 @@ func MarshalMessage(c any) ([]byte, error) {
 		return s.WriteUint8(common.Type_ReviewCounter).WriteBytes(v.Serialize()).ToBytes(), nil
 	case *NamedReviewCounter:
 		return s.WriteUint8(common.Type_NamedReviewCounter).WriteBytes(v.Serialize()).ToBytes(), nil
+	case *SaltedReviewCounter:
+		return s.WriteUint8(common.Type_SaltedReviewCounter).WriteBytes(v.Serialize()).ToBytes(), nil
+	case *HotReviewCounter:
+		return s.WriteUint8(common.Type_HotReviewCounter).WriteBytes(v.Serialize()).ToBytes(), nil
+	case *ReviewCounterUpsert:
+		return s.WriteUint8(common.Type_ReviewCounterUpsert).WriteBytes(v.Serialize()).ToBytes(), nil
+	case *QuantileSketch:
+		return s.WriteUint8(common.Type_QuantileSketch).WriteBytes(v.Serialize()).ToBytes(), nil
+	case *CountHistogram:
+		return s.WriteUint8(common.Type_CountHistogram).WriteBytes(v.Serialize()).ToBytes(), nil
+	case *PercentileThreshold:
+		return s.WriteUint8(common.Type_PercentileThreshold).WriteBytes(v.Serialize()).ToBytes(), nil
+	case *PricedGame:
+		return s.WriteUint8(common.Type_PricedGame).WriteBytes(v.Serialize()).ToBytes(), nil
+	case *PriceStats:
+		return s.WriteUint8(common.Type_PriceStats).WriteBytes(v.Serialize()).ToBytes(), nil
+	case *PriceSummary:
+		return s.WriteUint8(common.Type_PriceSummary).WriteBytes(v.Serialize()).ToBytes(), nil
+	case *GameCompanies:
+		return s.WriteUint8(common.Type_GameCompanies).WriteBytes(v.Serialize()).ToBytes(), nil
+	case *ReviewTally:
+		return s.WriteUint8(common.Type_ReviewTally).WriteBytes(v.Serialize()).ToBytes(), nil
+	case *CompanyTally:
+		return s.WriteUint8(common.Type_CompanyTally).WriteBytes(v.Serialize()).ToBytes(), nil
+	case *CompanyRank:
+		return s.WriteUint8(common.Type_CompanyRank).WriteBytes(v.Serialize()).ToBytes(), nil
+	case *DatedGame:
+		return s.WriteUint8(common.Type_DatedGame).WriteBytes(v.Serialize()).ToBytes(), nil
+	case *SentimentBucket:
+		return s.WriteUint8(common.Type_SentimentBucket).WriteBytes(v.Serialize()).ToBytes(), nil
+	case *LanguageCount:
+		return s.WriteUint8(common.Type_LanguageCount).WriteBytes(v.Serialize()).ToBytes(), nil
+	case *ProvisionalTop:
+		return s.WriteUint8(common.Type_ProvisionalTop).WriteBytes(v.Serialize()).ToBytes(), nil
 	}
 	return nil, &UnknownTypeError{}
 }
@@ -401,6 +700,40 @@ func UnmarshalMessageDeserializer(d *common.Deserializer) (any, error) {
 		return ReviewCounterDeserialize(d)
 	case common.Type_NamedReviewCounter:
 		return NamedReviewCounterDeserialize(d)
+	case common.Type_SaltedReviewCounter:
+		return SaltedReviewCounterDeserialize(d)
+	case common.Type_HotReviewCounter:
+		return HotReviewCounterDeserialize(d)
+	case common.Type_ReviewCounterUpsert:
+		return ReviewCounterUpsertDeserialize(d)
+	case common.Type_QuantileSketch:
+		return QuantileSketchDeserialize(d)
+	case common.Type_CountHistogram:
+		return CountHistogramDeserialize(d)
+	case common.Type_PercentileThreshold:
+		return PercentileThresholdDeserialize(d)
+	case common.Type_PricedGame:
+		return PricedGameDeserialize(d)
+	case common.Type_PriceStats:
+		return PriceStatsDeserialize(d)
+	case common.Type_PriceSummary:
+		return PriceSummaryDeserialize(d)
+	case common.Type_GameCompanies:
+		return GameCompaniesDeserialize(d)
+	case common.Type_ReviewTally:
+		return ReviewTallyDeserialize(d)
+	case common.Type_CompanyTally:
+		return CompanyTallyDeserialize(d)
+	case common.Type_CompanyRank:
+		return CompanyRankDeserialize(d)
+	case common.Type_DatedGame:
+		return DatedGameDeserialize(d)
+	case common.Type_SentimentBucket:
+		return SentimentBucketDeserialize(d)
+	case common.Type_LanguageCount:
+		return LanguageCountDeserialize(d)
+	case common.Type_ProvisionalTop:
+		return ProvisionalTopDeserialize(d)
 	}
 	return nil, &UnknownTypeError{}
 }
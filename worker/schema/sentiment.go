@@ -0,0 +1,107 @@
+package schema
+
+import (
+	"fmt"
+	"middleware/common"
+)
+
+// A game with the release period it's bucketed in, at the granularity of the query
+type DatedGame struct {
+	AppID  string
+	Period string
+	Genres []string
+}
+
+func (g *DatedGame) Serialize() []byte {
+	se := common.NewSerializer()
+	se.WriteString(g.AppID).WriteString(g.Period)
+	writeStrings(&se, g.Genres)
+	return se.ToBytes()
+}
+
+func (g *DatedGame) PartitionKey() string {
+	return g.AppID
+}
+
+func DatedGameDeserialize(d *common.Deserializer) (*DatedGame, error) {
+	id, err := d.ReadString()
+	if err != nil {
+		return nil, err
+	}
+	period, err := d.ReadString()
+	if err != nil {
+		return nil, err
+	}
+	genres, err := readStrings(d)
+	if err != nil {
+		return nil, err
+	}
+	return &DatedGame{AppID: id, Period: period, Genres: genres}, nil
+}
+
+// Reviews of the games of a genre released in a period. Stage two sends the ones of its
+// games, stage three adds them up and sends the results.
+type SentimentBucket struct {
+	Genre    string
+	Period   string
+	Games    uint32
+	Positive uint32
+	Negative uint32
+}
+
+func (s *SentimentBucket) Merge(o *SentimentBucket) {
+	s.Games += o.Games
+	s.Positive += o.Positive
+	s.Negative += o.Negative
+}
+
+// The order of the Q8 results: the time series of each genre
+func SentimentBucketBefore(a, b *SentimentBucket) bool {
+	if a.Genre != b.Genre {
+		return a.Genre < b.Genre
+	}
+	return a.Period < b.Period
+}
+
+func (s *SentimentBucket) Serialize() []byte {
+	se := common.NewSerializer()
+	return se.WriteString(s.Genre).WriteString(s.Period).
+		WriteUint32(s.Games).WriteUint32(s.Positive).WriteUint32(s.Negative).ToBytes()
+}
+
+func (s *SentimentBucket) PartitionKey() string {
+	return s.Genre + s.Period
+}
+
+func (s *SentimentBucket) ToCSV() []string {
+	var share float64
+	if total := s.Positive + s.Negative; total > 0 {
+		share = float64(s.Positive) / float64(total)
+	}
+	return []string{
+		s.Genre,
+		s.Period,
+		fmt.Sprintf("%d", s.Games),
+		fmt.Sprintf("%d", s.Positive),
+		fmt.Sprintf("%d", s.Negative),
+		fmt.Sprintf("%.4f", share),
+	}
+}
+
+func SentimentBucketDeserialize(d *common.Deserializer) (*SentimentBucket, error) {
+	genre, err := d.ReadString()
+	if err != nil {
+		return nil, err
+	}
+	period, err := d.ReadString()
+	if err != nil {
+		return nil, err
+	}
+	counts := make([]uint32, 3)
+	for i := range counts {
+		if counts[i], err = d.ReadUint32(); err != nil {
+			return nil, err
+		}
+	}
+	return &SentimentBucket{Genre: genre, Period: period, Games: counts[0], Positive: counts[1], Negative: counts[2]}, nil
+}